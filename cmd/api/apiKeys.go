@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+// getAPIKey reads the API key named in the URL. It responds itself and
+// returns nil if there's no such key.
+func (app *application) getAPIKey(w http.ResponseWriter, r *http.Request) *data.APIKey {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	apiKey, err := app.models.APIKeys.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return apiKey
+}
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name           string          `json:"name"`
+		Scopes         []string        `json:"scopes"`
+		ExpiresAt      *time.Time      `json:"expires_at"`
+		RateLimit      *data.RateLimit `json:"rate_limit"`
+		Quota          *data.Quota     `json:"quota"`
+		RequireSigning bool            `json:"require_signing"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	apiKey := &data.APIKey{
+		Name:           input.Name,
+		Scopes:         input.Scopes,
+		IsActive:       true,
+		ExpiresAt:      input.ExpiresAt,
+		RateLimit:      input.RateLimit,
+		Quota:          input.Quota,
+		RequireSigning: input.RequireSigning,
+	}
+
+	v := validator.New()
+
+	if input.ExpiresAt != nil {
+		v.Check(input.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	}
+
+	if data.ValidateAPIKey(v, apiKey); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.APIKeys.Create(r.Context(), apiKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/api-keys/%d", apiKey.ID))
+
+	// The key is only stored as a hash, so this is the one chance to see it.
+	// The signing secret is only shown here too.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": apiKey, "token": token, "signing_secret": apiKey.SigningSecret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	apiKeys, err := app.models.APIKeys.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": apiKeys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	apiKey := app.getAPIKey(w, r)
+	if apiKey == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"api_key": apiKey}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	apiKey := app.getAPIKey(w, r)
+	if apiKey == nil {
+		return
+	}
+
+	var input struct {
+		Name           *string         `json:"name"`
+		Scopes         []string        `json:"scopes"`
+		ExpiresAt      *time.Time      `json:"expires_at"`
+		RateLimit      *data.RateLimit `json:"rate_limit"`
+		Quota          *data.Quota     `json:"quota"`
+		RequireSigning *bool           `json:"require_signing"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	updateIfNotNil(&apiKey.Name, input.Name)
+	updateIfNotNil(&apiKey.RequireSigning, input.RequireSigning)
+
+	if input.Scopes != nil {
+		apiKey.Scopes = input.Scopes
+	}
+
+	// An empty object takes away the key's own limit, leaving it with the
+	// server's default rate limit or no quota.
+	if input.RateLimit != nil {
+		apiKey.RateLimit = input.RateLimit
+		if *input.RateLimit == (data.RateLimit{}) {
+			apiKey.RateLimit = nil
+		}
+	}
+
+	if input.Quota != nil {
+		apiKey.Quota = input.Quota
+		if *input.Quota == (data.Quota{}) {
+			apiKey.Quota = nil
+		}
+	}
+
+	v := validator.New()
+
+	if input.ExpiresAt != nil {
+		v.Check(input.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+		apiKey.ExpiresAt = input.ExpiresAt
+	}
+
+	// Keys made before request signing have no secret to sign with.
+	v.Check(!apiKey.RequireSigning || apiKey.SigningSecret != "", "require_signing", "needs a signing secret; issue one first")
+
+	if data.ValidateAPIKey(v, apiKey); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.APIKeys.Update(r.Context(), apiKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_key": apiKey}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deactivateAPIKeyHandler stops a key from working while keeping it, and the
+// audit trail that names it, on record.
+func (app *application) deactivateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	apiKey := app.getAPIKey(w, r)
+	if apiKey == nil {
+		return
+	}
+
+	apiKey.IsActive = false
+
+	err := app.models.APIKeys.Update(r.Context(), apiKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_key": apiKey}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rotateAPIKeyHandler replaces a key with a new one. The old key keeps
+// working for KEY_ROTATION_GRACE, so clients can switch over without
+// downtime.
+func (app *application) rotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	successor, token, err := app.models.APIKeys.Rotate(r.Context(), id, app.config.auth.rotationGrace)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrKeyInactive):
+			app.inactiveAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	replaced, err := app.models.APIKeys.Get(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/api-keys/%d", successor.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": successor, "token": token, "signing_secret": successor.SigningSecret, "replaced": replaced}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newSigningSecretHandler gives a key a new signing secret, for keys made
+// before request signing or whose secret has leaked. Requests signed with the
+// old secret stop being accepted straight away.
+func (app *application) newSigningSecretHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	secret, err := app.models.APIKeys.NewSigningSecret(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	apiKey, err := app.models.APIKeys.Get(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_key": apiKey, "signing_secret": secret}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyManagement(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+
+	insertTestAPIKey(t, app, "marine-hq")
+	insertTestAPIKey(t, app, "bounty-office", "characters:write")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	admin := map[string]string{"Authorization": "Bearer marine-hq"}
+
+	status, _ := ts.doWithHeaders(t, http.MethodGet, "/v1/admin/api-keys", nil, map[string]string{"Authorization": "Bearer bounty-office"})
+	equal(t, status, http.StatusForbidden)
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys", map[string]any{
+		"name":   "news coo",
+		"scopes": []string{"characters:read", "archives:write"},
+	}, admin)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, response["error"].(map[string]any)["scopes"] != nil, true)
+
+	expiresAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys", map[string]any{
+		"name":       "news coo",
+		"scopes":     []string{"crews:write"},
+		"expires_at": expiresAt,
+	}, admin)
+	equal(t, status, http.StatusCreated)
+
+	token := response["token"].(string)
+	equal(t, len(token), 64)
+
+	apiKey := response["api_key"].(map[string]any)
+	equal(t, apiKey["name"], "news coo")
+	equal(t, apiKey["key_hash"], nil)
+	path := fmt.Sprintf("/v1/admin/api-keys/%d", int64(apiKey["id"].(float64)))
+
+	// The new key works straight away, within its scopes.
+	auth := map[string]string{"Authorization": "Bearer " + token}
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/crews", map[string]any{"name": "News Coo Delivery"}, auth)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{}, auth)
+	equal(t, status, http.StatusForbidden)
+
+	status, response = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"name": "morgans", "scopes": []string{"characters:write"}}, admin)
+	equal(t, status, http.StatusOK)
+	equal(t, response["api_key"].(map[string]any)["name"], "morgans")
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{}, auth)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, _ = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"expires_at": time.Now().Add(-time.Hour)}, admin)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, path+"/deactivate", nil, admin)
+	equal(t, status, http.StatusOK)
+	equal(t, response["api_key"].(map[string]any)["is_active"], false)
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{}, auth)
+	equal(t, status, http.StatusUnauthorized)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/admin/api-keys", nil, admin)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["api_keys"].([]any)), 3)
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, path, nil, admin)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, path, nil, admin)
+	equal(t, status, http.StatusNotFound)
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+	app.config.auth.rotationGrace = time.Hour
+
+	insertTestAPIKey(t, app, "marine-hq")
+	insertTestAPIKey(t, app, "news-coo", "trash:read")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	admin := map[string]string{"Authorization": "Bearer marine-hq"}
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys/2/rotate", nil, admin)
+	equal(t, status, http.StatusCreated)
+
+	token := response["token"].(string)
+	successor := response["api_key"].(map[string]any)
+	equal(t, successor["name"], "news-coo")
+	equal(t, successor["scopes"].([]any)[0], "trash:read")
+
+	replaced := response["replaced"].(map[string]any)
+	equal(t, replaced["replaced_by"], successor["id"])
+
+	expiresAt, err := time.Parse(time.RFC3339, replaced["expires_at"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(expiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("old key expires in %s; want an hour", until)
+	}
+
+	// The old key still works, with a warning.
+	res, _ := ts.get(t, "/v1/trash", map[string]string{"Authorization": "Bearer news-coo"})
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, strings.HasPrefix(res.Header.Get("Deprecation"), "@"), true)
+	equal(t, res.Header.Get("Sunset"), expiresAt.UTC().Format(http.TimeFormat))
+	equal(t, strings.Contains(res.Header.Get("Warning"), "rotated"), true)
+
+	res, _ = ts.get(t, "/v1/trash", map[string]string{"Authorization": "Bearer " + token})
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("Deprecation"), "")
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys/2/rotate", nil, admin)
+	equal(t, status, http.StatusConflict)
+
+	// Without a grace period the old key stops working straight away.
+	app.config.auth.rotationGrace = 0
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/admin/api-keys/%d/rotate", int64(successor["id"].(float64))), nil, admin)
+	equal(t, status, http.StatusCreated)
+
+	res, _ = ts.get(t, "/v1/trash", map[string]string{"Authorization": "Bearer " + token})
+	equal(t, res.StatusCode, http.StatusUnauthorized)
+}
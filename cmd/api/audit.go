@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+func (app *application) listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Entity   string
+		EntityID int
+		APIKeyID int
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Entity = app.readString(qs, "entity", "")
+	input.EntityID = app.readInt(qs, "id", 0, v)
+	input.APIKeyID = app.readInt(qs, "key_id", 0, v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "-id"}
+
+	if input.Entity != "" {
+		v.Check(validator.PermittedValue(input.Entity, data.AuditEntities...), "entity", "must be characters, devilfruits, crews or crew_members")
+	}
+	v.Check(input.EntityID >= 0, "id", "must be a positive integer")
+	v.Check(input.EntityID == 0 || input.Entity != "", "id", "requires an entity")
+	v.Check(input.APIKeyID >= 0, "key_id", "must be a positive integer")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.GetAll(r.Context(), input.Entity, int64(input.EntityID), int64(input.APIKeyID), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
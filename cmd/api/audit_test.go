@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+)
+
+func TestAuditLog(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+
+	apiKey := insertTestAPIKey(t, app, "marine-hq-token")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	auth := map[string]string{"Authorization": "Bearer marine-hq-token"}
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{
+		"name":        "Buggy",
+		"age":         39,
+		"description": "Captain of the Buggy Pirates",
+		"origin":      "Grand Line",
+		"race":        "human",
+		"bounty":      "15M berries",
+		"episode":     4,
+	}, auth)
+	equal(t, status, http.StatusCreated)
+	id := int64(response["character"].(map[string]any)["id"].(float64))
+	path := fmt.Sprintf("/v1/characters/%d", id)
+
+	headers := map[string]string{"Authorization": auth["Authorization"], "X-Request-ID": "buggy-bounty-1"}
+
+	status, _ = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"bounty": "10B berries"}, headers)
+	equal(t, status, http.StatusOK)
+
+	// A rejected change leaves no trace.
+	status, _ = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"age": -1}, auth)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, path, nil, auth)
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/audit?entity=characters&id=%d&sort=id", id), nil, auth)
+	equal(t, status, http.StatusOK)
+
+	entries := response["audit"].([]any)
+	if len(entries) != 3 {
+		t.Fatalf("got %d audit entries; want 3", len(entries))
+	}
+
+	for i, action := range []string{data.AuditCreate, data.AuditUpdate, data.AuditDelete} {
+		entry := entries[i].(map[string]any)
+		equal(t, entry["action"].(string), action)
+		equal(t, int64(entry["api_key_id"].(float64)), apiKey.ID)
+	}
+
+	create := entries[0].(map[string]any)
+	equal(t, create["before"], nil)
+	equal(t, create["route"], "POST /v1/characters")
+
+	update := entries[1].(map[string]any)
+	equal(t, update["request_id"], "buggy-bounty-1")
+	equal(t, update["route"].(string), "PATCH "+path)
+	equal(t, update["before"].(map[string]any)["bounty"], "15M berries")
+	equal(t, update["after"].(map[string]any)["bounty"], "10B berries")
+
+	remove := entries[2].(map[string]any)
+	equal(t, remove["after"], nil)
+	equal(t, remove["before"].(map[string]any)["name"], "Buggy")
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/audit?key_id=%d", apiKey.ID+1), nil, auth)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["audit"].([]any)), 0)
+
+	status, _ = ts.do(t, http.MethodGet, "/v1/audit", nil)
+	equal(t, status, http.StatusUnauthorized)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/audit?entity=pirates", nil, auth)
+	equal(t, status, http.StatusUnprocessableEntity)
+}
+
+func TestAuditRequestID(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	res, _ := ts.get(t, "/v1/healthcheck", map[string]string{"X-Request-ID": "abc-123"})
+	equal(t, res.Header.Get("X-Request-ID"), "abc-123")
+
+	// Anything that isn't a plain token is replaced.
+	res, _ = ts.get(t, "/v1/healthcheck", map[string]string{"X-Request-ID": "abc 123; drop"})
+	if id := res.Header.Get("X-Request-ID"); id == "" || id == "abc 123; drop" {
+		t.Errorf("got request ID %q; want a generated one", id)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// limiterSweepInterval is how often the rate limiter forgets idle buckets.
+const limiterSweepInterval = time.Minute
+
+// noncePurgeInterval is how often the nonces of signed requests that are too
+// old to be replayed are forgotten.
+const noncePurgeInterval = time.Minute
+
+// finalRunTimeout bounds the last run of the jobs that flush on shutdown.
+const finalRunTimeout = 10 * time.Second
+
+// job is work the background runs over and over until the server stops.
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+
+	// wake, if set, runs the job early whenever it receives.
+	wake <-chan struct{}
+
+	// atStart runs the job as soon as it's started, rather than an interval
+	// later.
+	atStart bool
+
+	// atStop runs the job once more as the background stops, for jobs that
+	// write out what requests have queued up. The server has finished with
+	// its requests by then, so nothing they queued is lost.
+	atStop bool
+}
+
+// background runs the server's jobs, each in a goroutine of its own. A job
+// that panics is logged and carries on at its next run.
+type background struct {
+	logger *slog.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackground(logger *slog.Logger) *background {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &background{logger: logger, ctx: ctx, cancel: cancel}
+}
+
+// start runs j until the background stops.
+func (b *background) start(j job) {
+	b.wg.Go(func() {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		if j.atStart {
+			b.runOnce(b.ctx, j)
+		}
+
+		for {
+			select {
+			case <-b.ctx.Done():
+				if j.atStop {
+					ctx, cancel := context.WithTimeout(context.Background(), finalRunTimeout)
+					defer cancel()
+
+					b.runOnce(ctx, j)
+				}
+				return
+			case <-ticker.C:
+			case <-j.wake:
+			}
+
+			b.runOnce(b.ctx, j)
+		}
+	})
+}
+
+func (b *background) runOnce(ctx context.Context, j job) {
+	defer func() {
+		if err := recover(); err != nil {
+			b.logger.Error("background job panicked", "job", j.name, "error", fmt.Sprint(err))
+		}
+	}()
+
+	err := j.run(ctx)
+	if err != nil && ctx.Err() == nil {
+		b.logger.Error("background job failed", "job", j.name, "error", err.Error())
+	}
+}
+
+// stop cancels every job and waits for them to finish, including their
+// final runs.
+func (b *background) stop() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// maxPendingLastUsed is how many keys the last-used queue holds. Beyond that
+// it asks to be flushed early, and uses of other keys are dropped until it
+// has been; their last_used_at catches up the next time they're used.
+const maxPendingLastUsed = 10_000
+
+// lastUsedQueue collects when each API key was last used until it's
+// flushed, so a busy key costs one write per flush rather than one per
+// request.
+type lastUsedQueue struct {
+	mu      sync.Mutex
+	pending map[int64]time.Time
+	full    chan struct{}
+}
+
+func newLastUsedQueue() *lastUsedQueue {
+	return &lastUsedQueue{
+		pending: make(map[int64]time.Time),
+		full:    make(chan struct{}, 1),
+	}
+}
+
+// touch records that a key was used just now.
+func (q *lastUsedQueue) touch(apiKeyID int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[apiKeyID]; !ok && len(q.pending) >= maxPendingLastUsed {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	q.pending[apiKeyID] = time.Now()
+}
+
+// take empties the queue, returning what it held.
+func (q *lastUsedQueue) take() map[int64]time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := q.pending
+	q.pending = make(map[int64]time.Time)
+
+	return pending
+}
+
+// flushLastUsed writes out when each key in the queue was last used.
+func (app *application) flushLastUsed(ctx context.Context) error {
+	lastUsed := app.lastUsed.take()
+	if len(lastUsed) == 0 {
+		return nil
+	}
+
+	return app.models.APIKeys.UpdateLastUsed(ctx, lastUsed)
+}
+
+// startBackground starts every background job the server runs.
+func (app *application) startBackground() *background {
+	b := newBackground(app.logger)
+
+	// A retention of zero keeps the trash forever.
+	if app.config.trash.retention > 0 {
+		b.start(job{
+			name:     "trash purger",
+			interval: app.config.trash.purgeInterval,
+			run:      app.purgeTrash,
+			atStart:  true,
+		})
+	}
+
+	// The webhook queue lives in the database, so deliveries that are due
+	// when the server stops go out once it's back.
+	b.start(job{
+		name:     "webhook dispatcher",
+		interval: app.config.webhooks.pollInterval,
+		run:      app.deliverWebhooks,
+		atStart:  true,
+	})
+
+	b.start(job{
+		name:     "limiter sweeper",
+		interval: limiterSweepInterval,
+		run:      app.limiter.Sweep,
+	})
+
+	b.start(job{
+		name:     "usage flusher",
+		interval: app.config.usage.flushInterval,
+		run:      app.flushUsage,
+		wake:     app.usage.full,
+		atStop:   true,
+	})
+
+	b.start(job{
+		name:     "last-used flusher",
+		interval: app.config.usage.flushInterval,
+		run:      app.flushLastUsed,
+		wake:     app.lastUsed.full,
+		atStop:   true,
+	})
+
+	b.start(job{
+		name:     "nonce purger",
+		interval: noncePurgeInterval,
+		run: func(ctx context.Context) error {
+			return app.models.APIKeys.PurgeNonces(ctx, time.Now())
+		},
+	})
+
+	if app.jwt != nil {
+		b.start(job{
+			name:     "jwks refresher",
+			interval: app.config.jwt.refreshInterval,
+			run:      app.refreshJWTKeys,
+		})
+	}
+
+	return b
+}
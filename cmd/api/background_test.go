@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackgroundRecoversPanics(t *testing.T) {
+	b := newBackground(slog.New(slog.DiscardHandler))
+
+	var runs atomic.Int64
+	wake := make(chan struct{})
+
+	b.start(job{
+		name:     "flaky",
+		interval: time.Hour,
+		wake:     wake,
+		atStart:  true,
+		run: func(ctx context.Context) error {
+			if runs.Add(1) == 1 {
+				panic("sea king")
+			}
+			return errors.New("still flaky")
+		},
+	})
+
+	// The job carries on after it panics, and after it fails.
+	wake <- struct{}{}
+	wake <- struct{}{}
+
+	b.stop()
+
+	equal(t, runs.Load(), int64(3))
+}
+
+func TestBackgroundRunsAtStop(t *testing.T) {
+	b := newBackground(slog.New(slog.DiscardHandler))
+
+	var runs atomic.Int64
+	var cancelled atomic.Bool
+
+	b.start(job{
+		name:     "flusher",
+		interval: time.Hour,
+		atStop:   true,
+		run: func(ctx context.Context) error {
+			runs.Add(1)
+			cancelled.Store(ctx.Err() != nil)
+			return nil
+		},
+	})
+
+	b.stop()
+
+	// The final run gets a context of its own, since the background's has
+	// been cancelled by then.
+	equal(t, runs.Load(), int64(1))
+	equal(t, cancelled.Load(), false)
+}
+
+func TestLastUsed(t *testing.T) {
+	app := newTestApplication(t)
+
+	apiKey := insertTestAPIKey(t, app, "news-coo", "characters:read")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	auth := map[string]string{"Authorization": "Bearer news-coo"}
+
+	for range 3 {
+		status, _ := ts.doWithHeaders(t, http.MethodGet, "/v1/characters", nil, auth)
+		equal(t, status, http.StatusOK)
+	}
+
+	// Requests only queue the update, and a key's requests share one.
+	equal(t, len(app.lastUsed.pending), 1)
+
+	apiKey, err := app.models.APIKeys.Get(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, apiKey.LastUsedAt == nil, true)
+
+	err = app.flushLastUsed(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(app.lastUsed.pending), 0)
+
+	apiKey, err = app.models.APIKeys.Get(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) > time.Minute {
+		t.Fatalf("got last used at %v; want just now", apiKey.LastUsedAt)
+	}
+
+	// An older time doesn't overwrite a newer one.
+	lastUsedAt := *apiKey.LastUsedAt
+
+	err = app.models.APIKeys.UpdateLastUsed(context.Background(), map[int64]time.Time{apiKey.ID: lastUsedAt.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKey, err = app.models.APIKeys.Get(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, *apiKey.LastUsedAt, lastUsedAt)
+}
+
+func TestLastUsedQueueBounded(t *testing.T) {
+	q := newLastUsedQueue()
+
+	for id := range int64(maxPendingLastUsed) {
+		q.touch(id + 1)
+	}
+
+	// A key already queued is still updated, but a new one is dropped and
+	// the queue asks to be flushed.
+	q.touch(1)
+	q.touch(maxPendingLastUsed + 1)
+
+	equal(t, len(q.pending), maxPendingLastUsed)
+
+	select {
+	case <-q.full:
+	default:
+		t.Fatal("full queue didn't ask to be flushed")
+	}
+
+	equal(t, len(q.take()), maxPendingLastUsed)
+	equal(t, len(q.pending), 0)
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/05blue04/Poneglyph/internal/backup"
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+func (app *application) backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("output", "-", "write the archive to this file instead of stdout; a .gz suffix compresses it")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if *output == "-" {
+		_, err = app.backup(ctx, os.Stdout, false)
+		return err
+	}
+
+	// Write to a temporary file first so a failed backup never replaces a
+	// good one.
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".poneglyph-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	archive, err := app.backup(ctx, tmp, strings.HasSuffix(*output, ".gz"))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), *output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "backed up %d characters, %d devil fruits, %d crews, %d crew members and %d api keys at schema version %d to %s\n",
+		len(archive.Characters), len(archive.DevilFruits), len(archive.Crews), len(archive.CrewMembers), len(archive.APIKeys), archive.SchemaVersion, *output)
+
+	return nil
+}
+
+// backup writes an archive of every record, read from a single snapshot.
+func (app *application) backup(ctx context.Context, w io.Writer, compress bool) (*backup.Archive, error) {
+	schemaVersion, err := app.schemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := backup.New(schemaVersion, version)
+
+	err = app.models.Snapshot(ctx, func(models data.Models) error {
+		return fillArchive(ctx, models, archive)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return archive, backup.Write(w, archive, compress)
+}
+
+func fillArchive(ctx context.Context, models data.Models, archive *backup.Archive) error {
+	byID := data.Filters{Sort: "id", SortSafelist: []string{"id"}}
+
+	err := models.Characters.Stream(ctx, "", 0, "", "", 0, byID, func(c *data.Character) error {
+		var bounty *int64
+		if c.Bounty != nil {
+			b := int64(*c.Bounty)
+			bounty = &b
+		}
+
+		archive.Characters = append(archive.Characters, backup.Character{
+			ID:          c.ID,
+			CreatedAt:   c.CreatedAt,
+			UpdatedAt:   c.UpdatedAt,
+			Name:        c.Name,
+			Age:         c.Age,
+			Description: c.Description,
+			Origin:      c.Origin,
+			Bounty:      bounty,
+			Race:        c.Race,
+			Episode:     c.Episode,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = models.DevilFruits.Stream(ctx, "", "", byID, func(df *data.DevilFruit) error {
+		var characterID *int64
+		if df.Character_id.Valid {
+			characterID = &df.Character_id.Int64
+		}
+
+		archive.DevilFruits = append(archive.DevilFruits, backup.DevilFruit{
+			ID:             df.ID,
+			CreatedAt:      df.CreatedAt,
+			UpdatedAt:      df.UpdatedAt,
+			Name:           df.Name,
+			Description:    df.Description,
+			Type:           df.Type,
+			CharacterID:    characterID,
+			PreviousOwners: df.PreviousOwners,
+			Episode:        df.Episode,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = models.Crews.Stream(ctx, "", "", 0, byID, func(c *data.Crew) error {
+		archive.Crews = append(archive.Crews, backup.Crew{
+			ID:          c.ID,
+			CreatedAt:   c.CreatedAt,
+			UpdatedAt:   c.UpdatedAt,
+			Name:        c.Name,
+			Description: c.Description,
+			ShipName:    c.ShipName,
+			CaptainID:   c.CaptainID,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, crew := range archive.Crews {
+		members, err := allCrewMembers(ctx, models, crew.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			archive.CrewMembers = append(archive.CrewMembers, backup.CrewMember{CrewID: crew.ID, CharacterID: member.ID})
+		}
+	}
+
+	apiKeys, err := models.APIKeys.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, apiKey := range apiKeys {
+		archived := backup.APIKey{
+			ID:         apiKey.ID,
+			CreatedAt:  apiKey.CreatedAt,
+			Name:       apiKey.Name,
+			KeyHash:    apiKey.KeyHash,
+			Scopes:     apiKey.Scopes,
+			IsActive:   apiKey.IsActive,
+			LastUsedAt: apiKey.LastUsedAt,
+			ExpiresAt:  apiKey.ExpiresAt,
+			ReplacedBy: apiKey.ReplacedBy,
+			RotatedAt:  apiKey.RotatedAt,
+
+			SigningSecret:  apiKey.SigningSecret,
+			RequireSigning: apiKey.RequireSigning,
+		}
+
+		if apiKey.RateLimit != nil {
+			archived.RateLimit = &backup.RateLimit{RPS: apiKey.RateLimit.RPS, Burst: apiKey.RateLimit.Burst}
+		}
+		if apiKey.Quota != nil {
+			archived.Quota = &backup.Quota{Limit: apiKey.Quota.Limit, Period: apiKey.Quota.Period}
+		}
+
+		archive.APIKeys = append(archive.APIKeys, archived)
+	}
+
+	webhooks, err := models.Webhooks.GetEvery(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		archive.Webhooks = append(archive.Webhooks, backup.Webhook{
+			ID:        webhook.ID,
+			CreatedAt: webhook.CreatedAt,
+			APIKeyID:  webhook.APIKeyID,
+			URL:       webhook.URL,
+			Resources: webhook.Resources,
+			Secret:    webhook.Secret,
+		})
+	}
+
+	return nil
+}
+
+func (app *application) restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	conflict := fs.String("conflict", "fail", "what to do with records whose name already exists: fail, skip or overwrite")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: api restore [--conflict fail|skip|overwrite] FILE")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("restore expects exactly one archive file, or - for stdin")
+	}
+
+	if !validator.PermittedValue(*conflict, "fail", "skip", "overwrite") {
+		return fmt.Errorf("unknown --conflict value %q", *conflict)
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		in = f
+	}
+
+	archive, err := backup.Read(in)
+	if err != nil {
+		return err
+	}
+
+	ctx := data.ContextWithActor(context.Background(), data.Actor{Route: "restore"})
+
+	return app.restore(ctx, archive, *conflict, os.Stdout)
+}
+
+// restore loads an archive in a single transaction. The database is first
+// migrated to the schema this binary expects, so an archive taken at an older
+// schema version is restored into an up-to-date database.
+func (app *application) restore(ctx context.Context, archive *backup.Archive, conflict string, out io.Writer) error {
+	latest, err := embeddedSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if archive.SchemaVersion > latest {
+		return fmt.Errorf("archive schema version %d is newer than this binary supports (%d)", archive.SchemaVersion, latest)
+	}
+
+	if app.db != nil {
+		migrator, err := app.newMigrator()
+		if err != nil {
+			return err
+		}
+
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range applied {
+			fmt.Fprintf(out, "applied %s\n", migration.Name)
+		}
+	}
+
+	r := &restorer{
+		conflict:       conflict,
+		characterIDs:   make(map[int64]int64),
+		characterNames: make(map[int64]string),
+		crewIDs:        make(map[int64]int64),
+		apiKeyIDs:      make(map[int64]int64),
+		counts:         make(map[string]*restoreCounts),
+	}
+
+	err = app.models.Transaction(ctx, func(models data.Models) error {
+		r.models = models
+		return r.run(ctx, archive)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "restored archive from %s (schema version %d)\n", archive.CreatedAt.Format("2006-01-02 15:04:05 MST"), archive.SchemaVersion)
+	for _, kind := range []string{"characters", "devil fruits", "crews", "crew members", "api keys", "webhooks"} {
+		c := r.count(kind)
+		fmt.Fprintf(out, "%-13s %d restored, %d overwritten, %d skipped\n", kind+":", c.restored, c.overwritten, c.skipped)
+	}
+
+	return nil
+}
+
+type restoreCounts struct {
+	restored, overwritten, skipped int
+}
+
+// restorer inserts archived records under new ids, translating every
+// reference from the archive's ids to the database's as it goes.
+type restorer struct {
+	models   data.Models
+	conflict string
+
+	characterIDs   map[int64]int64  // archive id -> database id
+	characterNames map[int64]string // database id -> name
+	crewIDs        map[int64]int64  // archive id -> database id, for crews whose members are restored
+	apiKeyIDs      map[int64]int64  // archive id -> database id
+	counts         map[string]*restoreCounts
+}
+
+func (r *restorer) count(kind string) *restoreCounts {
+	if r.counts[kind] == nil {
+		r.counts[kind] = &restoreCounts{}
+	}
+	return r.counts[kind]
+}
+
+// existing decides what to do with an archived record whose name is already
+// taken, returning true if it should be overwritten.
+func (r *restorer) existing(kind, name string) (bool, error) {
+	switch r.conflict {
+	case "skip":
+		r.count(kind).skipped++
+		return false, nil
+	case "overwrite":
+		r.count(kind).overwritten++
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s %q already exists (use --conflict skip or overwrite)", strings.TrimSuffix(kind, "s"), name)
+	}
+}
+
+func (r *restorer) run(ctx context.Context, archive *backup.Archive) error {
+	for _, input := range archive.Characters {
+		err := r.restoreCharacter(ctx, input)
+		if err != nil {
+			return fmt.Errorf("character %d: %w", input.ID, err)
+		}
+	}
+
+	for _, input := range archive.DevilFruits {
+		err := r.restoreDevilFruit(ctx, input)
+		if err != nil {
+			return fmt.Errorf("devil fruit %d: %w", input.ID, err)
+		}
+	}
+
+	for _, input := range archive.Crews {
+		err := r.restoreCrew(ctx, input)
+		if err != nil {
+			return fmt.Errorf("crew %d: %w", input.ID, err)
+		}
+	}
+
+	for _, input := range archive.CrewMembers {
+		err := r.restoreCrewMember(ctx, input)
+		if err != nil {
+			return fmt.Errorf("crew member %d of crew %d: %w", input.CharacterID, input.CrewID, err)
+		}
+	}
+
+	err := r.restoreAPIKeys(ctx, archive.APIKeys)
+	if err != nil {
+		return err
+	}
+
+	for _, input := range archive.Webhooks {
+		err := r.restoreWebhook(ctx, input)
+		if err != nil {
+			return fmt.Errorf("webhook %d: %w", input.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *restorer) restoreCharacter(ctx context.Context, input backup.Character) error {
+	character := &data.Character{
+		Name:        input.Name,
+		Age:         input.Age,
+		Description: input.Description,
+		Origin:      input.Origin,
+		Race:        input.Race,
+		Episode:     input.Episode,
+	}
+	if input.Bounty != nil {
+		bounty := data.Berries(*input.Bounty)
+		character.Bounty = &bounty
+	}
+
+	v := validator.New()
+	if data.ValidateCharacter(v, character); !v.Valid() {
+		return fmt.Errorf("invalid record: %v", v.Errors)
+	}
+
+	existing, err := r.models.Characters.GetByName(ctx, character.Name)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		err = r.models.Characters.Insert(ctx, character)
+		if err != nil {
+			return err
+		}
+		r.count("characters").restored++
+	case err != nil:
+		return err
+	default:
+		overwrite, err := r.existing("characters", character.Name)
+		if err != nil {
+			return err
+		}
+
+		character.ID = existing.ID
+		character.Version = existing.Version
+		if overwrite {
+			err = r.models.Characters.Update(ctx, character)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	r.characterIDs[input.ID] = character.ID
+	r.characterNames[character.ID] = character.Name
+
+	return nil
+}
+
+func (r *restorer) restoreDevilFruit(ctx context.Context, input backup.DevilFruit) error {
+	devilFruit := &data.DevilFruit{
+		Name:           input.Name,
+		Description:    input.Description,
+		Type:           input.Type,
+		PreviousOwners: input.PreviousOwners,
+		Episode:        input.Episode,
+	}
+
+	if input.CharacterID != nil {
+		id, ok := r.characterIDs[*input.CharacterID]
+		if !ok {
+			return fmt.Errorf("owner %d is not in the archive", *input.CharacterID)
+		}
+
+		devilFruit.Character_id = sql.NullInt64{Int64: id, Valid: true}
+		devilFruit.CurrentOwner = sql.NullString{String: r.characterNames[id], Valid: true}
+	}
+
+	v := validator.New()
+	if data.ValidateDevilFruit(v, devilFruit); !v.Valid() {
+		return fmt.Errorf("invalid record: %v", v.Errors)
+	}
+
+	existing, err := r.models.DevilFruits.GetByName(ctx, devilFruit.Name)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		r.count("devil fruits").restored++
+		return r.models.DevilFruits.Insert(ctx, devilFruit)
+	case err != nil:
+		return err
+	}
+
+	overwrite, err := r.existing("devil fruits", devilFruit.Name)
+	if err != nil || !overwrite {
+		return err
+	}
+
+	devilFruit.ID = existing.ID
+	devilFruit.Version = existing.Version
+	return r.models.DevilFruits.Update(ctx, devilFruit)
+}
+
+func (r *restorer) restoreCrew(ctx context.Context, input backup.Crew) error {
+	captainID, ok := r.characterIDs[input.CaptainID]
+	if !ok {
+		return fmt.Errorf("captain %d is not in the archive", input.CaptainID)
+	}
+
+	crew := &data.Crew{
+		Name:        input.Name,
+		Description: input.Description,
+		ShipName:    input.ShipName,
+		CaptainID:   captainID,
+		CaptainName: r.characterNames[captainID],
+	}
+
+	v := validator.New()
+	if data.ValidateCrew(v, crew); !v.Valid() {
+		return fmt.Errorf("invalid record: %v", v.Errors)
+	}
+
+	existing, err := r.models.Crews.GetByName(ctx, crew.Name)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		// The crew starts out empty and its total bounty is built up as
+		// the archived memberships are added.
+		err = r.models.Crews.Insert(ctx, crew)
+		if err != nil {
+			return err
+		}
+
+		r.count("crews").restored++
+		r.crewIDs[input.ID] = crew.ID
+		return nil
+	case err != nil:
+		return err
+	}
+
+	overwrite, err := r.existing("crews", crew.Name)
+	if err != nil || !overwrite {
+		return err
+	}
+
+	existing.Description = crew.Description
+	existing.ShipName = crew.ShipName
+
+	if existing.CaptainID != captainID {
+		captain, err := r.models.Characters.Get(ctx, captainID)
+		if err != nil {
+			return err
+		}
+
+		err = swapCaptain(ctx, r.models, existing, captain)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = r.models.Crews.Update(ctx, existing)
+	if err != nil {
+		return err
+	}
+
+	r.crewIDs[input.ID] = existing.ID
+	return nil
+}
+
+func (r *restorer) restoreCrewMember(ctx context.Context, input backup.CrewMember) error {
+	crewID, ok := r.crewIDs[input.CrewID]
+	if !ok {
+		// The crew was skipped, so its members are left as they are.
+		r.count("crew members").skipped++
+		return nil
+	}
+
+	characterID, ok := r.characterIDs[input.CharacterID]
+	if !ok {
+		return errors.New("character is not in the archive")
+	}
+
+	err := r.models.Crews.AddMember(ctx, crewID, characterID)
+	switch {
+	case errors.Is(err, data.ErrAlreadyMember):
+		r.count("crew members").skipped++
+		return nil
+	case err != nil:
+		return err
+	}
+
+	r.count("crew members").restored++
+	return nil
+}
+
+// restoreAPIKeys adds archived keys whose hash isn't already in use. A key
+// with the same hash is the same key, so it is always left as it is. A
+// rotated key's replacement is restored before it, so the key can point to
+// it.
+func (r *restorer) restoreAPIKeys(ctx context.Context, inputs []backup.APIKey) error {
+	current, err := r.models.APIKeys.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]int64, len(current))
+	for _, apiKey := range current {
+		existing[apiKey.KeyHash] = apiKey.ID
+	}
+
+	archived := make(map[int64]backup.APIKey, len(inputs))
+	for _, input := range inputs {
+		archived[input.ID] = input
+	}
+
+	var restore func(input backup.APIKey) error
+	restore = func(input backup.APIKey) error {
+		if _, ok := r.apiKeyIDs[input.ID]; ok {
+			return nil
+		}
+
+		if id, ok := existing[input.KeyHash]; ok {
+			r.apiKeyIDs[input.ID] = id
+			r.count("api keys").skipped++
+			return nil
+		}
+
+		scopes := input.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{data.ScopeAdmin}
+		}
+
+		apiKey := &data.APIKey{
+			Name:      input.Name,
+			KeyHash:   input.KeyHash,
+			Scopes:    scopes,
+			IsActive:  input.IsActive,
+			ExpiresAt: input.ExpiresAt,
+			RotatedAt: input.RotatedAt,
+
+			SigningSecret:  input.SigningSecret,
+			RequireSigning: input.RequireSigning,
+		}
+
+		// A replacement that isn't in the archive was deleted, and the key
+		// no longer points to it.
+		if input.ReplacedBy != nil {
+			if successor, ok := archived[*input.ReplacedBy]; ok && successor.ID != input.ID {
+				err := restore(successor)
+				if err != nil {
+					return err
+				}
+
+				replacedBy := r.apiKeyIDs[successor.ID]
+				apiKey.ReplacedBy = &replacedBy
+			}
+		}
+
+		if input.RateLimit != nil {
+			apiKey.RateLimit = &data.RateLimit{RPS: input.RateLimit.RPS, Burst: input.RateLimit.Burst}
+		}
+		if input.Quota != nil {
+			apiKey.Quota = &data.Quota{Limit: input.Quota.Limit, Period: input.Quota.Period}
+		}
+
+		err := r.models.APIKeys.Insert(ctx, apiKey)
+		if err != nil {
+			return fmt.Errorf("api key %d: %w", input.ID, err)
+		}
+
+		existing[input.KeyHash] = apiKey.ID
+		r.apiKeyIDs[input.ID] = apiKey.ID
+		r.count("api keys").restored++
+
+		return nil
+	}
+
+	for _, input := range inputs {
+		err := restore(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreWebhook adds an archived webhook to its key, unless the key already
+// has one for the same URL, as a key that was already in the database may.
+func (r *restorer) restoreWebhook(ctx context.Context, input backup.Webhook) error {
+	apiKeyID, ok := r.apiKeyIDs[input.APIKeyID]
+	if !ok {
+		return errors.New("api key is not in the archive")
+	}
+
+	current, err := r.models.Webhooks.GetAll(ctx, apiKeyID)
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(current, func(w *data.Webhook) bool { return w.URL == input.URL }) {
+		r.count("webhooks").skipped++
+		return nil
+	}
+
+	resources := input.Resources
+	if resources == nil {
+		resources = []string{}
+	}
+
+	err = r.models.Webhooks.Insert(ctx, &data.Webhook{
+		APIKeyID:  apiKeyID,
+		URL:       input.URL,
+		Resources: resources,
+		Secret:    input.Secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.count("webhooks").restored++
+	return nil
+}
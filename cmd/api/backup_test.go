@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/backup"
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/seeds"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	dataset, err := seeds.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	source := newTestApplication(t)
+
+	err = (&seeder{models: source.models, out: io.Discard}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mirror := &data.APIKey{Name: "nightly mirror", KeyHash: "0123abcd", Scopes: []string{"characters:read"}, IsActive: true}
+
+	err = source.models.APIKeys.Insert(ctx, mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key in the middle of rotation comes back as one.
+	successor, _, err := source.models.APIKeys.Rotate(ctx, mirror.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = source.models.Webhooks.Insert(ctx, &data.Webhook{APIKeyID: successor.ID, URL: "https://mirror.example.com/hooks", Resources: []string{"crews"}, Secret: "whsec_mirror"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	_, err = source.backup(ctx, &buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), "Straw Hat Pirates") {
+		t.Fatal("compressed archive contains plain text")
+	}
+
+	archive, err := backup.Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(archive.Characters), len(dataset.Characters))
+	equal(t, len(archive.APIKeys), 2)
+	equal(t, archive.APIKeys[0].KeyHash, "0123abcd")
+
+	// Restore into a database that already has a record, so every archived
+	// id ends up mapped to a different one.
+	target := newTestApplication(t)
+
+	bounty := data.Berries(100)
+	err = target.models.Characters.Insert(ctx, &data.Character{Name: "Koby", Age: 18, Description: "A marine", Origin: "East Blue", Race: "human", Bounty: &bounty, Episode: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestAPIKey(t, target, "marine-hq")
+
+	err = target.restore(ctx, archive, "fail", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	law, err := target.models.Characters.GetByName(ctx, "Trafalgar Law")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fruit, err := target.models.DevilFruits.GetByName(ctx, "Ope Ope no Mi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, fruit.Character_id.Int64, law.ID)
+
+	original, err := source.models.Crews.GetByName(ctx, "Straw Hat Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := target.models.Crews.GetByName(ctx, "Straw Hat Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, restored.MemberCount, original.MemberCount)
+	equal(t, restored.TotalBounty, original.TotalBounty)
+
+	apiKey, err := target.models.APIKeys.GetByHash(ctx, "0123abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, apiKey.Name, "nightly mirror")
+	equal(t, strings.Join(apiKey.Scopes, ","), "characters:read")
+	equal(t, apiKey.Rotated(), true)
+
+	replacement, err := target.models.APIKeys.Get(ctx, *apiKey.ReplacedBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, replacement.KeyHash, successor.KeyHash)
+	equal(t, replacement.Rotated(), false)
+
+	// Webhooks come back with their keys, and keep their secrets.
+	webhooks, err := target.models.Webhooks.GetEvery(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(webhooks), 1)
+	equal(t, webhooks[0].APIKeyID, replacement.ID)
+	equal(t, webhooks[0].URL, "https://mirror.example.com/hooks")
+	equal(t, webhooks[0].Secret, "whsec_mirror")
+
+	// A second restore conflicts on every name, and fails as a whole
+	// unless told to skip.
+	err = target.restore(ctx, archive, "fail", io.Discard)
+	if err == nil {
+		t.Fatal("expected a conflict error")
+	}
+
+	var out bytes.Buffer
+
+	err = target.restore(ctx, archive, "skip", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "characters:   0 restored, 0 overwritten, 15 skipped") || !strings.Contains(out.String(), "webhooks:     0 restored, 0 overwritten, 1 skipped") {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+
+	restored, err = target.models.Crews.GetByName(ctx, "Straw Hat Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, restored.TotalBounty, original.TotalBounty)
+}
+
+func TestRestoreRejectsNewerSchema(t *testing.T) {
+	app := newTestApplication(t)
+
+	latest, err := embeddedSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.restore(context.Background(), backup.New(latest+1, version), "fail", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "newer than this binary supports") {
+		t.Errorf("got %v; want a schema version error", err)
+	}
+}
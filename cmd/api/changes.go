@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+var errInvalidChangeToken = errors.New("invalid change token")
+
+// encodeChangeToken turns a change sequence number into the opaque token
+// clients pass back as since.
+func encodeChangeToken(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+func decodeChangeToken(token string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidChangeToken
+	}
+
+	seq, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || seq < 0 {
+		return 0, errInvalidChangeToken
+	}
+
+	return seq, nil
+}
+
+// listChangesHandler pages through the change feed. Without since it starts
+// from the beginning; each response carries the token to resume from, which
+// stays the same until there's something new.
+func (app *application) listChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Since int64
+		Limit int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	if token := app.readString(qs, "since", ""); token != "" {
+		seq, err := decodeChangeToken(token)
+		if err != nil {
+			v.AddError("since", "must be a token from a previous response")
+		}
+		input.Since = seq
+	}
+
+	input.Limit = app.readInt(qs, "limit", 100, v)
+
+	v.Check(input.Limit > 0, "limit", "must be greater than zero")
+	v.Check(input.Limit <= 1000, "limit", "must be a maximum of 1000")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Ask for one more than the limit to find out if there are more.
+	changes, err := app.models.Changes.GetSince(r.Context(), input.Since, input.Limit+1)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	hasMore := len(changes) > input.Limit
+	if hasMore {
+		changes = changes[:input.Limit]
+	}
+
+	next := input.Since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"changes": changes, "next": encodeChangeToken(next), "has_more": hasMore}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
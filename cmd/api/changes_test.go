@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestChangeFeed(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Buggy", 39, "15M berries")
+	path := fmt.Sprintf("/v1/characters/%d", id)
+
+	status, _ := ts.do(t, http.MethodPatch, path, map[string]any{"age": 40})
+	equal(t, status, http.StatusOK)
+
+	status, response := ts.do(t, http.MethodGet, "/v1/changes?limit=1", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, response["has_more"], true)
+
+	changes := response["changes"].([]any)
+	equal(t, len(changes), 1)
+	equal(t, changes[0].(map[string]any)["action"], "create")
+
+	status, _ = ts.do(t, http.MethodDelete, path, nil)
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.do(t, http.MethodGet, "/v1/changes?since="+response["next"].(string), nil)
+	equal(t, status, http.StatusOK)
+	equal(t, response["has_more"], false)
+
+	changes = response["changes"].([]any)
+	equal(t, len(changes), 2)
+
+	update := changes[0].(map[string]any)
+	equal(t, update["action"], "update")
+	equal(t, int(update["data"].(map[string]any)["age"].(float64)), 40)
+
+	tombstone := changes[1].(map[string]any)
+	equal(t, tombstone["action"], "delete")
+	equal(t, int64(tombstone["id"].(float64)), id)
+	equal(t, tombstone["data"], nil)
+
+	next := response["next"].(string)
+
+	status, response = ts.do(t, http.MethodGet, "/v1/changes?since="+next, nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["changes"].([]any)), 0)
+	equal(t, response["next"].(string), next)
+
+	status, _ = ts.do(t, http.MethodGet, "/v1/changes?since=not-a-token", nil)
+	equal(t, status, http.StatusUnprocessableEntity)
+}
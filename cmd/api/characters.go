@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/05blue04/Poneglyph/internal/data"
 	"github.com/05blue04/Poneglyph/internal/validator"
@@ -44,9 +45,15 @@ func (app *application) createCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.models.Characters.Insert(character)
+	err = app.models.Characters.Insert(r.Context(), character)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateName):
+			v.AddError("name", "a character with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -66,7 +73,7 @@ func (app *application) showCharacterHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	character, err := app.models.Characters.Get(id)
+	character, err := app.models.Characters.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -77,7 +84,7 @@ func (app *application) showCharacterHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"character": character}, character.UpdatedAt)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -91,7 +98,7 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	character, err := app.models.Characters.Get(id)
+	character, err := app.models.Characters.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -102,15 +109,17 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	var input struct {
-		Name        *string       `json:"name"`
-		Age         *int          `json:"age"`
-		Description *string       `json:"description"`
-		Origin      *string       `json:"origin"`
-		Bounty      *data.Berries `json:"bounty,omitempty"`
-		Race        *string       `json:"race"`
-		Episode     *int          `json:"episode"`
+	match, err := ifMatch(r, character.Version, envelope{"character": character})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var input characterUpdate
 
 	err = app.readJSON(w, r, &input)
 	if err != nil {
@@ -118,6 +127,24 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	app.applyCharacterUpdate(w, r, character, input)
+}
+
+// characterUpdate holds the fields a character update may change. Fields
+// left nil keep their current value.
+type characterUpdate struct {
+	Name        *string       `json:"name"`
+	Age         *int          `json:"age"`
+	Description *string       `json:"description"`
+	Origin      *string       `json:"origin"`
+	Bounty      *data.Berries `json:"bounty,omitempty"`
+	Race        *string       `json:"race"`
+	Episode     *int          `json:"episode"`
+}
+
+// applyCharacterUpdate validates and saves the changes in input and responds
+// with the updated character. It is shared by updates and reverts.
+func (app *application) applyCharacterUpdate(w http.ResponseWriter, r *http.Request, character *data.Character, input characterUpdate) {
 	updateIfNotNil(&character.Name, input.Name)
 	updateIfNotNil(&character.Age, input.Age)
 	updateIfNotNil(&character.Description, input.Description)
@@ -140,9 +167,17 @@ func (app *application) updateCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.models.Characters.Update(character)
+	err := app.models.Characters.Update(r.Context(), character)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateName):
+			v.AddError("name", "a character with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -160,11 +195,13 @@ func (app *application) deleteCharacterHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.models.Characters.Delete(id)
+	err = app.models.Characters.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrCaptain):
+			app.errorResponse(w, r, http.StatusConflict, "this character captains a crew; give the crew a new captain first")
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -178,6 +215,40 @@ func (app *application) deleteCharacterHandler(w http.ResponseWriter, r *http.Re
 
 }
 
+func (app *application) restoreCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Characters.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateName):
+			v := validator.New()
+			v.AddError("name", "a character with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	character, err := app.models.Characters.Get(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"character": character}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listCharactersHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Search string
@@ -210,13 +281,13 @@ func (app *application) listCharactersHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	characters, metadata, err := app.models.Characters.GetAll(input.Search, input.Age, input.Origin, input.Race, input.Bounty, input.Filters)
+	characters, metadata, err := app.models.Characters.GetAll(r.Context(), input.Search, input.Age, input.Origin, input.Race, input.Bounty, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"characters": characters, "metadata": metadata}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"characters": characters, "metadata": metadata}, time.Time{})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
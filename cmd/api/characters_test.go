@@ -22,7 +22,6 @@ func TestCreateCharacterHandler(t *testing.T) {
 		"origin":      "East Blue",
 		"race":        "human",
 		"episode":     1,
-		"time_skip":   "pre",
 	}
 
 	jsonBody, err := json.Marshal(payload)
@@ -55,8 +54,6 @@ func TestCreateCharacterHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	fmt.Println(response)
-
 	character, ok := response["character"]
 	if !ok {
 		t.Fatal("expected response to contain 'character' field")
@@ -65,6 +62,121 @@ func TestCreateCharacterHandler(t *testing.T) {
 	characterMap := character.(map[string]any)
 	equal(t, characterMap["name"], "Monkey D. Luffy")
 	equal(t, int(characterMap["age"].(float64)), 19)
-	equal(t, characterMap["race"], "Human")
+	equal(t, characterMap["race"], "human")
+	equal(t, res.Header.Get("Location"), "/v1/characters/1")
+
+}
+
+func createTestCharacter(t *testing.T, ts *testServer, name string, age int, bounty string) int64 {
+	t.Helper()
+
+	payload := map[string]any{
+		"name":        name,
+		"age":         age,
+		"description": "A pirate sailing the Grand Line",
+		"origin":      "East Blue",
+		"race":        "human",
+		"episode":     1,
+	}
+	if bounty != "" {
+		payload["bounty"] = bounty
+	}
+
+	status, response := ts.do(t, http.MethodPost, "/v1/characters", payload)
+	if status != http.StatusCreated {
+		t.Fatalf("creating %s: got status %d: %v", name, status, response)
+	}
+
+	return int64(response["character"].(map[string]any)["id"].(float64))
+}
+
+func TestCreateCharacterDuplicateName(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	createTestCharacter(t, ts, "Roronoa Zoro", 21, "")
+
+	payload := map[string]any{
+		"name":        "Roronoa Zoro",
+		"age":         21,
+		"description": "First mate of the Straw Hat Pirates",
+		"origin":      "East Blue",
+		"race":        "human",
+		"episode":     2,
+	}
 
+	status, response := ts.do(t, http.MethodPost, "/v1/characters", payload)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, response["error"].(map[string]any)["name"], "a character with this name already exists")
+}
+
+func TestUpdateAndDeleteCharacter(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Buggy", 39, "15M berries")
+
+	status, response := ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/characters/%d", id), map[string]any{"bounty": "3.1B berries", "episode": 8})
+	equal(t, status, http.StatusOK)
+
+	character := response["character"].(map[string]any)
+	equal(t, character["bounty"], "3.1B berries")
+	equal(t, int(character["episode"].(float64)), 8)
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", id), nil)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/characters/%d", id), nil)
+	equal(t, status, http.StatusNotFound)
+}
+
+func TestListCharactersHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	createTestCharacter(t, ts, "Monkey D. Luffy", 19, "3B berries")
+	createTestCharacter(t, ts, "Nami", 20, "366M berries")
+	createTestCharacter(t, ts, "Koby", 18, "")
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+		total    int
+	}{
+		{"default order", "", []string{"Monkey D. Luffy", "Nami", "Koby"}, 3},
+		{"sort by name", "?sort=name", []string{"Koby", "Monkey D. Luffy", "Nami"}, 3},
+		{"sort by bounty skips unknown bounties", "?sort=-bounty", []string{"Monkey D. Luffy", "Nami"}, 2},
+		{"minimum bounty", "?bounty=1B%20berries", []string{"Monkey D. Luffy"}, 1},
+		{"minimum age", "?age=19", []string{"Monkey D. Luffy", "Nami"}, 2},
+		{"search", "?search=luffy", []string{"Monkey D. Luffy"}, 1},
+		{"pagination", "?page=2&page_size=2", []string{"Koby"}, 3},
+		{"page past the end", "?page=3&page_size=2", []string{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := ts.do(t, http.MethodGet, "/v1/characters"+tt.query, nil)
+			equal(t, status, http.StatusOK)
+
+			characters := response["characters"].([]any)
+			equal(t, len(characters), len(tt.expected))
+
+			for i, character := range characters {
+				if i < len(tt.expected) {
+					equal[any](t, character.(map[string]any)["name"], tt.expected[i])
+				}
+			}
+
+			metadata := response["metadata"].(map[string]any)
+			total, _ := metadata["total_records"].(float64)
+			equal(t, int(total), tt.total)
+		})
+	}
 }
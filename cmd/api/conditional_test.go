@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+)
+
+// get sends a GET with the given request headers and returns the response
+// with its body read.
+func (ts *testServer) get(t *testing.T, urlPath string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, body
+}
+
+func TestConditionalShow(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Nico Robin", 28, "79M berries")
+	path := fmt.Sprintf("/v1/characters/%d", id)
+
+	status, response := ts.do(t, http.MethodGet, path, nil)
+	equal(t, status, http.StatusOK)
+
+	character := response["character"].(map[string]any)
+	if character["created_at"] == nil || character["updated_at"] == nil {
+		t.Fatalf("expected created_at and updated_at in %v", character)
+	}
+
+	res, _ := ts.get(t, path, nil)
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("expected ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+
+	res, body := ts.get(t, path, map[string]string{"If-None-Match": etag})
+	equal(t, res.StatusCode, http.StatusNotModified)
+	equal(t, len(body), 0)
+	equal(t, res.Header.Get("ETag"), etag)
+
+	res, _ = ts.get(t, path, map[string]string{"If-None-Match": `"stale", W/` + etag})
+	equal(t, res.StatusCode, http.StatusNotModified)
+
+	res, _ = ts.get(t, path, map[string]string{"If-Modified-Since": lastModified})
+	equal(t, res.StatusCode, http.StatusNotModified)
+
+	// If-None-Match wins over a matching If-Modified-Since.
+	res, _ = ts.get(t, path, map[string]string{"If-None-Match": `"stale"`, "If-Modified-Since": lastModified})
+	equal(t, res.StatusCode, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodPatch, path, map[string]any{"age": 30})
+	equal(t, status, http.StatusOK)
+
+	res, _ = ts.get(t, path, map[string]string{"If-None-Match": etag})
+	equal(t, res.StatusCode, http.StatusOK)
+	if res.Header.Get("ETag") == etag {
+		t.Error("expected a new ETag after an update")
+	}
+}
+
+func TestConditionalList(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	createTestCharacter(t, ts, "Franky", 36, "94M berries")
+
+	res, _ := ts.get(t, "/v1/characters", nil)
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("Last-Modified"), "")
+
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag on the list response")
+	}
+
+	res, _ = ts.get(t, "/v1/characters", map[string]string{"If-None-Match": etag})
+	equal(t, res.StatusCode, http.StatusNotModified)
+
+	createTestCharacter(t, ts, "Brook", 90, "83M berries")
+
+	res, _ = ts.get(t, "/v1/characters", map[string]string{"If-None-Match": etag})
+	equal(t, res.StatusCode, http.StatusOK)
+}
+
+func TestIfMatch(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Usopp", 17, "500M berries")
+	path := fmt.Sprintf("/v1/characters/%d", id)
+
+	status, response := ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"age": 19}, map[string]string{"If-Match": "1"})
+	equal(t, status, http.StatusOK)
+	equal(t, int(response["character"].(map[string]any)["version"].(float64)), 2)
+
+	status, _ = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"age": 20}, map[string]string{"If-Match": `"1"`})
+	equal(t, status, http.StatusPreconditionFailed)
+
+	res, _ := ts.get(t, path, nil)
+	etag := res.Header.Get("ETag")
+
+	status, _ = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"age": 20}, map[string]string{"If-Match": "W/" + etag})
+	equal(t, status, http.StatusPreconditionFailed)
+
+	status, response = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"age": 20}, map[string]string{"If-Match": etag})
+	equal(t, status, http.StatusOK)
+	equal(t, int(response["character"].(map[string]any)["version"].(float64)), 3)
+}
+
+func TestUpdateEditConflict(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Tony Tony Chopper", 17, "1000 berries")
+
+	// Two editors read the same version; the second write must not
+	// overwrite the first.
+	first, err := app.models.Characters.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := app.models.Characters.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first.Age = 18
+	err = app.models.Characters.Update(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second.Age = 19
+	err = app.models.Characters.Update(context.Background(), second)
+	if !errors.Is(err, data.ErrEditConflict) {
+		t.Fatalf("got %v; want %v", err, data.ErrEditConflict)
+	}
+
+	status, response := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/characters/%d", id), nil)
+	equal(t, status, http.StatusOK)
+	equal(t, int(response["character"].(map[string]any)["age"].(float64)), 18)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/05blue04/Poneglyph/internal/data"
 	"github.com/05blue04/Poneglyph/internal/validator"
@@ -23,7 +25,7 @@ func (app *application) createCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	character, err := app.models.Characters.Get(input.CaptainID)
+	character, err := app.models.Characters.Get(r.Context(), input.CaptainID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -34,20 +36,14 @@ func (app *application) createCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var total_bounty data.Berries
-
-	if character.Bounty != nil {
-		total_bounty = *character.Bounty
-	}
-
+	// The crew starts out empty; adding the captain as its first member below
+	// is what brings their bounty into the total.
 	crew := &data.Crew{
 		Name:        input.Name,
 		Description: input.Description,
 		ShipName:    input.ShipName,
 		CaptainID:   input.CaptainID,
 		CaptainName: character.Name,
-		TotalBounty: total_bounty,
-		MemberCount: 1,
 	}
 
 	v := validator.New()
@@ -57,18 +53,29 @@ func (app *application) createCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Crews.Insert(crew)
+	err = app.models.Crews.Insert(r.Context(), crew)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateName):
+			v.AddError("name", "a crew with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.models.Crews.AddMember(crew.ID, crew.CaptainID)
+	err = app.models.Crews.AddMember(r.Context(), crew.ID, crew.CaptainID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if character.Bounty != nil {
+		crew.TotalBounty = *character.Bounty
+	}
+	crew.MemberCount = 1
+
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/crews/%d", crew.ID))
 
@@ -85,7 +92,7 @@ func (app *application) showCrewHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	crew, err := app.models.Crews.Get(id)
+	crew, err := app.models.Crews.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -96,7 +103,7 @@ func (app *application) showCrewHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"crew": crew}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"crew": crew}, crew.UpdatedAt)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -110,7 +117,7 @@ func (app *application) updateCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	crew, err := app.models.Crews.Get(id)
+	crew, err := app.models.Crews.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -121,12 +128,17 @@ func (app *application) updateCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var input struct {
-		Name        *string `json:"name"`
-		Description *string `json:"description"`
-		ShipName    *string `json:"ship_name"`
-		CaptainID   *int64  `json:"captain_id"`
+	match, err := ifMatch(r, crew.Version, envelope{"crew": crew})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var input crewUpdate
 
 	err = app.readJSON(w, r, &input)
 	if err != nil {
@@ -134,12 +146,27 @@ func (app *application) updateCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	app.applyCrewUpdate(w, r, crew, input)
+}
+
+// crewUpdate holds the fields a crew update may change. Fields left nil keep
+// their current value.
+type crewUpdate struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	ShipName    *string `json:"ship_name"`
+	CaptainID   *int64  `json:"captain_id"`
+}
+
+// applyCrewUpdate validates and saves the changes in input and responds with
+// the updated crew. It is shared by updates and reverts.
+func (app *application) applyCrewUpdate(w http.ResponseWriter, r *http.Request, crew *data.Crew, input crewUpdate) {
 	updateIfNotNil(&crew.Name, input.Name)
 	updateIfNotNil(&crew.Description, input.Description)
 	updateIfNotNil(&crew.ShipName, input.ShipName)
 
 	if input.CaptainID != nil {
-		newCaptain, err := app.models.Characters.Get(*input.CaptainID)
+		newCaptain, err := app.models.Characters.Get(r.Context(), *input.CaptainID)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -150,28 +177,11 @@ func (app *application) updateCrewHandler(w http.ResponseWriter, r *http.Request
 			return
 		}
 
-		oldCaptain, err := app.models.Characters.Get(crew.CaptainID)
+		err = swapCaptain(r.Context(), app.models, crew, newCaptain)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-
-		var oldBounty data.Berries
-		var newBounty data.Berries
-
-		if oldCaptain.Bounty != nil {
-			oldBounty = *oldCaptain.Bounty
-		}
-
-		if newCaptain.Bounty != nil {
-			newBounty = *newCaptain.Bounty
-		}
-
-		newTotalBounty := (crew.TotalBounty - oldBounty) + newBounty
-
-		crew.CaptainID = newCaptain.ID
-		crew.CaptainName = newCaptain.Name
-		crew.TotalBounty = newTotalBounty
 	}
 
 	v := validator.New()
@@ -181,9 +191,17 @@ func (app *application) updateCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Crews.Update(crew)
+	err := app.models.Crews.Update(r.Context(), crew)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateName):
+			v.AddError("name", "a crew with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -201,7 +219,7 @@ func (app *application) deleteCrewHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Crews.Delete(id)
+	err = app.models.Crews.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -219,6 +237,40 @@ func (app *application) deleteCrewHandler(w http.ResponseWriter, r *http.Request
 
 }
 
+func (app *application) restoreCrewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Crews.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateName):
+			v := validator.New()
+			v.AddError("name", "a crew with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	crew, err := app.models.Crews.Get(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crew": crew}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) addCrewMemberHandler(w http.ResponseWriter, r *http.Request) {
 	crewID, err := app.readIDParam(r)
 	if err != nil {
@@ -226,6 +278,17 @@ func (app *application) addCrewMemberHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	_, err = app.models.Crews.Get(r.Context(), crewID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	var input struct {
 		CharacterID int64 `json:"character_id"`
 	}
@@ -236,7 +299,7 @@ func (app *application) addCrewMemberHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	character, err := app.models.Characters.Get(input.CharacterID)
+	character, err := app.models.Characters.Get(r.Context(), input.CharacterID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -247,9 +310,16 @@ func (app *application) addCrewMemberHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.models.Crews.AddMember(crewID, character.ID)
+	err = app.models.Crews.AddMember(r.Context(), crewID, character.ID)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrAlreadyMember):
+			app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("character %v is already a member of this crew", character.Name))
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -269,7 +339,7 @@ func (app *application) deleteCrewMemberHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	character, err := app.models.Characters.Get(characterID)
+	character, err := app.models.Characters.Get(r.Context(), characterID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -280,7 +350,7 @@ func (app *application) deleteCrewMemberHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.Crews.DeleteMember(crewID, character.ID)
+	err = app.models.Crews.DeleteMember(r.Context(), crewID, character.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -304,7 +374,7 @@ func (app *application) listCrewMembersHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	_, err = app.models.Crews.Get(crewID)
+	_, err = app.models.Crews.Get(r.Context(), crewID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -335,13 +405,13 @@ func (app *application) listCrewMembersHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	members, metadata, err := app.models.Crews.GetMembers(crewID, input.Bounty, input.Filters)
+	members, metadata, err := app.models.Crews.GetMembers(r.Context(), crewID, input.Bounty, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"crew_members": members, "metadata": metadata}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"crew_members": members, "metadata": metadata}, time.Time{})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -366,22 +436,69 @@ func (app *application) listCrewsHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "name", "bounty", "-id", "-name", "-total_bounty"}
+	input.Filters.SortSafelist = []string{"id", "name", "total_bounty", "-id", "-name", "-total_bounty"}
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	crews, metadata, err := app.models.Crews.GetAll(input.Search, input.ShipName, input.TotalBounty, input.Filters)
+	crews, metadata, err := app.models.Crews.GetAll(r.Context(), input.Search, input.ShipName, input.TotalBounty, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"crews": crews, "metadata": metadata}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"crews": crews, "metadata": metadata}, time.Time{})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 
 }
+
+// swapCaptain makes newCaptain the captain of crew, taking the old captain's
+// bounty out of the crew total and adding the new captain's.
+func swapCaptain(ctx context.Context, models data.Models, crew *data.Crew, newCaptain *data.Character) error {
+	oldCaptain, err := models.Characters.Get(ctx, crew.CaptainID)
+	if err != nil {
+		return err
+	}
+
+	var oldBounty data.Berries
+	var newBounty data.Berries
+
+	if oldCaptain.Bounty != nil {
+		oldBounty = *oldCaptain.Bounty
+	}
+
+	if newCaptain.Bounty != nil {
+		newBounty = *newCaptain.Bounty
+	}
+
+	crew.CaptainID = newCaptain.ID
+	crew.CaptainName = newCaptain.Name
+	crew.TotalBounty = (crew.TotalBounty - oldBounty) + newBounty
+
+	return nil
+}
+
+// allCrewMembers pages through every member of a crew, for the commands that
+// need the whole list at once.
+func allCrewMembers(ctx context.Context, models data.Models, crewID int64) ([]*data.CrewMember, error) {
+	var members []*data.CrewMember
+
+	filters := data.Filters{PageSize: 100, Sort: "id", SortSafelist: []string{"id"}}
+
+	for filters.Page = 1; ; filters.Page++ {
+		page, _, err := models.Crews.GetMembers(ctx, crewID, 0, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, page...)
+
+		if len(page) < filters.PageSize {
+			return members, nil
+		}
+	}
+}
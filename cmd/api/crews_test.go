@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCrewMembership(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	luffy := createTestCharacter(t, ts, "Monkey D. Luffy", 19, "3B berries")
+	zoro := createTestCharacter(t, ts, "Roronoa Zoro", 21, "1.1B berries")
+
+	status, response := ts.do(t, http.MethodPost, "/v1/crews", map[string]any{
+		"name":        "Straw Hat Pirates",
+		"description": "A pirate crew led by Monkey D. Luffy",
+		"ship_name":   "Thousand Sunny",
+		"captain_id":  luffy,
+	})
+	equal(t, status, http.StatusCreated)
+
+	crew := response["crew"].(map[string]any)
+	crewID := int64(crew["id"].(float64))
+	equal(t, crew["captain_name"], "Monkey D. Luffy")
+	equal(t, crew["total_bounty"], "3B berries")
+
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/crews/%d/members", crewID), map[string]any{"character_id": zoro})
+	equal(t, status, http.StatusNoContent)
+
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/crews/%d/members", crewID), map[string]any{"character_id": zoro})
+	equal(t, status, http.StatusConflict)
+
+	status, response = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/crews/%d", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	crew = response["crew"].(map[string]any)
+	equal(t, crew["total_bounty"], "4.1B berries")
+	equal(t, int(crew["member_count"].(float64)), 2)
+
+	status, response = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/crews/%d/members?sort=-bounty", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	members := response["crew_members"].([]any)
+	equal(t, len(members), 2)
+	equal(t, members[0].(map[string]any)["name"], "Monkey D. Luffy")
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/crews/%d/members/%d", crewID, zoro), nil)
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/crews/%d", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	crew = response["crew"].(map[string]any)
+	equal(t, crew["total_bounty"], "3B berries")
+	equal(t, int(crew["member_count"].(float64)), 1)
+
+	status, _ = ts.do(t, http.MethodPost, "/v1/crews/99/members", map[string]any{"character_id": zoro})
+	equal(t, status, http.StatusNotFound)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/05blue04/Poneglyph/internal/data"
 	"github.com/05blue04/Poneglyph/internal/validator"
@@ -32,7 +33,7 @@ func (app *application) createDevilFruitHandler(w http.ResponseWriter, r *http.R
 
 	// If character_id provided, fetch the character and auto-populate current_owner
 	if input.Character_id != nil {
-		character, err := app.models.Characters.Get(*input.Character_id)
+		character, err := app.models.Characters.Get(r.Context(), *input.Character_id)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -64,9 +65,15 @@ func (app *application) createDevilFruitHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.DevilFruits.Insert(devilFruit)
+	err = app.models.DevilFruits.Insert(r.Context(), devilFruit)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateName):
+			v.AddError("name", "a devil fruit with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -86,7 +93,7 @@ func (app *application) showDevilFruitHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	devilFruit, err := app.models.DevilFruits.Get(id)
+	devilFruit, err := app.models.DevilFruits.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -97,7 +104,7 @@ func (app *application) showDevilFruitHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"devilfruit": devilFruit}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"devilfruit": devilFruit}, devilFruit.UpdatedAt)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -111,7 +118,7 @@ func (app *application) updateDevilFruitHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	devilFruit, err := app.models.DevilFruits.Get(id)
+	devilFruit, err := app.models.DevilFruits.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -122,21 +129,42 @@ func (app *application) updateDevilFruitHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	var input struct {
-		Name           *string  `json:"name"`
-		Description    *string  `json:"description"`
-		Type           *string  `json:"type"`
-		Character_id   *int64   `json:"character_id"`
-		PreviousOwners []string `json:"previous_owners"`
-		Episode        *int     `json:"episode"`
+	match, err := ifMatch(r, devilFruit.Version, envelope{"devilfruit": devilFruit})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
 	}
 
+	var input devilFruitUpdate
+
 	err = app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
+	app.applyDevilFruitUpdate(w, r, devilFruit, input)
+}
+
+// devilFruitUpdate holds the fields a devil fruit update may change. Fields
+// left nil keep their current value, and a character_id of 0 removes the
+// owner.
+type devilFruitUpdate struct {
+	Name           *string  `json:"name"`
+	Description    *string  `json:"description"`
+	Type           *string  `json:"type"`
+	Character_id   *int64   `json:"character_id"`
+	PreviousOwners []string `json:"previous_owners"`
+	Episode        *int     `json:"episode"`
+}
+
+// applyDevilFruitUpdate validates and saves the changes in input and responds
+// with the updated devil fruit. It is shared by updates and reverts.
+func (app *application) applyDevilFruitUpdate(w http.ResponseWriter, r *http.Request, devilFruit *data.DevilFruit, input devilFruitUpdate) {
 	updateIfNotNil(&devilFruit.Name, input.Name)
 	updateIfNotNil(&devilFruit.Description, input.Description)
 	updateIfNotNil(&devilFruit.Type, input.Type)
@@ -152,7 +180,7 @@ func (app *application) updateDevilFruitHandler(w http.ResponseWriter, r *http.R
 			devilFruit.Character_id = sql.NullInt64{Valid: false}
 			devilFruit.CurrentOwner = sql.NullString{Valid: false}
 		} else {
-			character, err := app.models.Characters.Get(*input.Character_id)
+			character, err := app.models.Characters.Get(r.Context(), *input.Character_id)
 			if err != nil {
 				switch {
 				case errors.Is(err, data.ErrRecordNotFound):
@@ -175,9 +203,17 @@ func (app *application) updateDevilFruitHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.DevilFruits.Update(devilFruit)
+	err := app.models.DevilFruits.Update(r.Context(), devilFruit)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateName):
+			v.AddError("name", "a devil fruit with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -195,7 +231,7 @@ func (app *application) deleteDevilFruitHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.DevilFruits.Delete(id)
+	err = app.models.DevilFruits.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -213,6 +249,40 @@ func (app *application) deleteDevilFruitHandler(w http.ResponseWriter, r *http.R
 
 }
 
+func (app *application) restoreDevilFruitHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.DevilFruits.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateName):
+			v := validator.New()
+			v.AddError("name", "a devil fruit with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	devilFruit, err := app.models.DevilFruits.Get(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"devilfruit": devilFruit}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listDevilFruitsHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Search string
@@ -226,6 +296,8 @@ func (app *application) listDevilFruitsHandler(w http.ResponseWriter, r *http.Re
 
 	input.Search = app.readString(qs, "search", "")
 	input.Type = app.readString(qs, "type", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	input.Filters.SortSafelist = []string{"id", "name", "-id", "-name"}
 
@@ -234,13 +306,13 @@ func (app *application) listDevilFruitsHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	devilFruits, metadata, err := app.models.DevilFruits.GetAll(input.Search, input.Type, input.Filters)
+	devilFruits, metadata, err := app.models.DevilFruits.GetAll(r.Context(), input.Search, input.Type, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"devil_fruits": devilFruits, "metadata": metadata}, nil)
+	err = app.writeConditionalJSON(w, r, envelope{"devil_fruits": devilFruits, "metadata": metadata}, time.Time{})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
 )
 
+// statusClientClosedRequest is the non-standard status (borrowed from nginx)
+// recorded when the client goes away before a response could be written.
+const statusClientClosedRequest = 499
+
+var totalRequestsCanceled = expvar.NewInt("total_requests_canceled")
+
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = r.URL.RequestURI()
+		requestID = data.ActorFromContext(r.Context()).RequestID
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestID)
 }
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
@@ -34,26 +50,88 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		app.requestCanceledResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+// requestCanceledResponse is used instead of a 500 when the client disconnected
+// and cancelled the request context while a query was in flight.
+func (app *application) requestCanceledResponse(w http.ResponseWriter, r *http.Request) {
+	totalRequestsCanceled.Add(1)
+
+	app.logger.Info("request canceled by client", "method", r.Method, "uri", r.URL.RequestURI())
+	w.WriteHeader(statusClientClosedRequest)
+}
+
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported ...string) {
+	message := fmt.Sprintf("the Content-Type must be one of: %s", strings.Join(supported, ", "))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has changed since the version given in If-Match"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) quotaExceededResponse(w http.ResponseWriter, r *http.Request, quota *data.Quota, resetsAt time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(time.Until(resetsAt).Seconds())))))
+
+	message := fmt.Sprintf("your API key has used up its quota of %d requests per %s", quota.Limit, quota.Period)
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request, scope string) {
+	credential := "API key"
+	if app.contextGetPrincipal(r).APIKey == nil {
+		credential = "token"
+	}
+
+	message := fmt.Sprintf("your %s doesn't have the %s scope needed for this request", credential, scope)
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) invalidSignatureResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid request signature: "+message)
+}
+
+func (app *application) apiKeyRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this endpoint needs an API key rather than a token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) inactiveAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this API key has been revoked, has expired or has already been rotated"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
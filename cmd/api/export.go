@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// exportFlushEvery is how many rows are written between flushes, so a slow
+// export still shows steady progress to the client.
+const exportFlushEvery = 500
+
+// exportFunc emits every record matching an export's filters as a row of
+// values, in the order of the exporter's columns.
+type exportFunc func(ctx context.Context, models data.Models, emit func(row ...any) error) error
+
+type exporter struct {
+	columns []string
+	// prepare reads the resource's list filters from the query string.
+	prepare func(app *application, qs url.Values, v *validator.Validator) exportFunc
+}
+
+var exporters = map[string]exporter{
+	"characters": {
+		columns: []string{"id", "name", "age", "description", "origin", "race", "bounty", "episode"},
+		prepare: prepareCharacterExport,
+	},
+	"devilfruits": {
+		columns: []string{"id", "name", "description", "type", "character_id", "current_owner", "previous_owners", "episode"},
+		prepare: prepareDevilFruitExport,
+	},
+	"crews": {
+		columns: []string{"id", "name", "description", "ship_name", "captain_id", "captain_name", "total_bounty", "member_count"},
+		prepare: prepareCrewExport,
+	},
+}
+
+type exportManifest struct {
+	Resource string `json:"resource"`
+	Format   string `json:"format"`
+	Rows     int    `json:"rows"`
+	SHA256   string `json:"sha256"`
+}
+
+func (app *application) exportHandler(w http.ResponseWriter, r *http.Request) {
+	resource := httprouter.ParamsFromContext(r.Context()).ByName("resource")
+
+	exp, ok := exporters[resource]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	format := app.readString(qs, "format", "ndjson")
+	berries := app.readString(qs, "berries", "formatted")
+	stream := exp.prepare(app, qs, v)
+
+	v.Check(validator.PermittedValue(format, "ndjson", "csv"), "format", "must be ndjson or csv")
+	v.Check(validator.PermittedValue(berries, "formatted", "raw"), "berries", "must be formatted or raw")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Exports of the whole dataset can outlast the server's write timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(app.config.exports.timeout))
+
+	ew := newExportWriter(w, format, berries == "raw", exp.columns)
+
+	err := app.models.Snapshot(r.Context(), func(models data.Models) error {
+		err := ew.writeHeader(resource)
+		if err != nil {
+			return err
+		}
+
+		err = stream(r.Context(), models, ew.writeRow)
+		if err != nil {
+			return err
+		}
+
+		return ew.finish(resource)
+	})
+	if err != nil {
+		// Once rows have been sent the status can't be changed, so the
+		// missing manifest is what tells the client the export is partial.
+		if ew.sink.started {
+			app.logError(r, err)
+			return
+		}
+
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Trailer")
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// exportSink records whether anything has been written to the client yet.
+type exportSink struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *exportSink) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// exportWriter encodes rows in the requested format while hashing everything
+// it writes for the manifest.
+type exportWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	sink    *exportSink
+	buf     *bufio.Writer
+	hash    hash.Hash
+	out     io.Writer
+	csv     *csv.Writer
+	format  string
+	raw     bool
+	columns []string
+	rows    int
+}
+
+func newExportWriter(w http.ResponseWriter, format string, raw bool, columns []string) *exportWriter {
+	sink := &exportSink{w: w}
+	buf := bufio.NewWriterSize(sink, 64*1024)
+	hash := sha256.New()
+	out := io.MultiWriter(buf, hash)
+
+	ew := &exportWriter{
+		w:       w,
+		rc:      http.NewResponseController(w),
+		sink:    sink,
+		buf:     buf,
+		hash:    hash,
+		out:     out,
+		format:  format,
+		raw:     raw,
+		columns: columns,
+	}
+
+	if format == "csv" {
+		ew.csv = csv.NewWriter(out)
+	}
+
+	return ew
+}
+
+func (ew *exportWriter) writeHeader(resource string) error {
+	contentType := "application/x-ndjson"
+	if ew.format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+
+	ew.w.Header().Set("Content-Type", contentType)
+	ew.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", resource+"."+ew.format))
+	ew.w.Header().Set("Trailer", "Export-Rows, Export-SHA256")
+
+	if ew.csv != nil {
+		return ew.csv.Write(ew.columns)
+	}
+
+	return nil
+}
+
+func (ew *exportWriter) writeRow(row ...any) error {
+	for i := range row {
+		row[i] = exportValue(row[i], ew.raw)
+	}
+
+	var err error
+	if ew.csv != nil {
+		err = ew.writeCSVRow(row)
+	} else {
+		err = ew.writeJSONRow(row)
+	}
+	if err != nil {
+		return err
+	}
+
+	ew.rows++
+	if ew.rows%exportFlushEvery == 0 {
+		return ew.flush()
+	}
+
+	return nil
+}
+
+// writeJSONRow writes the row as an object with its keys in column order.
+func (ew *exportWriter) writeJSONRow(row []any) error {
+	line := []byte{'{'}
+
+	for i, value := range row {
+		if i > 0 {
+			line = append(line, ',')
+		}
+
+		line = strconv.AppendQuote(line, ew.columns[i])
+		line = append(line, ':')
+
+		js, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		line = append(line, js...)
+	}
+
+	line = append(line, '}', '\n')
+
+	_, err := ew.out.Write(line)
+	return err
+}
+
+func (ew *exportWriter) writeCSVRow(row []any) error {
+	record := make([]string, len(row))
+
+	for i, value := range row {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			record[i] = value
+		case []string:
+			record[i] = strings.Join(value, ";")
+		case data.Berries:
+			js, err := value.MarshalJSON()
+			if err != nil {
+				return err
+			}
+			record[i], _ = strconv.Unquote(string(js))
+		default:
+			record[i] = fmt.Sprint(value)
+		}
+	}
+
+	return ew.csv.Write(record)
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+		if err := ew.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	err := ew.buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	return ew.rc.Flush()
+}
+
+// finish writes the manifest: as HTTP trailers, and as a final line so it
+// survives proxies that drop trailers and being saved to a file. For CSV the
+// line is a comment, starting with "# ". The checksum covers everything
+// before that line.
+func (ew *exportWriter) finish(resource string) error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+		if err := ew.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	manifest := exportManifest{
+		Resource: resource,
+		Format:   ew.format,
+		Rows:     ew.rows,
+		SHA256:   hex.EncodeToString(ew.hash.Sum(nil)),
+	}
+
+	js, err := json.Marshal(map[string]exportManifest{"manifest": manifest})
+	if err != nil {
+		return err
+	}
+
+	if ew.csv != nil {
+		js = append([]byte("# "), js...)
+	}
+
+	_, err = ew.buf.Write(append(js, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = ew.buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	ew.w.Header().Set("Export-Rows", strconv.Itoa(manifest.Rows))
+	ew.w.Header().Set("Export-SHA256", manifest.SHA256)
+
+	return nil
+}
+
+// exportValue normalises the Go types used by the models into plain values,
+// with bounties left as Berries unless raw integers were asked for.
+func exportValue(value any, raw bool) any {
+	switch value := value.(type) {
+	case *data.Berries:
+		if value == nil {
+			return nil
+		}
+		return exportValue(*value, raw)
+	case data.Berries:
+		if raw {
+			return int64(value)
+		}
+		return value
+	case sql.NullInt64:
+		if !value.Valid {
+			return nil
+		}
+		return value.Int64
+	case sql.NullString:
+		if !value.Valid {
+			return nil
+		}
+		return value.String
+	case []string:
+		if value == nil {
+			return []string{}
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// readExportSort reads the sort parameter the same way the list handlers do.
+// Exports aren't paginated, so page and page_size are ignored.
+func (app *application) readExportSort(qs url.Values, v *validator.Validator, safelist ...string) data.Filters {
+	filters := data.Filters{
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: safelist,
+	}
+
+	v.Check(validator.PermittedValue(filters.Sort, filters.SortSafelist...), "sort", "invalid sort value")
+
+	return filters
+}
+
+func prepareCharacterExport(app *application, qs url.Values, v *validator.Validator) exportFunc {
+	search := app.readString(qs, "search", "")
+	age := app.readInt(qs, "age", 0, v)
+	origin := app.readString(qs, "origin", "")
+	race := strings.ToLower(app.readString(qs, "race", ""))
+	bounty := app.readBounty(qs, "bounty", data.Berries(0), v)
+	filters := app.readExportSort(qs, v, "id", "name", "age", "bounty", "race", "-id", "-name", "-age", "-bounty", "-race")
+
+	return func(ctx context.Context, models data.Models, emit func(row ...any) error) error {
+		return models.Characters.Stream(ctx, search, age, origin, race, bounty, filters, func(c *data.Character) error {
+			return emit(c.ID, c.Name, c.Age, c.Description, c.Origin, c.Race, c.Bounty, c.Episode)
+		})
+	}
+}
+
+func prepareDevilFruitExport(app *application, qs url.Values, v *validator.Validator) exportFunc {
+	search := app.readString(qs, "search", "")
+	fruitType := app.readString(qs, "type", "")
+	filters := app.readExportSort(qs, v, "id", "name", "-id", "-name")
+
+	return func(ctx context.Context, models data.Models, emit func(row ...any) error) error {
+		return models.DevilFruits.Stream(ctx, search, fruitType, filters, func(df *data.DevilFruit) error {
+			return emit(df.ID, df.Name, df.Description, df.Type, df.Character_id, df.CurrentOwner, df.PreviousOwners, df.Episode)
+		})
+	}
+}
+
+func prepareCrewExport(app *application, qs url.Values, v *validator.Validator) exportFunc {
+	search := app.readString(qs, "search", "")
+	totalBounty := app.readBounty(qs, "total_bounty", data.Berries(0), v)
+	shipName := app.readString(qs, "ship_name", "")
+	filters := app.readExportSort(qs, v, "id", "name", "total_bounty", "-id", "-name", "-total_bounty")
+
+	return func(ctx context.Context, models data.Models, emit func(row ...any) error) error {
+		return models.Crews.Stream(ctx, search, shipName, totalBounty, filters, func(c *data.Crew) error {
+			return emit(c.ID, c.Name, c.Description, c.ShipName, c.CaptainID, c.CaptainName, c.TotalBounty, c.MemberCount)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// getExport fetches an export and returns its body and HTTP trailers.
+func getExport(t *testing.T, ts *testServer, path string) (int, []byte, http.Header) {
+	t.Helper()
+
+	res, err := ts.Client().Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, body, res.Trailer
+}
+
+func TestExportCharacters(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	createTestCharacter(t, ts, "Monkey D. Luffy", 19, "3B berries")
+	createTestCharacter(t, ts, "Roronoa Zoro", 21, "1111000000 berries")
+	createTestCharacter(t, ts, "Usopp", 19, "500M berries")
+
+	status, body, trailer := getExport(t, ts, "/v1/export/characters?sort=-bounty&berries=raw")
+	equal(t, status, http.StatusOK)
+
+	lines := bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"))
+	equal(t, len(lines), 4)
+
+	var first map[string]any
+	err := json.Unmarshal(lines[0], &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, first["name"], any("Monkey D. Luffy"))
+	equal(t, first["bounty"], any(3e9))
+
+	var manifest struct {
+		Manifest exportManifest `json:"manifest"`
+	}
+	err = json.Unmarshal(lines[3], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(body[:len(body)-len(lines[3])-1])
+	equal(t, manifest.Manifest.Rows, 3)
+	equal(t, manifest.Manifest.SHA256, hex.EncodeToString(sum[:]))
+	equal(t, trailer.Get("Export-Rows"), "3")
+	equal(t, trailer.Get("Export-SHA256"), manifest.Manifest.SHA256)
+
+	status, body, trailer = getExport(t, ts, "/v1/export/characters?format=csv&bounty=1B+berries&sort=name")
+	equal(t, status, http.StatusOK)
+
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.Comment = '#'
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(records), 3)
+	equal(t, records[0][6], "bounty")
+	equal(t, records[1][1], "Monkey D. Luffy")
+	equal(t, records[2][6], "1.1B berries")
+
+	// The manifest is a comment on the last line, covering everything
+	// before it.
+	csvLines := bytes.SplitAfter(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"))
+	last := csvLines[len(csvLines)-1]
+
+	err = json.Unmarshal(bytes.TrimPrefix(last, []byte("# ")), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum = sha256.Sum256(body[:len(body)-len(last)-1])
+	equal(t, manifest.Manifest.Format, "csv")
+	equal(t, manifest.Manifest.Rows, 2)
+	equal(t, manifest.Manifest.SHA256, hex.EncodeToString(sum[:]))
+	equal(t, trailer.Get("Export-Rows"), "2")
+	equal(t, trailer.Get("Export-SHA256"), manifest.Manifest.SHA256)
+}
+
+func TestExportRejectsBadRequests(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"unknown resource", "/v1/export/ships", http.StatusNotFound},
+		{"invalid format", "/v1/export/crews?format=xml", http.StatusUnprocessableEntity},
+		{"invalid berries", "/v1/export/crews?berries=rounded", http.StatusUnprocessableEntity},
+		{"invalid sort", "/v1/export/devilfruits?sort=-type", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, _ := getExport(t, ts, tt.path)
+			equal(t, status, tt.wantStatus)
+		})
+	}
+}
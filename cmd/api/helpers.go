@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,14 +22,11 @@ import (
 type envelope map[string]any
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	js, err := json.MarshalIndent(data, "", "\t") //change to regular marshal in production as adding indents has an impact on performance
+	js, err := marshalEnvelope(data)
 	if err != nil {
 		return err
 	}
 
-	// Append a newline to make it easier to view in terminal
-	js = append(js, '\n')
-
 	for key, values := range headers {
 		for _, value := range values {
 			w.Header().Add(key, value)
@@ -41,51 +40,123 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
-func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
-	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
-
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields() //prevent mfs from adding non existent parameters in their requests
-	err := decoder.Decode(dst)
+// writeConditionalJSON writes a 200 response for a GET, validated by a
+// strong ETag hashed from the body and, unless lastModified is zero, a
+// Last-Modified header. When the request's If-None-Match or If-Modified-Since
+// shows the client already holds this representation, a bodyless 304 is sent
+// instead.
+func (app *application) writeConditionalJSON(w http.ResponseWriter, r *http.Request, data envelope, lastModified time.Time) error {
+	js, err := marshalEnvelope(data)
 	if err != nil {
+		return err
+	}
 
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
-		var maxBytesError *http.MaxBytesError
+	etag := entityTag(js)
 
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
 
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+	return nil
+}
 
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+// notModified evaluates the request's cache validators. If-None-Match takes
+// precedence, and If-Modified-Since is only consulted without it (RFC 9110
+// section 13.2.2). Entity tags are compared weakly, as GET allows.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
 			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+		}
+		return false
+	}
 
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates have whole-second precision.
+		return !lastModified.Truncate(time.Second).After(since)
+	}
 
-		// A json.InvalidUnmarshalError error will be returned if we pass something
-		// that is not a non-nil pointer as the target destination to Decode(). In this case we panic
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
+	return false
+}
+
+// ifMatch reports whether the request's If-Match precondition, if it has one,
+// holds for a record at the given version whose show response would be data.
+// Each listed tag may be the record's version, quoted or not, or the ETag
+// from a GET. Weak tags never match, as If-Match requires strong comparison.
+func ifMatch(r *http.Request, version int32, data envelope) (bool, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true, nil
+	}
+
+	js, err := marshalEnvelope(data)
+	if err != nil {
+		return false, err
+	}
+	etag := entityTag(js)
 
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
 
-		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
-		default:
-			return err
+		switch {
+		case candidate == "*" || candidate == etag:
+			return true, nil
+		case strings.HasPrefix(candidate, "W/"):
+			continue
+		}
+
+		n, err := strconv.ParseInt(strings.Trim(candidate, `"`), 10, 32)
+		if err == nil && int32(n) == version {
+			return true, nil
 		}
 	}
 
+	return false, nil
+}
+
+// entityTag returns the strong ETag for a response body.
+func entityTag(js []byte) string {
+	sum := sha256.Sum256(js)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func marshalEnvelope(data envelope) ([]byte, error) {
+	js, err := json.MarshalIndent(data, "", "\t") //change to regular marshal in production as adding indents has an impact on performance
+	if err != nil {
+		return nil, err
+	}
+
+	// Append a newline to make it easier to view in terminal
+	return append(js, '\n'), nil
+}
+
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields() //prevent mfs from adding non existent parameters in their requests
+	err := decoder.Decode(dst)
+	if err != nil {
+		return jsonDecodeError(err)
+	}
+
 	err = decoder.Decode(&struct{}{}) //call decoder again-> decoder is meant to read a stream of json so if more is provided it can keep reading since we only expect one object we can raise an error if more is provided
 	if !errors.Is(err, io.EOF) {
 		return errors.New("body must only contain a single JSON value")
@@ -94,6 +165,46 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+// jsonDecodeError turns the errors returned by json.Decoder into messages that
+// are safe to send back to the client.
+func jsonDecodeError(err error) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+		}
+		return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+
+	// A json.InvalidUnmarshalError error will be returned if we pass something
+	// that is not a non-nil pointer as the target destination to Decode(). In this case we panic
+	case errors.As(err, &invalidUnmarshalError):
+		panic(err)
+
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return fmt.Errorf("body contains unknown key %s", fieldName)
+
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	default:
+		return err
+	}
+}
+
 func parseConfig() (config, error) {
 	var cfg config
 	var err error
@@ -106,8 +217,13 @@ func parseConfig() (config, error) {
 
 	cfg.env = getEnvWithDefault("ENV", "development")
 
+	cfg.storage = getEnvWithDefault("STORAGE", "postgres")
+	if cfg.storage != "postgres" && cfg.storage != "memory" {
+		return cfg, fmt.Errorf("STORAGE must be either postgres or memory")
+	}
+
 	cfg.db.dsn = os.Getenv("DSN")
-	if cfg.db.dsn == "" {
+	if cfg.db.dsn == "" && cfg.storage == "postgres" {
 		return cfg, fmt.Errorf("DSN environment variable is required")
 	}
 
@@ -129,6 +245,72 @@ func parseConfig() (config, error) {
 		return cfg, err
 	}
 
+	dbReadTimeoutStr := getEnvWithDefault("DB_READ_TIMEOUT", "3s")
+	cfg.db.timeouts.Read, err = time.ParseDuration(dbReadTimeoutStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.db.timeouts.Read <= 0 {
+		return cfg, fmt.Errorf("DB_READ_TIMEOUT must be greater than zero")
+	}
+
+	dbListTimeoutStr := getEnvWithDefault("DB_LIST_TIMEOUT", "4s")
+	cfg.db.timeouts.List, err = time.ParseDuration(dbListTimeoutStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.db.timeouts.List <= 0 {
+		return cfg, fmt.Errorf("DB_LIST_TIMEOUT must be greater than zero")
+	}
+
+	dbWriteTimeoutStr := getEnvWithDefault("DB_WRITE_TIMEOUT", "4s")
+	cfg.db.timeouts.Write, err = time.ParseDuration(dbWriteTimeoutStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.db.timeouts.Write <= 0 {
+		return cfg, fmt.Errorf("DB_WRITE_TIMEOUT must be greater than zero")
+	}
+
+	migrateOnStartStr := getEnvWithDefault("MIGRATE_ON_START", "false")
+	cfg.db.migrateOnStart, err = strconv.ParseBool(migrateOnStartStr)
+	if err != nil {
+		return cfg, err
+	}
+
+	importMaxBytesStr := getEnvWithDefault("IMPORT_MAX_BYTES", "104857600")
+	cfg.imports.maxBytes, err = strconv.ParseInt(importMaxBytesStr, 10, 64)
+	if err != nil {
+		return cfg, err
+	}
+
+	importTimeoutStr := getEnvWithDefault("IMPORT_TIMEOUT", "10m")
+	cfg.imports.timeout, err = time.ParseDuration(importTimeoutStr)
+	if err != nil {
+		return cfg, err
+	}
+
+	exportTimeoutStr := getEnvWithDefault("EXPORT_TIMEOUT", "10m")
+	cfg.exports.timeout, err = time.ParseDuration(exportTimeoutStr)
+	if err != nil {
+		return cfg, err
+	}
+
+	trashRetentionStr := getEnvWithDefault("TRASH_RETENTION", "720h")
+	cfg.trash.retention, err = time.ParseDuration(trashRetentionStr)
+	if err != nil {
+		return cfg, err
+	}
+
+	trashPurgeIntervalStr := getEnvWithDefault("TRASH_PURGE_INTERVAL", "1h")
+	cfg.trash.purgeInterval, err = time.ParseDuration(trashPurgeIntervalStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.trash.purgeInterval <= 0 {
+		return cfg, fmt.Errorf("TRASH_PURGE_INTERVAL must be greater than zero")
+	}
+
 	limiterRPSStr := getEnvWithDefault("LIMITER_RPS", "2")
 	cfg.limiter.rps, err = strconv.ParseFloat(limiterRPSStr, 64)
 	if err != nil {
@@ -141,12 +323,65 @@ func parseConfig() (config, error) {
 		return cfg, err
 	}
 
+	usageFlushIntervalStr := getEnvWithDefault("USAGE_FLUSH_INTERVAL", "10s")
+	cfg.usage.flushInterval, err = time.ParseDuration(usageFlushIntervalStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.usage.flushInterval <= 0 {
+		return cfg, fmt.Errorf("USAGE_FLUSH_INTERVAL must be greater than zero")
+	}
+
 	limiterEnabledStr := getEnvWithDefault("LIMITER_ENABLED", "true")
 	cfg.limiter.enabled, err = strconv.ParseBool(limiterEnabledStr)
 	if err != nil {
 		return cfg, err
 	}
 
+	cfg.limiter.backend = getEnvWithDefault("LIMITER_BACKEND", "memory")
+	if cfg.limiter.backend != "memory" && cfg.limiter.backend != "postgres" {
+		return cfg, fmt.Errorf("LIMITER_BACKEND must be either memory or postgres")
+	}
+	if cfg.limiter.backend == "postgres" && cfg.storage != "postgres" {
+		return cfg, fmt.Errorf("LIMITER_BACKEND=postgres needs STORAGE=postgres")
+	}
+
+	webhookTimeoutStr := getEnvWithDefault("WEBHOOK_TIMEOUT", "10s")
+	cfg.webhooks.timeout, err = time.ParseDuration(webhookTimeoutStr)
+	if err != nil {
+		return cfg, err
+	}
+
+	webhookPollIntervalStr := getEnvWithDefault("WEBHOOK_POLL_INTERVAL", "5s")
+	cfg.webhooks.pollInterval, err = time.ParseDuration(webhookPollIntervalStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.webhooks.pollInterval <= 0 {
+		return cfg, fmt.Errorf("WEBHOOK_POLL_INTERVAL must be greater than zero")
+	}
+
+	webhookRetryBaseStr := getEnvWithDefault("WEBHOOK_RETRY_BASE", "30s")
+	cfg.webhooks.retryBase, err = time.ParseDuration(webhookRetryBaseStr)
+	if err != nil {
+		return cfg, err
+	}
+
+	webhookMaxAttemptsStr := getEnvWithDefault("WEBHOOK_MAX_ATTEMPTS", "8")
+	cfg.webhooks.maxAttempts, err = strconv.Atoi(webhookMaxAttemptsStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.webhooks.maxAttempts < 1 {
+		return cfg, fmt.Errorf("WEBHOOK_MAX_ATTEMPTS must be at least 1")
+	}
+
+	webhookAllowPrivateStr := getEnvWithDefault("WEBHOOK_ALLOW_PRIVATE", "false")
+	cfg.webhooks.allowPrivate, err = strconv.ParseBool(webhookAllowPrivateStr)
+	if err != nil {
+		return cfg, err
+	}
+
 	authRequired := os.Getenv("REQUIRE_AUTH")
 	if authRequired == "" {
 		cfg.auth.required = true // default to requiring auth
@@ -154,6 +389,51 @@ func parseConfig() (config, error) {
 		cfg.auth.required = authRequired == "true"
 	}
 
+	rotationGraceStr := getEnvWithDefault("KEY_ROTATION_GRACE", "24h")
+	cfg.auth.rotationGrace, err = time.ParseDuration(rotationGraceStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.auth.rotationGrace < 0 {
+		return cfg, fmt.Errorf("KEY_ROTATION_GRACE must not be negative")
+	}
+
+	signatureSkewStr := getEnvWithDefault("SIGNATURE_MAX_SKEW", "5m")
+	cfg.auth.signatureSkew, err = time.ParseDuration(signatureSkewStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.auth.signatureSkew <= 0 {
+		return cfg, fmt.Errorf("SIGNATURE_MAX_SKEW must be greater than zero")
+	}
+
+	cfg.jwt.jwks = os.Getenv("JWT_JWKS")
+	cfg.jwt.issuer = os.Getenv("JWT_ISSUER")
+	cfg.jwt.audience = os.Getenv("JWT_AUDIENCE")
+	if cfg.jwt.jwks != "" && (cfg.jwt.issuer == "" || cfg.jwt.audience == "") {
+		return cfg, fmt.Errorf("JWT_JWKS needs JWT_ISSUER and JWT_AUDIENCE")
+	}
+
+	cfg.jwt.scopesClaim = getEnvWithDefault("JWT_SCOPES_CLAIM", "scope")
+
+	jwtLeewayStr := getEnvWithDefault("JWT_LEEWAY", "1m")
+	cfg.jwt.leeway, err = time.ParseDuration(jwtLeewayStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.jwt.leeway < 0 {
+		return cfg, fmt.Errorf("JWT_LEEWAY must not be negative")
+	}
+
+	jwtRefreshIntervalStr := getEnvWithDefault("JWT_JWKS_REFRESH_INTERVAL", "5m")
+	cfg.jwt.refreshInterval, err = time.ParseDuration(jwtRefreshIntervalStr)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.jwt.refreshInterval <= 0 {
+		return cfg, fmt.Errorf("JWT_JWKS_REFRESH_INTERVAL must be greater than zero")
+	}
+
 	return cfg, nil
 }
 func getEnvWithDefault(key, defaultValue string) string {
@@ -202,6 +482,40 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool() helper returns a bool value from the query string
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// readTime() helper returns an RFC 3339 time from the query string
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 time, such as 2025-01-01T00:00:00Z")
+		return defaultValue
+	}
+
+	return t
+}
+
 // readBounty() helper returns a Berries value from the query string
 func (app *application) readBounty(qs url.Values, key string, defaultValue data.Berries, v *validator.Validator) data.Berries {
 	s := qs.Get(key)
@@ -234,3 +548,13 @@ func (app *application) readCharacterIDParam(r *http.Request) (int64, error) {
 	}
 	return id, nil
 }
+
+// readRevisionParam reads a revision number from the named URL parameter.
+func (app *application) readRevisionParam(r *http.Request, name string) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	revision, err := strconv.ParseInt(params.ByName(name), 10, 32)
+	if err != nil || revision < 1 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+	return int32(revision), nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxImportLine caps a single NDJSON line, mirroring the 1MB readJSON
+	// limit for one record.
+	maxImportLine = 1_048_576
+
+	// maxImportErrors caps how many row errors are echoed back, so a file
+	// that is wrong on every line doesn't produce an even larger response.
+	maxImportErrors = 1000
+)
+
+// errImportRolledBack is returned from an atomic import's transaction to
+// roll it back once any row has failed.
+var errImportRolledBack = errors.New("import rolled back")
+
+// rowError is a problem with a single row. It is reported back to the client
+// alongside the row's line number rather than failing the whole request.
+type rowError struct {
+	message any
+}
+
+func (e rowError) Error() string {
+	return fmt.Sprint(e.message)
+}
+
+// preparedRow is a row that has been read and validated, waiting to be
+// written.
+type preparedRow struct {
+	line  int
+	write importWriter
+}
+
+// importWriter stores one prepared row and reports whether it was created
+// (true) or updated an existing record (false).
+type importWriter func(ctx context.Context, models data.Models, upsert bool) (bool, error)
+
+// csvKind tells csvRowToJSON how to turn a CSV cell into a JSON value.
+type csvKind int
+
+const (
+	csvString csvKind = iota
+	csvInteger
+	csvList // semicolon-separated
+)
+
+type importer struct {
+	columns map[string]csvKind
+	prepare func(row []byte) (importWriter, error)
+}
+
+var importers = map[string]importer{
+	"characters": {
+		columns: map[string]csvKind{
+			"name":        csvString,
+			"age":         csvInteger,
+			"description": csvString,
+			"origin":      csvString,
+			"bounty":      csvString,
+			"race":        csvString,
+			"episode":     csvInteger,
+		},
+		prepare: prepareCharacterRow,
+	},
+	"devilfruits": {
+		columns: map[string]csvKind{
+			"name":            csvString,
+			"description":     csvString,
+			"type":            csvString,
+			"character_id":    csvInteger,
+			"previous_owners": csvList,
+			"episode":         csvInteger,
+		},
+		prepare: prepareDevilFruitRow,
+	},
+	"crews": {
+		columns: map[string]csvKind{
+			"name":        csvString,
+			"description": csvString,
+			"ship_name":   csvString,
+			"captain_id":  csvInteger,
+		},
+		prepare: prepareCrewRow,
+	},
+}
+
+type importRowError struct {
+	Line  int `json:"line"`
+	Error any `json:"error"`
+}
+
+type importReport struct {
+	Resource        string           `json:"resource"`
+	Mode            string           `json:"mode"`
+	Atomic          bool             `json:"atomic"`
+	Committed       bool             `json:"committed"`
+	Rows            int              `json:"rows"`
+	Created         int              `json:"created"`
+	Updated         int              `json:"updated"`
+	Failed          int              `json:"failed"`
+	Errors          []importRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated,omitempty"`
+}
+
+func (report *importReport) fail(line int, message any) {
+	report.Failed++
+
+	if len(report.Errors) == maxImportErrors {
+		report.ErrorsTruncated = true
+		return
+	}
+	report.Errors = append(report.Errors, importRowError{Line: line, Error: message})
+}
+
+func (app *application) importHandler(w http.ResponseWriter, r *http.Request) {
+	resource := httprouter.ParamsFromContext(r.Context()).ByName("resource")
+
+	imp, ok := importers[resource]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	mode := app.readString(qs, "mode", "insert")
+	atomic := app.readBool(qs, "atomic", false, v)
+
+	v.Check(validator.PermittedValue(mode, "insert", "upsert"), "mode", "must be insert or upsert")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	// Imports are expected to take longer than the server-wide timeouts
+	// allow, so they get their own deadline and body size limit.
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(app.config.imports.timeout)
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+
+	body := http.MaxBytesReader(w, r.Body, app.config.imports.maxBytes)
+
+	var rows rowReader
+	var err error
+
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl":
+		rows = newNDJSONReader(body)
+	case "text/csv":
+		rows, err = newCSVReader(body, imp.columns)
+		if err != nil {
+			app.importReadErrorResponse(w, r, err)
+			return
+		}
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "application/x-ndjson", "text/csv")
+		return
+	}
+
+	report := &importReport{
+		Resource: resource,
+		Mode:     mode,
+		Atomic:   atomic,
+		Errors:   []importRowError{},
+	}
+
+	// save writes one prepared row and counts it in the report.
+	save := func(models data.Models, line int, write importWriter) error {
+		created, err := write(r.Context(), models, mode == "upsert")
+		var rowErr rowError
+		if errors.As(err, &rowErr) {
+			report.fail(line, rowErr.message)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+
+		return nil
+	}
+
+	// An atomic import reads and validates the whole body before it opens
+	// its transaction, so a slow client can't keep the transaction open.
+	// The prepared rows are bounded by the body size limit.
+	var prepared []preparedRow
+
+	for {
+		line, row, err := rows.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var rowErr rowError
+		if errors.As(err, &rowErr) {
+			report.Rows++
+			report.fail(line, rowErr.message)
+			continue
+		}
+		if err != nil {
+			app.importReadErrorResponse(w, r, err)
+			return
+		}
+
+		report.Rows++
+
+		write, err := imp.prepare(row)
+		if errors.As(err, &rowErr) {
+			report.fail(line, rowErr.message)
+			continue
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if atomic {
+			prepared = append(prepared, preparedRow{line: line, write: write})
+			continue
+		}
+
+		err = save(app.models, line, write)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if atomic {
+		err = errImportRolledBack
+
+		// Nothing is written when any row failed validation. Otherwise the
+		// writes stop at the first row the database rejects.
+		if report.Failed == 0 {
+			err = app.models.Transaction(r.Context(), func(models data.Models) error {
+				for _, row := range prepared {
+					err := save(models, row.line, row.write)
+					if err != nil {
+						return err
+					}
+
+					if report.Failed > 0 {
+						return errImportRolledBack
+					}
+				}
+
+				return nil
+			})
+		}
+	}
+
+	switch {
+	case errors.Is(err, errImportRolledBack):
+		err = app.writeJSON(w, http.StatusUnprocessableEntity, envelope{"import": report}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	report.Committed = true
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importReadErrorResponse reports errors that stop an import part way
+// through. Problems reading the body are the client's fault; anything else
+// is treated as a server error.
+func (app *application) importReadErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesError *http.MaxBytesError
+	var parseError *csv.ParseError
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+	case errors.Is(err, bufio.ErrTooLong):
+		app.badRequestResponse(w, r, fmt.Errorf("lines must not be longer than %d bytes", maxImportLine))
+	case errors.As(err, &parseError), errors.Is(err, errInvalidCSVHeader):
+		app.badRequestResponse(w, r, err)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rowReader yields import rows one at a time as JSON objects, along with
+// the line they started on. It returns io.EOF once the body is exhausted and
+// a rowError for rows that can't be read but don't stop the import.
+type rowReader interface {
+	next() (line int, row []byte, err error)
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONReader(body io.Reader) *ndjsonReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (nr *ndjsonReader) next() (int, []byte, error) {
+	for nr.scanner.Scan() {
+		nr.line++
+
+		row := bytes.TrimSpace(nr.scanner.Bytes())
+		if len(row) == 0 {
+			continue
+		}
+
+		return nr.line, row, nil
+	}
+
+	if err := nr.scanner.Err(); err != nil {
+		return nr.line + 1, nil, err
+	}
+
+	return nr.line, nil, io.EOF
+}
+
+var errInvalidCSVHeader = errors.New("invalid CSV header")
+
+type csvReader struct {
+	reader  *csv.Reader
+	header  []string
+	columns map[string]csvKind
+}
+
+// newCSVReader reads the header row, which must name the columns using the
+// same keys as the JSON API.
+func newCSVReader(body io.Reader, columns map[string]csvKind) (*csvReader, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: body must not be empty", errInvalidCSVHeader)
+		}
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%w: unknown column %q", errInvalidCSVHeader, column)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("%w: duplicate column %q", errInvalidCSVHeader, column)
+		}
+		seen[column] = true
+		header[i] = column
+	}
+
+	return &csvReader{reader: reader, header: header, columns: columns}, nil
+}
+
+func (cr *csvReader) next() (int, []byte, error) {
+	record, err := cr.reader.Read()
+	if err != nil {
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) && errors.Is(err, csv.ErrFieldCount) {
+			return parseError.StartLine, nil, rowError{fmt.Sprintf("expected %d fields, got %d", len(cr.header), len(record))}
+		}
+		return 0, nil, err
+	}
+
+	line, _ := cr.reader.FieldPos(0)
+
+	row, err := csvRowToJSON(cr.header, cr.columns, record)
+	return line, row, err
+}
+
+// csvRowToJSON converts a CSV record into the JSON object the matching API
+// endpoint would accept, so rows from both formats go through the same
+// decoding and validation. Empty cells are left out.
+func csvRowToJSON(header []string, columns map[string]csvKind, record []string) ([]byte, error) {
+	object := make(map[string]any, len(record))
+
+	for i, value := range record {
+		if value == "" {
+			continue
+		}
+
+		column := header[i]
+
+		switch columns[column] {
+		case csvInteger:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, rowError{map[string]string{column: "must be an integer value"}}
+			}
+			object[column] = n
+		case csvList:
+			items := strings.Split(value, ";")
+			for i := range items {
+				items[i] = strings.TrimSpace(items[i])
+			}
+			object[column] = items
+		default:
+			object[column] = value
+		}
+	}
+
+	return json.Marshal(object)
+}
+
+// decodeRow decodes a single import row with the same strictness as readJSON.
+func decodeRow(row []byte, dst any) error {
+	decoder := json.NewDecoder(bytes.NewReader(row))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dst)
+	if err != nil {
+		return rowError{strings.Replace(jsonDecodeError(err).Error(), "body", "row", 1)}
+	}
+
+	if decoder.More() {
+		return rowError{"row must only contain a single JSON value"}
+	}
+
+	return nil
+}
+
+func prepareCharacterRow(row []byte) (importWriter, error) {
+	var input struct {
+		Name        string        `json:"name"`
+		Age         int           `json:"age"`
+		Description string        `json:"description"`
+		Origin      string        `json:"origin"`
+		Bounty      *data.Berries `json:"bounty,omitempty"`
+		Race        string        `json:"race"`
+		Episode     int           `json:"episode"`
+	}
+
+	err := decodeRow(row, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	character := &data.Character{
+		Name:        input.Name,
+		Age:         input.Age,
+		Description: input.Description,
+		Origin:      input.Origin,
+		Bounty:      input.Bounty,
+		Race:        strings.ToLower(input.Race),
+		Episode:     input.Episode,
+	}
+
+	v := validator.New()
+
+	if data.ValidateCharacter(v, character); !v.Valid() {
+		return nil, rowError{v.Errors}
+	}
+
+	return func(ctx context.Context, models data.Models, upsert bool) (bool, error) {
+		if upsert {
+			existing, err := models.Characters.GetByName(ctx, character.Name)
+			switch {
+			case err == nil:
+				character.ID = existing.ID
+				character.Version = existing.Version
+				return false, writeRowError(models.Characters.Update(ctx, character), "character")
+			case !errors.Is(err, data.ErrRecordNotFound):
+				return false, err
+			}
+		}
+
+		err := writeRowError(models.Characters.Insert(ctx, character), "character")
+		return err == nil, err
+	}, nil
+}
+
+func prepareDevilFruitRow(row []byte) (importWriter, error) {
+	var input struct {
+		Name           string   `json:"name"`
+		Description    string   `json:"description"`
+		Type           string   `json:"type"`
+		Character_id   *int64   `json:"character_id"`
+		PreviousOwners []string `json:"previous_owners"`
+		Episode        int      `json:"episode"`
+	}
+
+	err := decodeRow(row, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	devilFruit := &data.DevilFruit{
+		Name:           input.Name,
+		Description:    input.Description,
+		Type:           strings.ToLower(input.Type),
+		PreviousOwners: input.PreviousOwners,
+		Episode:        input.Episode,
+	}
+
+	v := validator.New()
+
+	if data.ValidateDevilFruit(v, devilFruit); !v.Valid() {
+		return nil, rowError{v.Errors}
+	}
+
+	return func(ctx context.Context, models data.Models, upsert bool) (bool, error) {
+		if input.Character_id != nil {
+			character, err := models.Characters.Get(ctx, *input.Character_id)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					return false, rowError{"character_id does not exist"}
+				default:
+					return false, err
+				}
+			}
+
+			devilFruit.Character_id = sql.NullInt64{Int64: character.ID, Valid: true}
+			devilFruit.CurrentOwner = sql.NullString{String: character.Name, Valid: true}
+		}
+
+		if upsert {
+			existing, err := models.DevilFruits.GetByName(ctx, devilFruit.Name)
+			switch {
+			case err == nil:
+				devilFruit.ID = existing.ID
+				devilFruit.Version = existing.Version
+				return false, writeRowError(models.DevilFruits.Update(ctx, devilFruit), "devil fruit")
+			case !errors.Is(err, data.ErrRecordNotFound):
+				return false, err
+			}
+		}
+
+		err := writeRowError(models.DevilFruits.Insert(ctx, devilFruit), "devil fruit")
+		return err == nil, err
+	}, nil
+}
+
+func prepareCrewRow(row []byte) (importWriter, error) {
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		ShipName    string `json:"ship_name"`
+		CaptainID   int64  `json:"captain_id"`
+	}
+
+	err := decodeRow(row, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	crew := &data.Crew{
+		Name:        input.Name,
+		Description: input.Description,
+		ShipName:    input.ShipName,
+		CaptainID:   input.CaptainID,
+	}
+
+	v := validator.New()
+
+	if data.ValidateCrew(v, crew); !v.Valid() {
+		return nil, rowError{v.Errors}
+	}
+
+	// A crew takes more than one write, so each row gets a transaction of
+	// its own; a row that fails part way leaves nothing behind, even when
+	// the import as a whole isn't atomic.
+	return func(ctx context.Context, models data.Models, upsert bool) (created bool, err error) {
+		err = models.Transaction(ctx, func(models data.Models) error {
+			captain, err := models.Characters.Get(ctx, crew.CaptainID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					return rowError{"captain_id does not exist"}
+				default:
+					return err
+				}
+			}
+
+			if upsert {
+				existing, err := models.Crews.GetByName(ctx, crew.Name)
+				switch {
+				case err == nil:
+					existing.Description = crew.Description
+					existing.ShipName = crew.ShipName
+
+					if existing.CaptainID != captain.ID {
+						err = swapCaptain(ctx, models, existing, captain)
+						if err != nil {
+							return err
+						}
+					}
+
+					return writeRowError(models.Crews.Update(ctx, existing), "crew")
+				case !errors.Is(err, data.ErrRecordNotFound):
+					return err
+				}
+			}
+
+			// As in createCrewHandler, the crew starts out empty and the
+			// captain's bounty is added along with their membership.
+			crew.CaptainName = captain.Name
+
+			err = writeRowError(models.Crews.Insert(ctx, crew), "crew")
+			if err != nil {
+				return err
+			}
+
+			err = models.Crews.AddMember(ctx, crew.ID, crew.CaptainID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrAlreadyMember):
+					return rowError{fmt.Sprintf("character %v is already a member of this crew", captain.Name)}
+				case errors.Is(err, data.ErrRecordNotFound):
+					return rowError{"captain_id does not exist"}
+				default:
+					return err
+				}
+			}
+
+			created = true
+			return nil
+		})
+
+		return created, err
+	}, nil
+}
+
+// writeRowError turns the errors a row can fail to be written with into
+// rowErrors, worded as the handlers word them; kind names the resource.
+// Anything else, including nil, is returned as it is.
+func writeRowError(err error, kind string) error {
+	switch {
+	case errors.Is(err, data.ErrDuplicateName):
+		return rowError{map[string]string{"name": fmt.Sprintf("a %s with this name already exists", kind)}}
+	case errors.Is(err, data.ErrEditConflict):
+		return rowError{"unable to update the record due to an edit conflict, please try again"}
+	default:
+		return err
+	}
+}
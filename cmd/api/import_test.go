@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+)
+
+// postImport sends a raw import body and decodes the report from the response.
+func postImport(t *testing.T, ts *testServer, path, contentType, body string) (int, map[string]any) {
+	t.Helper()
+
+	res, err := ts.Client().Post(ts.URL+path, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var response map[string]any
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, _ := response["import"].(map[string]any)
+	return res.StatusCode, report
+}
+
+func TestImportCharacters(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ndjson := `{"name": "Monkey D. Luffy", "age": 19, "description": "Captain of the Straw Hats", "origin": "East Blue", "bounty": "3B berries", "race": "Human", "episode": 1}
+
+{"name": "Roronoa Zoro", "age": -1, "description": "Swordsman of the Straw Hats", "origin": "East Blue", "race": "human", "episode": 2}
+{"name": "Nami", "age": 20, "description": "Navigator of the Straw Hats", "origin": "East Blue", "race": "human", "episode": 1, "pet": "none"}
+`
+
+	status, report := postImport(t, ts, "/v1/import/characters", "application/x-ndjson", ndjson)
+	equal(t, status, http.StatusOK)
+	equal(t, report["rows"], any(3.0))
+	equal(t, report["created"], any(1.0))
+	equal(t, report["failed"], any(2.0))
+
+	errs := report["errors"].([]any)
+	equal(t, len(errs), 2)
+	equal(t, errs[0].(map[string]any)["line"], any(3.0))
+	equal(t, errs[1].(map[string]any)["line"], any(4.0))
+	equal(t, errs[1].(map[string]any)["error"], any(`row contains unknown key "pet"`))
+
+	csv := "name,age,description,origin,bounty,race,episode\n" +
+		"Monkey D. Luffy,19,Captain of the Straw Hats,East Blue,3B berries,human,1\n" +
+		"Nami,20,Navigator of the Straw Hats,East Blue,366M berries,human,1\n"
+
+	status, report = postImport(t, ts, "/v1/import/characters", "text/csv", csv)
+	equal(t, status, http.StatusOK)
+	equal(t, report["failed"], any(1.0))
+	equal(t, report["created"], any(1.0))
+
+	status, report = postImport(t, ts, "/v1/import/characters?mode=upsert", "text/csv", csv)
+	equal(t, status, http.StatusOK)
+	equal(t, report["failed"], any(0.0))
+	equal(t, report["updated"], any(2.0))
+
+	status, response := ts.do(t, http.MethodGet, "/v1/characters?search=luffy", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, response["characters"].([]any)[0].(map[string]any)["description"], any("Captain of the Straw Hats"))
+}
+
+func TestImportAtomic(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csv := "name,age,description,origin,race,episode\n" +
+		"Usopp,19,Sniper of the Straw Hats,East Blue,human,9\n" +
+		"Sanji,not-a-number,Cook of the Straw Hats,North Blue,human,20\n" +
+		"Chopper,17,Doctor of the Straw Hats,Drum Island,reindeer\n"
+
+	status, report := postImport(t, ts, "/v1/import/characters?atomic=true", "text/csv", csv)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, report["committed"], any(false))
+	equal(t, report["failed"], any(2.0))
+
+	errs := report["errors"].([]any)
+	equal(t, errs[0].(map[string]any)["line"], any(3.0))
+	equal(t, errs[1].(map[string]any)["line"], any(4.0))
+
+	status, response := ts.do(t, http.MethodGet, "/v1/characters", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["characters"].([]any)), 0)
+
+	// Rows that pass validation but are rejected when written roll back
+	// the rows written before them.
+	createTestCharacter(t, ts, "Sanji", 21, "1.032B berries")
+
+	csv = "name,age,description,origin,race,episode\n" +
+		"Usopp,19,Sniper of the Straw Hats,East Blue,human,9\n" +
+		"Sanji,21,Cook of the Straw Hats,North Blue,human,20\n"
+
+	status, report = postImport(t, ts, "/v1/import/characters?atomic=true", "text/csv", csv)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, report["committed"], any(false))
+	equal(t, report["failed"], any(1.0))
+
+	status, response = ts.do(t, http.MethodGet, "/v1/characters", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["characters"].([]any)), 1)
+}
+
+func TestImportCrews(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	luffy := createTestCharacter(t, ts, "Monkey D. Luffy", 19, "3B berries")
+	zoro := createTestCharacter(t, ts, "Roronoa Zoro", 21, "1.1B berries")
+
+	csv := "name,description,ship_name,captain_id\n" +
+		fmt.Sprintf("Straw Hat Pirates,A crew from East Blue,Thousand Sunny,%d\n", luffy) +
+		"Buggy Pirates,A crew from the Grand Line,Big Top,999\n"
+
+	status, report := postImport(t, ts, "/v1/import/crews", "text/csv", csv)
+	equal(t, status, http.StatusOK)
+	equal(t, report["created"], any(1.0))
+	equal(t, report["failed"], any(1.0))
+
+	// A row that fails leaves nothing behind.
+	status, response := ts.do(t, http.MethodGet, "/v1/crews", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["crews"].([]any)), 1)
+
+	crew := response["crews"].([]any)[0].(map[string]any)
+	equal(t, crew["total_bounty"], any("3B berries"))
+
+	csv = "name,description,ship_name,captain_id\n" +
+		fmt.Sprintf("Straw Hat Pirates,A crew from East Blue,Thousand Sunny,%d\n", zoro)
+
+	status, report = postImport(t, ts, "/v1/import/crews?mode=upsert", "text/csv", csv)
+	equal(t, status, http.StatusOK)
+	equal(t, report["updated"], any(1.0))
+}
+
+func TestWriteRowError(t *testing.T) {
+	var rowErr rowError
+
+	err := writeRowError(data.ErrEditConflict, "character")
+	if !errors.As(err, &rowErr) {
+		t.Fatalf("got %v for an edit conflict; want a rowError", err)
+	}
+
+	err = writeRowError(fmt.Errorf("updating: %w", data.ErrDuplicateName), "devil fruit")
+	if !errors.As(err, &rowErr) {
+		t.Fatalf("got %v for a duplicate name; want a rowError", err)
+	}
+	equal(t, rowErr.message.(map[string]string)["name"], "a devil fruit with this name already exists")
+
+	err = writeRowError(sql.ErrConnDone, "crew")
+	if !errors.Is(err, sql.ErrConnDone) || errors.As(err, &rowErr) {
+		t.Fatalf("got %v for a database error; want it returned as it is", err)
+	}
+
+	equal(t, writeRowError(nil, "crew"), nil)
+}
+
+func TestImportRejectsBadRequests(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"unknown resource", "/v1/import/ships", "text/csv", "name\n", http.StatusNotFound},
+		{"unsupported media type", "/v1/import/characters", "application/json", "{}", http.StatusUnsupportedMediaType},
+		{"invalid mode", "/v1/import/characters?mode=replace", "text/csv", "name\n", http.StatusUnprocessableEntity},
+		{"unknown column", "/v1/import/characters", "text/csv", "name,ship\n", http.StatusBadRequest},
+		{"body too large", "/v1/import/characters", "application/x-ndjson", strings.Repeat("\n", 2_000_000), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ts.Client().Post(ts.URL+tt.path, tt.contentType, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			equal(t, res.StatusCode, tt.wantStatus)
+		})
+	}
+}
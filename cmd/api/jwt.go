@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/jwt"
+)
+
+// jwksTimeout bounds loading JWT_JWKS when it's a URL.
+const jwksTimeout = 10 * time.Second
+
+// loadJWTKeys loads the key set named by JWT_JWKS and starts accepting JWTs
+// signed with it. With JWT_JWKS unset, only API keys are accepted.
+func (app *application) loadJWTKeys() error {
+	if app.config.jwt.jwks == "" {
+		return nil
+	}
+
+	keys, err := app.fetchJWTKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	app.jwt = jwt.NewVerifier(app.config.jwt.issuer, app.config.jwt.audience, app.config.jwt.leeway, keys)
+
+	app.logger.Info("accepting JWTs", "issuer", app.config.jwt.issuer, "audience", app.config.jwt.audience, "keys", keys.Len())
+
+	return nil
+}
+
+func (app *application) fetchJWTKeys(ctx context.Context) (*jwt.KeySet, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksTimeout)
+	defer cancel()
+
+	return jwt.LoadKeySet(ctx, &http.Client{Timeout: jwksTimeout}, app.config.jwt.jwks)
+}
+
+// refreshJWTKeys reloads the key set, so keys the issuer adds or retires are
+// picked up without a restart. If it can't be loaded the old keys are kept.
+func (app *application) refreshJWTKeys(ctx context.Context) error {
+	keys, err := app.fetchJWTKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	app.jwt.SetKeys(keys)
+
+	return nil
+}
+
+// jwtPrincipal verifies a JWT and returns who it was issued to. Its scopes
+// are read from the JWT_SCOPES_CLAIM claim, ignoring any the API doesn't
+// know.
+func (app *application) jwtPrincipal(token string) (*principal, error) {
+	claims, err := app.jwt.Verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub claim", jwt.ErrMalformed)
+	}
+
+	var scopes []string
+	for _, scope := range claims.Strings(app.config.jwt.scopesClaim) {
+		if slices.Contains(data.Scopes, scope) && !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return &principal{Subject: claims.Subject, Scopes: scopes}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestJWTKey has app accept JWTs signed with a freshly generated key, and
+// returns a function that issues them.
+func useTestJWTKey(t *testing.T, app *application) func(claims map[string]any) string {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"marines-1","use":"sig","x":%q}]}`, base64.RawURLEncoding.EncodeToString(public))
+
+	app.config.jwt.jwks = filepath.Join(t.TempDir(), "jwks.json")
+	app.config.jwt.issuer = "https://auth.marines.test"
+	app.config.jwt.audience = "poneglyph"
+	app.config.jwt.scopesClaim = "scope"
+	app.config.jwt.leeway = time.Minute
+
+	err = os.WriteFile(app.config.jwt.jwks, []byte(jwks), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.loadJWTKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func(claims map[string]any) string {
+		full := map[string]any{
+			"iss": app.config.jwt.issuer,
+			"aud": app.config.jwt.audience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range claims {
+			full[name] = value
+		}
+
+		header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": "marines-1", "typ": "JWT"})
+		payload, _ := json.Marshal(full)
+
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+		return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, []byte(signed)))
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+
+	issue := useTestJWTKey(t, app)
+
+	insertTestAPIKey(t, app, "marine-hq", "admin")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	character := map[string]any{
+		"name":        "Buggy",
+		"age":         39,
+		"description": "Captain of the Buggy Pirates",
+		"origin":      "Grand Line",
+		"race":        "human",
+		"bounty":      "15M berries",
+		"episode":     4,
+	}
+
+	// Scopes the API doesn't know are ignored.
+	reader := issue(map[string]any{"sub": "news-coo", "scope": "characters:read openid"})
+
+	status, _ := ts.doWithHeaders(t, http.MethodGet, "/v1/characters", nil, bearer(reader))
+	equal(t, status, http.StatusOK)
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, bearer(reader))
+	equal(t, status, http.StatusForbidden)
+	equal(t, response["error"], "your token doesn't have the characters:write scope needed for this request")
+
+	// Scopes can also come as an array.
+	writer := issue(map[string]any{"sub": "bounty-service", "scope": []string{"characters:write"}})
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, bearer(writer))
+	equal(t, status, http.StatusCreated)
+	id := int64(response["character"].(map[string]any)["id"].(float64))
+
+	// The change is attributed to the token's subject.
+	status, response = ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/audit?entity=characters&id=%d", id), nil, bearer("marine-hq"))
+	equal(t, status, http.StatusOK)
+
+	entry := response["audit"].([]any)[0].(map[string]any)
+	equal(t, entry["subject"], "bounty-service")
+	equal(t, entry["api_key_id"], nil)
+
+	// Webhooks and usage belong to API keys.
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/me/usage", nil, bearer(writer))
+	equal(t, status, http.StatusForbidden)
+	equal(t, response["error"], "this endpoint needs an API key rather than a token")
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/webhooks", nil, bearer(issue(map[string]any{"sub": "bounty-service", "scope": "admin"})))
+	equal(t, status, http.StatusForbidden)
+
+	// API keys still work alongside JWTs.
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/me/usage", nil, bearer("marine-hq"))
+	equal(t, status, http.StatusOK)
+}
+
+func TestJWTRejected(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+
+	issue := useTestJWTKey(t, app)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	status, _ := ts.doWithHeaders(t, http.MethodGet, "/v1/trash", nil, map[string]string{"Authorization": "Bearer " + issue(map[string]any{"sub": "bounty-service", "scope": "trash:read"})})
+	equal(t, status, http.StatusOK)
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+	}{
+		{"expired", map[string]any{"sub": "bounty-service", "scope": "trash:read", "exp": time.Now().Add(-time.Hour).Unix()}},
+		{"wrong issuer", map[string]any{"sub": "bounty-service", "scope": "trash:read", "iss": "https://auth.revolutionaries.test"}},
+		{"wrong audience", map[string]any{"sub": "bounty-service", "scope": "trash:read", "aud": "vegapunk"}},
+		{"no subject", map[string]any{"scope": "trash:read"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := ts.doWithHeaders(t, http.MethodGet, "/v1/trash", nil, map[string]string{"Authorization": "Bearer " + issue(tt.claims)})
+			equal(t, status, http.StatusUnauthorized)
+		})
+	}
+
+	// Without JWT_JWKS, JWTs are looked up as API keys and aren't found.
+	token := issue(map[string]any{"sub": "bounty-service", "scope": "trash:read"})
+	app.jwt = nil
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/trash", nil, map[string]string{"Authorization": "Bearer " + token})
+	equal(t, status, http.StatusUnauthorized)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+const (
+	keysRule    = "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━"
+	keysDivider = "────────────────────────────────────────────────────────────────────────────────"
+)
+
+func (app *application) keysCommand(args []string) error {
+	return app.runKeys(os.Stdout, args)
+}
+
+// runKeys carries out a keys subcommand, writing what it did to w.
+func (app *application) runKeys(w io.Writer, args []string) error {
+	usage := "Usage: api keys create|list|show|revoke|rotate [flags]"
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return errors.New("keys expects a subcommand")
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		return app.keysCreate(ctx, w, args[1:])
+	case "list":
+		return app.keysList(ctx, w, args[1:])
+	case "show":
+		return app.keysShow(ctx, w, args[1:])
+	case "revoke":
+		return app.keysRevoke(ctx, w, args[1:])
+	case "rotate":
+		return app.keysRotate(ctx, w, args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return fmt.Errorf("unknown keys subcommand %q", args[0])
+	}
+}
+
+// parseKeyID parses a subcommand that takes one key id, allowing flags on
+// either side of it.
+func parseKeyID(fs *flag.FlagSet, args []string) (int64, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return 0, err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 0, fmt.Errorf("%s expects an api key id", fs.Name())
+	}
+
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid api key id %q", fs.Arg(0))
+	}
+
+	err = fs.Parse(fs.Args()[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 0, fmt.Errorf("%s expects exactly one api key id", fs.Name())
+	}
+
+	return id, nil
+}
+
+// getKey reads an API key, naming it in the error if there's no such key.
+func getKey(ctx context.Context, models data.Models, id int64) (*data.APIKey, error) {
+	apiKey, err := models.APIKeys.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, fmt.Errorf("api key %d not found", id)
+		}
+		return nil, err
+	}
+
+	return apiKey, nil
+}
+
+// keyValidationError reports every problem a validator found, in a stable
+// order.
+func keyValidationError(v *validator.Validator) error {
+	var problems []string
+
+	for field, message := range v.Errors {
+		problems = append(problems, fmt.Sprintf("--%s %s", field, message))
+	}
+	slices.Sort(problems)
+
+	return fmt.Errorf("invalid api key: %s", strings.Join(problems, "; "))
+}
+
+func writeKeysJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(v)
+}
+
+func (app *application) keysCreate(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	name := fs.String("name", "", "API key name/description (required)")
+	scopes := fs.String("scopes", data.ScopeAdmin, "comma-separated scopes")
+	expires := fs.Int("expires", 0, "expiry in days, 0 for no expiry")
+	rps := fs.Float64("rps", 0, "requests per second the key may make, 0 for the server default")
+	burst := fs.Int("burst", 0, "requests the key may make in a burst (needs --rps)")
+	quota := fs.Int64("quota", 0, "requests the key may make each quota period, 0 for no quota")
+	quotaPeriod := fs.String("quota-period", data.QuotaDaily, "quota period: day or month")
+	requireSigning := fs.Bool("require-signing", false, "only accept signed write requests from the key")
+	asJSON := fs.Bool("json", false, "print the key as JSON")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	apiKey := &data.APIKey{
+		Name:           *name,
+		Scopes:         strings.Split(*scopes, ","),
+		IsActive:       true,
+		RequireSigning: *requireSigning,
+	}
+
+	v := validator.New()
+
+	v.Check(*expires >= 0, "expires", "must not be negative")
+	if *expires > 0 {
+		expiresAt := time.Now().AddDate(0, 0, *expires).Truncate(time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if *rps != 0 || *burst != 0 {
+		apiKey.RateLimit = &data.RateLimit{RPS: *rps, Burst: *burst}
+	}
+
+	if *quota != 0 {
+		apiKey.Quota = &data.Quota{Limit: *quota, Period: *quotaPeriod}
+	}
+
+	if data.ValidateAPIKey(v, apiKey); !v.Valid() {
+		return keyValidationError(v)
+	}
+
+	token, err := app.models.APIKeys.Create(ctx, apiKey)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return writeKeysJSON(w, envelope{"api_key": apiKey, "token": token, "signing_secret": apiKey.SigningSecret})
+	}
+
+	printNewKey(w, apiKey, token, "created")
+	return nil
+}
+
+// printNewKey prints a key that has just been made, the one time its token
+// can be shown.
+func printNewKey(w io.Writer, apiKey *data.APIKey, token, verb string) {
+	fmt.Fprintf(w, "✅ API Key %s successfully!\n", verb)
+	fmt.Fprintln(w, keysRule)
+	fmt.Fprintf(w, "ID:      %d\n", apiKey.ID)
+	fmt.Fprintf(w, "Name:    %s\n", apiKey.Name)
+	fmt.Fprintf(w, "Scopes:  %s\n", strings.Join(apiKey.Scopes, ","))
+	fmt.Fprintf(w, "Created: %s\n", apiKey.CreatedAt.Local().Format(time.DateTime))
+	if apiKey.ExpiresAt != nil {
+		fmt.Fprintf(w, "Expires: %s\n", apiKey.ExpiresAt.Local().Format(time.DateTime))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "🔑 API Key (save this securely - it won't be shown again):")
+	fmt.Fprintln(w, token)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "📝 Usage example:")
+	fmt.Fprintf(w, "Authorization: Bearer %s\n", token)
+	fmt.Fprintln(w)
+	if apiKey.RequireSigning {
+		fmt.Fprintln(w, "✍️  Signing secret (this key's write requests must be signed with it):")
+	} else {
+		fmt.Fprintln(w, "✍️  Signing secret (for signing requests, if you choose to):")
+	}
+	fmt.Fprintln(w, apiKey.SigningSecret)
+	fmt.Fprintln(w, keysRule)
+}
+
+func (app *application) keysList(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+	all := fs.Bool("all", false, "show inactive keys as well")
+	asJSON := fs.Bool("json", false, "print the keys as JSON")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !*all {
+		apiKeys = slices.DeleteFunc(apiKeys, func(k *data.APIKey) bool { return !k.IsActive })
+	}
+
+	// Newest first, as the list script always showed them.
+	slices.Reverse(apiKeys)
+
+	if *asJSON {
+		return writeKeysJSON(w, envelope{"api_keys": apiKeys})
+	}
+
+	fmt.Fprintln(w, "API Keys:")
+	fmt.Fprintln(w, keysRule)
+
+	for _, apiKey := range apiKeys {
+		printKey(w, apiKey)
+	}
+
+	if !*all {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "💡 Use --all to show inactive keys as well")
+	}
+
+	return nil
+}
+
+// printKey prints one entry of the key table.
+func printKey(w io.Writer, apiKey *data.APIKey) {
+	status := "🟢 Active"
+	switch {
+	case !apiKey.IsActive:
+		status = "⚫ Inactive"
+	case apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()):
+		status = "🔴 EXPIRED"
+	case apiKey.Rotated():
+		status = fmt.Sprintf("🟡 Rotated to %d", *apiKey.ReplacedBy)
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "Never"
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	}
+
+	name := apiKey.Name
+	if runes := []rune(name); len(runes) > 25 {
+		name = string(runes[:22]) + "..."
+	}
+
+	fmt.Fprintf(w, "ID: %-5d | %-28s | %s\n", apiKey.ID, name, status)
+	fmt.Fprintf(w, "         Created: %-16s | Last Used: %-16s | Expires: %s\n", formatTime(&apiKey.CreatedAt), formatTime(apiKey.LastUsedAt), formatTime(apiKey.ExpiresAt))
+	fmt.Fprintf(w, "         Scopes: %s\n", strings.Join(apiKey.Scopes, ","))
+	if apiKey.RequireSigning {
+		fmt.Fprintln(w, "         Signing: required for writes")
+	}
+	if apiKey.RateLimit != nil || apiKey.Quota != nil {
+		fmt.Fprintf(w, "         Limits: %s\n", formatKeyLimits(apiKey))
+	}
+	fmt.Fprintf(w, "         %s\n", keysDivider)
+}
+
+// formatKeyLimits describes a key's own rate limit and quota.
+func formatKeyLimits(apiKey *data.APIKey) string {
+	var limits []string
+
+	if apiKey.RateLimit != nil {
+		limits = append(limits, fmt.Sprintf("%g req/s, burst %d", apiKey.RateLimit.RPS, apiKey.RateLimit.Burst))
+	}
+	if apiKey.Quota != nil {
+		limits = append(limits, fmt.Sprintf("%d req/%s", apiKey.Quota.Limit, apiKey.Quota.Period))
+	}
+
+	return strings.Join(limits, " | ")
+}
+
+func (app *application) keysShow(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("keys show", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the key as JSON")
+
+	id, err := parseKeyID(fs, args)
+	if err != nil {
+		return err
+	}
+
+	apiKey, err := getKey(ctx, app.models, id)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return writeKeysJSON(w, envelope{"api_key": apiKey})
+	}
+
+	printKey(w, apiKey)
+	return nil
+}
+
+// keysRevoke deactivates a key, which keeps it on record for the audit log.
+func (app *application) keysRevoke(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("keys revoke", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the revoked key as JSON")
+
+	id, err := parseKeyID(fs, args)
+	if err != nil {
+		return err
+	}
+
+	apiKey, err := getKey(ctx, app.models, id)
+	if err != nil {
+		return err
+	}
+
+	apiKey.IsActive = false
+
+	err = app.models.APIKeys.Update(ctx, apiKey)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return writeKeysJSON(w, envelope{"api_key": apiKey})
+	}
+
+	fmt.Fprintf(w, "revoked api key %d (%s)\n", apiKey.ID, apiKey.Name)
+	return nil
+}
+
+// keysRotate replaces a key with a new one that has the same name, scopes
+// and expiry. The old key keeps working for the grace period, so clients
+// can switch over without downtime.
+func (app *application) keysRotate(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	grace := fs.Duration("grace", app.config.auth.rotationGrace, "how long the old key keeps working")
+	asJSON := fs.Bool("json", false, "print the new key as JSON")
+
+	id, err := parseKeyID(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *grace < 0 {
+		return errors.New("--grace must not be negative")
+	}
+
+	successor, token, err := app.models.APIKeys.Rotate(ctx, id, *grace)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return fmt.Errorf("api key %d not found", id)
+		case errors.Is(err, data.ErrKeyInactive):
+			return fmt.Errorf("api key %d has been revoked, has expired or has already been rotated", id)
+		default:
+			return err
+		}
+	}
+
+	replaced, err := getKey(ctx, app.models, id)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return writeKeysJSON(w, envelope{"api_key": successor, "token": token, "signing_secret": successor.SigningSecret, "replaced": replaced})
+	}
+
+	printNewKey(w, successor, token, "rotated")
+	fmt.Fprintf(w, "api key %d keeps working until %s\n", id, replaced.ExpiresAt.Local().Format(time.DateTime))
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestKeysCommand(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+
+	var out bytes.Buffer
+
+	err := app.runKeys(&out, []string{"create", "--name", "News Coo", "--scopes", "characters:write", "--expires", "30", "--json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created struct {
+		APIKey struct {
+			ID     int64    `json:"id"`
+			Scopes []string `json:"scopes"`
+		} `json:"api_key"`
+		Token string `json:"token"`
+	}
+
+	err = json.Unmarshal(out.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(created.Token), 64)
+	equal(t, strings.Join(created.APIKey.Scopes, ","), "characters:write")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	status, _ := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{}, map[string]string{"Authorization": "Bearer " + created.Token})
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	err = app.runKeys(&out, []string{"create", "--name", "Vegapunk", "--scopes", "characters:write,gorosei"})
+	if err == nil || !strings.Contains(err.Error(), "--scopes must only contain known scopes") {
+		t.Fatalf("expected an invalid scopes error, got %v", err)
+	}
+
+	out.Reset()
+
+	err = app.runKeys(&out, []string{"rotate", "1", "--grace", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := out.String()
+	if !strings.Contains(rotated, "ID:      2") || !strings.Contains(rotated, "Scopes:  characters:write") {
+		t.Fatalf("unexpected rotate output:\n%s", rotated)
+	}
+
+	// The old key works until the grace period is over.
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{}, map[string]string{"Authorization": "Bearer " + created.Token})
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	out.Reset()
+
+	err = app.runKeys(&out, []string{"list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := out.String()
+	if !strings.Contains(list, "ID: 2     | News Coo                     | 🟢 Active") || !strings.Contains(list, "ID: 1     | News Coo                     | 🟡 Rotated to 2") {
+		t.Fatalf("unexpected list output:\n%s", list)
+	}
+
+	err = app.runKeys(&out, []string{"rotate", "1"})
+	if err == nil {
+		t.Fatal("expected rotating a rotated key to fail")
+	}
+
+	err = app.runKeys(&out, []string{"revoke", "1", "--json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+
+	err = app.runKeys(&out, []string{"list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "ID: 1 ") {
+		t.Fatalf("unexpected list output:\n%s", out.String())
+	}
+
+	out.Reset()
+
+	err = app.runKeys(&out, []string{"list", "--all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "ID: 1     | News Coo                     | ⚫ Inactive") {
+		t.Fatalf("unexpected list output:\n%s", out.String())
+	}
+
+	err = app.runKeys(&out, []string{"show", "9"})
+	if err == nil || err.Error() != "api key 9 not found" {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestKeysCreateLimits(t *testing.T) {
+	app := newTestApplication(t)
+
+	var out bytes.Buffer
+
+	err := app.runKeys(&out, []string{"create", "--name", "News Coo", "--rps", "5", "--burst", "10", "--quota", "1000", "--quota-period", "month"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+
+	err = app.runKeys(&out, []string{"show", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "Limits: 5 req/s, burst 10 | 1000 req/month") {
+		t.Fatalf("unexpected show output:\n%s", out.String())
+	}
+
+	err = app.runKeys(&out, []string{"create", "--name", "Vegapunk", "--quota", "1000", "--quota-period", "week"})
+	if err == nil || !strings.Contains(err.Error(), "--quota period must be day or month") {
+		t.Fatalf("expected an invalid quota error, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.01
+	app.config.limiter.burst = 2
+
+	insertTestAPIKey(t, app, "marine-hq")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	res, _ := ts.get(t, "/v1/characters", nil)
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("RateLimit-Limit"), "2")
+	equal(t, res.Header.Get("RateLimit-Remaining"), "1")
+
+	res, _ = ts.get(t, "/v1/characters", nil)
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("RateLimit-Remaining"), "0")
+
+	res, _ = ts.get(t, "/v1/characters", nil)
+	equal(t, res.StatusCode, http.StatusTooManyRequests)
+	equal(t, res.Header.Get("RateLimit-Remaining"), "0")
+
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 100 {
+		t.Fatalf("got Retry-After %q; want 1 to 100 seconds", res.Header.Get("Retry-After"))
+	}
+
+	// A key has a bucket of its own, apart from its IP address's.
+	res, _ = ts.get(t, "/v1/characters", map[string]string{"Authorization": "Bearer marine-hq"})
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("RateLimit-Remaining"), "1")
+}
+
+func TestUnknownKeyRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.01
+	app.config.limiter.burst = 2
+
+	apiKey := insertTestAPIKey(t, app, "marine-hq")
+	apiKey.RateLimit = &data.RateLimit{RPS: 100, Burst: 100}
+
+	err := app.models.APIKeys.Update(context.Background(), apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Real keys don't count against their IP address's guesses.
+	for range 5 {
+		res, _ := ts.get(t, "/v1/characters", map[string]string{"Authorization": "Bearer marine-hq"})
+		equal(t, res.StatusCode, http.StatusOK)
+	}
+
+	for i := range 2 {
+		res, _ := ts.get(t, "/v1/characters", map[string]string{"Authorization": fmt.Sprintf("Bearer made-up-%d", i)})
+		equal(t, res.StatusCode, http.StatusOK)
+	}
+
+	// Once it's out of guesses, no token from the address is looked up.
+	res, _ := ts.get(t, "/v1/characters", map[string]string{"Authorization": "Bearer marine-hq"})
+	equal(t, res.StatusCode, http.StatusTooManyRequests)
+
+	if res.Header.Get("Retry-After") == "" {
+		t.Fatal("got no Retry-After header")
+	}
+}
+
+func TestPerKeyRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+
+	apiKey := insertTestAPIKey(t, app, "news-coo", "characters:read")
+	apiKey.RateLimit = &data.RateLimit{RPS: 0.01, Burst: 1}
+
+	err := app.models.APIKeys.Update(context.Background(), apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	auth := map[string]string{"Authorization": "Bearer news-coo"}
+
+	// The key's own limit applies even with the limiter off.
+	res, _ := ts.get(t, "/v1/characters", auth)
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("RateLimit-Limit"), "1")
+
+	res, _ = ts.get(t, "/v1/characters", auth)
+	equal(t, res.StatusCode, http.StatusTooManyRequests)
+
+	// Anonymous traffic isn't limited.
+	for range 3 {
+		res, _ = ts.get(t, "/v1/characters", nil)
+		equal(t, res.StatusCode, http.StatusOK)
+		equal(t, res.Header.Get("RateLimit-Limit"), "")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertTestAPIKey(t, app, "marine-hq")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	admin := map[string]string{"Authorization": "Bearer marine-hq"}
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys", map[string]any{
+		"name":  "news coo",
+		"quota": map[string]any{"limit": 3, "period": "fortnight"},
+	}, admin)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, response["error"].(map[string]any)["quota"], "period must be day or month")
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys", map[string]any{
+		"name":   "news coo",
+		"scopes": []string{"characters:read"},
+		"quota":  map[string]any{"limit": 3, "period": "day"},
+	}, admin)
+	equal(t, status, http.StatusCreated)
+
+	path := fmt.Sprintf("/v1/admin/api-keys/%d", int64(response["api_key"].(map[string]any)["id"].(float64)))
+	auth := map[string]string{"Authorization": "Bearer " + response["token"].(string)}
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/characters", nil, auth)
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/me/usage", nil, auth)
+	equal(t, status, http.StatusOK)
+
+	usage := response["usage"].(map[string]any)
+	equal(t, usage["rate_limit"], nil)
+
+	quota := usage["quota"].(map[string]any)
+	equal(t, int(quota["used"].(float64)), 2)
+	equal(t, int(quota["remaining"].(float64)), 1)
+	equal(t, quota["period"], "day")
+
+	resetsAt, err := time.Parse(time.RFC3339, quota["resets_at"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, resetsAt, time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1))
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/characters", nil, auth)
+	equal(t, status, http.StatusOK)
+
+	res, _ := ts.get(t, "/v1/characters", auth)
+	equal(t, res.StatusCode, http.StatusTooManyRequests)
+
+	if res.Header.Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+
+	// An empty quota takes it away.
+	status, response = ts.doWithHeaders(t, http.MethodPatch, path, map[string]any{"quota": map[string]any{}}, admin)
+	equal(t, status, http.StatusOK)
+	equal(t, response["api_key"].(map[string]any)["quota"], nil)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/me/usage", nil, auth)
+	equal(t, status, http.StatusOK)
+	equal(t, response["usage"].(map[string]any)["quota"], nil)
+
+	// Usage is only for keys.
+	status, _ = ts.do(t, http.MethodGet, "/v1/me/usage", nil)
+	equal(t, status, http.StatusUnauthorized)
+}
+
+func TestQuotaPeriods(t *testing.T) {
+	now := time.Date(2024, time.February, 29, 20, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+
+	daily := &data.Quota{Limit: 1, Period: data.QuotaDaily}
+	equal(t, daily.PeriodStart(now), time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	equal(t, daily.PeriodEnd(now), time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC))
+
+	monthly := &data.Quota{Limit: 1, Period: data.QuotaMonthly}
+	equal(t, monthly.PeriodStart(now), time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	equal(t, monthly.PeriodEnd(now), time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC))
+}
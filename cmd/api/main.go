@@ -4,12 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"expvar"
+	"fmt"
 	"log/slog"
 	"os"
 	"runtime"
 	"time"
 
 	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/jwt"
+	"github.com/05blue04/Poneglyph/internal/ratelimit"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
@@ -17,29 +20,71 @@ import (
 const version = "1.0.0"
 
 type config struct {
-	port int
-	env  string
-	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  time.Duration
+	port    int
+	env     string
+	storage string
+	db      struct {
+		dsn            string
+		maxOpenConns   int
+		maxIdleConns   int
+		maxIdleTime    time.Duration
+		timeouts       data.Timeouts
+		migrateOnStart bool
 	}
 
+	imports struct {
+		maxBytes int64
+		timeout  time.Duration
+	}
+	exports struct {
+		timeout time.Duration
+	}
+	trash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+
+	usage struct {
+		flushInterval time.Duration
+	}
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
+		backend string
 	}
 	auth struct {
-		required bool
+		required      bool
+		rotationGrace time.Duration
+		signatureSkew time.Duration
+	}
+	jwt struct {
+		jwks            string // a file or URL; empty turns JWTs off
+		issuer          string
+		audience        string
+		scopesClaim     string
+		leeway          time.Duration
+		refreshInterval time.Duration
+	}
+	webhooks struct {
+		timeout      time.Duration
+		pollInterval time.Duration
+		retryBase    time.Duration
+		maxAttempts  int
+		allowPrivate bool // lets webhooks reach loopback and private addresses
 	}
 }
 
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
+	config   config
+	logger   *slog.Logger
+	db       *sql.DB // nil when running with in-memory storage
+	models   data.Models
+	limiter  ratelimit.Limiter
+	usage    *usageRecorder
+	lastUsed *lastUsedQueue
+	jwt      *jwt.Verifier // nil unless JWT_JWKS is set
+	stream   *changeHub    // nil until the server starts
 }
 
 func main() {
@@ -62,13 +107,6 @@ func main() {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slogOptions))
 
-	db, err := openDB(cfg)
-	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
-	}
-	defer db.Close()
-
 	expvar.NewString("version").Set(version)
 
 	expvar.Publish("goroutines", expvar.Func(func() any {
@@ -80,12 +118,36 @@ func main() {
 	}))
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
+		config:   cfg,
+		logger:   logger,
+		usage:    newUsageRecorder(),
+		lastUsed: newLastUsedQueue(),
+	}
+
+	switch cfg.storage {
+	case "memory":
+		logger.Warn("using in-memory storage, data will be lost on shutdown")
+		app.models = data.NewMemoryModels()
+	default:
+		db, err := openDB(cfg)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		app.db = db
+		app.models = data.NewModels(db, cfg.db.timeouts)
+	}
+
+	switch cfg.limiter.backend {
+	case "postgres":
+		app.limiter = ratelimit.NewPostgres(app.db, cfg.db.timeouts.Write)
+	default:
+		app.limiter = ratelimit.NewMemory()
 	}
 
-	err = app.serve()
+	err = app.run(os.Args[1:])
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
@@ -93,6 +155,39 @@ func main() {
 
 }
 
+// run dispatches to the subcommand named by the first argument and serves the
+// API when there is none.
+func (app *application) run(args []string) error {
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	switch args[0] {
+	case "serve":
+		err := app.prepareSchema()
+		if err != nil {
+			return err
+		}
+		err = app.loadJWTKeys()
+		if err != nil {
+			return err
+		}
+		return app.serve()
+	case "migrate":
+		return app.migrateCommand(args[1:])
+	case "seed":
+		return app.seedCommand(args[1:])
+	case "backup":
+		return app.backupCommand(args[1:])
+	case "restore":
+		return app.restoreCommand(args[1:])
+	case "keys":
+		return app.keysCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q, expected one of: serve, migrate, seed, backup, restore, keys", args[0])
+	}
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
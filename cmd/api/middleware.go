@@ -1,29 +1,54 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"net/http"
+	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/julienschmidt/httprouter"
 	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
 type contextKey string
 
 const (
-	apiKeyContextKey contextKey = "apikey"
+	apiKeyContextKey    contextKey = "apikey"
+	principalContextKey contextKey = "principal"
 )
 
+// principal is who a request was authenticated as: an API key, or a service
+// holding a JWT from JWT_ISSUER.
+type principal struct {
+	APIKey  *data.APIKey // nil for JWTs
+	Subject string       // the JWT's sub claim; empty for API keys
+	Scopes  []string
+}
+
+// HasScope reports whether the principal has been granted scope.
+func (p *principal) HasScope(scope string) bool {
+	return data.HasScope(p.Scopes, scope)
+}
+
+// requestIDRX matches the request IDs accepted from clients and proxies.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
 type metricsResponseWriter struct {
 	wrapped       http.ResponseWriter
 	statusCode    int
@@ -44,6 +69,35 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// identifyRequest gives each request an ID, reusing a well-formed
+// X-Request-ID header if there is one, and echoes it back. The ID, client IP
+// and route go into the request context, so every change the request makes
+// is attributed to it in the audit log.
+func (app *application) identifyRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := data.ContextWithActor(r.Context(), data.Actor{
+			IP:        realip.FromRequest(r),
+			Route:     r.Method + " " + r.URL.Path,
+			RequestID: requestID,
+		})
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
@@ -53,113 +107,478 @@ func (app *application) logRequest(next http.Handler) http.Handler {
 			uri    = r.URL.RequestURI()
 		)
 
-		app.logger.Info("received request", "ip", ip, "proto", proto, "method", method, "uri", uri)
+		requestID := data.ActorFromContext(r.Context()).RequestID
+
+		app.logger.Info("received request", "ip", ip, "proto", proto, "method", method, "uri", uri, "request_id", requestID)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// rateLimit gives each API key a token bucket of its own, sized by the key's
+// rate limit or else LIMITER_RPS and LIMITER_BURST. Each JWT subject gets one
+// sized by those, and anonymous clients one per IP address. Keys with a rate
+// limit of their own are held to it even when LIMITER_ENABLED is off.
 func (app *application) rateLimit(next http.Handler) http.Handler {
-	if !app.config.limiter.enabled {
-		return next
-	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket  = "ip:" + realip.FromRequest(r)
+			rps     = app.config.limiter.rps
+			burst   = app.config.limiter.burst
+			enabled = app.config.limiter.enabled
+		)
 
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+		if p, ok := r.Context().Value(principalContextKey).(*principal); ok && p.APIKey == nil {
+			bucket = "sub:" + p.Subject
+		}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+		if apiKey, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey); ok {
+			bucket = fmt.Sprintf("key:%d", apiKey.ID)
 
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+			if apiKey.RateLimit != nil {
+				rps, burst = apiKey.RateLimit.RPS, apiKey.RateLimit.Burst
+				enabled = true
+			}
+		}
 
-			mu.Lock()
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
+		result, err := app.limiter.Allow(r.Context(), bucket, rps, burst)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+
+		if !result.Allowed {
+			retryAfter := math.Ceil(result.RetryAfter.Seconds())
+			app.rateLimitExceededResponse(w, r, max(1, int(retryAfter)))
+			return
+		}
 
-			mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enforceQuota counts each request made with an API key that has a quota,
+// and turns the key away once it's used up until the next period starts.
+func (app *application) enforceQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+		if !ok || apiKey.Quota == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+
+		_, err := app.models.APIKeys.CountRequest(r.Context(), apiKey.ID, apiKey.Quota.PeriodStart(now), apiKey.Quota.Limit)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrQuotaExceeded):
+				app.quotaExceededResponse(w, r, apiKey.Quota, apiKey.Quota.PeriodEnd(now))
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
 		}
-	}()
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identifyPrincipal works out who a request was made by, from the API key
+// or JWT in its Authorization header, and puts them in the request context
+// for the rate limiter, the quota and the handlers. Requests with a missing,
+// unknown or invalid token carry on anonymously; it's up to authenticate to
+// turn them away from routes that need one.
+func (app *application) identifyPrincipal(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := realip.FromRequest(r)
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || strings.Contains(token, " ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// API keys are hex, so a token with dots in it is a JWT.
+		if app.jwt != nil && strings.Count(token, ".") == 2 {
+			p, err := app.jwtPrincipal(token)
+			if err != nil {
+				app.logger.Info("rejected jwt", "error", err.Error(), "request_id", data.ActorFromContext(r.Context()).RequestID)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			actor := data.ActorFromContext(r.Context())
+			actor.Subject = p.Subject
+
+			ctx := context.WithValue(r.Context(), principalContextKey, p)
+			ctx = data.ContextWithActor(ctx, actor)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		// Tokens that turn out not to be keys are counted against the IP
+		// address they came from, and once it's used up its bucket, its
+		// tokens aren't looked up any more until the bucket refills. Made-up
+		// tokens would otherwise each cost a query before they were limited.
+		guesses := "unknown-key:" + realip.FromRequest(r)
 
-		mu.Lock()
+		if app.config.limiter.enabled {
+			result, err := app.limiter.Peek(r.Context(), guesses, app.config.limiter.rps, app.config.limiter.burst)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{
-				limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+			if !result.Allowed {
+				retryAfter := math.Ceil(result.RetryAfter.Seconds())
+				app.rateLimitExceededResponse(w, r, max(1, int(retryAfter)))
+				return
 			}
 		}
 
-		clients[ip].lastSeen = time.Now()
+		apiKey, err := app.models.APIKeys.GetByHash(r.Context(), data.HashAPIKey(token))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				if app.config.limiter.enabled {
+					_, err = app.limiter.Allow(r.Context(), guesses, app.config.limiter.rps, app.config.limiter.burst)
+					if err != nil {
+						app.serverErrorResponse(w, r, err)
+						return
+					}
+				}
 
-		if !clients[ip].limiter.Allow() {
-			mu.Unlock()
-			app.rateLimitExceededResponse(w, r)
+				next.ServeHTTP(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
 			return
 		}
 
-		mu.Unlock()
+		if apiKey.Rotated() {
+			deprecateAPIKey(w, apiKey)
+		}
 
-		next.ServeHTTP(w, r)
+		app.lastUsed.touch(apiKey.ID)
+
+		actor := data.ActorFromContext(r.Context())
+		actor.APIKeyID = &apiKey.ID
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, apiKey)
+		ctx = context.WithValue(ctx, principalContextKey, &principal{APIKey: apiKey, Scopes: apiKey.Scopes})
+		ctx = data.ContextWithActor(ctx, actor)
+
+		// Signatures are checked on every request made with a key, whether
+		// or not the route needs one, so a key that must sign can't make
+		// unsigned writes where REQUIRE_AUTH is off.
+		app.verifySignature(next).ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// recordUsage counts each request made with an API key, by the route it
+// matched, along with its status and how long it took.
+func (app *application) recordUsage(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		app.usage.record(apiKey.ID, routePattern(router, r), start, mw.statusCode, time.Since(start))
 	})
 }
 
+// authenticate turns away requests that weren't made with a valid API key
+// or JWT.
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		if _, ok := r.Context().Value(principalContextKey).(*principal); !ok {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Request signing headers.
+const (
+	signatureHeader = "X-Poneglyph-Signature"
+	timestampHeader = "X-Poneglyph-Timestamp"
+	nonceHeader     = "X-Poneglyph-Nonce"
+)
+
+// nonceRX matches the nonces accepted on signed requests.
+var nonceRX = regexp.MustCompile(`^[A-Za-z0-9._-]{16,128}$`)
+
+// verifySignature checks the signature on requests made with an API key
+// that carry one, and turns away writes without one from keys that must
+// sign. A signature covers the method, path and query, timestamp, nonce and
+// body, so a captured request can't be altered, or replayed once its nonce
+// has been used or its timestamp is more than SIGNATURE_MAX_SKEW away.
+func (app *application) verifySignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		signature := r.Header.Get(signatureHeader)
+		if signature == "" {
+			if apiKey.RequireSigning && !isSafeMethod(r.Method) {
+				app.invalidSignatureResponse(w, r, "this API key must sign its write requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if apiKey.SigningSecret == "" {
+			app.invalidSignatureResponse(w, r, "this API key has no signing secret")
+			return
+		}
+
+		timestamp := r.Header.Get(timestampHeader)
+
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			app.invalidSignatureResponse(w, r, timestampHeader+" must be a Unix time in seconds")
 			return
 		}
 
-		token := headerParts[1]
+		skew := time.Since(time.Unix(signedAt, 0))
+		if skew > app.config.auth.signatureSkew || skew < -app.config.auth.signatureSkew {
+			app.invalidSignatureResponse(w, r, fmt.Sprintf("%s must be within %s of the server's clock", timestampHeader, app.config.auth.signatureSkew))
+			return
+		}
 
-		hash := sha256.Sum256([]byte(token))
-		hashString := hex.EncodeToString(hash[:])
+		nonce := r.Header.Get(nonceHeader)
+		if !nonceRX.MatchString(nonce) {
+			app.invalidSignatureResponse(w, r, nonceHeader+" must be 16 to 128 letters, digits, dots, dashes or underscores")
+			return
+		}
 
-		apiKey, err := app.models.APIKeys.GetByHash(hashString)
+		bodyHash, cleanup, err := app.bufferBody(w, r)
 		if err != nil {
+			var (
+				maxBytesError *http.MaxBytesError
+				pathError     *fs.PathError
+			)
 			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
-			default:
+			case errors.As(err, &maxBytesError):
+				app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+			case errors.As(err, &pathError):
 				app.serverErrorResponse(w, r, err)
+			default:
+				app.badRequestResponse(w, r, err)
 			}
 			return
 		}
+		defer cleanup()
 
-		go func() {
-			app.models.APIKeys.UpdateLastUsed(apiKey.ID)
-		}()
+		expected := signRequest(apiKey.SigningSecret, r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			app.invalidSignatureResponse(w, r, "signature does not match the request")
+			return
+		}
 
-		ctx := context.WithValue(r.Context(), apiKeyContextKey, apiKey)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		// Only signed requests use up nonces, so nobody else can burn them.
+		// A nonce is remembered for as long as its timestamp would pass.
+		err = app.models.APIKeys.UseNonce(r.Context(), apiKey.ID, nonce, time.Unix(signedAt, 0).Add(app.config.auth.signatureSkew))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNonceUsed):
+				app.invalidSignatureResponse(w, r, "this request has already been made; sign each request with a new nonce")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) requireAuthOptional(next http.Handler) http.Handler {
+// maxSignedBodyBytes is the largest body a signed request may have, other
+// than an import.
+const maxSignedBodyBytes = 1_048_576
+
+// bufferBody reads a signed request's body in full, so its SHA-256 can be
+// checked before the handler sees any of it, and replaces r.Body with a copy
+// to be read again. Imports can run to IMPORT_MAX_BYTES, so rather than
+// being held in memory they're hashed as they're written to a temporary
+// file, which cleanup removes.
+func (app *application) bufferBody(w http.ResponseWriter, r *http.Request) (bodyHash []byte, cleanup func(), err error) {
+	hash := sha256.New()
+
+	if !isImportRequest(r) {
+		body, err := io.ReadAll(io.TeeReader(http.MaxBytesReader(w, r.Body, maxSignedBodyBytes), hash))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return hash.Sum(nil), func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "poneglyph-import-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup = func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	_, err = io.Copy(io.MultiWriter(file, hash), http.MaxBytesReader(w, r.Body, app.config.imports.maxBytes))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	r.Body = file
+	return hash.Sum(nil), cleanup, nil
+}
+
+// isImportRequest reports whether r is for the bulk import endpoint.
+func isImportRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/import/")
+}
+
+// signRequest signs a request for the X-Poneglyph-Signature header. Each
+// part goes on a line of its own, with the body as the hex of bodyHash, its
+// SHA-256.
+func signRequest(secret, method, uri, timestamp, nonce string, bodyHash []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash)))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSafeMethod reports whether requests with method only read.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// requireAPIKey turns away requests that weren't made with a valid API key,
+// for routes that deal in things only keys have, such as webhooks and usage.
+func (app *application) requireAPIKey(next http.Handler) http.Handler {
+	return app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetPrincipal(r).APIKey == nil {
+			app.apiKeyRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// deprecateAPIKey warns a client still using a key that has been rotated,
+// saying when it was replaced and when it stops working.
+func deprecateAPIKey(w http.ResponseWriter, apiKey *data.APIKey) {
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", apiKey.RotatedAt.Unix()))
+	w.Header().Set("Sunset", apiKey.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Warning", fmt.Sprintf(`299 - "This API key has been rotated and stops working at %s; switch to its replacement"`, apiKey.ExpiresAt.UTC().Format(time.RFC3339)))
+}
+
+// contextGetPrincipal returns who the request was authenticated as. It's
+// only called from handlers behind authenticate.
+func (app *application) contextGetPrincipal(r *http.Request) *principal {
+	p, ok := r.Context().Value(principalContextKey).(*principal)
+	if !ok {
+		panic("missing principal in request context")
+	}
+
+	return p
+}
+
+// contextGetAPIKey returns the API key that authenticated the request. It's
+// only called from handlers behind requireAPIKey.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	apiKey, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		panic("missing api key in request context")
+	}
+
+	return apiKey
+}
+
+// requireScope lets a request through if its API key or JWT has scope.
+// With REQUIRE_AUTH off there are no keys to check, so everything gets
+// through.
+func (app *application) requireScope(scope string, next http.Handler) http.Handler {
 	if !app.config.auth.required {
 		return next
 	}
 
-	return app.authenticate(next)
+	return app.authenticate(app.checkScope(scope, next))
+}
+
+// requireReadScope is requireScope for routes that read the resource named
+// by resource, such as the change feed and exports. A request that doesn't
+// name one of them reads every resource, and needs each one's read scope.
+func (app *application) requireReadScope(resource func(r *http.Request) string, next http.Handler) http.Handler {
+	return app.requireResourceScope("read", resource, next)
+}
+
+// requireWriteScope is requireReadScope for routes that write the resource,
+// such as imports.
+func (app *application) requireWriteScope(resource func(r *http.Request) string, next http.Handler) http.Handler {
+	return app.requireResourceScope("write", resource, next)
+}
+
+func (app *application) requireResourceScope(access string, resource func(r *http.Request) string, next http.Handler) http.Handler {
+	if !app.config.auth.required {
+		return next
+	}
+
+	return app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resources := data.TrashResources
+		if name := resource(r); slices.Contains(data.TrashResources, name) {
+			resources = []string{name}
+		}
+
+		for _, name := range resources {
+			if scope := name + ":" + access; !app.contextGetPrincipal(r).HasScope(scope) {
+				app.notPermittedResponse(w, r, scope)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// checkScope responds with a 403 unless whoever authenticated the request
+// has scope.
+func (app *application) checkScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.contextGetPrincipal(r).HasScope(scope) {
+			app.notPermittedResponse(w, r, scope)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
@@ -179,11 +598,11 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 func (app *application) metrics(next http.Handler) http.Handler {
 	var (
-		totalRequestsReceived           = expvar.NewInt("total_requests_received")
-		totalResponsesSent              = expvar.NewInt("total_responses_sent")
-		totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+		totalRequestsReceived           = publishedInt("total_requests_received")
+		totalResponsesSent              = publishedInt("total_responses_sent")
+		totalProcessingTimeMicroseconds = publishedInt("total_processing_time_μs")
 
-		totalResponsesSentByStatus = expvar.NewMap("total_responses_sent_by_status")
+		totalResponsesSentByStatus = publishedMap("total_responses_sent_by_status")
 	)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -204,6 +623,24 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	})
 }
 
+// publishedInt returns the expvar.Int registered under name, creating it on
+// first use. expvar panics on duplicate names, and routes() may be built more
+// than once in tests.
+func publishedInt(name string) *expvar.Int {
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v
+	}
+	return expvar.NewInt(name)
+}
+
+// publishedMap is the expvar.Map counterpart of publishedInt.
+func publishedMap(name string) *expvar.Map {
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	return expvar.NewMap(name)
+}
+
 func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
 	return &metricsResponseWriter{
 		wrapped:    w,
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/migrate"
+	"github.com/05blue04/Poneglyph/migrations"
+)
+
+var errMigrationsNeedPostgres = errors.New("migrations require STORAGE=postgres")
+
+func (app *application) newMigrator() (*migrate.Migrator, error) {
+	if app.db == nil {
+		return nil, errMigrationsNeedPostgres
+	}
+
+	return migrate.New(app.db, migrations.FS)
+}
+
+// prepareSchema runs before the server starts. It applies pending migrations
+// when MIGRATE_ON_START is set, and refuses to start against a schema newer
+// than the migrations embedded in this binary.
+func (app *application) prepareSchema() error {
+	if app.db == nil {
+		return nil
+	}
+
+	migrator, err := app.newMigrator()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if app.config.db.migrateOnStart {
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range applied {
+			app.logger.Info("applied migration", "version", migration.Version, "name", migration.Name)
+		}
+	}
+
+	current, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	expected := migrator.Latest()
+
+	switch {
+	case current > expected:
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, expected)
+	case current < expected:
+		app.logger.Warn("database schema has pending migrations", "version", current, "expected", expected)
+	}
+
+	return nil
+}
+
+// embeddedSchemaVersion returns the schema version this binary expects.
+func embeddedSchemaVersion() (int64, error) {
+	embedded, err := migrate.Load(migrations.FS)
+	if err != nil {
+		return 0, err
+	}
+
+	return (&migrate.Migrator{Migrations: embedded}).Latest(), nil
+}
+
+// schemaVersion returns the version of the database schema. In-memory storage
+// has no schema of its own and always matches the embedded migrations.
+func (app *application) schemaVersion(ctx context.Context) (int64, error) {
+	if app.db == nil {
+		return embeddedSchemaVersion()
+	}
+
+	migrator, err := app.newMigrator()
+	if err != nil {
+		return 0, err
+	}
+
+	return migrator.Version(ctx)
+}
+
+func (app *application) migrateCommand(args []string) error {
+	return app.runMigrate(os.Stdout, args)
+}
+
+// runMigrate carries out a migrate subcommand, writing what it did to out.
+func (app *application) runMigrate(out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: api migrate up|down|status|version")
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("migrate expects exactly one subcommand")
+	}
+
+	migrator, err := app.newMigrator()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		for _, migration := range applied {
+			fmt.Fprintf(out, "applied %s\n", migration.Name)
+		}
+
+	case "down":
+		migration, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "rolled back %s\n", migration.Name)
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "Applied At\tMigration")
+		for _, status := range statuses {
+			appliedAt := "Pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.DateTime)
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", appliedAt, status.Migration.Name)
+		}
+		return tw.Flush()
+
+	case "version":
+		current, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "database: %d\nbinary:   %d\n", current, migrator.Latest())
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate subcommand %q", fs.Arg(0))
+	}
+
+	return nil
+}
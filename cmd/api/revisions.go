@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+// fieldChange is one field that differs between two revisions. A field that
+// one of them doesn't have is null on that side.
+type fieldChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+}
+
+// unversionedFields change with every revision, so diffs leave them out.
+var unversionedFields = []string{"updated_at", "version"}
+
+// getLiveRecord reads a character, devil fruit or crew, failing with
+// data.ErrRecordNotFound if it's in the trash. Revisions of trashed records
+// are hidden along with the records themselves.
+func (app *application) getLiveRecord(ctx context.Context, entity string, id int64) error {
+	var err error
+
+	switch entity {
+	case "characters":
+		_, err = app.models.Characters.Get(ctx, id)
+	case "devilfruits":
+		_, err = app.models.DevilFruits.Get(ctx, id)
+	case "crews":
+		_, err = app.models.Crews.Get(ctx, id)
+	}
+
+	return err
+}
+
+func (app *application) listRevisionsHandler(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		var input struct {
+			data.Filters
+		}
+
+		v := validator.New()
+
+		qs := r.URL.Query()
+
+		input.Filters.Page = app.readInt(qs, "page", 1, v)
+		input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+		input.Filters.Sort = app.readString(qs, "sort", "-revision")
+		input.Filters.SortSafelist = []string{"revision", "-revision"}
+
+		if data.ValidateFilters(v, input.Filters); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.getLiveRecord(r.Context(), entity, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		revisions, metadata, err := app.models.Revisions.GetAll(r.Context(), entity, id, input.Filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions, "metadata": metadata}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+func (app *application) showRevisionHandler(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		rev, err := app.readRevisionParam(r, "rev")
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		revision, err := app.getRevision(r.Context(), entity, id, rev)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"revision": revision}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+func (app *application) diffRevisionsHandler(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		fromRev, err := app.readRevisionParam(r, "rev")
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		toRev, err := app.readRevisionParam(r, "other")
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		from, err := app.getRevision(r.Context(), entity, id, fromRev)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		to, err := app.models.Revisions.Get(r.Context(), entity, id, toRev)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		changes, err := diffRevisions(from.Data, to.Data)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"from": fromRev, "to": toRev, "changes": changes}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// getRevision reads one revision of a record that isn't in the trash.
+func (app *application) getRevision(ctx context.Context, entity string, id int64, rev int32) (*data.Revision, error) {
+	err := app.getLiveRecord(ctx, entity, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.models.Revisions.Get(ctx, entity, id, rev)
+}
+
+// diffRevisions compares two snapshots field by field, returning the fields
+// that differ in name order.
+func diffRevisions(from, to json.RawMessage) ([]fieldChange, error) {
+	var fromFields, toFields map[string]json.RawMessage
+
+	err := json.Unmarshal(from, &fromFields)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(to, &toFields)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := maps.Clone(fromFields)
+	maps.Copy(fields, toFields)
+
+	changes := []fieldChange{}
+
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		if slices.Contains(unversionedFields, field) {
+			continue
+		}
+
+		if !bytes.Equal(fromFields[field], toFields[field]) {
+			changes = append(changes, fieldChange{Field: field, From: fromFields[field], To: toFields[field]})
+		}
+	}
+
+	return changes, nil
+}
+
+// readRevertTarget reads the revision a revert asks for. It responds itself
+// and returns nil if there's no such revision.
+func (app *application) readRevertTarget(w http.ResponseWriter, r *http.Request, entity string, id int64) *data.Revision {
+	rev, err := app.readRevisionParam(r, "rev")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	revision, err := app.models.Revisions.Get(r.Context(), entity, id, rev)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return revision
+}
+
+func (app *application) revertCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	character, err := app.models.Characters.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := ifMatch(r, character.Version, envelope{"character": character})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	revision := app.readRevertTarget(w, r, "characters", id)
+	if revision == nil {
+		return
+	}
+
+	var input characterUpdate
+
+	err = json.Unmarshal(revision.Data, &input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Snapshots leave out a missing bounty, which an update would take
+	// to mean "unchanged".
+	character.Bounty = nil
+
+	app.applyCharacterUpdate(w, r, character, input)
+}
+
+func (app *application) revertDevilFruitHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	devilFruit, err := app.models.DevilFruits.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := ifMatch(r, devilFruit.Version, envelope{"devilfruit": devilFruit})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	revision := app.readRevertTarget(w, r, "devilfruits", id)
+	if revision == nil {
+		return
+	}
+
+	var input devilFruitUpdate
+
+	err = json.Unmarshal(revision.Data, &input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Snapshots hold null for an unowned fruit or one with no previous
+	// owners, which an update would take to mean "unchanged".
+	if input.Character_id == nil {
+		input.Character_id = new(int64)
+	}
+	if input.PreviousOwners == nil {
+		input.PreviousOwners = []string{}
+	}
+
+	app.applyDevilFruitUpdate(w, r, devilFruit, input)
+}
+
+func (app *application) revertCrewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	crew, err := app.models.Crews.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := ifMatch(r, crew.Version, envelope{"crew": crew})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	revision := app.readRevertTarget(w, r, "crews", id)
+	if revision == nil {
+		return
+	}
+
+	// The total bounty and member count follow the current members, so
+	// only the crew's own fields are reverted.
+	var input crewUpdate
+
+	err = json.Unmarshal(revision.Data, &input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.applyCrewUpdate(w, r, crew, input)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCharacterRevisions(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Buggy", 39, "15M berries")
+	path := fmt.Sprintf("/v1/characters/%d", id)
+
+	status, _ := ts.do(t, http.MethodPatch, path, map[string]any{"bounty": "10B berries"})
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodPatch, path, map[string]any{"age": 40})
+	equal(t, status, http.StatusOK)
+
+	status, response := ts.do(t, http.MethodGet, path+"/revisions", nil)
+	equal(t, status, http.StatusOK)
+
+	revisions := response["revisions"].([]any)
+	equal(t, len(revisions), 3)
+	equal(t, int(revisions[0].(map[string]any)["revision"].(float64)), 3)
+
+	status, response = ts.do(t, http.MethodGet, path+"/revisions/1", nil)
+	equal(t, status, http.StatusOK)
+
+	first := response["revision"].(map[string]any)["data"].(map[string]any)
+	equal(t, first["bounty"], "15M berries")
+	equal(t, int(first["age"].(float64)), 39)
+
+	status, response = ts.do(t, http.MethodGet, path+"/revisions/1/diff/3", nil)
+	equal(t, status, http.StatusOK)
+
+	changes := response["changes"].([]any)
+	equal(t, len(changes), 2)
+
+	age := changes[0].(map[string]any)
+	equal(t, age["field"], "age")
+	equal(t, int(age["to"].(float64)), 40)
+
+	bounty := changes[1].(map[string]any)
+	equal(t, bounty["field"], "bounty")
+	equal(t, bounty["from"], "15M berries")
+	equal(t, bounty["to"], "10B berries")
+
+	status, response = ts.do(t, http.MethodPost, path+"/revisions/1/revert", nil)
+	equal(t, status, http.StatusOK)
+
+	character := response["character"].(map[string]any)
+	equal(t, character["bounty"], "15M berries")
+	equal(t, int(character["age"].(float64)), 39)
+	equal(t, int(character["version"].(float64)), 4)
+
+	status, _ = ts.do(t, http.MethodGet, path+"/revisions/9", nil)
+	equal(t, status, http.StatusNotFound)
+
+	status, _ = ts.do(t, http.MethodPost, path+"/revisions/9/revert", nil)
+	equal(t, status, http.StatusNotFound)
+
+	status, _ = ts.do(t, http.MethodDelete, path, nil)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodGet, path+"/revisions", nil)
+	equal(t, status, http.StatusNotFound)
+}
+
+func TestRevertValidates(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	owner := createTestCharacter(t, ts, "Marshall D. Teach", 40, "3.9B berries")
+
+	status, response := ts.do(t, http.MethodPost, "/v1/devilfruits", map[string]any{
+		"name":         "Yami Yami no Mi",
+		"description":  "Allows the user to create and control darkness",
+		"type":         "logia",
+		"character_id": owner,
+		"episode":      325,
+	})
+	equal(t, status, http.StatusCreated)
+	path := fmt.Sprintf("/v1/devilfruits/%d", int64(response["devilfruit"].(map[string]any)["id"].(float64)))
+
+	status, _ = ts.do(t, http.MethodPatch, path, map[string]any{"character_id": 0, "previous_owners": []string{"Marshall D. Teach"}})
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", owner), nil)
+	equal(t, status, http.StatusOK)
+
+	// Revision 1 names an owner who is now in the trash, which an update
+	// would refuse too.
+	status, _ = ts.do(t, http.MethodPost, path+"/revisions/1/revert", nil)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/characters/%d/restore", owner), nil)
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.do(t, http.MethodPost, path+"/revisions/1/revert", nil)
+	equal(t, status, http.StatusOK)
+
+	devilFruit := response["devilfruit"].(map[string]any)
+	equal(t, int64(devilFruit["character_id"].(float64)), owner)
+	equal(t, len(devilFruit["previous_owners"].([]any)), 0)
+}
@@ -17,31 +17,101 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	//character endpoints
-	router.HandlerFunc(http.MethodGet, "/v1/characters/:id", app.showCharacterHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/characters", app.listCharactersHandler)
-	router.Handler(http.MethodPost, "/v1/characters", app.requireAuthOptional(http.HandlerFunc(app.createCharacterHandler)))
-	router.Handler(http.MethodPatch, "/v1/characters/:id", app.requireAuthOptional(http.HandlerFunc(app.updateCharacterHandler)))
-	router.Handler(http.MethodDelete, "/v1/characters/:id", app.requireAuthOptional(http.HandlerFunc(app.deleteCharacterHandler)))
+	router.Handler(http.MethodGet, "/v1/characters/:id", app.requireScope("characters:read", http.HandlerFunc(app.showCharacterHandler)))
+	router.Handler(http.MethodGet, "/v1/characters", app.requireScope("characters:read", http.HandlerFunc(app.listCharactersHandler)))
+	router.Handler(http.MethodPost, "/v1/characters", app.requireScope("characters:write", http.HandlerFunc(app.createCharacterHandler)))
+	router.Handler(http.MethodPatch, "/v1/characters/:id", app.requireScope("characters:write", http.HandlerFunc(app.updateCharacterHandler)))
+	router.Handler(http.MethodDelete, "/v1/characters/:id", app.requireScope("characters:write", http.HandlerFunc(app.deleteCharacterHandler)))
+	router.Handler(http.MethodPost, "/v1/characters/:id/restore", app.requireScope("characters:write", http.HandlerFunc(app.restoreCharacterHandler)))
+	router.Handler(http.MethodGet, "/v1/characters/:id/revisions", app.requireScope("characters:read", app.listRevisionsHandler("characters")))
+	router.Handler(http.MethodGet, "/v1/characters/:id/revisions/:rev", app.requireScope("characters:read", app.showRevisionHandler("characters")))
+	router.Handler(http.MethodGet, "/v1/characters/:id/revisions/:rev/diff/:other", app.requireScope("characters:read", app.diffRevisionsHandler("characters")))
+	router.Handler(http.MethodPost, "/v1/characters/:id/revisions/:rev/revert", app.requireScope("characters:write", http.HandlerFunc(app.revertCharacterHandler)))
 
 	//devilfruit endpoints
-	router.HandlerFunc(http.MethodGet, "/v1/devilfruits/:id", app.showDevilFruitHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/devilfruits", app.listDevilFruitsHandler)
-	router.Handler(http.MethodPost, "/v1/devilfruits", app.requireAuthOptional(http.HandlerFunc(app.createDevilFruitHandler)))
-	router.Handler(http.MethodPatch, "/v1/devilfruits/:id", app.requireAuthOptional(http.HandlerFunc(app.updateDevilFruitHandler)))
-	router.Handler(http.MethodDelete, "/v1/devilfruits/:id", app.requireAuthOptional(http.HandlerFunc(app.deleteDevilFruitHandler)))
+	router.Handler(http.MethodGet, "/v1/devilfruits/:id", app.requireScope("devilfruits:read", http.HandlerFunc(app.showDevilFruitHandler)))
+	router.Handler(http.MethodGet, "/v1/devilfruits", app.requireScope("devilfruits:read", http.HandlerFunc(app.listDevilFruitsHandler)))
+	router.Handler(http.MethodPost, "/v1/devilfruits", app.requireScope("devilfruits:write", http.HandlerFunc(app.createDevilFruitHandler)))
+	router.Handler(http.MethodPatch, "/v1/devilfruits/:id", app.requireScope("devilfruits:write", http.HandlerFunc(app.updateDevilFruitHandler)))
+	router.Handler(http.MethodDelete, "/v1/devilfruits/:id", app.requireScope("devilfruits:write", http.HandlerFunc(app.deleteDevilFruitHandler)))
+	router.Handler(http.MethodPost, "/v1/devilfruits/:id/restore", app.requireScope("devilfruits:write", http.HandlerFunc(app.restoreDevilFruitHandler)))
+	router.Handler(http.MethodGet, "/v1/devilfruits/:id/revisions", app.requireScope("devilfruits:read", app.listRevisionsHandler("devilfruits")))
+	router.Handler(http.MethodGet, "/v1/devilfruits/:id/revisions/:rev", app.requireScope("devilfruits:read", app.showRevisionHandler("devilfruits")))
+	router.Handler(http.MethodGet, "/v1/devilfruits/:id/revisions/:rev/diff/:other", app.requireScope("devilfruits:read", app.diffRevisionsHandler("devilfruits")))
+	router.Handler(http.MethodPost, "/v1/devilfruits/:id/revisions/:rev/revert", app.requireScope("devilfruits:write", http.HandlerFunc(app.revertDevilFruitHandler)))
 
 	//crew endpoints
-	router.HandlerFunc(http.MethodGet, "/v1/crews/:id", app.showCrewHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/crews", app.listCrewsHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/crews/:id/members", app.listCrewMembersHandler)
-	router.Handler(http.MethodPost, "/v1/crews", app.requireAuthOptional(http.HandlerFunc(app.createCrewHandler)))
-	router.Handler(http.MethodPatch, "/v1/crews/:id", app.requireAuthOptional(http.HandlerFunc(app.updateCrewHandler)))
-	router.Handler(http.MethodDelete, "/v1/crews/:id", app.requireAuthOptional(http.HandlerFunc(app.deleteCrewHandler)))
-	router.Handler(http.MethodPost, "/v1/crews/:id/members", app.requireAuthOptional(http.HandlerFunc(app.addCrewMemberHandler)))
-	router.Handler(http.MethodDelete, "/v1/crews/:id/members/:character_id", app.requireAuthOptional(http.HandlerFunc(app.deleteCrewMemberHandler)))
+	router.Handler(http.MethodGet, "/v1/crews/:id", app.requireScope("crews:read", http.HandlerFunc(app.showCrewHandler)))
+	router.Handler(http.MethodGet, "/v1/crews", app.requireScope("crews:read", http.HandlerFunc(app.listCrewsHandler)))
+	router.Handler(http.MethodGet, "/v1/crews/:id/members", app.requireScope("crews:read", http.HandlerFunc(app.listCrewMembersHandler)))
+	router.Handler(http.MethodPost, "/v1/crews", app.requireScope("crews:write", http.HandlerFunc(app.createCrewHandler)))
+	router.Handler(http.MethodPatch, "/v1/crews/:id", app.requireScope("crews:write", http.HandlerFunc(app.updateCrewHandler)))
+	router.Handler(http.MethodDelete, "/v1/crews/:id", app.requireScope("crews:write", http.HandlerFunc(app.deleteCrewHandler)))
+	router.Handler(http.MethodPost, "/v1/crews/:id/restore", app.requireScope("crews:write", http.HandlerFunc(app.restoreCrewHandler)))
+	router.Handler(http.MethodGet, "/v1/crews/:id/revisions", app.requireScope("crews:read", app.listRevisionsHandler("crews")))
+	router.Handler(http.MethodGet, "/v1/crews/:id/revisions/:rev", app.requireScope("crews:read", app.showRevisionHandler("crews")))
+	router.Handler(http.MethodGet, "/v1/crews/:id/revisions/:rev/diff/:other", app.requireScope("crews:read", app.diffRevisionsHandler("crews")))
+	router.Handler(http.MethodPost, "/v1/crews/:id/revisions/:rev/revert", app.requireScope("crews:write", http.HandlerFunc(app.revertCrewHandler)))
+	router.Handler(http.MethodPost, "/v1/crews/:id/members", app.requireScope("crews:write", http.HandlerFunc(app.addCrewMemberHandler)))
+	router.Handler(http.MethodDelete, "/v1/crews/:id/members/:character_id", app.requireScope("crews:write", http.HandlerFunc(app.deleteCrewMemberHandler)))
+
+	//trash endpoint
+	router.Handler(http.MethodGet, "/v1/trash", app.requireScope("trash:read", http.HandlerFunc(app.listTrashHandler)))
+
+	//audit endpoint, which holds client IPs and whole records, so it always
+	//needs a key or JWT
+	router.Handler(http.MethodGet, "/v1/audit", app.authenticate(app.checkScope("audit:read", http.HandlerFunc(app.listAuditHandler))))
+
+	//change feed endpoint
+	router.Handler(http.MethodGet, "/v1/changes", app.requireReadScope(allResources, http.HandlerFunc(app.listChangesHandler)))
+	router.Handler(http.MethodGet, "/v1/stream", app.requireReadScope(queryResource, http.HandlerFunc(app.streamHandler)))
+
+	//usage endpoint for the API key making the request
+	router.Handler(http.MethodGet, "/v1/me/usage", app.requireAPIKey(http.HandlerFunc(app.showMyUsageHandler)))
+
+	//webhook endpoints, which always need an API key to own them
+	router.Handler(http.MethodGet, "/v1/webhooks", app.requireAPIKey(app.checkScope("webhooks:read", http.HandlerFunc(app.listWebhooksHandler))))
+	router.Handler(http.MethodPost, "/v1/webhooks", app.requireAPIKey(app.checkScope("webhooks:write", http.HandlerFunc(app.createWebhookHandler))))
+	router.Handler(http.MethodGet, "/v1/webhooks/:id", app.requireAPIKey(app.checkScope("webhooks:read", http.HandlerFunc(app.showWebhookHandler))))
+	router.Handler(http.MethodDelete, "/v1/webhooks/:id", app.requireAPIKey(app.checkScope("webhooks:write", http.HandlerFunc(app.deleteWebhookHandler))))
+	router.Handler(http.MethodPost, "/v1/webhooks/:id/test", app.requireAPIKey(app.checkScope("webhooks:write", http.HandlerFunc(app.testWebhookHandler))))
+	router.Handler(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requireAPIKey(app.checkScope("webhooks:read", http.HandlerFunc(app.listWebhookDeliveriesHandler))))
+
+	//api key management endpoints, which always need an admin key
+	router.Handler(http.MethodGet, "/v1/admin/api-keys", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.listAPIKeysHandler))))
+	router.Handler(http.MethodPost, "/v1/admin/api-keys", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.createAPIKeyHandler))))
+	router.Handler(http.MethodGet, "/v1/admin/api-keys/:id", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.showAPIKeyHandler))))
+	router.Handler(http.MethodPatch, "/v1/admin/api-keys/:id", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.updateAPIKeyHandler))))
+	router.Handler(http.MethodDelete, "/v1/admin/api-keys/:id", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.deleteAPIKeyHandler))))
+	router.Handler(http.MethodPost, "/v1/admin/api-keys/:id/deactivate", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.deactivateAPIKeyHandler))))
+	router.Handler(http.MethodPost, "/v1/admin/api-keys/:id/rotate", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.rotateAPIKeyHandler))))
+	router.Handler(http.MethodPost, "/v1/admin/api-keys/:id/signing-secret", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.newSigningSecretHandler))))
+
+	//usage reports for every key, which need an admin key too
+	router.Handler(http.MethodGet, "/v1/admin/usage", app.authenticate(app.checkScope("admin", http.HandlerFunc(app.listUsageHandler))))
+
+	//bulk import endpoint
+	router.Handler(http.MethodPost, "/v1/import/:resource", app.requireWriteScope(pathResource, http.HandlerFunc(app.importHandler)))
+
+	//bulk export endpoint
+	router.Handler(http.MethodGet, "/v1/export/:resource", app.requireReadScope(pathResource, http.HandlerFunc(app.exportHandler)))
 
 	//metric endpoint
-	router.Handler(http.MethodGet, "/v1/metrics", app.requireAuthOptional(expvar.Handler()))
+	router.Handler(http.MethodGet, "/v1/metrics", app.requireScope("metrics:read", expvar.Handler()))
+
+	return app.metrics(app.identifyRequest(app.recoverPanic(app.enableCORS(app.identifyPrincipal(app.recordUsage(router, app.rateLimit(app.enforceQuota(app.logRequest(router)))))))))
+}
+
+// allResources, queryResource and pathResource tell requireReadScope which
+// resource a request reads.
+func allResources(r *http.Request) string {
+	return ""
+}
+
+func queryResource(r *http.Request) string {
+	return r.URL.Query().Get("resource")
+}
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.logRequest(router)))))
+func pathResource(r *http.Request) string {
+	return httprouter.ParamsFromContext(r.Context()).ByName("resource")
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRequireScope(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+
+	insertTestAPIKey(t, app, "marine-hq", "admin")
+	insertTestAPIKey(t, app, "news-coo", "characters:read", "crews:read")
+	insertTestAPIKey(t, app, "bounty-office", "characters:write")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	character := map[string]any{
+		"name":        "Buggy",
+		"age":         39,
+		"description": "Captain of the Buggy Pirates",
+		"origin":      "Grand Line",
+		"race":        "human",
+		"bounty":      "15M berries",
+		"episode":     4,
+	}
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, bearer("news-coo"))
+	equal(t, status, http.StatusForbidden)
+	equal(t, response["error"], "your API key doesn't have the characters:write scope needed for this request")
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, bearer("bounty-office"))
+	equal(t, status, http.StatusCreated)
+	path := fmt.Sprintf("/v1/characters/%d", int64(response["character"].(map[string]any)["id"].(float64)))
+
+	// A write scope is limited to its own resource.
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/crews", map[string]any{"name": "Buggy Pirates"}, bearer("bounty-office"))
+	equal(t, status, http.StatusForbidden)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/trash", nil, bearer("bounty-office"))
+	equal(t, status, http.StatusForbidden)
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, path, nil, bearer("marine-hq"))
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/trash", nil, bearer("marine-hq"))
+	equal(t, status, http.StatusOK)
+
+	// A missing key is still a 401, not a 403.
+	status, _ = ts.do(t, http.MethodPost, path+"/restore", nil)
+	equal(t, status, http.StatusUnauthorized)
+
+	// Reads need the resource's read scope, which a write scope includes.
+	status, _ = ts.do(t, http.MethodGet, "/v1/characters", nil)
+	equal(t, status, http.StatusUnauthorized)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/characters", nil, bearer("news-coo"))
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/characters", nil, bearer("bounty-office"))
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/devilfruits", nil, bearer("news-coo"))
+	equal(t, status, http.StatusForbidden)
+	equal(t, response["error"], "your API key doesn't have the devilfruits:read scope needed for this request")
+
+	// Feeds and exports of one resource need its read scope, and of every
+	// resource need them all.
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/export/crews", nil, bearer("news-coo"))
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/export/devilfruits", nil, bearer("news-coo"))
+	equal(t, status, http.StatusForbidden)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/changes", nil, bearer("news-coo"))
+	equal(t, status, http.StatusForbidden)
+	equal(t, response["error"], "your API key doesn't have the devilfruits:read scope needed for this request")
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/changes", nil, bearer("marine-hq"))
+	equal(t, status, http.StatusOK)
+
+	// Imports need the write scope of the resource being imported. These
+	// bodies aren't CSV or NDJSON, so getting past the scope check is a 415.
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/import/characters", nil, bearer("bounty-office"))
+	equal(t, status, http.StatusUnsupportedMediaType)
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, "/v1/import/crews", nil, bearer("bounty-office"))
+	equal(t, status, http.StatusForbidden)
+	equal(t, response["error"], "your API key doesn't have the crews:write scope needed for this request")
+}
+
+func TestAuditNeedsScope(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertTestAPIKey(t, app, "marine-hq", "audit:read")
+	insertTestAPIKey(t, app, "news-coo", "characters:read")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// The audit log holds client IPs and whole records, so it needs a key
+	// even when REQUIRE_AUTH is off.
+	status, _ := ts.do(t, http.MethodGet, "/v1/audit", nil)
+	equal(t, status, http.StatusUnauthorized)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/audit", nil, map[string]string{"Authorization": "Bearer news-coo"})
+	equal(t, status, http.StatusForbidden)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/audit", nil, map[string]string{"Authorization": "Bearer marine-hq"})
+	equal(t, status, http.StatusOK)
+}
+
+func TestWebhooksNeedScope(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertTestAPIKey(t, app, "news-coo", "webhooks:read")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	auth := map[string]string{"Authorization": "Bearer news-coo"}
+
+	status, _ := ts.doWithHeaders(t, http.MethodGet, "/v1/webhooks", nil, auth)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": "https://example.com/hook"}, auth)
+	equal(t, status, http.StatusForbidden)
+}
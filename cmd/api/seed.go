@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+	"github.com/05blue04/Poneglyph/seeds"
+)
+
+func (app *application) seedCommand(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the changes without writing anything")
+	prune := fs.Bool("prune", false, "delete records and memberships that are not in the dataset")
+	file := fs.String("file", "", "load this dataset instead of the embedded one")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var dataset *seeds.Dataset
+	if *file != "" {
+		dataset, err = seeds.LoadFile(os.DirFS(filepath.Dir(*file)), filepath.Base(*file))
+	} else {
+		dataset, err = seeds.Load()
+	}
+	if err != nil {
+		return err
+	}
+
+	s := &seeder{
+		models: app.models,
+		dryRun: *dryRun,
+		prune:  *prune,
+		out:    os.Stdout,
+	}
+
+	// Changes made by the seeder are logged without an API key.
+	ctx := data.ContextWithActor(context.Background(), data.Actor{Route: "seed"})
+
+	return s.run(ctx, dataset)
+}
+
+// seedCounts tallies what happened to one kind of record.
+type seedCounts struct {
+	created, updated, unchanged, deleted int
+}
+
+// seeder loads a dataset through the models, matching existing records by
+// their unique name so that running it twice changes nothing.
+type seeder struct {
+	models data.Models
+	dryRun bool
+	prune  bool
+	out    io.Writer
+
+	characterIDs map[string]int64
+	counts       map[string]*seedCounts
+}
+
+func (s *seeder) logf(format string, args ...any) {
+	if s.dryRun {
+		format = "(dry run) " + format
+	}
+	fmt.Fprintf(s.out, format+"\n", args...)
+}
+
+func (s *seeder) count(kind string) *seedCounts {
+	if s.counts[kind] == nil {
+		s.counts[kind] = &seedCounts{}
+	}
+	return s.counts[kind]
+}
+
+func (s *seeder) run(ctx context.Context, dataset *seeds.Dataset) error {
+	s.characterIDs = make(map[string]int64)
+	s.counts = make(map[string]*seedCounts)
+
+	err := validateDataset(dataset)
+	if err != nil {
+		return err
+	}
+
+	// The dataset is written in a single transaction, so a seed that fails
+	// part way leaves the database as it was.
+	models := s.models
+	defer func() { s.models = models }()
+
+	err = models.Transaction(ctx, func(models data.Models) error {
+		s.models = models
+		return s.seed(ctx, dataset)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(s.out, "seeded dataset version %d\n", dataset.Version)
+	for _, kind := range []string{"characters", "devil fruits", "crews", "crew members"} {
+		c := s.count(kind)
+		fmt.Fprintf(s.out, "%-13s %d created, %d updated, %d unchanged, %d deleted\n", kind+":", c.created, c.updated, c.unchanged, c.deleted)
+	}
+
+	return nil
+}
+
+// seed writes each record in the dataset through s.models.
+func (s *seeder) seed(ctx context.Context, dataset *seeds.Dataset) error {
+	for _, input := range dataset.Characters {
+		err := s.seedCharacter(ctx, input)
+		if err != nil {
+			return fmt.Errorf("character %q: %w", input.Name, err)
+		}
+	}
+
+	for _, input := range dataset.DevilFruits {
+		err := s.seedDevilFruit(ctx, input)
+		if err != nil {
+			return fmt.Errorf("devil fruit %q: %w", input.Name, err)
+		}
+	}
+
+	for _, input := range dataset.Crews {
+		err := s.seedCrew(ctx, input)
+		if err != nil {
+			return fmt.Errorf("crew %q: %w", input.Name, err)
+		}
+	}
+
+	if s.prune {
+		return s.pruneRecords(ctx, dataset)
+	}
+
+	return nil
+}
+
+// validateDataset runs every record through the same validators as the
+// handlers, and checks that relationships refer to characters in the dataset,
+// before anything is written.
+func validateDataset(dataset *seeds.Dataset) error {
+	var problems []string
+
+	report := func(kind, name string, v *validator.Validator) {
+		for field, message := range v.Errors {
+			problems = append(problems, fmt.Sprintf("%s %q: %s %s", kind, name, field, message))
+		}
+	}
+
+	characters := make(map[string]bool)
+
+	for _, input := range dataset.Characters {
+		v := validator.New()
+		data.ValidateCharacter(v, newSeedCharacter(input))
+		v.Check(!characters[input.Name], "name", "is listed more than once")
+		report("character", input.Name, v)
+
+		characters[input.Name] = true
+	}
+
+	devilFruits := make(map[string]bool)
+
+	for _, input := range dataset.DevilFruits {
+		v := validator.New()
+		data.ValidateDevilFruit(v, newSeedDevilFruit(input))
+		v.Check(!devilFruits[input.Name], "name", "is listed more than once")
+		v.Check(input.Owner == "" || characters[input.Owner], "owner", "must be a character in the dataset")
+		report("devil fruit", input.Name, v)
+
+		devilFruits[input.Name] = true
+	}
+
+	crews := make(map[string]bool)
+
+	for _, input := range dataset.Crews {
+		// The captain is checked by name here; the id is only known once
+		// characters have been written, so validate against a placeholder.
+		crew := newSeedCrew(input)
+		crew.CaptainID = 1
+
+		v := validator.New()
+		data.ValidateCrew(v, crew)
+		v.Check(!crews[input.Name], "name", "is listed more than once")
+		v.Check(characters[input.Captain], "captain", "must be a character in the dataset")
+		for _, member := range input.Members {
+			v.Check(characters[member], "members", fmt.Sprintf("%q must be a character in the dataset", member))
+		}
+		report("crew", input.Name, v)
+
+		crews[input.Name] = true
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return fmt.Errorf("invalid seed dataset:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+func newSeedCharacter(input seeds.Character) *data.Character {
+	return &data.Character{
+		Name:        input.Name,
+		Age:         input.Age,
+		Description: input.Description,
+		Origin:      input.Origin,
+		Bounty:      input.Bounty,
+		Race:        strings.ToLower(input.Race),
+		Episode:     input.Episode,
+	}
+}
+
+func newSeedDevilFruit(input seeds.DevilFruit) *data.DevilFruit {
+	previousOwners := input.PreviousOwners
+	if previousOwners == nil {
+		previousOwners = []string{}
+	}
+
+	return &data.DevilFruit{
+		Name:           input.Name,
+		Description:    input.Description,
+		Type:           strings.ToLower(input.Type),
+		PreviousOwners: previousOwners,
+		Episode:        input.Episode,
+	}
+}
+
+func newSeedCrew(input seeds.Crew) *data.Crew {
+	return &data.Crew{
+		Name:        input.Name,
+		Description: input.Description,
+		ShipName:    input.ShipName,
+		CaptainName: input.Captain,
+	}
+}
+
+func (s *seeder) seedCharacter(ctx context.Context, input seeds.Character) error {
+	want := newSeedCharacter(input)
+	counts := s.count("characters")
+
+	existing, err := s.models.Characters.GetByName(ctx, want.Name)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		s.logf("create character %q", want.Name)
+		counts.created++
+
+		if s.dryRun {
+			return nil
+		}
+
+		err = s.models.Characters.Insert(ctx, want)
+		if err != nil {
+			return err
+		}
+
+		s.characterIDs[want.Name] = want.ID
+		return nil
+	case err != nil:
+		return err
+	}
+
+	s.characterIDs[want.Name] = existing.ID
+
+	if existing.Age == want.Age &&
+		existing.Description == want.Description &&
+		existing.Origin == want.Origin &&
+		existing.Race == want.Race &&
+		existing.Episode == want.Episode &&
+		bountyEqual(existing.Bounty, want.Bounty) {
+		counts.unchanged++
+		return nil
+	}
+
+	s.logf("update character %q", want.Name)
+	counts.updated++
+
+	if s.dryRun {
+		return nil
+	}
+
+	want.ID = existing.ID
+	want.Version = existing.Version
+	return s.models.Characters.Update(ctx, want)
+}
+
+func bountyEqual(a, b *data.Berries) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (s *seeder) seedDevilFruit(ctx context.Context, input seeds.DevilFruit) error {
+	want := newSeedDevilFruit(input)
+	counts := s.count("devil fruits")
+
+	if input.Owner != "" {
+		want.Character_id = sql.NullInt64{Int64: s.characterIDs[input.Owner], Valid: true}
+		want.CurrentOwner = sql.NullString{String: input.Owner, Valid: true}
+	}
+
+	existing, err := s.models.DevilFruits.GetByName(ctx, want.Name)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		s.logf("create devil fruit %q", want.Name)
+		counts.created++
+
+		if s.dryRun {
+			return nil
+		}
+
+		return s.models.DevilFruits.Insert(ctx, want)
+	case err != nil:
+		return err
+	}
+
+	if existing.Description == want.Description &&
+		existing.Type == want.Type &&
+		existing.Episode == want.Episode &&
+		existing.Character_id == want.Character_id &&
+		existing.CurrentOwner == want.CurrentOwner &&
+		slices.Equal(existing.PreviousOwners, want.PreviousOwners) {
+		counts.unchanged++
+		return nil
+	}
+
+	s.logf("update devil fruit %q", want.Name)
+	counts.updated++
+
+	if s.dryRun {
+		return nil
+	}
+
+	want.ID = existing.ID
+	want.Version = existing.Version
+	return s.models.DevilFruits.Update(ctx, want)
+}
+
+func (s *seeder) seedCrew(ctx context.Context, input seeds.Crew) error {
+	want := newSeedCrew(input)
+	want.CaptainID = s.characterIDs[input.Captain]
+	counts := s.count("crews")
+
+	existing, err := s.models.Crews.GetByName(ctx, want.Name)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		s.logf("create crew %q", want.Name)
+		counts.created++
+
+		if !s.dryRun {
+			// As in createCrewHandler, the total bounty is built up by
+			// adding members, starting with the captain.
+			err = s.models.Crews.Insert(ctx, want)
+			if err != nil {
+				return err
+			}
+		}
+
+		return s.syncCrewMembers(ctx, want, input, map[int64]string{})
+	case err != nil:
+		return err
+	}
+
+	want.ID = existing.ID
+
+	if existing.Description == want.Description &&
+		existing.ShipName == want.ShipName &&
+		existing.CaptainID == want.CaptainID &&
+		existing.CaptainName == want.CaptainName {
+		counts.unchanged++
+	} else {
+		s.logf("update crew %q", want.Name)
+		counts.updated++
+
+		if !s.dryRun {
+			existing.Description = want.Description
+			existing.ShipName = want.ShipName
+
+			// As in updateCrewHandler, a new captain's bounty takes the place
+			// of the old one's in the crew total.
+			if existing.CaptainID != want.CaptainID {
+				captain, err := s.models.Characters.Get(ctx, want.CaptainID)
+				if err != nil {
+					return err
+				}
+
+				err = swapCaptain(ctx, s.models, existing, captain)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = s.models.Crews.Update(ctx, existing)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	current, err := s.crewMembers(ctx, existing.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.syncCrewMembers(ctx, want, input, current)
+}
+
+// syncCrewMembers adds the captain and listed members that are missing from
+// the crew and, when pruning, removes everyone else.
+func (s *seeder) syncCrewMembers(ctx context.Context, crew *data.Crew, input seeds.Crew, current map[int64]string) error {
+	counts := s.count("crew members")
+
+	wanted := append([]string{input.Captain}, input.Members...)
+	keep := make(map[int64]bool)
+
+	for _, name := range wanted {
+		id := s.characterIDs[name]
+
+		// In a dry run new characters have no id yet, so they can't
+		// already be members.
+		if _, ok := current[id]; ok && id != 0 {
+			keep[id] = true
+			counts.unchanged++
+			continue
+		}
+
+		s.logf("add %q to crew %q", name, crew.Name)
+		counts.created++
+
+		if s.dryRun {
+			continue
+		}
+
+		err := s.models.Crews.AddMember(ctx, crew.ID, id)
+		if err != nil {
+			return err
+		}
+		keep[id] = true
+	}
+
+	if !s.prune {
+		return nil
+	}
+
+	for id, name := range current {
+		if keep[id] {
+			continue
+		}
+
+		s.logf("remove %q from crew %q", name, crew.Name)
+		counts.deleted++
+
+		if s.dryRun {
+			continue
+		}
+
+		err := s.models.Crews.DeleteMember(ctx, crew.ID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seedPageSize is the largest page the list filters allow.
+const seedPageSize = 100
+
+func (s *seeder) crewMembers(ctx context.Context, crewID int64) (map[int64]string, error) {
+	page, err := allCrewMembers(ctx, s.models, crewID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[int64]string, len(page))
+	for _, member := range page {
+		members[member.ID] = member.Name
+	}
+
+	return members, nil
+}
+
+// pruneRecords deletes crews, devil fruits and characters whose names are not
+// in the dataset, in that order so nothing is left pointing at a deleted
+// character.
+func (s *seeder) pruneRecords(ctx context.Context, dataset *seeds.Dataset) error {
+	filters := data.Filters{PageSize: seedPageSize, Sort: "id", SortSafelist: []string{"id"}}
+
+	keepCrews := make(map[string]bool)
+	for _, crew := range dataset.Crews {
+		keepCrews[crew.Name] = true
+	}
+
+	var crews []*data.Crew
+	for filters.Page = 1; ; filters.Page++ {
+		page, _, err := s.models.Crews.GetAll(ctx, "", "", 0, filters)
+		if err != nil {
+			return err
+		}
+		crews = append(crews, page...)
+		if len(page) < seedPageSize {
+			break
+		}
+	}
+
+	for _, crew := range crews {
+		if keepCrews[crew.Name] {
+			continue
+		}
+
+		err := s.pruneOne(ctx, "crews", "crew", crew.Name, crew.ID, s.models.Crews.Delete)
+		if err != nil {
+			return err
+		}
+	}
+
+	keepDevilFruits := make(map[string]bool)
+	for _, devilFruit := range dataset.DevilFruits {
+		keepDevilFruits[devilFruit.Name] = true
+	}
+
+	var devilFruits []*data.DevilFruit
+	for filters.Page = 1; ; filters.Page++ {
+		page, _, err := s.models.DevilFruits.GetAll(ctx, "", "", filters)
+		if err != nil {
+			return err
+		}
+		devilFruits = append(devilFruits, page...)
+		if len(page) < seedPageSize {
+			break
+		}
+	}
+
+	for _, devilFruit := range devilFruits {
+		if keepDevilFruits[devilFruit.Name] {
+			continue
+		}
+
+		err := s.pruneOne(ctx, "devil fruits", "devil fruit", devilFruit.Name, devilFruit.ID, s.models.DevilFruits.Delete)
+		if err != nil {
+			return err
+		}
+	}
+
+	keepCharacters := make(map[string]bool)
+	for _, character := range dataset.Characters {
+		keepCharacters[character.Name] = true
+	}
+
+	var characters []*data.Character
+	for filters.Page = 1; ; filters.Page++ {
+		page, _, err := s.models.Characters.GetAll(ctx, "", 0, "", "", 0, filters)
+		if err != nil {
+			return err
+		}
+		characters = append(characters, page...)
+		if len(page) < seedPageSize {
+			break
+		}
+	}
+
+	for _, character := range characters {
+		if keepCharacters[character.Name] {
+			continue
+		}
+
+		err := s.pruneOne(ctx, "characters", "character", character.Name, character.ID, s.models.Characters.Delete)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *seeder) pruneOne(ctx context.Context, kind, noun, name string, id int64, del func(context.Context, int64) error) error {
+	s.logf("delete %s %q", noun, name)
+	s.count(kind).deleted++
+
+	if s.dryRun {
+		return nil
+	}
+
+	return del(ctx, id)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/seeds"
+)
+
+func TestSeedIsIdempotent(t *testing.T) {
+	dataset, err := seeds.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.NewMemoryModels()
+	ctx := context.Background()
+
+	var out bytes.Buffer
+
+	err = (&seeder{models: models, dryRun: true, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, metadata, err := models.Characters.GetAll(ctx, "", 0, "", "", 0, data.Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, metadata.TotalRecords, 0)
+
+	err = (&seeder{models: models, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crew, err := models.Crews.GetByName(ctx, "Straw Hat Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, crew.MemberCount, 10)
+
+	luffy, err := models.Characters.GetByName(ctx, "Monkey D. Luffy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, crew.CaptainID, luffy.ID)
+
+	out.Reset()
+	err = (&seeder{models: models, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "create ") || strings.Contains(out.String(), "update ") || strings.Contains(out.String(), "add ") {
+		t.Errorf("second run made changes:\n%s", out.String())
+	}
+}
+
+func TestSeedPrune(t *testing.T) {
+	dataset, err := seeds.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.NewMemoryModels()
+	ctx := context.Background()
+
+	var out bytes.Buffer
+
+	err = (&seeder{models: models, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := &data.Character{Name: "Alvida", Age: 25, Description: "Captain of the Alvida Pirates", Origin: "East Blue", Race: "human", Episode: 1}
+	err = models.Characters.Insert(ctx, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	heart, err := models.Crews.GetByName(ctx, "Heart Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Crews.AddMember(ctx, heart.ID, extra.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&seeder{models: models, prune: true, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = models.Characters.GetByName(ctx, "Alvida")
+	equal(t, err, data.ErrRecordNotFound)
+
+	heart, err = models.Crews.GetByName(ctx, "Heart Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, heart.MemberCount, 1)
+}
+
+func TestSeedNewCaptain(t *testing.T) {
+	dataset, err := seeds.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.NewMemoryModels()
+	ctx := context.Background()
+
+	var out bytes.Buffer
+
+	err = (&seeder{models: models, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := models.Crews.GetByName(ctx, "Straw Hat Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	luffy, err := models.Characters.GetByName(ctx, "Monkey D. Luffy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zoro, err := models.Characters.GetByName(ctx, "Roronoa Zoro")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range dataset.Crews {
+		if dataset.Crews[i].Name == "Straw Hat Pirates" {
+			dataset.Crews[i].Captain = zoro.Name
+		}
+	}
+
+	err = (&seeder{models: models, out: &out}).run(ctx, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := models.Crews.GetByName(ctx, "Straw Hat Pirates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	equal(t, after.CaptainID, zoro.ID)
+	equal(t, after.CaptainName, zoro.Name)
+	equal(t, after.MemberCount, before.MemberCount)
+	equal(t, after.TotalBounty, before.TotalBounty-*luffy.Bounty+*zoro.Bounty)
+}
+
+func TestSeedRejectsInvalidDataset(t *testing.T) {
+	dataset := &seeds.Dataset{
+		Version: 1,
+		Crews: []seeds.Crew{{
+			Name:        "Buggy Pirates",
+			Description: "A crew of circus performers",
+			ShipName:    "Big Top",
+			Captain:     "Buggy",
+		}},
+	}
+
+	err := (&seeder{models: data.NewMemoryModels(), out: &bytes.Buffer{}}).run(context.Background(), dataset)
+	if err == nil || !strings.Contains(err.Error(), `crew "Buggy Pirates": captain must be a character in the dataset`) {
+		t.Errorf("got error %v", err)
+	}
+}
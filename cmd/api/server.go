@@ -22,6 +22,24 @@ func (app *application) serve() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// Background jobs run until the server has shut down, so the last of
+	// what its requests queued up is written out before it exits.
+	jobs := app.startBackground()
+	defer jobs.stop()
+
+	// Streams never go idle on their own, so the hub disconnects them as
+	// soon as shutdown starts; otherwise Shutdown would wait them out.
+	streamCtx, stopStream := context.WithCancel(context.Background())
+	defer stopStream()
+
+	hub, streamDone, err := app.startChangeHub(streamCtx)
+	if err != nil {
+		return err
+	}
+	app.stream = hub
+
+	srv.RegisterOnShutdown(stopStream)
+
 	shutdownError := make(chan error)
 
 	go func() {
@@ -39,7 +57,7 @@ func (app *application) serve() error {
 
 	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -49,6 +67,9 @@ func (app *application) serve() error {
 		return err
 	}
 
+	jobs.stop()
+	<-streamDone
+
 	app.logger.Info("stopped server", "addr", srv.Addr)
 
 	return nil
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedHeaders returns the headers for a request made with token and signed
+// with secret, marshalling body the way doWithHeaders does.
+func signedHeaders(t *testing.T, token, secret, method, uri string, body any, signedAt time.Time, nonce string) map[string]string {
+	t.Helper()
+
+	var js []byte
+	if body != nil {
+		var err error
+		js, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return signedRawHeaders(token, secret, method, uri, js, signedAt, nonce)
+}
+
+// signedRawHeaders is signedHeaders for a body that's already been encoded.
+func signedRawHeaders(token, secret, method, uri string, body []byte, signedAt time.Time, nonce string) map[string]string {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+
+	return map[string]string{
+		"Authorization": "Bearer " + token,
+		timestampHeader: timestamp,
+		nonceHeader:     nonce,
+		signatureHeader: signRequest(secret, method, uri, timestamp, nonce, bodyHash[:]),
+	}
+}
+
+func TestRequestSigning(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+	app.config.auth.signatureSkew = 5 * time.Minute
+
+	apiKey := insertTestAPIKey(t, app, "news-coo", "characters:write")
+
+	secret, err := app.models.APIKeys.NewSigningSecret(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	character := map[string]any{
+		"name":        "Buggy",
+		"age":         39,
+		"description": "Captain of the Buggy Pirates",
+		"origin":      "Grand Line",
+		"race":        "human",
+		"bounty":      "15M berries",
+		"episode":     4,
+	}
+
+	headers := signedHeaders(t, "news-coo", secret, http.MethodPost, "/v1/characters", character, time.Now(), "first-edition-0001")
+
+	status, _ := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, headers)
+	equal(t, status, http.StatusCreated)
+
+	// The same request can't be made twice.
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, headers)
+	equal(t, status, http.StatusUnauthorized)
+	equal(t, response["error"], "invalid request signature: this request has already been made; sign each request with a new nonce")
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    any
+	}{
+		{"wrong secret", signedHeaders(t, "news-coo", "sigsec_forged", http.MethodPost, "/v1/characters", character, time.Now(), "forged-edition-01"), character},
+		{"altered body", signedHeaders(t, "news-coo", secret, http.MethodPost, "/v1/characters", character, time.Now(), "altered-edition-1"), map[string]any{"name": "Buggy"}},
+		{"too old", signedHeaders(t, "news-coo", secret, http.MethodPost, "/v1/characters", character, time.Now().Add(-time.Hour), "stale-edition-001"), character},
+		{"too new", signedHeaders(t, "news-coo", secret, http.MethodPost, "/v1/characters", character, time.Now().Add(time.Hour), "future-edition-01"), character},
+		{"short nonce", signedHeaders(t, "news-coo", secret, http.MethodPost, "/v1/characters", character, time.Now(), "short"), character},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", tt.body, tt.headers)
+			equal(t, status, http.StatusUnauthorized)
+		})
+	}
+
+	// Signing is optional for keys that don't require it.
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, "/v1/characters/999", nil, map[string]string{"Authorization": "Bearer news-coo"})
+	equal(t, status, http.StatusNotFound)
+}
+
+func TestRequireSigning(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+	app.config.auth.signatureSkew = 5 * time.Minute
+
+	insertTestAPIKey(t, app, "marine-hq", "admin")
+	legacy := insertTestAPIKey(t, app, "vegapunk", "characters:write", "characters:read")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	admin := map[string]string{"Authorization": "Bearer marine-hq"}
+
+	// Keys made before request signing have to be given a secret first.
+	status, response := ts.doWithHeaders(t, http.MethodPatch, fmt.Sprintf("/v1/admin/api-keys/%d", legacy.ID), map[string]any{"require_signing": true}, admin)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, response["error"].(map[string]any)["require_signing"], "needs a signing secret; issue one first")
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/admin/api-keys/%d/signing-secret", legacy.ID), nil, admin)
+	equal(t, status, http.StatusOK)
+	secret := response["signing_secret"].(string)
+
+	status, response = ts.doWithHeaders(t, http.MethodPatch, fmt.Sprintf("/v1/admin/api-keys/%d", legacy.ID), map[string]any{"require_signing": true}, admin)
+	equal(t, status, http.StatusOK)
+	equal(t, response["api_key"].(map[string]any)["require_signing"], true)
+	equal(t, response["api_key"].(map[string]any)["signing_secret"], nil)
+
+	// Reads needn't be signed, but writes must be.
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/trash", nil, map[string]string{"Authorization": "Bearer vegapunk"})
+	equal(t, status, http.StatusForbidden)
+
+	status, response = ts.doWithHeaders(t, http.MethodDelete, "/v1/characters/999", nil, map[string]string{"Authorization": "Bearer vegapunk"})
+	equal(t, status, http.StatusUnauthorized)
+	equal(t, response["error"], "invalid request signature: this API key must sign its write requests")
+
+	headers := signedHeaders(t, "vegapunk", secret, http.MethodDelete, "/v1/characters/999", nil, time.Now(), "egghead-lab-00001")
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, "/v1/characters/999", nil, headers)
+	equal(t, status, http.StatusNotFound)
+
+	// New keys come with a secret, which is only shown when they're made.
+	status, response = ts.doWithHeaders(t, http.MethodPost, "/v1/admin/api-keys", map[string]any{"name": "Stussy", "scopes": []string{"characters:write"}, "require_signing": true}, admin)
+	equal(t, status, http.StatusCreated)
+	equal(t, response["api_key"].(map[string]any)["require_signing"], true)
+
+	token := response["token"].(string)
+	secret = response["signing_secret"].(string)
+	id := int64(response["api_key"].(map[string]any)["id"].(float64))
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/admin/api-keys/%d", id), nil, admin)
+	equal(t, status, http.StatusOK)
+	equal(t, response["api_key"].(map[string]any)["signing_secret"], nil)
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, "/v1/characters/999", nil, signedHeaders(t, token, secret, http.MethodDelete, "/v1/characters/999", nil, time.Now(), "egghead-lab-00002"))
+	equal(t, status, http.StatusNotFound)
+
+	// A new secret replaces the old one straight away.
+	status, _ = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/admin/api-keys/%d/signing-secret", id), nil, admin)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, "/v1/characters/999", nil, signedHeaders(t, token, secret, http.MethodDelete, "/v1/characters/999", nil, time.Now(), "egghead-lab-00003"))
+	equal(t, status, http.StatusUnauthorized)
+}
+
+func TestRequireSigningWithoutAuth(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.signatureSkew = 5 * time.Minute
+
+	apiKey := insertTestAPIKey(t, app, "vegapunk", "characters:write")
+
+	secret, err := app.models.APIKeys.NewSigningSecret(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKey.RequireSigning = true
+
+	err = app.models.APIKeys.Update(context.Background(), apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Writes don't need a key with REQUIRE_AUTH off, but one made with a key
+	// that must sign is still turned away unsigned, rather than being
+	// recorded as the key's.
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", map[string]any{"name": "Buggy"}, map[string]string{"Authorization": "Bearer vegapunk"})
+	equal(t, status, http.StatusUnauthorized)
+	equal(t, response["error"], "invalid request signature: this API key must sign its write requests")
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, "/v1/characters/999", nil, signedHeaders(t, "vegapunk", secret, http.MethodDelete, "/v1/characters/999", nil, time.Now(), "egghead-lab-00004"))
+	equal(t, status, http.StatusNotFound)
+
+	status, _ = ts.do(t, http.MethodGet, "/v1/characters", nil)
+	equal(t, status, http.StatusOK)
+}
+
+func TestSignedBodyLimits(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.auth.required = true
+	app.config.auth.signatureSkew = 5 * time.Minute
+	app.config.imports.maxBytes = 4 * maxSignedBodyBytes
+
+	apiKey := insertTestAPIKey(t, app, "marine-hq", "admin")
+
+	secret, err := app.models.APIKeys.NewSigningSecret(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Signed bodies are capped at 1MB, rather than at IMPORT_MAX_BYTES...
+	character := map[string]any{"name": "Buggy", "description": strings.Repeat("a", maxSignedBodyBytes)}
+
+	status, _ := ts.doWithHeaders(t, http.MethodPost, "/v1/characters", character, signedHeaders(t, "marine-hq", secret, http.MethodPost, "/v1/characters", character, time.Now(), "impel-down-00001"))
+	equal(t, status, http.StatusRequestEntityTooLarge)
+
+	// ...except for imports, which are hashed on their way to disk.
+	csv := "name,age,description,origin,bounty,race,episode\n" +
+		"Monkey D. Luffy,19," + strings.Repeat("a", 2*maxSignedBodyBytes) + ",East Blue,3B berries,human,1\n"
+
+	postSigned := func(body, nonce string) (int, map[string]any) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/import/characters", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/csv")
+		for key, value := range signedRawHeaders("marine-hq", secret, http.MethodPost, "/v1/import/characters", []byte(body), time.Now(), nonce) {
+			req.Header.Set(key, value)
+		}
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var response map[string]any
+		err = json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res.StatusCode, response
+	}
+
+	status, response := postSigned(csv, "impel-down-00002")
+	equal(t, status, http.StatusOK)
+	equal(t, response["import"].(map[string]any)["rows"], any(1.0))
+
+	status, _ = postSigned(csv+strings.Repeat("\n", 3*maxSignedBodyBytes), "impel-down-00003")
+	equal(t, status, http.StatusRequestEntityTooLarge)
+}
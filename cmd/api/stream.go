@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+const (
+	// streamBacklog is how many changes a subscriber can fall behind by
+	// before it's dropped. Its client reconnects and catches up from the
+	// change feed with Last-Event-ID.
+	streamBacklog = 256
+
+	// streamPageSize is how many changes are read from the feed at a time.
+	streamPageSize = 500
+
+	// streamHeartbeat is how often an idle stream sends a comment, so
+	// proxies don't time it out.
+	streamHeartbeat = 15 * time.Second
+)
+
+// changeHub follows the change feed and fans new changes out to stream
+// subscribers. There's one per server, woken by a single LISTEN connection,
+// so each change is read once however many clients are connected.
+type changeHub struct {
+	models data.Models
+
+	mu          sync.Mutex
+	seq         int64 // the last change sent to subscribers
+	subscribers map[chan *data.Change]struct{}
+	closed      bool
+}
+
+// startChangeHub starts following the change feed from the latest change.
+// The hub runs until ctx is cancelled, then disconnects every subscriber.
+// done is closed once it has stopped.
+func (app *application) startChangeHub(ctx context.Context) (hub *changeHub, done <-chan struct{}, err error) {
+	listener, err := app.models.ListenForChanges(app.config.db.dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seq, err := app.models.Changes.Latest(ctx)
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+
+	hub = &changeHub{
+		models:      app.models,
+		seq:         seq,
+		subscribers: make(map[chan *data.Change]struct{}),
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer hub.close()
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-listener.Notify():
+				if !ok {
+					app.logger.Error("change listener stopped")
+					return
+				}
+
+				err := hub.catchUp(ctx)
+				if err != nil && ctx.Err() == nil {
+					app.logger.Error("reading changes for stream", "error", err.Error())
+				}
+			}
+		}
+	}()
+
+	return hub, stopped, nil
+}
+
+// catchUp sends subscribers every change since the last one they were sent.
+func (h *changeHub) catchUp(ctx context.Context) error {
+	for {
+		h.mu.Lock()
+		seq := h.seq
+		h.mu.Unlock()
+
+		changes, err := h.models.Changes.GetSince(ctx, seq, streamPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			h.broadcast(change)
+		}
+
+		if len(changes) < streamPageSize {
+			return nil
+		}
+	}
+}
+
+func (h *changeHub) broadcast(change *data.Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq = change.Seq
+
+	for changes := range h.subscribers {
+		select {
+		case changes <- change:
+		default:
+			delete(h.subscribers, changes)
+			close(changes)
+		}
+	}
+}
+
+// subscribe returns a channel of changes after seq, the last change the hub
+// has sent. The channel is closed if the subscriber falls too far behind or
+// the hub shuts down.
+func (h *changeHub) subscribe() (changes chan *data.Change, seq int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changes = make(chan *data.Change, streamBacklog)
+
+	if h.closed {
+		close(changes)
+		return changes, h.seq
+	}
+
+	h.subscribers[changes] = struct{}{}
+
+	return changes, h.seq
+}
+
+func (h *changeHub) unsubscribe(changes chan *data.Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[changes]; ok {
+		delete(h.subscribers, changes)
+		close(changes)
+	}
+}
+
+func (h *changeHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+
+	for changes := range h.subscribers {
+		delete(h.subscribers, changes)
+		close(changes)
+	}
+}
+
+// writeChangeEvent writes a change as a server-sent event. The id is the same
+// token /v1/changes uses, so either can pick up where the other left off.
+func writeChangeEvent(w io.Writer, change *data.Change) error {
+	js, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", encodeChangeToken(change.Seq), change.Event, js)
+	return err
+}
+
+func (app *application) streamHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Resource string
+		ID       int
+		Since    int64
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Resource = app.readString(qs, "resource", "")
+	input.ID = app.readInt(qs, "id", 0, v)
+
+	// EventSource sends Last-Event-ID when it reconnects. since is for the
+	// first connection, which can't set headers.
+	token := r.Header.Get("Last-Event-ID")
+	if token == "" {
+		token = app.readString(qs, "since", "")
+	}
+
+	resume := token != ""
+	if resume {
+		seq, err := decodeChangeToken(token)
+		if err != nil {
+			v.AddError("since", "must be an event id from a previous stream or a token from /v1/changes")
+		}
+		input.Since = seq
+	}
+
+	if input.Resource != "" {
+		v.Check(validator.PermittedValue(input.Resource, data.TrashResources...), "resource", "must be characters, devilfruits or crews")
+	}
+	v.Check(input.ID >= 0, "id", "must be a positive integer")
+	v.Check(input.ID == 0 || input.Resource != "", "id", "requires a resource")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if app.stream == nil {
+		app.errorResponse(w, r, http.StatusServiceUnavailable, "the change stream is not available")
+		return
+	}
+
+	wanted := func(change *data.Change) bool {
+		return (input.Resource == "" || change.Entity == input.Resource) &&
+			(input.ID == 0 || change.ID == int64(input.ID))
+	}
+
+	changes, seq := app.stream.subscribe()
+	defer app.stream.unsubscribe(changes)
+
+	// The stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(change *data.Change) bool {
+		err := writeChangeEvent(w, change)
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil
+	}
+
+	ping := func() bool {
+		_, err := io.WriteString(w, ": ping\n\n")
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil
+	}
+
+	if !ping() {
+		return
+	}
+
+	// Changes up to seq come from the feed; the hub sends the ones after.
+	for since := input.Since; resume && since < seq; {
+		backlog, err := app.models.Changes.GetSince(r.Context(), since, streamPageSize)
+		if err != nil {
+			if r.Context().Err() == nil {
+				app.logError(r, err)
+			}
+			return
+		}
+
+		if len(backlog) == 0 {
+			break
+		}
+
+		for _, change := range backlog {
+			since = change.Seq
+			if since > seq {
+				break
+			}
+			if wanted(change) && !send(change) {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			if wanted(change) && !send(change) {
+				return
+			}
+		case <-heartbeat.C:
+			if !ping() {
+				return
+			}
+		}
+	}
+}
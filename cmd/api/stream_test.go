@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamEvent is one server-sent event, with its data decoded.
+type streamEvent struct {
+	id    string
+	event string
+	data  map[string]any
+}
+
+// openStream connects to the change stream and returns its events as they
+// arrive.
+func openStream(t *testing.T, ts *testServer, path string, headers map[string]string) <-chan streamEvent {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, res.StatusCode, http.StatusOK)
+	equal(t, res.Header.Get("Content-Type"), "text/event-stream")
+
+	events := make(chan streamEvent)
+
+	go func() {
+		defer res.Body.Close()
+		defer close(events)
+
+		var event streamEvent
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				json.Unmarshal([]byte(value), &event.data)
+			case "":
+				if event.event != "" {
+					events <- event
+				}
+				event = streamEvent{}
+			}
+		}
+	}()
+
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan streamEvent) streamEvent {
+	t.Helper()
+
+	event, ok := <-events
+	if !ok {
+		t.Fatal("stream closed before the next event")
+	}
+
+	return event
+}
+
+func TestStream(t *testing.T) {
+	app := newTestApplication(t)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	hub, done, err := app.startChangeHub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.stream = hub
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	luffy := createTestCharacter(t, ts, "Monkey D. Luffy", 19, "1.5M berries")
+	zoro := createTestCharacter(t, ts, "Roronoa Zoro", 21, "60M berries")
+
+	// Resuming from the first event replays everything after it.
+	status, response := ts.do(t, http.MethodGet, "/v1/changes?limit=1", nil)
+	equal(t, status, http.StatusOK)
+
+	events := openStream(t, ts, "/v1/stream?resource=characters", map[string]string{"Last-Event-ID": response["next"].(string)})
+
+	event := nextEvent(t, events)
+	equal(t, event.event, "character.created")
+	equal(t, int64(event.data["id"].(float64)), zoro)
+
+	status, _ = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/characters/%d", luffy), map[string]any{"bounty": "30M berries"})
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.do(t, http.MethodPost, "/v1/crews", map[string]any{
+		"name":        "Straw Hat Pirates",
+		"description": "A pirate crew led by Monkey D. Luffy",
+		"captain_id":  luffy,
+		"ship_name":   "Going Merry",
+	})
+	equal(t, status, http.StatusCreated)
+
+	status, _ = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/characters/%d", zoro), map[string]any{"age": 19})
+	equal(t, status, http.StatusOK)
+
+	// The crew is filtered out.
+	event = nextEvent(t, events)
+	equal(t, event.event, "bounty.changed")
+	equal(t, event.data["data"].(map[string]any)["bounty"], "30M berries")
+
+	event = nextEvent(t, events)
+	equal(t, event.event, "character.updated")
+
+	// Shutting the hub down ends the stream.
+	stop()
+	<-done
+
+	if _, ok := <-events; ok {
+		t.Fatal("stream still open after shutdown")
+	}
+}
+
+func TestStreamValidation(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	status, _ := ts.do(t, http.MethodGet, "/v1/stream?id=1", nil)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, _ = ts.do(t, http.MethodGet, "/v1/stream?resource=bounties", nil)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/stream", nil, map[string]string{"Last-Event-ID": "???"})
+	equal(t, status, http.StatusUnprocessableEntity)
+}
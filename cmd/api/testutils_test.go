@@ -1,16 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/ratelimit"
 )
 
 func newTestApplication(t *testing.T) *application {
-	return &application{
-		logger: slog.New(slog.DiscardHandler),
+	app := &application{
+		logger:   slog.New(slog.DiscardHandler),
+		models:   data.NewMemoryModels(),
+		limiter:  ratelimit.NewMemory(),
+		usage:    newUsageRecorder(),
+		lastUsed: newLastUsedQueue(),
 	}
+
+	app.config.imports.maxBytes = 1_048_576
+	app.config.imports.timeout = time.Minute
+	app.config.exports.timeout = time.Minute
+	app.config.webhooks.timeout = 5 * time.Second
+	app.config.webhooks.retryBase = time.Minute
+	app.config.webhooks.maxAttempts = 3
+
+	return app
 }
 
 type testServer struct {
@@ -22,6 +43,57 @@ func newTestServer(t *testing.T, h http.Handler) *testServer {
 	return &testServer{ts}
 }
 
+// do sends a request with an optional JSON body and decodes the JSON response.
+func (ts *testServer) do(t *testing.T, method, urlPath string, body any) (int, map[string]any) {
+	t.Helper()
+
+	return ts.doWithHeaders(t, method, urlPath, body, nil)
+}
+
+// doWithHeaders is do with extra request headers.
+func (ts *testServer) doWithHeaders(t *testing.T, method, urlPath string, body any, headers map[string]string) (int, map[string]any) {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response map[string]any
+	if len(resBody) > 0 {
+		err = json.Unmarshal(resBody, &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return res.StatusCode, response
+}
+
 func equal[T comparable](t *testing.T, actual, expected T) {
 	t.Helper()
 
@@ -29,3 +101,22 @@ func equal[T comparable](t *testing.T, actual, expected T) {
 		t.Errorf("got :%v; want %v", actual, expected)
 	}
 }
+
+// insertTestAPIKey adds an active API key for token, with the admin scope
+// unless it's given others.
+func insertTestAPIKey(t *testing.T, app *application, token string, scopes ...string) *data.APIKey {
+	t.Helper()
+
+	if len(scopes) == 0 {
+		scopes = []string{data.ScopeAdmin}
+	}
+
+	apiKey := &data.APIKey{Name: token, KeyHash: data.HashAPIKey(token), Scopes: scopes, IsActive: true}
+
+	err := app.models.APIKeys.Insert(context.Background(), apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return apiKey
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+func (app *application) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Resource string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Resource = app.readString(qs, "resource", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	input.Filters.SortSafelist = []string{"deleted_at", "-deleted_at"}
+
+	if input.Resource != "" {
+		v.Check(validator.PermittedValue(input.Resource, data.TrashResources...), "resource", "must be characters, devilfruits or crews")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	records, metadata, err := app.models.Trash.GetAll(r.Context(), input.Resource, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.config.trash.retention > 0 {
+		for _, record := range records {
+			purgeAt := record.DeletedAt.Add(app.config.trash.retention)
+			record.PurgeAt = &purgeAt
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"trash": records, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeTrash permanently deletes everything that has been in the trash for
+// longer than the retention period.
+func (app *application) purgeTrash(ctx context.Context) error {
+	purged, err := app.models.Trash.Purge(ctx, time.Now().Add(-app.config.trash.retention))
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range data.TrashResources {
+		if purged[resource] > 0 {
+			app.logger.Info("purged trash", "resource", resource, "records", purged[resource])
+		}
+	}
+
+	return nil
+}
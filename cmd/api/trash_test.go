@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.trash.retention = 720 * time.Hour
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	luffy := createTestCharacter(t, ts, "Monkey D. Luffy", 19, "3B berries")
+	sanji := createTestCharacter(t, ts, "Vinsmoke Sanji", 21, "1B berries")
+
+	status, response := ts.do(t, http.MethodPost, "/v1/crews", map[string]any{
+		"name":        "Straw Hat Pirates",
+		"description": "A pirate crew led by Monkey D. Luffy",
+		"ship_name":   "Thousand Sunny",
+		"captain_id":  luffy,
+	})
+	equal(t, status, http.StatusCreated)
+	crewID := int64(response["crew"].(map[string]any)["id"].(float64))
+
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/crews/%d/members", crewID), map[string]any{"character_id": sanji})
+	equal(t, status, http.StatusNoContent)
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", sanji), nil)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/characters/%d", sanji), nil)
+	equal(t, status, http.StatusNotFound)
+
+	status, response = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/crews/%d", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	crew := response["crew"].(map[string]any)
+	equal(t, crew["total_bounty"], "3B berries")
+	equal(t, int(crew["member_count"].(float64)), 1)
+
+	status, response = ts.do(t, http.MethodGet, "/v1/trash", nil)
+	equal(t, status, http.StatusOK)
+
+	trash := response["trash"].([]any)
+	equal(t, len(trash), 1)
+
+	record := trash[0].(map[string]any)
+	equal(t, record["resource"], "characters")
+	equal(t, record["name"], "Vinsmoke Sanji")
+	if record["purge_at"] == nil {
+		t.Error("expected purge_at with a retention period set")
+	}
+
+	status, response = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/characters/%d/restore", sanji), nil)
+	equal(t, status, http.StatusOK)
+	equal(t, response["character"].(map[string]any)["name"], "Vinsmoke Sanji")
+
+	status, response = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/crews/%d", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	crew = response["crew"].(map[string]any)
+	equal(t, crew["total_bounty"], "4B berries")
+	equal(t, int(crew["member_count"].(float64)), 2)
+
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/characters/%d/restore", sanji), nil)
+	equal(t, status, http.StatusNotFound)
+}
+
+func TestRestoreNameTaken(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Jinbe", 46, "1.1B berries")
+
+	status, _ := ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", id), nil)
+	equal(t, status, http.StatusOK)
+
+	// The trashed character no longer holds on to its name.
+	createTestCharacter(t, ts, "Jinbe", 46, "")
+
+	status, response := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/characters/%d/restore", id), nil)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, response["error"].(map[string]any)["name"], "a character with this name already exists")
+}
+
+func TestPurgeTrash(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	id := createTestCharacter(t, ts, "Nefertari Vivi", 18, "")
+
+	status, response := ts.do(t, http.MethodPost, "/v1/devilfruits", map[string]any{
+		"name":         "Test Test no Mi",
+		"description":  "A fruit that exists only for testing",
+		"type":         "paramecia",
+		"character_id": id,
+		"episode":      1,
+	})
+	equal(t, status, http.StatusCreated)
+	fruitID := int64(response["devilfruit"].(map[string]any)["id"].(float64))
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", id), nil)
+	equal(t, status, http.StatusOK)
+
+	// Nothing has been in the trash for an hour yet.
+	app.config.trash.retention = time.Hour
+
+	err := app.purgeTrash(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response = ts.do(t, http.MethodGet, "/v1/trash?resource=characters", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["trash"].([]any)), 1)
+
+	app.config.trash.retention = -time.Minute
+
+	err = app.purgeTrash(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response = ts.do(t, http.MethodGet, "/v1/trash", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["trash"].([]any)), 0)
+
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/characters/%d/restore", id), nil)
+	equal(t, status, http.StatusNotFound)
+
+	status, response = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/devilfruits/%d", fruitID), nil)
+	equal(t, status, http.StatusOK)
+	equal(t, response["devilfruit"].(map[string]any)["character_id"], nil)
+
+	status, response = ts.do(t, http.MethodGet, "/v1/trash?resource=pirates", nil)
+	equal(t, status, http.StatusUnprocessableEntity)
+}
+
+func TestPurgeTrashedCaptain(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	buggy := createTestCharacter(t, ts, "Buggy", 39, "3.1B berries")
+
+	status, response := ts.do(t, http.MethodPost, "/v1/crews", map[string]any{
+		"name":        "Buggy Pirates",
+		"description": "A crew of circus performers",
+		"ship_name":   "Big Top",
+		"captain_id":  buggy,
+	})
+	equal(t, status, http.StatusCreated)
+	crewID := int64(response["crew"].(map[string]any)["id"].(float64))
+
+	// A captain can't be trashed while their crew is out of the trash.
+	status, response = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", buggy), nil)
+	equal(t, status, http.StatusConflict)
+	equal(t, response["error"], "this character captains a crew; give the crew a new captain first")
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/crews/%d", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/characters/%d", buggy), nil)
+	equal(t, status, http.StatusOK)
+
+	// With the crew back, its captain stays in the trash when it's purged.
+	status, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/crews/%d/restore", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	app.config.trash.retention = -time.Minute
+
+	err := app.purgeTrash(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response = ts.do(t, http.MethodGet, "/v1/trash?resource=characters", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["trash"].([]any)), 1)
+
+	status, response = ts.do(t, http.MethodGet, "/v1/crews", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, response["crews"].([]any)[0].(map[string]any)["captain_id"], any(float64(buggy)))
+
+	// Once the crew is purged too, so is its captain.
+	status, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/crews/%d", crewID), nil)
+	equal(t, status, http.StatusOK)
+
+	err = app.purgeTrash(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response = ts.do(t, http.MethodGet, "/v1/trash", nil)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["trash"].([]any)), 0)
+
+	status, _ = ts.do(t, http.MethodGet, "/v1/crews", nil)
+	equal(t, status, http.StatusOK)
+}
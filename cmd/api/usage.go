@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxPendingUsage is how many key, route and hour combinations the usage
+// recorder holds before it asks to be flushed early.
+const maxPendingUsage = 10_000
+
+// usageRecorder adds up API usage in memory until it's flushed, so counting
+// a request costs a map update rather than a database write.
+type usageRecorder struct {
+	mu      sync.Mutex
+	pending map[usageBucket]*data.Usage
+	full    chan struct{}
+}
+
+type usageBucket struct {
+	apiKeyID int64
+	hour     time.Time
+	route    string
+}
+
+func newUsageRecorder() *usageRecorder {
+	return &usageRecorder{
+		pending: make(map[usageBucket]*data.Usage),
+		full:    make(chan struct{}, 1),
+	}
+}
+
+// record counts one request made with an API key at the given time.
+func (u *usageRecorder) record(apiKeyID int64, route string, at time.Time, status int, latency time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	bucket := usageBucket{apiKeyID, at.UTC().Truncate(time.Hour), route}
+
+	usage, ok := u.pending[bucket]
+	if !ok {
+		usage = &data.Usage{APIKeyID: apiKeyID, Hour: bucket.hour, Route: route}
+		u.pending[bucket] = usage
+	}
+
+	usage.Add(status, latency)
+
+	if len(u.pending) >= maxPendingUsage {
+		select {
+		case u.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take empties the recorder, returning what it held.
+func (u *usageRecorder) take() []*data.Usage {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[usageBucket]*data.Usage)
+	u.mu.Unlock()
+
+	usage := make([]*data.Usage, 0, len(pending))
+	for _, counts := range pending {
+		usage = append(usage, counts)
+	}
+
+	return usage
+}
+
+// flushUsage writes out the usage recorded since the last flush. If that
+// fails the batch is dropped, so a database outage can't fill up memory.
+func (app *application) flushUsage(ctx context.Context) error {
+	return app.models.Usage.Record(ctx, app.usage.take())
+}
+
+// routePattern names the route a request matched, such as
+// GET /v1/characters/:id, so usage is counted per endpoint rather than per
+// record. Requests that matched no route are counted under the method and *.
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return r.Method + " *"
+	}
+
+	// Parameters come in the order they appear in the path.
+	segments := strings.Split(r.URL.Path, "/")
+
+	i := 0
+	for _, param := range params {
+		for ; i < len(segments); i++ {
+			if segments[i] == param.Value {
+				segments[i] = ":" + param.Key
+				break
+			}
+		}
+	}
+
+	return r.Method + " " + strings.Join(segments, "/")
+}
+
+// readUsageRange reads the from and to query parameters, which default to
+// the last 24 hours.
+func (app *application) readUsageRange(r *http.Request, v *validator.Validator) (time.Time, time.Time) {
+	qs := r.URL.Query()
+
+	to := app.readTime(qs, "to", time.Now(), v)
+	from := app.readTime(qs, "from", to.Add(-24*time.Hour), v)
+
+	v.Check(from.Before(to), "from", "must be before to")
+	v.Check(to.Sub(from) <= 90*24*time.Hour, "to", "must be no more than 90 days after from")
+
+	return from, to
+}
+
+// listUsageHandler reports how each API key has used the API, route by route
+// and hour by hour.
+func (app *application) listUsageHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	apiKeyID := app.readInt(r.URL.Query(), "key_id", 0, v)
+	v.Check(apiKeyID >= 0, "key_id", "must be a positive integer")
+
+	from, to := app.readUsageRange(r, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	usage, err := app.models.Usage.GetAll(r.Context(), int64(apiKeyID), from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"usage": usage, "from": from, "to": to}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// quotaUsage is how much of its quota a key has used this period.
+type quotaUsage struct {
+	Limit     int64     `json:"limit"`
+	Period    string    `json:"period"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// showMyUsageHandler tells the client the limits its API key is held to, how
+// much of its quota it has used and what requests it has made, route by route
+// and hour by hour. A null rate limit or quota means there isn't one.
+func (app *application) showMyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	apiKey := app.contextGetAPIKey(r)
+
+	v := validator.New()
+
+	from, to := app.readUsageRange(r, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	history, err := app.models.Usage.GetAll(r.Context(), apiKey.ID, from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	rateLimit := apiKey.RateLimit
+	if rateLimit == nil && app.config.limiter.enabled {
+		rateLimit = &data.RateLimit{RPS: app.config.limiter.rps, Burst: app.config.limiter.burst}
+	}
+
+	var quota *quotaUsage
+
+	if apiKey.Quota != nil {
+		now := time.Now()
+
+		used, err := app.models.APIKeys.QuotaUsage(r.Context(), apiKey.ID, apiKey.Quota.PeriodStart(now))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		quota = &quotaUsage{
+			Limit:     apiKey.Quota.Limit,
+			Period:    apiKey.Quota.Period,
+			Used:      used,
+			Remaining: max(0, apiKey.Quota.Limit-used),
+			ResetsAt:  apiKey.Quota.PeriodEnd(now),
+		}
+	}
+
+	usage := envelope{
+		"api_key_id": apiKey.ID,
+		"rate_limit": rateLimit,
+		"quota":      quota,
+		"from":       from,
+		"to":         to,
+		"history":    history,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"usage": usage}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
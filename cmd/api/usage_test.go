@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRoutePattern(t *testing.T) {
+	router := httprouter.New()
+	router.HandlerFunc(http.MethodGet, "/v1/characters/:id", func(http.ResponseWriter, *http.Request) {})
+	router.HandlerFunc(http.MethodGet, "/v1/characters/:id/revisions/:revision/diff/:other", func(http.ResponseWriter, *http.Request) {})
+
+	tests := []struct {
+		method, path, expected string
+	}{
+		{http.MethodGet, "/v1/characters/12", "GET /v1/characters/:id"},
+		{http.MethodGet, "/v1/characters/12/revisions/1/diff/12", "GET /v1/characters/:id/revisions/:revision/diff/:other"},
+		{http.MethodPost, "/v1/characters/12", "POST *"},
+		{http.MethodGet, "/v1/sea-kings", "GET *"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		equal(t, routePattern(router, r), tt.expected)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertTestAPIKey(t, app, "marine-hq")
+	newsCoo := insertTestAPIKey(t, app, "news-coo", "characters:read")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	admin := map[string]string{"Authorization": "Bearer marine-hq"}
+	auth := map[string]string{"Authorization": "Bearer news-coo"}
+
+	id := createTestCharacter(t, ts, "Buggy", 39, "15M berries")
+
+	for _, path := range []string{"/v1/characters", fmt.Sprintf("/v1/characters/%d", id), "/v1/characters/999"} {
+		status, _ := ts.doWithHeaders(t, http.MethodGet, path, nil, auth)
+		if status != http.StatusOK && status != http.StatusNotFound {
+			t.Fatalf("GET %s: got status %d", path, status)
+		}
+	}
+
+	// Anonymous requests aren't counted.
+	status, _ := ts.do(t, http.MethodGet, "/v1/characters", nil)
+	equal(t, status, http.StatusOK)
+
+	err := app.flushUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response := ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/admin/usage?key_id=%d", newsCoo.ID), nil, admin)
+	equal(t, status, http.StatusOK)
+
+	usage := response["usage"].([]any)
+	equal(t, len(usage), 2)
+
+	list := usage[0].(map[string]any)
+	equal(t, list["route"], "GET /v1/characters")
+	equal(t, int(list["requests"].(float64)), 1)
+
+	show := usage[1].(map[string]any)
+	equal(t, show["route"], "GET /v1/characters/:id")
+	equal(t, int(show["requests"].(float64)), 2)
+	equal(t, int(show["statuses"].(map[string]any)["2xx"].(float64)), 1)
+	equal(t, int(show["statuses"].(map[string]any)["4xx"].(float64)), 1)
+
+	hour, err := time.Parse(time.RFC3339, show["hour"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, hour, time.Now().UTC().Truncate(time.Hour))
+
+	// A key sees its own history, up to the last flush.
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/me/usage", nil, auth)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["usage"].(map[string]any)["history"].([]any)), 2)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/admin/usage?from=2025-01-02T00:00:00Z&to=2025-01-01T00:00:00Z", nil, admin)
+	equal(t, status, http.StatusUnprocessableEntity)
+	equal(t, response["error"].(map[string]any)["from"], "must be before to")
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, "/v1/admin/usage", nil, auth)
+	equal(t, status, http.StatusForbidden)
+}
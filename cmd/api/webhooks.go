@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+	"github.com/05blue04/Poneglyph/internal/validator"
+)
+
+const (
+	// webhookBatchSize is how many deliveries are claimed and sent at once.
+	webhookBatchSize = 20
+
+	// maxWebhookBackoff caps the wait between attempts.
+	maxWebhookBackoff = 6 * time.Hour
+)
+
+// webhookLease is how long a claimed delivery is left alone before it's
+// assumed lost and sent again; comfortably longer than an attempt can take.
+func (app *application) webhookLease() time.Duration {
+	return app.config.webhooks.timeout + 30*time.Second
+}
+
+// webhookBackoff is the wait before the next attempt after attempts failed
+// ones: the retry base, doubling each time.
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxWebhookBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxWebhookBackoff)
+}
+
+// signWebhook signs a delivery for the X-Poneglyph-Signature header. The
+// timestamp is signed along with the body so a captured delivery can't be
+// replayed later.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// errPrivateAddress is returned for webhook URLs that resolve to addresses
+// on the server's own network.
+var errPrivateAddress = errors.New("webhook address is loopback, link-local, private or unspecified")
+
+// isPublicAddr reports whether addr is one webhooks may be sent to. Without
+// this, anyone with an API key could have the server send requests to itself,
+// its cloud metadata service or other hosts on its network.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsPrivate() &&
+		!addr.IsUnspecified()
+}
+
+// checkWebhookURL resolves a webhook URL's host and makes sure every address
+// it has is public, unless WEBHOOK_ALLOW_PRIVATE is set.
+func (app *application) checkWebhookURL(ctx context.Context, rawURL string) error {
+	if app.config.webhooks.allowPrivate {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return errPrivateAddress
+		}
+	}
+
+	return nil
+}
+
+// webhookDialer connects to receivers. The address is checked again as the
+// connection is made, since the host may resolve differently than it did
+// when the webhook was registered.
+func (app *application) webhookDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: app.config.webhooks.timeout}
+
+	if !app.config.webhooks.allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	return dialer
+}
+
+// postWebhook makes one attempt at a delivery, returning the response status
+// if there was one. Anything but a 2xx is a failure.
+func (app *application) postWebhook(ctx context.Context, delivery *data.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, app.config.webhooks.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Poneglyph-Webhooks/"+version)
+	req.Header.Set("X-Poneglyph-Event", delivery.Event)
+	req.Header.Set("X-Poneglyph-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Poneglyph-Timestamp", timestamp)
+	req.Header.Set("X-Poneglyph-Signature", signWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	// Deliveries go straight to the receiver rather than through a proxy,
+	// so it's the receiver's address the dialer checks.
+	transport := &http.Transport{
+		DialContext:         app.webhookDialer().DialContext,
+		TLSHandshakeTimeout: app.config.webhooks.timeout,
+		DisableKeepAlives:   true,
+	}
+
+	// Redirects aren't followed, so a delivery only ever goes to the URL
+	// that was registered.
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded with %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// sendWebhook attempts a delivery and records how it went, scheduling a
+// retry or giving up once it's out of attempts.
+func (app *application) sendWebhook(ctx context.Context, delivery *data.WebhookDelivery) {
+	status, err := app.postWebhook(ctx, delivery)
+
+	// An attempt cut short by shutdown doesn't count. The delivery is sent
+	// again once its lease runs out.
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+
+	delivery.Attempts++
+	delivery.ResponseStatus = nil
+	if status != 0 {
+		delivery.ResponseStatus = &status
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = data.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= app.config.webhooks.maxAttempts:
+		delivery.Status = data.DeliveryFailed
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = nil
+	default:
+		nextAttemptAt := now.Add(webhookBackoff(app.config.webhooks.retryBase, delivery.Attempts))
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+
+	app.logger.Info("webhook delivery",
+		"delivery_id", delivery.ID,
+		"webhook_id", delivery.WebhookID,
+		"event", delivery.Event,
+		"attempt", delivery.Attempts,
+		"status", delivery.Status,
+		"response_status", status,
+		"error", delivery.LastError,
+	)
+
+	err = app.models.Webhooks.UpdateDelivery(ctx, delivery)
+	if err != nil {
+		app.logger.Error("recording webhook delivery", "delivery_id", delivery.ID, "error", err.Error())
+	}
+}
+
+// deliverWebhooks sends every delivery that's due.
+func (app *application) deliverWebhooks(ctx context.Context) error {
+	for {
+		deliveries, err := app.models.Webhooks.ClaimDeliveries(ctx, webhookBatchSize, app.webhookLease())
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Go(func() {
+				app.sendWebhook(ctx, delivery)
+			})
+		}
+		wg.Wait()
+
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// getOwnWebhook reads a webhook belonging to the request's API key. It
+// responds itself and returns nil if there's no such webhook.
+func (app *application) getOwnWebhook(w http.ResponseWriter, r *http.Request) *data.Webhook {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	apiKey := app.contextGetAPIKey(r)
+
+	webhook, err := app.models.Webhooks.Get(r.Context(), id, apiKey.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return webhook
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL       string   `json:"url"`
+		Resources []string `json:"resources"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		APIKeyID:  app.contextGetAPIKey(r).ID,
+		URL:       input.URL,
+		Resources: input.Resources,
+		Secret:    "whsec_" + rand.Text(),
+	}
+
+	if webhook.Resources == nil {
+		webhook.Resources = []string{}
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.checkWebhookURL(r.Context(), webhook.URL)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPrivateAddress):
+			v.AddError("url", "must not point to a loopback, link-local, private or unspecified address")
+		default:
+			v.AddError("url", "must have a host that can be resolved")
+		}
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(r.Context(), webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(r.Context(), app.contextGetAPIKey(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := app.getOwnWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(r.Context(), id, app.contextGetAPIKey(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// testWebhookHandler sends a ping to a webhook straight away and reports how
+// it went. A failed ping is retried like any other delivery.
+func (app *application) testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := app.getOwnWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	delivery, err := app.models.Webhooks.Ping(r.Context(), webhook.ID, app.webhookLease())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendWebhook(r.Context(), delivery)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "-id"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhook := app.getOwnWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(r.Context(), webhook.ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
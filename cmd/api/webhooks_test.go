@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+)
+
+// receivedWebhook is a delivery as a receiver saw it.
+type receivedWebhook struct {
+	event   string
+	payload map[string]any
+	valid   bool
+}
+
+// webhookReceiver is a local endpoint that checks signatures and answers
+// with status.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	secret   string
+	status   int
+	received []receivedWebhook
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	wr := &webhookReceiver{status: http.StatusNoContent}
+
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+
+		webhook := receivedWebhook{
+			event: r.Header.Get("X-Poneglyph-Event"),
+			valid: r.Header.Get("X-Poneglyph-Signature") == signWebhook(wr.secret, r.Header.Get("X-Poneglyph-Timestamp"), body),
+		}
+		json.Unmarshal(body, &webhook.payload)
+
+		wr.received = append(wr.received, webhook)
+
+		w.WriteHeader(wr.status)
+	}))
+	t.Cleanup(wr.Close)
+
+	return wr
+}
+
+func (wr *webhookReceiver) take() []receivedWebhook {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	received := wr.received
+	wr.received = nil
+
+	return received
+}
+
+func TestWebhooks(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.webhooks.allowPrivate = true
+
+	insertTestAPIKey(t, app, "going-merry")
+	insertTestAPIKey(t, app, "thousand-sunny")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	receiver := newWebhookReceiver(t)
+
+	auth := map[string]string{"Authorization": "Bearer going-merry"}
+	otherAuth := map[string]string{"Authorization": "Bearer thousand-sunny"}
+
+	status, _ := ts.do(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": receiver.URL})
+	equal(t, status, http.StatusUnauthorized)
+
+	status, _ = ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": "ftp://example.com", "resources": []string{"bounties"}}, auth)
+	equal(t, status, http.StatusUnprocessableEntity)
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": receiver.URL, "resources": []string{"characters"}}, auth)
+	equal(t, status, http.StatusCreated)
+
+	webhook := response["webhook"].(map[string]any)
+	receiver.secret = webhook["secret"].(string)
+	path := fmt.Sprintf("/v1/webhooks/%d", int64(webhook["id"].(float64)))
+
+	// Only the owner can see it, and never the secret again.
+	status, response = ts.doWithHeaders(t, http.MethodGet, path, nil, auth)
+	equal(t, status, http.StatusOK)
+	equal(t, response["webhook"].(map[string]any)["secret"], nil)
+
+	status, _ = ts.doWithHeaders(t, http.MethodGet, path, nil, otherAuth)
+	equal(t, status, http.StatusNotFound)
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, path+"/test", nil, auth)
+	equal(t, status, http.StatusOK)
+
+	delivery := response["delivery"].(map[string]any)
+	equal(t, delivery["status"], data.DeliveryDelivered)
+	equal(t, int(delivery["response_status"].(float64)), http.StatusNoContent)
+
+	received := receiver.take()
+	equal(t, len(received), 1)
+	equal(t, received[0].event, data.EventPing)
+	equal(t, received[0].valid, true)
+
+	createTestCharacter(t, ts, "Nico Robin", 28, "79M berries")
+
+	status, _ = ts.do(t, http.MethodPost, "/v1/crews", map[string]any{
+		"name":        "Baroque Works",
+		"description": "A secret criminal organisation",
+		"captain_id":  1,
+		"ship_name":   "Unnamed",
+	})
+	equal(t, status, http.StatusCreated)
+
+	err := app.deliverWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The crew isn't one of the webhook's resources.
+	received = receiver.take()
+	equal(t, len(received), 1)
+	equal(t, received[0].event, "character.created")
+	equal(t, received[0].payload["data"].(map[string]any)["name"], "Nico Robin")
+	equal(t, received[0].valid, true)
+
+	// A failed delivery is logged and put off for a retry.
+	receiver.mu.Lock()
+	receiver.status = http.StatusServiceUnavailable
+	receiver.mu.Unlock()
+
+	status, _ = ts.do(t, http.MethodPatch, "/v1/characters/1", map[string]any{"age": 30})
+	equal(t, status, http.StatusOK)
+
+	err = app.deliverWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(receiver.take()), 1)
+
+	err = app.deliverWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(receiver.take()), 0)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, path+"/deliveries", nil, auth)
+	equal(t, status, http.StatusOK)
+
+	deliveries := response["deliveries"].([]any)
+	equal(t, len(deliveries), 3)
+
+	retry := deliveries[0].(map[string]any)
+	equal(t, retry["status"], data.DeliveryPending)
+	equal(t, int(retry["attempts"].(float64)), 1)
+	equal(t, int(retry["response_status"].(float64)), http.StatusServiceUnavailable)
+	equal(t, retry["last_error"], "receiver responded with 503")
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, path, nil, otherAuth)
+	equal(t, status, http.StatusNotFound)
+
+	status, _ = ts.doWithHeaders(t, http.MethodDelete, path, nil, auth)
+	equal(t, status, http.StatusOK)
+
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/webhooks", nil, auth)
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["webhooks"].([]any)), 0)
+}
+
+func TestWebhookKeyRotation(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.webhooks.allowPrivate = true
+	app.config.auth.rotationGrace = time.Hour
+
+	insertTestAPIKey(t, app, "marine-hq", "admin")
+	apiKey := insertTestAPIKey(t, app, "going-merry")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	receiver := newWebhookReceiver(t)
+
+	status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": receiver.URL}, map[string]string{"Authorization": "Bearer going-merry"})
+	equal(t, status, http.StatusCreated)
+	receiver.secret = response["webhook"].(map[string]any)["secret"].(string)
+
+	status, response = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/admin/api-keys/%d/rotate", apiKey.ID), nil, map[string]string{"Authorization": "Bearer marine-hq"})
+	equal(t, status, http.StatusCreated)
+	token := response["token"].(string)
+
+	// The webhook belongs to the new key now, and outlives the old one.
+	status, response = ts.doWithHeaders(t, http.MethodGet, "/v1/webhooks", nil, map[string]string{"Authorization": "Bearer " + token})
+	equal(t, status, http.StatusOK)
+	equal(t, len(response["webhooks"].([]any)), 1)
+
+	err := app.models.APIKeys.Delete(context.Background(), apiKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestCharacter(t, ts, "Nico Robin", 28, "79M berries")
+
+	err = app.deliverWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := receiver.take()
+	equal(t, len(received), 1)
+	equal(t, received[0].event, "character.created")
+	equal(t, received[0].valid, true)
+}
+
+func TestWebhookExpiredKey(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.webhooks.allowPrivate = true
+
+	apiKey := insertTestAPIKey(t, app, "going-merry")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	receiver := newWebhookReceiver(t)
+
+	status, _ := ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": receiver.URL}, map[string]string{"Authorization": "Bearer going-merry"})
+	equal(t, status, http.StatusCreated)
+
+	// Once the key expires, its webhooks stop being sent changes.
+	expiresAt := time.Now().Add(-time.Minute)
+	apiKey.ExpiresAt = &expiresAt
+
+	err := app.models.APIKeys.Update(context.Background(), apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestCharacter(t, ts, "Nico Robin", 28, "79M berries")
+
+	err = app.deliverWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, len(receiver.take()), 0)
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertTestAPIKey(t, app, "going-merry")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	receiver := newWebhookReceiver(t)
+
+	auth := map[string]string{"Authorization": "Bearer going-merry"}
+
+	for _, url := range []string{receiver.URL, "http://169.254.169.254/latest/meta-data", "http://10.0.0.1/hooks", "http://[::1]:8080/", "http://0.0.0.0/"} {
+		status, response := ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", map[string]any{"url": url}, auth)
+		equal(t, status, http.StatusUnprocessableEntity)
+		equal(t, response["error"].(map[string]any)["url"], "must not point to a loopback, link-local, private or unspecified address")
+	}
+
+	// Deliveries are checked as they're sent too, in case the host has
+	// started resolving somewhere else since.
+	_, err := app.postWebhook(context.Background(), &data.WebhookDelivery{URL: receiver.URL, Event: data.EventPing})
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("got %v; want %v", err, errPrivateAddress)
+	}
+	equal(t, len(receiver.take()), 0)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     string
+	}{
+		{1, "30s"},
+		{2, "1m0s"},
+		{4, "4m0s"},
+		{20, "6h0m0s"},
+	}
+
+	for _, tt := range tests {
+		got := webhookBackoff(30*time.Second, tt.attempts)
+		equal(t, got.String(), tt.want)
+	}
+}
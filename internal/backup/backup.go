@@ -0,0 +1,208 @@
+// Package backup defines the archive written by `api backup` and read by
+// `api restore`.
+//
+// An archive is a single JSON document describing every record by its
+// original id, independent of how the tables that held it were laid out.
+// Archives are gzip-compressed when written to a file ending in .gz; Read
+// accepts either form.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Format identifies a Poneglyph archive, and FormatVersion the layout of this
+// file itself. The layout of the data is described by the schema version.
+const (
+	Format        = "poneglyph-backup"
+	FormatVersion = 1
+)
+
+var ErrNotArchive = errors.New("not a poneglyph backup archive")
+
+type Archive struct {
+	Format        string    `json:"format"`
+	FormatVersion int       `json:"format_version"`
+	SchemaVersion int64     `json:"schema_version"`
+	AppVersion    string    `json:"app_version"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	Characters  []Character  `json:"characters"`
+	DevilFruits []DevilFruit `json:"devil_fruits"`
+	Crews       []Crew       `json:"crews"`
+	CrewMembers []CrewMember `json:"crew_members"`
+	APIKeys     []APIKey     `json:"api_keys"`
+	Webhooks    []Webhook    `json:"webhooks"`
+}
+
+// Character bounties are stored in berries rather than the API's rounded
+// "1.1B berries" strings, so nothing is lost in a round trip.
+type Character struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `json:"name"`
+	Age         int       `json:"age"`
+	Description string    `json:"description"`
+	Origin      string    `json:"origin"`
+	Bounty      *int64    `json:"bounty"`
+	Race        string    `json:"race"`
+	Episode     int       `json:"episode"`
+}
+
+type DevilFruit struct {
+	ID             int64     `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	Type           string    `json:"type"`
+	CharacterID    *int64    `json:"character_id"`
+	PreviousOwners []string  `json:"previous_owners"`
+	Episode        int       `json:"episode"`
+}
+
+// Crew totals and member counts aren't stored; they follow from the
+// memberships.
+type Crew struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	ShipName    string    `json:"ship_name"`
+	CaptainID   int64     `json:"captain_id"`
+}
+
+type CrewMember struct {
+	CrewID      int64 `json:"crew_id"`
+	CharacterID int64 `json:"character_id"`
+}
+
+// APIKey holds a key's metadata and the SHA-256 hash used to look it up,
+// which lets restored keys keep working. The keys themselves are never
+// stored anywhere, so they can't be archived. Archives made before keys had
+// scopes have none, and those keys are restored as admin keys.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	KeyHash    string     `json:"key_hash"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	IsActive   bool       `json:"is_active"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RateLimit  *RateLimit `json:"rate_limit,omitempty"`
+	Quota      *Quota     `json:"quota,omitempty"`
+
+	// A rotated key keeps the id of the key that replaced it, so a key in
+	// its grace period is restored as one.
+	ReplacedBy *int64     `json:"replaced_by,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+
+	// SigningSecret has to be archived as it is, unlike the key, for signed
+	// requests to keep being accepted.
+	SigningSecret  string `json:"signing_secret,omitempty"`
+	RequireSigning bool   `json:"require_signing,omitempty"`
+}
+
+// RateLimit and Quota are a key's own limits, for keys that have them.
+type RateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+type Quota struct {
+	Limit  int64  `json:"limit"`
+	Period string `json:"period"`
+}
+
+// Webhook is an endpoint registered by one of the archived keys. Its secret
+// is archived as it is, so receivers can keep checking signatures after a
+// restore. Deliveries, sent or not, aren't archived.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	APIKeyID  int64     `json:"api_key_id"`
+	URL       string    `json:"url"`
+	Resources []string  `json:"resources"`
+	Secret    string    `json:"secret"`
+}
+
+// New returns an empty archive stamped with the given schema and app
+// versions.
+func New(schemaVersion int64, appVersion string) *Archive {
+	return &Archive{
+		Format:        Format,
+		FormatVersion: FormatVersion,
+		SchemaVersion: schemaVersion,
+		AppVersion:    appVersion,
+		CreatedAt:     time.Now().UTC(),
+		Characters:    []Character{},
+		DevilFruits:   []DevilFruit{},
+		Crews:         []Crew{},
+		CrewMembers:   []CrewMember{},
+		APIKeys:       []APIKey{},
+	}
+}
+
+// Write encodes the archive to w, gzip-compressed if compress is set.
+func Write(w io.Writer, archive *Archive, compress bool) error {
+	if !compress {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(archive)
+	}
+
+	zw := gzip.NewWriter(w)
+
+	err := json.NewEncoder(zw).Encode(archive)
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// Read decodes an archive written by Write, compressed or not, and checks
+// that this binary understands its layout.
+func Read(r io.Reader) (*Archive, error) {
+	br := bufio.NewReader(r)
+
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		r = zr
+	} else {
+		r = br
+	}
+
+	var archive Archive
+
+	err := json.NewDecoder(r).Decode(&archive)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotArchive, err)
+	}
+
+	if archive.Format != Format {
+		return nil, ErrNotArchive
+	}
+
+	if archive.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("archive format version %d is newer than this binary supports (%d)", archive.FormatVersion, FormatVersion)
+	}
+
+	return &archive, nil
+}
@@ -2,44 +2,318 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/05blue04/Poneglyph/internal/validator"
+	"github.com/lib/pq"
 )
 
+// ScopeAdmin grants every other scope.
+const ScopeAdmin = "admin"
+
+// Scopes are the permissions an API key can be given. A write scope grants
+// the read scope of the same name.
+var Scopes = []string{
+	"characters:read", "characters:write",
+	"devilfruits:read", "devilfruits:write",
+	"crews:read", "crews:write",
+	"trash:read",
+	"audit:read",
+	"metrics:read",
+	"webhooks:read", "webhooks:write",
+	ScopeAdmin,
+}
+
 type APIKey struct {
 	ID         int64      `json:"id"`
-	CreatedAt  time.Time  `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
 	UpdatedAt  time.Time  `json:"-"`
 	Name       string     `json:"name"`
 	KeyHash    string     `json:"-"`
 	IsActive   bool       `json:"is_active"`
+	Scopes     []string   `json:"scopes"`
 	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
 	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ReplacedBy *int64     `json:"replaced_by,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RateLimit  *RateLimit `json:"rate_limit,omitempty"`
+	Quota      *Quota     `json:"quota,omitempty"`
+
+	// SigningSecret signs the key's requests, for clients that sign them.
+	// Like the key itself, it's only shown when it's made.
+	SigningSecret  string `json:"-"`
+	RequireSigning bool   `json:"require_signing"`
+}
+
+// RateLimit overrides the default token bucket for one key. Keys without one
+// get LIMITER_RPS and LIMITER_BURST.
+type RateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// Quota periods. Periods are calendar days and months in UTC.
+const (
+	QuotaDaily   = "day"
+	QuotaMonthly = "month"
+)
+
+// Quota caps how many requests a key can make in a day or a month.
+type Quota struct {
+	Limit  int64  `json:"limit"`
+	Period string `json:"period"`
+}
+
+// PeriodStart returns the start of the quota period t falls in.
+func (q *Quota) PeriodStart(t time.Time) time.Time {
+	t = t.UTC()
+
+	if q.Period == QuotaMonthly {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// PeriodEnd returns when the quota period t falls in is over.
+func (q *Quota) PeriodEnd(t time.Time) time.Time {
+	start := q.PeriodStart(t)
+
+	if q.Period == QuotaMonthly {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// ErrKeyInactive is returned when rotating a key that has been revoked, has
+// expired or has already been rotated.
+var ErrKeyInactive = errors.New("api key is no longer active")
+
+// ErrNonceUsed is returned when recording the nonce of a signed request that
+// has been made before.
+var ErrNonceUsed = errors.New("nonce has already been used")
+
+// ErrQuotaExceeded is returned when counting a request that a key's quota
+// has no room left for.
+var ErrQuotaExceeded = errors.New("api key quota exceeded")
+
+func (k *APIKey) expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// Rotated reports whether the key has been replaced, and is only still
+// working for the rest of its grace period.
+func (k *APIKey) Rotated() bool {
+	return k.RotatedAt != nil
+}
+
+// HasScope reports whether the key has been granted scope, directly or
+// through admin or the matching write scope.
+func (k *APIKey) HasScope(scope string) bool {
+	return HasScope(k.Scopes, scope)
+}
+
+// HasScope reports whether scopes grant scope, directly or through admin or
+// the matching write scope.
+func HasScope(scopes []string, scope string) bool {
+	if slices.Contains(scopes, ScopeAdmin) || slices.Contains(scopes, scope) {
+		return true
+	}
+
+	if area, ok := strings.CutSuffix(scope, ":read"); ok {
+		return slices.Contains(scopes, area+":write")
+	}
+
+	return false
+}
+
+// HashAPIKey returns the hash a key is stored and looked up by. Keys are
+// random, so a plain SHA-256 is enough.
+func HashAPIKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateAPIKey makes a new key for apiKey, setting its hash and a fresh
+// signing secret, and returns the key itself, which is never stored.
+func generateAPIKey(apiKey *APIKey) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	token := hex.EncodeToString(b)
+	apiKey.KeyHash = HashAPIKey(token)
+	apiKey.SigningSecret = generateSigningSecret()
+
+	return token
+}
+
+func generateSigningSecret() string {
+	return "sigsec_" + rand.Text()
+}
+
+func ValidateAPIKey(v *validator.Validator, apiKey *APIKey) {
+	v.Check(apiKey.Name != "", "name", "must be provided")
+	v.Check(len(apiKey.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	ValidateScopes(v, apiKey.Scopes)
+
+	if apiKey.RateLimit != nil {
+		v.Check(apiKey.RateLimit.RPS > 0, "rate_limit", "rps must be greater than zero")
+		v.Check(apiKey.RateLimit.Burst >= 1, "rate_limit", "burst must be at least 1")
+	}
+
+	if apiKey.Quota != nil {
+		v.Check(apiKey.Quota.Limit >= 1, "quota", "limit must be at least 1")
+		v.Check(validator.PermittedValue(apiKey.Quota.Period, QuotaDaily, QuotaMonthly), "quota", "period must be day or month")
+	}
+}
+
+func ValidateScopes(v *validator.Validator, scopes []string) {
+	v.Check(len(scopes) > 0, "scopes", "must contain at least 1 scope")
+
+	for _, scope := range scopes {
+		v.Check(validator.PermittedValue(scope, Scopes...), "scopes", "must only contain known scopes: "+strings.Join(Scopes, ", "))
+	}
+	v.Check(validator.Unique(scopes), "scopes", "must not contain duplicate values")
 }
 
 type APIKeyModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Timeouts Timeouts
 }
 
-func (m APIKeyModel) GetByHash(hash string) (*APIKey, error) {
-	query := `
-        SELECT id, name, is_active, expires_at
-        FROM api_keys
-        WHERE key_hash = $1 AND is_active = true
-    `
+// apiKeyColumns are the columns scanAPIKey reads, in order.
+const apiKeyColumns = `id, created_at, updated_at, name, key_hash, is_active, scopes, last_used_at, expires_at,
+	replaced_by, rotated_at, rate_limit_rps, rate_limit_burst, quota_limit, quota_period, signing_secret, require_signing`
 
-	var apiKey APIKey
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+func scanAPIKey(scan func(dest ...any) error) (*APIKey, error) {
+	var (
+		apiKey      APIKey
+		rps         sql.NullFloat64
+		burst       sql.NullInt32
+		quotaLimit  sql.NullInt64
+		quotaPeriod sql.NullString
+	)
 
-	err := m.DB.QueryRowContext(ctx, query, hash).Scan(
+	err := scan(
 		&apiKey.ID,
+		&apiKey.CreatedAt,
+		&apiKey.UpdatedAt,
 		&apiKey.Name,
+		&apiKey.KeyHash,
 		&apiKey.IsActive,
+		pq.Array(&apiKey.Scopes),
+		&apiKey.LastUsedAt,
 		&apiKey.ExpiresAt,
+		&apiKey.ReplacedBy,
+		&apiKey.RotatedAt,
+		&rps,
+		&burst,
+		&quotaLimit,
+		&quotaPeriod,
+		&apiKey.SigningSecret,
+		&apiKey.RequireSigning,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if rps.Valid {
+		apiKey.RateLimit = &RateLimit{RPS: rps.Float64, Burst: int(burst.Int32)}
+	}
+	if quotaLimit.Valid {
+		apiKey.Quota = &Quota{Limit: quotaLimit.Int64, Period: quotaPeriod.String}
+	}
+
+	return &apiKey, nil
+}
+
+// limitArgs returns the rate limit and quota columns to store, which are null
+// for a key that doesn't have them.
+func (k *APIKey) limitArgs() []any {
+	args := []any{nil, nil, nil, nil}
+
+	if k.RateLimit != nil {
+		args[0], args[1] = k.RateLimit.RPS, k.RateLimit.Burst
+	}
+	if k.Quota != nil {
+		args[2], args[3] = k.Quota.Limit, k.Quota.Period
+	}
 
+	return args
+}
+
+func (m APIKeyModel) Insert(ctx context.Context, apiKey *APIKey) error {
+	query := `
+		INSERT INTO api_keys (name, key_hash, is_active, scopes, expires_at, rate_limit_rps, rate_limit_burst, quota_limit, quota_period,
+			signing_secret, require_signing, replaced_by, rotated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id, created_at, updated_at
+	`
+
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+
+	args := []any{apiKey.Name, apiKey.KeyHash, apiKey.IsActive, pq.Array(apiKey.Scopes), apiKey.ExpiresAt}
+	args = append(args, apiKey.limitArgs()...)
+	args = append(args, apiKey.SigningSecret, apiKey.RequireSigning, apiKey.ReplacedBy, apiKey.RotatedAt)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&apiKey.ID, &apiKey.CreatedAt, &apiKey.UpdatedAt)
+}
+
+// Create generates a new key, stores it and returns the key itself. This is
+// the only time it can be read.
+func (m APIKeyModel) Create(ctx context.Context, apiKey *APIKey) (string, error) {
+	token := generateAPIKey(apiKey)
+
+	err := m.Insert(ctx, apiKey)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (m APIKeyModel) Get(ctx context.Context, id int64) (*APIKey, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	apiKey, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, id).Scan)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return apiKey, nil
+}
+
+func (m APIKeyModel) GetByHash(ctx context.Context, hash string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1 AND is_active = true`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	apiKey, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, hash).Scan)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -49,18 +323,278 @@ func (m APIKeyModel) GetByHash(hash string) (*APIKey, error) {
 		}
 	}
 
-	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+	if apiKey.expired() {
 		return nil, ErrRecordNotFound
 	}
 
-	return &apiKey, nil
+	return apiKey, nil
 }
 
-func (m APIKeyModel) UpdateLastUsed(id int64) error {
-	query := `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Update saves a key's name, scopes, expiry, limits, whether it must sign
+// its requests and whether it's active.
+func (m APIKeyModel) Update(ctx context.Context, apiKey *APIKey) error {
+	query := `
+		UPDATE api_keys
+		SET name = $1, scopes = $2, is_active = $3, expires_at = $4,
+			rate_limit_rps = $5, rate_limit_burst = $6, quota_limit = $7, quota_period = $8,
+			require_signing = $9, updated_at = now()
+		WHERE id = $10
+		RETURNING updated_at
+	`
+
+	args := []any{apiKey.Name, pq.Array(apiKey.Scopes), apiKey.IsActive, apiKey.ExpiresAt}
+	args = append(args, apiKey.limitArgs()...)
+	args = append(args, apiKey.RequireSigning, apiKey.ID)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&apiKey.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// successor returns the key that replaces k when it's rotated.
+func (k *APIKey) successor() *APIKey {
+	return &APIKey{
+		Name:      k.Name,
+		Scopes:    slices.Clone(k.Scopes),
+		IsActive:  true,
+		ExpiresAt: k.ExpiresAt,
+		RateLimit: k.RateLimit,
+		Quota:     k.Quota,
+
+		RequireSigning: k.RequireSigning,
+	}
+}
+
+// Rotate replaces a key with a new one that has the same name, scopes,
+// expiry, limits and signing requirement, returning the new key and its
+// token. The new key has a signing secret of its own, and takes over the old
+// key's webhooks. The old key keeps working for grace, or until it was due to
+// expire if that's sooner.
+func (m APIKeyModel) Rotate(ctx context.Context, id int64, grace time.Duration) (*APIKey, string, error) {
+	var (
+		successor *APIKey
+		token     string
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	err := inTx(ctx, m.DB, func(tx DBTX) error {
+		query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = $1 FOR UPDATE`
+
+		current, err := scanAPIKey(tx.QueryRowContext(ctx, query, id).Scan)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		if !current.IsActive || current.expired() || current.Rotated() {
+			return ErrKeyInactive
+		}
+
+		successor = current.successor()
+
+		token, err = APIKeyModel{DB: tx, Timeouts: m.Timeouts}.Create(ctx, successor)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE api_keys
+			SET replaced_by = $1, rotated_at = now(), updated_at = now(),
+				expires_at = LEAST(expires_at, now() + make_interval(secs => $2))
+			WHERE id = $3`
+
+		_, err = tx.ExecContext(ctx, query, successor.ID, grace.Seconds(), id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE webhooks SET api_key_id = $1 WHERE api_key_id = $2`, successor.ID, id)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return successor, token, nil
+}
+
+// Delete removes a key for good, along with its webhooks. Audit entries keep
+// the key's id.
+func (m APIKeyModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM api_keys WHERE id = $1`
+
+	return execOne(ctx, m.DB, m.Timeouts.Write, query, id)
+}
+
+// UpdateLastUsed records when each of a batch of keys was last used. A time
+// older than the one already recorded is ignored, and keys that have since
+// been deleted are skipped.
+func (m APIKeyModel) UpdateLastUsed(ctx context.Context, lastUsed map[int64]time.Time) error {
+	if len(lastUsed) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(lastUsed))
+	usedAt := make([]int64, 0, len(lastUsed))
+
+	for id, at := range lastUsed {
+		ids = append(ids, id)
+		usedAt = append(usedAt, at.Unix())
+	}
+
+	query := `
+		UPDATE api_keys k
+		SET last_used_at = GREATEST(k.last_used_at, to_timestamp(b.used_at))
+		FROM unnest($1::bigint[], $2::bigint[]) AS b (id, used_at)
+		WHERE k.id = b.id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids), pq.Array(usedAt))
+	return err
+}
+
+// NewSigningSecret replaces a key's signing secret with a new one and returns
+// it. This is the only time it can be read.
+func (m APIKeyModel) NewSigningSecret(ctx context.Context, id int64) (string, error) {
+	if id < 1 {
+		return "", ErrRecordNotFound
+	}
+
+	secret := generateSigningSecret()
+
+	query := `UPDATE api_keys SET signing_secret = $1, updated_at = now() WHERE id = $2`
+
+	err := execOne(ctx, m.DB, m.Timeouts.Write, query, secret, id)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// UseNonce records the nonce of a signed request, until expiresAt, and
+// returns ErrNonceUsed if the key has already made a request with it.
+func (m APIKeyModel) UseNonce(ctx context.Context, id int64, nonce string, expiresAt time.Time) error {
+	// A nonce that has expired but not yet been purged can be used again.
+	query := `
+		INSERT INTO request_nonces AS n (api_key_id, nonce, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (api_key_id, nonce) DO UPDATE SET expires_at = excluded.expires_at
+		WHERE n.expires_at <= now()`
+
+	err := execOne(ctx, m.DB, m.Timeouts.Write, query, id, nonce, expiresAt)
+	if errors.Is(err, ErrRecordNotFound) {
+		return ErrNonceUsed
+	}
+
+	return err
+}
+
+// PurgeNonces forgets nonces that expired before t.
+func (m APIKeyModel) PurgeNonces(ctx context.Context, t time.Time) error {
+	query := `DELETE FROM request_nonces WHERE expires_at < $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	_, err := m.DB.ExecContext(ctx, query, t)
 	return err
 }
+
+// CountRequest counts a request against a key's quota for the period
+// starting at periodStart, returning how many the key has made in that period
+// so far. Once it has made limit requests, it returns ErrQuotaExceeded and
+// counts nothing.
+func (m APIKeyModel) CountRequest(ctx context.Context, id int64, periodStart time.Time, limit int64) (int64, error) {
+	query := `
+		INSERT INTO api_key_quota_usage AS u (api_key_id, period_start, requests)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (api_key_id, period_start) DO UPDATE SET requests = u.requests + 1
+		WHERE u.requests < $3
+		RETURNING requests`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	var requests int64
+
+	err := m.DB.QueryRowContext(ctx, query, id, periodStart, limit).Scan(&requests)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrQuotaExceeded
+		default:
+			return 0, err
+		}
+	}
+
+	return requests, nil
+}
+
+// QuotaUsage returns how many requests a key has made in the period starting
+// at periodStart.
+func (m APIKeyModel) QuotaUsage(ctx context.Context, id int64, periodStart time.Time) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM(requests), 0)
+		FROM api_key_quota_usage
+		WHERE api_key_id = $1 AND period_start = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	var requests int64
+
+	err := m.DB.QueryRowContext(ctx, query, id, periodStart).Scan(&requests)
+	return requests, err
+}
+
+// GetAll returns every API key, including inactive and expired ones, in the
+// order they were created.
+func (m APIKeyModel) GetAll(ctx context.Context) ([]*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiKeys := []*APIKey{}
+
+	for rows.Next() {
+		apiKey, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, rows.Err()
+}
@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Audit log actions.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+)
+
+// AuditEntities are the entities that appear in the audit log. Crew
+// memberships are logged against the crew's id.
+var AuditEntities = []string{"characters", "devilfruits", "crews", "crew_members"}
+
+// AuditEntry records one change to one record: who made it, through which
+// route and what the record looked like before and after.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	APIKeyID  *int64          `json:"api_key_id"`
+	Subject   string          `json:"subject,omitempty"`
+	IP        string          `json:"ip"`
+	Route     string          `json:"route"`
+	RequestID string          `json:"request_id"`
+	Entity    string          `json:"entity"`
+	EntityID  int64           `json:"entity_id"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+}
+
+// CrewMembership is what the audit log records for crew_members changes.
+type CrewMembership struct {
+	CrewID      int64 `json:"crew_id"`
+	CharacterID int64 `json:"character_id"`
+}
+
+// Actor is who is behind the changes made with a context. The models copy it
+// into every audit entry they write; changes made without one, such as by
+// the seed command, are logged anonymously.
+type Actor struct {
+	APIKeyID  *int64
+	Subject   string // the sub claim of the JWT the request was made with
+	IP        string
+	Route     string
+	RequestID string
+}
+
+type actorContextKey struct{}
+
+// ContextWithActor returns a copy of ctx that attributes changes to actor.
+func ContextWithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by ContextWithActor, or the zero
+// Actor if there isn't one.
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorContextKey{}).(Actor)
+	return actor
+}
+
+// newAuditEntry builds the entry for a change made by the actor in ctx.
+// before is nil for creates and after is nil for deletes.
+func newAuditEntry(ctx context.Context, entity string, id int64, action string, before, after any) (*AuditEntry, error) {
+	actor := ActorFromContext(ctx)
+
+	entry := &AuditEntry{
+		APIKeyID:  actor.APIKeyID,
+		Subject:   actor.Subject,
+		IP:        actor.IP,
+		Route:     actor.Route,
+		RequestID: actor.RequestID,
+		Entity:    entity,
+		EntityID:  id,
+		Action:    action,
+	}
+
+	var err error
+
+	if before != nil {
+		entry.Before, err = json.Marshal(before)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if after != nil {
+		entry.After, err = json.Marshal(after)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// audit appends a change to the audit log. Callers run it in the same
+// transaction as the change, so one is never kept without the other.
+func audit(ctx context.Context, db DBTX, timeout time.Duration, entity string, id int64, action string, before, after any) error {
+	entry, err := newAuditEntry(ctx, entity, id, action, before, after)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_log (api_key_id, subject, ip, route, request_id, entity, entity_id, action, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	args := []any{
+		entry.APIKeyID,
+		entry.Subject,
+		entry.IP,
+		entry.Route,
+		entry.RequestID,
+		entry.Entity,
+		entry.EntityID,
+		entry.Action,
+		jsonValue(entry.Before),
+		jsonValue(entry.After),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// jsonValue passes a JSON document to a jsonb parameter, with nil as NULL.
+func jsonValue(js json.RawMessage) any {
+	if js == nil {
+		return nil
+	}
+	return string(js)
+}
+
+type AuditModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+// GetAll lists audit entries, optionally narrowed down to one entity, one
+// record of it and the API key that made the change.
+func (m AuditModel) GetAll(ctx context.Context, entity string, entityID, apiKeyID int64, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, api_key_id, subject, ip, route, request_id, entity, entity_id, action, before, after
+		FROM audit_log
+		WHERE (entity = $1 OR $1 = '')
+		AND (entity_id = $2 OR $2 = 0)
+		AND (api_key_id = $3 OR $3 = 0)
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, entity, entityID, apiKeyID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var (
+			entry         AuditEntry
+			before, after []byte
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.APIKeyID,
+			&entry.Subject,
+			&entry.IP,
+			&entry.Route,
+			&entry.RequestID,
+			&entry.Entity,
+			&entry.EntityID,
+			&entry.Action,
+			&before,
+			&after,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entry.Before = before
+		entry.After = after
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return entries, metadata, nil
+}
@@ -74,3 +74,12 @@ func (b *Berries) UnmarshalJSON(jsonValue []byte) error {
 
 	return nil
 }
+
+// sameBounty reports whether two optional bounties are equal, treating two
+// missing bounties as the same.
+func sameBounty(a, b *Berries) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
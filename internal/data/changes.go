@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Change feed actions. A restore appears as a create, since that is what it
+// looks like to a client that saw the delete.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// Events name a change more precisely than its action, for the live stream.
+// Most are the entity and what happened to it, such as character.updated or
+// crew.restored; these are the exceptions.
+const (
+	EventBountyChanged     = "bounty.changed"
+	EventCrewMemberAdded   = "crew.member_added"
+	EventCrewMemberRemoved = "crew.member_removed"
+)
+
+// eventName builds an event such as character.created from an entity and a
+// past-tense verb.
+func eventName(entity, verb string) string {
+	return strings.TrimSuffix(entity, "s") + "." + verb
+}
+
+// Change is one entry in the change feed. Deletes are tombstones: Data is
+// null and only the entity and id say what went away.
+type Change struct {
+	Seq       int64           `json:"-"`
+	Entity    string          `json:"entity"`
+	ID        int64           `json:"id"`
+	Action    string          `json:"action"`
+	Event     string          `json:"event"`
+	ChangedAt time.Time       `json:"changed_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// changeChannel is the Postgres notification channel each change is
+// announced on once it commits.
+const changeChannel = "changes"
+
+// changeFeedLock is the advisory lock key that serialises writes to the
+// change feed. Sequence numbers are handed out as rows are inserted, not as
+// transactions commit, so without it a reader could see seq 11 before a
+// slower transaction commits seq 10, and skip 10 for good.
+const changeFeedLock = 0x706f6e65676c7970 // "poneglyp"
+
+// recordChange appends a change to the feed. record is nil for deletes.
+// Callers run it in the same transaction as the change, as late as possible,
+// since it holds the feed lock until the transaction ends.
+func recordChange(ctx context.Context, db DBTX, timeout time.Duration, entity string, id int64, action string, record any) error {
+	return recordEvent(ctx, db, timeout, entity, id, action, eventName(entity, action+"d"), record)
+}
+
+// recordEvent is recordChange for changes that have their own event.
+func recordEvent(ctx context.Context, db DBTX, timeout time.Duration, entity string, id int64, action, event string, record any) error {
+	var js json.RawMessage
+
+	if record != nil {
+		var err error
+
+		js, err = json.Marshal(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(changeFeedLock))
+	if err != nil {
+		return err
+	}
+
+	// Notifications are only delivered on commit, and in commit order. The
+	// change is queued for every webhook that wants it at the same time, so
+	// a webhook hears about exactly the changes that commit.
+	query := `
+		WITH inserted AS (
+			INSERT INTO changes (entity, entity_id, action, event, data)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING seq, entity, entity_id, action, event, created_at, data
+		), queued AS (
+			INSERT INTO webhook_deliveries (webhook_id, event, payload)
+			SELECT w.id, i.event, jsonb_build_object(
+				'entity', i.entity, 'id', i.entity_id, 'action', i.action,
+				'event', i.event, 'changed_at', i.created_at, 'data', i.data)
+			FROM inserted i
+			INNER JOIN webhooks w ON cardinality(w.resources) = 0 OR i.entity = ANY(w.resources)
+			INNER JOIN api_keys k ON k.id = w.api_key_id AND k.is_active
+				AND (k.expires_at IS NULL OR k.expires_at > now())
+		)
+		SELECT pg_notify($6, seq::text) FROM inserted`
+
+	_, err = db.ExecContext(ctx, query, entity, id, action, event, jsonValue(js), changeChannel)
+	return err
+}
+
+type ChangeModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+// GetSince returns up to limit changes made after the one numbered since, in
+// the order they were made.
+func (m ChangeModel) GetSince(ctx context.Context, since int64, limit int) ([]*Change, error) {
+	query := `
+		SELECT seq, entity, entity_id, action, event, created_at, data
+		FROM changes
+		WHERE seq > $1
+		ORDER BY seq ASC
+		LIMIT $2
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*Change{}
+
+	for rows.Next() {
+		var (
+			change Change
+			js     []byte
+		)
+
+		err := rows.Scan(&change.Seq, &change.Entity, &change.ID, &change.Action, &change.Event, &change.ChangedAt, &js)
+		if err != nil {
+			return nil, err
+		}
+
+		change.Data = js
+
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Latest returns the number of the most recent change, or 0 if there are
+// none.
+func (m ChangeModel) Latest(ctx context.Context) (int64, error) {
+	query := `SELECT COALESCE(MAX(seq), 0) FROM changes`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	var seq int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&seq)
+	return seq, err
+}
+
+// ChangeListener wakes up readers of the change feed when there may be new
+// changes. Notifications carry nothing, and several changes can share one,
+// so readers go back to the feed for what's new.
+type ChangeListener interface {
+	Notify() <-chan struct{}
+	Close() error
+}
+
+// ListenForChanges starts listening for changes. Postgres-backed models
+// open a dedicated connection to dsn with LISTEN; in-memory models ignore it.
+func (m Models) ListenForChanges(dsn string) (ChangeListener, error) {
+	if changes, ok := m.Changes.(memoryChangeModel); ok {
+		return changes.listen(), nil
+	}
+
+	listener := pq.NewListener(dsn, time.Second, time.Minute, nil)
+
+	err := listener.Listen(changeChannel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	pl := &pgChangeListener{listener: listener, notify: make(chan struct{}, 1)}
+
+	go pl.run()
+
+	return pl, nil
+}
+
+type pgChangeListener struct {
+	listener *pq.Listener
+	notify   chan struct{}
+}
+
+func (pl *pgChangeListener) run() {
+	defer close(pl.notify)
+
+	// The listener sends nil after reconnecting, when notifications may
+	// have been missed, so that wakes readers too. Pinging now and then
+	// notices a dead connection that would otherwise go quiet.
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case _, ok := <-pl.listener.Notify:
+			if !ok {
+				return
+			}
+			wake(pl.notify)
+		case <-ticker.C:
+			go pl.listener.Ping()
+		}
+	}
+}
+
+func (pl *pgChangeListener) Notify() <-chan struct{} {
+	return pl.notify
+}
+
+func (pl *pgChangeListener) Close() error {
+	return pl.listener.Close()
+}
+
+// wake sends on a notification channel without blocking. A pending
+// notification already covers whatever happened since.
+func wake(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
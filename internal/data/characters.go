@@ -14,8 +14,9 @@ import (
 
 type Character struct {
 	ID          int64     `json:"id"`
-	CreatedAt   time.Time `json:"-"`
-	UpdatedAt   time.Time `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Version     int32     `json:"version"`
 	Name        string    `json:"name"`
 	Age         int       `json:"age"`
 	Description string    `json:"description"`
@@ -26,7 +27,8 @@ type Character struct {
 }
 
 type CharacterModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Timeouts Timeouts
 }
 
 func ValidateCharacter(v *validator.Validator, character *Character) {
@@ -55,11 +57,11 @@ func ValidateCharacter(v *validator.Validator, character *Character) {
 
 }
 
-func (m CharacterModel) Insert(character *Character) error {
+func (m CharacterModel) Insert(ctx context.Context, character *Character) error {
 	query := `
 		INSERT INTO characters (name, age, description, origin, bounty, race, episode)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id
+		RETURNING id, created_at, updated_at, version
 	`
 	var bounty sql.NullInt64
 	if character.Bounty != nil {
@@ -68,34 +70,94 @@ func (m CharacterModel) Insert(character *Character) error {
 
 	args := []any{character.Name, character.Age, character.Description, character.Origin, bounty, character.Race, character.Episode}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
-
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&character.ID)
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&character.ID, &character.CreatedAt, &character.UpdatedAt, &character.Version)
+		if err != nil {
+			switch {
+			case isUniqueViolation(err):
+				return ErrDuplicateName
+			default:
+				return err
+			}
+		}
+
+		err = saveRevisions(ctx, tx, m.Timeouts.Write, "characters", character)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "characters", character.ID, AuditCreate, nil, character)
+		if err != nil {
+			return err
+		}
+
+		return recordChange(ctx, tx, m.Timeouts.Write, "characters", character.ID, ChangeCreate, character)
+	})
 }
 
-func (m CharacterModel) Get(id int64) (*Character, error) {
+func (m CharacterModel) Get(ctx context.Context, id int64) (*Character, error) {
 
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT * FROM characters
-		WHERE id = $1
+		SELECT id, created_at, updated_at, version, name, age, description, origin, race, bounty, episode
+		FROM characters
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	var character Character
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
-
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&character.ID,
 		&character.CreatedAt,
 		&character.UpdatedAt,
+		&character.Version,
+		&character.Name,
+		&character.Age,
+		&character.Description,
+		&character.Origin,
+		&character.Race,
+		&character.Bounty,
+		&character.Episode,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &character, nil
+}
+
+func (m CharacterModel) GetByName(ctx context.Context, name string) (*Character, error) {
+	query := `
+		SELECT id, created_at, updated_at, version, name, age, description, origin, race, bounty, episode
+		FROM characters
+		WHERE name = $1 AND deleted_at IS NULL
+	`
+
+	var character Character
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(
+		&character.ID,
+		&character.CreatedAt,
+		&character.UpdatedAt,
+		&character.Version,
 		&character.Name,
 		&character.Age,
 		&character.Description,
@@ -117,11 +179,12 @@ func (m CharacterModel) Get(id int64) (*Character, error) {
 	return &character, nil
 }
 
-func (m CharacterModel) Update(character *Character) error {
+func (m CharacterModel) Update(ctx context.Context, character *Character) error {
 	query := `
 		UPDATE characters
-		SET name = $1, age = $2, description = $3, origin = $4, bounty = $5, race = $6, updated_at = now() 
-		WHERE id = $7
+		SET name = $1, age = $2, description = $3, origin = $4, bounty = $5, race = $6, episode = $7, updated_at = now(), version = version + 1
+		WHERE id = $8 AND version = $9 AND deleted_at IS NULL
+		RETURNING updated_at, version
 	`
 	var bounty sql.NullInt64
 	if character.Bounty != nil {
@@ -135,46 +198,221 @@ func (m CharacterModel) Update(character *Character) error {
 		character.Origin,
 		bounty,
 		character.Race,
+		character.Episode,
 		character.ID,
+		character.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		before, err := m.lockAndGet(ctx, tx, character.ID)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return ErrEditConflict
+			}
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&character.UpdatedAt, &character.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			case isUniqueViolation(err):
+				return ErrDuplicateName
+			default:
+				return err
+			}
+		}
+
+		err = saveRevisions(ctx, tx, m.Timeouts.Write, "characters", before, character)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "characters", character.ID, AuditUpdate, before, character)
+		if err != nil {
+			return err
+		}
+
+		event := eventName("characters", "updated")
+		if !sameBounty(before.Bounty, character.Bounty) {
+			event = EventBountyChanged
+		}
+
+		return recordEvent(ctx, tx, m.Timeouts.Write, "characters", character.ID, ChangeUpdate, event, character)
+	})
+}
+
+// Delete moves the character to the trash. Their crew memberships are kept
+// but hidden, and their bounty leaves each crew's total until they're
+// restored. Captains of crews outside the trash can't be deleted, since
+// purging them would leave their crews without one.
+func (m CharacterModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		WITH deleted AS (
+			UPDATE characters
+			SET deleted_at = now(), updated_at = now(), version = version + 1
+			WHERE id = $1 AND deleted_at IS NULL
+			RETURNING id, bounty
+		), adjusted AS (
+			UPDATE crews
+			SET total_bounty = total_bounty - COALESCE(d.bounty, 0), updated_at = now(), version = version + 1
+			FROM deleted d
+			INNER JOIN crew_members cm ON cm.character_id = d.id
+			WHERE crews.id = cm.crew_id
+		)
+		SELECT COUNT(*) FROM deleted`
+
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		before, err := m.lockAndGet(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		err = m.checkNotCaptain(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		err = m.trashQuery(ctx, tx, query, id)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "characters", id, AuditDelete, before, nil)
+		if err != nil {
+			return err
+		}
+
+		err = recordChange(ctx, tx, m.Timeouts.Write, "characters", id, ChangeDelete, nil)
+		if err != nil {
+			return err
+		}
+
+		return recordCrewChanges(ctx, tx, m.Timeouts, id)
+	})
+}
+
+// Restore takes the character out of the trash, along with their crew
+// memberships and their share of each crew's total bounty.
+func (m CharacterModel) Restore(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		WITH restored AS (
+			UPDATE characters
+			SET deleted_at = NULL, updated_at = now(), version = version + 1
+			WHERE id = $1 AND deleted_at IS NOT NULL
+			RETURNING id, bounty
+		), adjusted AS (
+			UPDATE crews
+			SET total_bounty = total_bounty + COALESCE(r.bounty, 0), updated_at = now(), version = version + 1
+			FROM restored r
+			INNER JOIN crew_members cm ON cm.character_id = r.id
+			WHERE crews.id = cm.crew_id
+		)
+		SELECT COUNT(*) FROM restored`
+
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		err := m.trashQuery(ctx, tx, query, id)
+		if err != nil {
+			return err
+		}
+
+		after, err := CharacterModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "characters", id, AuditRestore, nil, after)
+		if err != nil {
+			return err
+		}
+
+		err = recordEvent(ctx, tx, m.Timeouts.Write, "characters", id, ChangeCreate, eventName("characters", "restored"), after)
+		if err != nil {
+			return err
+		}
+
+		return recordCrewChanges(ctx, tx, m.Timeouts, id)
+	})
+}
+
+// lockAndGet locks a live character's row for the rest of the transaction and
+// reads it, as it is before a change.
+func (m CharacterModel) lockAndGet(ctx context.Context, tx DBTX, id int64) (*Character, error) {
+	err := lockRecord(ctx, tx, m.Timeouts.Write, "characters", id)
+	if err != nil {
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	return CharacterModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, id)
+}
+
+// checkNotCaptain returns ErrCaptain if the character captains a crew that
+// isn't in the trash.
+func (m CharacterModel) checkNotCaptain(ctx context.Context, tx DBTX, id int64) error {
+	query := `SELECT EXISTS (SELECT 1 FROM crews WHERE captain_id = $1 AND deleted_at IS NULL)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	var captain bool
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(&captain)
 	if err != nil {
 		return err
 	}
 
+	if captain {
+		return ErrCaptain
+	}
+
 	return nil
 }
 
-func (m CharacterModel) Delete(id int64) error {
-	return deleteRecord(m.DB, "characters", id)
-}
+// trashQuery runs a Delete or Restore query, which reports how many
+// characters it changed.
+func (m CharacterModel) trashQuery(ctx context.Context, tx DBTX, query string, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
 
-func (m CharacterModel) GetAll(search string, age int, origin, race string, bounty Berries, filters Filters) ([]*Character, Metadata, error) {
+	var count int
 
-	bountyCondition := "(bounty >= $4 OR $4 = 0)"
+	err := tx.QueryRowContext(ctx, query, id).Scan(&count)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicateName
+		}
+		return err
+	}
 
-	if strings.Contains(filters.Sort, "bounty") {
-		bountyCondition = "(bounty >= $4 AND bounty > 0)"
+	if count == 0 {
+		return ErrRecordNotFound
 	}
 
-	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, name, age, description, origin, race, bounty, episode 
-		FROM characters
-		WHERE (to_tsvector('english', name || ' ' || description) @@ plainto_tsquery('english', $1) OR $1 = '')
-		AND (LOWER(race) = LOWER($2) OR $2 = '')
-		AND (age >= $3 OR $3 = 0)
-		AND %s
-		ORDER BY %s %s, id ASC
-		LIMIT $5 OFFSET $6`, bountyCondition, filters.sortColumn(), filters.sortDirection())
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*4)
+func (m CharacterModel) GetAll(ctx context.Context, search string, age int, origin, race string, bounty Berries, filters Filters) ([]*Character, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), id, created_at, updated_at, version, name, age, description, origin, race, bounty, episode
+		FROM characters` + characterFilter(filters) + `
+		LIMIT $6 OFFSET $7`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, search, race, age, bounty, filters.limit(), filters.offset())
+	rows, err := m.DB.QueryContext(ctx, query, search, race, age, bounty, origin, filters.limit(), filters.offset())
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -192,6 +430,8 @@ func (m CharacterModel) GetAll(search string, age int, origin, race string, boun
 			&totalRecords,
 			&character.ID,
 			&character.CreatedAt,
+			&character.UpdatedAt,
+			&character.Version,
 			&character.Name,
 			&character.Age,
 			&character.Description,
@@ -216,3 +456,65 @@ func (m CharacterModel) GetAll(search string, age int, origin, race string, boun
 	return characters, metadata, nil
 
 }
+
+// Stream calls fn with every character that GetAll would return across all
+// of its pages, reading them from a single query. It isn't bound by the list
+// timeout, so it is up to the caller to limit how long ctx lives.
+func (m CharacterModel) Stream(ctx context.Context, search string, age int, origin, race string, bounty Berries, filters Filters, fn func(*Character) error) error {
+	query := `
+		SELECT id, created_at, updated_at, version, name, age, description, origin, race, bounty, episode
+		FROM characters` + characterFilter(filters)
+
+	rows, err := m.DB.QueryContext(ctx, query, search, race, age, bounty, origin)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var character Character
+
+		err := rows.Scan(
+			&character.ID,
+			&character.CreatedAt,
+			&character.UpdatedAt,
+			&character.Version,
+			&character.Name,
+			&character.Age,
+			&character.Description,
+			&character.Origin,
+			&character.Race,
+			&character.Bounty,
+			&character.Episode,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&character)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// characterFilter returns the WHERE and ORDER BY clauses shared by GetAll and
+// Stream, which take search, race, age, bounty and origin as $1 to $5.
+func characterFilter(filters Filters) string {
+	bountyCondition := "(bounty >= $4 OR $4 = 0)"
+
+	if strings.Contains(filters.Sort, "bounty") {
+		bountyCondition = "(bounty >= $4 AND bounty > 0)"
+	}
+
+	return fmt.Sprintf(`
+		WHERE deleted_at IS NULL
+		AND (to_tsvector('english', name || ' ' || description) @@ plainto_tsquery('english', $1) OR $1 = '')
+		AND (LOWER(race) = LOWER($2) OR $2 = '')
+		AND (age >= $3 OR $3 = 0)
+		AND (origin ILIKE '%%' || $5 || '%%' OR $5 = '')
+		AND %s
+		ORDER BY %s %s, id ASC`, bountyCondition, filters.sortColumn(), filters.sortDirection())
+}
@@ -13,8 +13,9 @@ import (
 
 type Crew struct {
 	ID          int64     `json:"id"`
-	CreatedAt   time.Time `json:"-"`
-	UpdatedAt   time.Time `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Version     int32     `json:"version"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	ShipName    string    `json:"ship_name"`
@@ -31,7 +32,8 @@ type CrewMember struct {
 }
 
 type CrewModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Timeouts Timeouts
 }
 
 func ValidateCrew(v *validator.Validator, crew *Crew) {
@@ -43,11 +45,11 @@ func ValidateCrew(v *validator.Validator, crew *Crew) {
 
 }
 
-func (m CrewModel) Insert(crew *Crew) error {
+func (m CrewModel) Insert(ctx context.Context, crew *Crew) error {
 	query := `
 		INSERT INTO crews (name, description, ship_name, captain_id, captain_name, total_bounty)
 		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id
+		RETURNING id, created_at, updated_at, version
 	`
 
 	args := []any{
@@ -59,31 +61,55 @@ func (m CrewModel) Insert(crew *Crew) error {
 		crew.TotalBounty,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&crew.ID)
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&crew.ID, &crew.CreatedAt, &crew.UpdatedAt, &crew.Version)
+		if err != nil {
+			switch {
+			case isUniqueViolation(err):
+				return ErrDuplicateName
+			default:
+				return err
+			}
+		}
+
+		err = saveRevisions(ctx, tx, m.Timeouts.Write, "crews", crew)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "crews", crew.ID, AuditCreate, nil, crew)
+		if err != nil {
+			return err
+		}
+
+		return recordChange(ctx, tx, m.Timeouts.Write, "crews", crew.ID, ChangeCreate, crew)
+	})
 }
 
-func (m CrewModel) Get(id int64) (*Crew, error) {
+func (m CrewModel) Get(ctx context.Context, id int64) (*Crew, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT * FROM crews
-		WHERE id = $1
+		SELECT id, created_at, updated_at, version, name, description, ship_name, captain_id, captain_name, total_bounty
+		FROM crews
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	var crew Crew
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&crew.ID,
 		&crew.CreatedAt,
 		&crew.UpdatedAt,
+		&crew.Version,
 		&crew.Name,
 		&crew.Description,
 		&crew.ShipName,
@@ -101,10 +127,12 @@ func (m CrewModel) Get(id int64) (*Crew, error) {
 		}
 	}
 
+	// Members in the trash aren't counted.
 	countQuery := `
 	    SELECT COUNT(*)
-	    FROM crew_members
-	    WHERE crew_id = $1
+	    FROM crew_members cm
+	    INNER JOIN characters ch ON ch.id = cm.character_id
+	    WHERE cm.crew_id = $1 AND ch.deleted_at IS NULL
 	`
 
 	err = m.DB.QueryRowContext(ctx, countQuery, id).Scan(&crew.MemberCount)
@@ -115,11 +143,51 @@ func (m CrewModel) Get(id int64) (*Crew, error) {
 	return &crew, nil
 }
 
-func (m CrewModel) Update(crew *Crew) error {
+func (m CrewModel) GetByName(ctx context.Context, name string) (*Crew, error) {
+	query := `
+		SELECT id, created_at, updated_at, version, name, description, ship_name, captain_id, captain_name, total_bounty,
+			(SELECT COUNT(*) FROM crew_members cm INNER JOIN characters ch ON ch.id = cm.character_id WHERE cm.crew_id = crews.id AND ch.deleted_at IS NULL)
+		FROM crews
+		WHERE name = $1 AND deleted_at IS NULL
+	`
+
+	var crew Crew
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(
+		&crew.ID,
+		&crew.CreatedAt,
+		&crew.UpdatedAt,
+		&crew.Version,
+		&crew.Name,
+		&crew.Description,
+		&crew.ShipName,
+		&crew.CaptainID,
+		&crew.CaptainName,
+		&crew.TotalBounty,
+		&crew.MemberCount,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &crew, nil
+}
+
+func (m CrewModel) Update(ctx context.Context, crew *Crew) error {
 	query := `
 		UPDATE crews
-		SET name = $1, description = $2, ship_name = $3, captain_id = $4, captain_name = $5, total_bounty = $6, updated_at = now()
-		WHERE id = $7
+		SET name = $1, description = $2, ship_name = $3, captain_id = $4, captain_name = $5, total_bounty = $6, updated_at = now(), version = version + 1
+		WHERE id = $7 AND version = $8 AND deleted_at IS NULL
+		RETURNING updated_at, version
 	`
 	args := []any{
 		crew.Name,
@@ -129,87 +197,240 @@ func (m CrewModel) Update(crew *Crew) error {
 		crew.CaptainName,
 		crew.TotalBounty,
 		crew.ID,
+		crew.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	if err != nil {
-		return err
-	}
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		err := lockRecord(ctx, tx, m.Timeouts.Write, "crews", crew.ID)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return ErrEditConflict
+			}
+			return err
+		}
 
-	return nil
+		before, err := CrewModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, crew.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&crew.UpdatedAt, &crew.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			case isUniqueViolation(err):
+				return ErrDuplicateName
+			default:
+				return err
+			}
+		}
+
+		err = saveRevisions(ctx, tx, m.Timeouts.Write, "crews", before, crew)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "crews", crew.ID, AuditUpdate, before, crew)
+		if err != nil {
+			return err
+		}
+
+		return recordChange(ctx, tx, m.Timeouts.Write, "crews", crew.ID, ChangeUpdate, crew)
+	})
+}
+
+// Delete moves the crew to the trash. Its memberships are kept, so restoring
+// it brings them back too.
+func (m CrewModel) Delete(ctx context.Context, id int64) error {
+	return deleteRecord(ctx, m.DB, m.Timeouts.Write, "crews", id, m.getIn(ctx, id))
 }
 
-func (m CrewModel) Delete(id int64) error {
-	return deleteRecord(m.DB, "crews", id)
+func (m CrewModel) Restore(ctx context.Context, id int64) error {
+	return restoreRecord(ctx, m.DB, m.Timeouts.Write, "crews", id, m.getIn(ctx, id))
 }
 
-func (m CrewModel) AddMember(crewID, characterID int64) error {
+// getIn returns a function that reads the crew inside a transaction.
+func (m CrewModel) getIn(ctx context.Context, id int64) func(tx DBTX) (any, error) {
+	return func(tx DBTX) (any, error) {
+		return CrewModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, id)
+	}
+}
+
+func (m CrewModel) AddMember(ctx context.Context, crewID, characterID int64) error {
+	// Characters and crews in the trash can't gain members.
 	query := `
         INSERT INTO crew_members (character_id, crew_id)
-        VALUES ($1, $2)
+        SELECT $1, $2
+        WHERE EXISTS (SELECT 1 FROM characters WHERE id = $1 AND deleted_at IS NULL)
+        AND EXISTS (SELECT 1 FROM crews WHERE id = $2 AND deleted_at IS NULL)
+    `
+
+	bountyQuery := `
+        UPDATE crews
+        SET total_bounty = total_bounty + COALESCE((SELECT bounty FROM characters WHERE id = $1), 0), updated_at = now(), version = version + 1
+        WHERE id = $2
     `
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, characterID, crewID)
-	if err != nil {
-		return err
-	}
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		result, err := tx.ExecContext(ctx, query, characterID, crewID)
+		if err != nil {
+			switch {
+			case isUniqueViolation(err):
+				return ErrAlreadyMember
+			case isForeignKeyViolation(err):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, bountyQuery, characterID, crewID)
+		if err != nil {
+			return err
+		}
+
+		membership := CrewMembership{CrewID: crewID, CharacterID: characterID}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "crew_members", crewID, AuditCreate, nil, membership)
+		if err != nil {
+			return err
+		}
+
+		// Memberships aren't in the change feed, but the crew's member
+		// count and total bounty are.
+		crew, err := CrewModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, crewID)
+		if err != nil {
+			return err
+		}
+
+		return recordEvent(ctx, tx, m.Timeouts.Write, "crews", crewID, ChangeUpdate, EventCrewMemberAdded, crew)
+	})
+}
+
+func (m CrewModel) DeleteMember(ctx context.Context, crewID, characterID int64) error {
+	query := `
+		DELETE FROM crew_members
+		WHERE crew_id = $1 AND character_id = $2
+		AND character_id IN (SELECT id FROM characters WHERE deleted_at IS NULL)
+	`
 
 	bountyQuery := `
         UPDATE crews
-        SET total_bounty = total_bounty + COALESCE((SELECT bounty FROM characters WHERE id = $1), 0)
+        SET total_bounty = total_bounty - COALESCE((SELECT bounty FROM characters WHERE id = $1), 0), updated_at = now(), version = version + 1
         WHERE id = $2
     `
 
-	_, err = m.DB.ExecContext(ctx, bountyQuery, characterID, crewID)
-	if err != nil {
-		return err
-	}
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
 
-	return nil
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		result, err := tx.ExecContext(ctx, query, crewID, characterID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, bountyQuery, characterID, crewID)
+		if err != nil {
+			return err
+		}
+
+		membership := CrewMembership{CrewID: crewID, CharacterID: characterID}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "crew_members", crewID, AuditDelete, membership, nil)
+		if err != nil {
+			return err
+		}
+
+		// Memberships aren't in the change feed, but the crew's member
+		// count and total bounty are.
+		crew, err := CrewModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, crewID)
+		if err != nil {
+			return err
+		}
+
+		return recordEvent(ctx, tx, m.Timeouts.Write, "crews", crewID, ChangeUpdate, EventCrewMemberRemoved, crew)
+	})
 }
 
-func (m CrewModel) DeleteMember(crewID, characterID int64) error {
+// recordCrewChanges adds the live crews a character belongs to to the change
+// feed, once the character's bounty has been added to or taken out of their
+// totals.
+func recordCrewChanges(ctx context.Context, tx DBTX, timeouts Timeouts, characterID int64) error {
 	query := `
-		DELETE FROM crew_members
-		WHERE crew_id = $1 AND character_id = $2
+		SELECT cm.crew_id
+		FROM crew_members cm
+		INNER JOIN crews c ON c.id = cm.crew_id
+		WHERE cm.character_id = $1 AND c.deleted_at IS NULL
+		ORDER BY cm.crew_id
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+
+	readCtx, cancel := context.WithTimeout(ctx, timeouts.Read)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, crewID, characterID)
+	rows, err := tx.QueryContext(readCtx, query, characterID)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+	var crewIDs []int64
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	for rows.Next() {
+		var crewID int64
+
+		err := rows.Scan(&crewID)
+		if err != nil {
+			return err
+		}
+
+		crewIDs = append(crewIDs, crewID)
 	}
 
-	bountyQuery := `
-        UPDATE crews
-        SET total_bounty = total_bounty - COALESCE((SELECT bounty FROM characters WHERE id = $1), 0)
-        WHERE id = $2
-    `
-	_, err = m.DB.ExecContext(ctx, bountyQuery, crewID, characterID)
-	if err != nil {
+	if err = rows.Err(); err != nil {
 		return err
 	}
 
+	for _, crewID := range crewIDs {
+		crew, err := CrewModel{DB: tx, Timeouts: timeouts}.Get(ctx, crewID)
+		if err != nil {
+			return err
+		}
+
+		err = recordChange(ctx, tx, timeouts.Write, "crews", crewID, ChangeUpdate, crew)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (m CrewModel) GetMembers(crewID int64, bounty Berries, filters Filters) ([]*CrewMember, Metadata, error) {
+func (m CrewModel) GetMembers(ctx context.Context, crewID int64, bounty Berries, filters Filters) ([]*CrewMember, Metadata, error) {
 
 	bountyCondition := "(c.bounty >= $2 OR $2 = 0)"
 
@@ -221,12 +442,12 @@ func (m CrewModel) GetMembers(crewID int64, bounty Berries, filters Filters) ([]
 		SELECT COUNT(*) OVER(), c.id, c.name, c.bounty
 		FROM characters c
 		INNER JOIN crew_members cm ON c.id = cm.character_id
-		WHERE cm.crew_id = $1
+		WHERE cm.crew_id = $1 AND c.deleted_at IS NULL
 		AND %s
 		ORDER BY %s %s, c.id ASC
 		LIMIT $3 OFFSET $4`, bountyCondition, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
 	args := []any{crewID, bounty, filters.limit(), filters.offset()}
@@ -238,7 +459,7 @@ func (m CrewModel) GetMembers(crewID int64, bounty Berries, filters Filters) ([]
 	defer rows.Close()
 
 	totalRecords := 0
-	var members []*CrewMember
+	members := []*CrewMember{}
 
 	for rows.Next() {
 		var member CrewMember
@@ -265,24 +486,16 @@ func (m CrewModel) GetMembers(crewID int64, bounty Berries, filters Filters) ([]
 	return members, metadata, nil
 }
 
-func (m CrewModel) GetAll(search string, shipName string, totalBounty Berries, filters Filters) ([]*Crew, Metadata, error) {
-	bountyCondition := "(total_bounty >= $3 OR $3 = 0)"
-	if strings.Contains(filters.Sort, "total_bounty") {
-		bountyCondition = "(total_bounty >= $3 AND total_bounty > 0)"
-	}
-
-	query := fmt.Sprintf(`
+func (m CrewModel) GetAll(ctx context.Context, search string, shipName string, totalBounty Berries, filters Filters) ([]*Crew, Metadata, error) {
+	query := `
 		SELECT COUNT(*) OVER(), 
-			c.id, c.created_at, c.updated_at, c.name, c.description, 
-			c.ship_name, c.captain_id, c.captain_name, c.total_bounty
-		FROM crews c
-		WHERE (to_tsvector('english', c.name || ' ' || c.description || ' ' || COALESCE(c.ship_name, '') || ' ' || COALESCE(c.captain_name, '')) @@ plainto_tsquery('english', $1) OR $1 = '')
-		AND (LOWER(c.ship_name) = LOWER($2) OR $2 = '' OR c.ship_name IS NULL)
-		AND %s
-		ORDER BY %s %s, c.id ASC
-		LIMIT $4 OFFSET $5`, bountyCondition, filters.sortColumn(), filters.sortDirection())
+			c.id, c.created_at, c.updated_at, c.version, c.name, c.description, 
+			c.ship_name, c.captain_id, c.captain_name, c.total_bounty,
+			(SELECT COUNT(*) FROM crew_members cm INNER JOIN characters ch ON ch.id = cm.character_id WHERE cm.crew_id = c.id AND ch.deleted_at IS NULL)
+		FROM crews c` + crewFilter(filters) + `
+		LIMIT $4 OFFSET $5`
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*4)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, search, shipName, totalBounty, filters.limit(), filters.offset())
@@ -301,12 +514,14 @@ func (m CrewModel) GetAll(search string, shipName string, totalBounty Berries, f
 			&crew.ID,
 			&crew.CreatedAt,
 			&crew.UpdatedAt,
+			&crew.Version,
 			&crew.Name,
 			&crew.Description,
 			&crew.ShipName,
 			&crew.CaptainID,
 			&crew.CaptainName,
 			&crew.TotalBounty,
+			&crew.MemberCount,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -321,3 +536,64 @@ func (m CrewModel) GetAll(search string, shipName string, totalBounty Berries, f
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	return crews, metadata, nil
 }
+
+// Stream calls fn with every crew that GetAll would return across all of its
+// pages, reading them from a single query. It isn't bound by the list
+// timeout, so it is up to the caller to limit how long ctx lives.
+func (m CrewModel) Stream(ctx context.Context, search string, shipName string, totalBounty Berries, filters Filters, fn func(*Crew) error) error {
+	query := `
+		SELECT c.id, c.created_at, c.updated_at, c.version, c.name, c.description,
+			c.ship_name, c.captain_id, c.captain_name, c.total_bounty,
+			(SELECT COUNT(*) FROM crew_members cm INNER JOIN characters ch ON ch.id = cm.character_id WHERE cm.crew_id = c.id AND ch.deleted_at IS NULL)
+		FROM crews c` + crewFilter(filters)
+
+	rows, err := m.DB.QueryContext(ctx, query, search, shipName, totalBounty)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var crew Crew
+
+		err := rows.Scan(
+			&crew.ID,
+			&crew.CreatedAt,
+			&crew.UpdatedAt,
+			&crew.Version,
+			&crew.Name,
+			&crew.Description,
+			&crew.ShipName,
+			&crew.CaptainID,
+			&crew.CaptainName,
+			&crew.TotalBounty,
+			&crew.MemberCount,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&crew)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// crewFilter returns the WHERE and ORDER BY clauses shared by GetAll and
+// Stream, which take search, ship name and total bounty as $1 to $3.
+func crewFilter(filters Filters) string {
+	bountyCondition := "(c.total_bounty >= $3 OR $3 = 0)"
+	if strings.Contains(filters.Sort, "total_bounty") {
+		bountyCondition = "(c.total_bounty >= $3 AND c.total_bounty > 0)"
+	}
+
+	return fmt.Sprintf(`
+		WHERE c.deleted_at IS NULL
+		AND (to_tsvector('english', c.name || ' ' || c.description || ' ' || COALESCE(c.ship_name, '') || ' ' || COALESCE(c.captain_name, '')) @@ plainto_tsquery('english', $1) OR $1 = '')
+		AND (LOWER(c.ship_name) = LOWER($2) OR $2 = '' OR c.ship_name IS NULL)
+		AND %s
+		ORDER BY %s %s, c.id ASC`, bountyCondition, filters.sortColumn(), filters.sortDirection())
+}
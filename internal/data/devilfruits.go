@@ -15,8 +15,9 @@ import (
 
 type DevilFruit struct {
 	ID             int64          `json:"id"`
-	CreatedAt      time.Time      `json:"-"`
-	UpdatedAt      time.Time      `json:"-"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	Version        int32          `json:"version"`
 	Name           string         `json:"name"`
 	Description    string         `json:"description"`
 	Type           string         `json:"type"`
@@ -27,7 +28,8 @@ type DevilFruit struct {
 }
 
 type DevilFruitModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Timeouts Timeouts
 }
 
 func (df DevilFruit) MarshalJSON() ([]byte, error) {
@@ -73,36 +75,60 @@ func ValidateDevilFruit(v *validator.Validator, devilFruit *DevilFruit) {
 
 }
 
-func (m DevilFruitModel) Insert(devilFruit *DevilFruit) error {
+func (m DevilFruitModel) Insert(ctx context.Context, devilFruit *DevilFruit) error {
 	query := `
 		INSERT INTO devilfruits (name, description, type, character_id, current_owner, previousOwners, episode)
     	VALUES ($1, $2, $3, $4, $5, $6, $7)
- 		RETURNING id
+ 		RETURNING id, created_at, updated_at, version
 	`
 
 	args := []any{devilFruit.Name, devilFruit.Description, devilFruit.Type, devilFruit.Character_id, devilFruit.CurrentOwner, pq.Array(devilFruit.PreviousOwners), devilFruit.Episode}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&devilFruit.ID)
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&devilFruit.ID, &devilFruit.CreatedAt, &devilFruit.UpdatedAt, &devilFruit.Version)
+		if err != nil {
+			switch {
+			case isUniqueViolation(err):
+				return ErrDuplicateName
+			default:
+				return err
+			}
+		}
+
+		err = saveRevisions(ctx, tx, m.Timeouts.Write, "devilfruits", devilFruit)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, m.Timeouts.Write, "devilfruits", devilFruit.ID, AuditCreate, nil, devilFruit)
+		if err != nil {
+			return err
+		}
+
+		return recordChange(ctx, tx, m.Timeouts.Write, "devilfruits", devilFruit.ID, ChangeCreate, devilFruit)
+	})
 }
 
-func (m DevilFruitModel) Get(id int64) (*DevilFruit, error) {
+func (m DevilFruitModel) Get(ctx context.Context, id int64) (*DevilFruit, error) {
 	query := `
-		SELECT * FROM devilfruits
-		WHERE id = $1
+		SELECT id, created_at, updated_at, version, name, description, type, current_owner, character_id, previousOwners, episode
+		FROM devilfruits
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	var devilFruit DevilFruit
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&devilFruit.ID,
 		&devilFruit.CreatedAt,
 		&devilFruit.UpdatedAt,
+		&devilFruit.Version,
 		&devilFruit.Name,
 		&devilFruit.Description,
 		&devilFruit.Type,
@@ -124,11 +150,50 @@ func (m DevilFruitModel) Get(id int64) (*DevilFruit, error) {
 	return &devilFruit, nil
 }
 
-func (m DevilFruitModel) Update(devilFruit *DevilFruit) error {
+func (m DevilFruitModel) GetByName(ctx context.Context, name string) (*DevilFruit, error) {
+	query := `
+		SELECT id, created_at, updated_at, version, name, description, type, current_owner, character_id, previousOwners, episode
+		FROM devilfruits
+		WHERE name = $1 AND deleted_at IS NULL
+	`
+
+	var devilFruit DevilFruit
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(
+		&devilFruit.ID,
+		&devilFruit.CreatedAt,
+		&devilFruit.UpdatedAt,
+		&devilFruit.Version,
+		&devilFruit.Name,
+		&devilFruit.Description,
+		&devilFruit.Type,
+		&devilFruit.CurrentOwner,
+		&devilFruit.Character_id,
+		pq.Array(&devilFruit.PreviousOwners),
+		&devilFruit.Episode,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &devilFruit, nil
+}
+
+func (m DevilFruitModel) Update(ctx context.Context, devilFruit *DevilFruit) error {
 	query := `
 		UPDATE devilfruits
-		SET name = $1, description = $2, type = $3, character_id = $4, current_owner = $5, previousOwners = $6, episode = $7, updated_at = now()
-		WHERE id = $8
+		SET name = $1, description = $2, type = $3, character_id = $4, current_owner = $5, previousOwners = $6, episode = $7, updated_at = now(), version = version + 1
+		WHERE id = $8 AND version = $9 AND deleted_at IS NULL
+		RETURNING updated_at, version
 	`
 
 	args := []any{
@@ -140,60 +205,75 @@ func (m DevilFruitModel) Update(devilFruit *DevilFruit) error {
 		pq.Array(devilFruit.PreviousOwners),
 		devilFruit.Episode,
 		devilFruit.ID,
+		devilFruit.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	if err != nil {
-		return err
-	}
-	return nil
-}
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		err := lockRecord(ctx, tx, m.Timeouts.Write, "devilfruits", devilFruit.ID)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return ErrEditConflict
+			}
+			return err
+		}
 
-func (m DevilFruitModel) Delete(id int64) error {
-	if id < 1 {
-		return ErrRecordNotFound
-	}
+		before, err := DevilFruitModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, devilFruit.ID)
+		if err != nil {
+			return err
+		}
 
-	query := `
-		DELETE FROM devilfruits
-		WHERE id = $1
-	`
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&devilFruit.UpdatedAt, &devilFruit.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			case isUniqueViolation(err):
+				return ErrDuplicateName
+			default:
+				return err
+			}
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*4)
+		err = saveRevisions(ctx, tx, m.Timeouts.Write, "devilfruits", before, devilFruit)
+		if err != nil {
+			return err
+		}
 
-	defer cancel()
+		err = audit(ctx, tx, m.Timeouts.Write, "devilfruits", devilFruit.ID, AuditUpdate, before, devilFruit)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+		return recordChange(ctx, tx, m.Timeouts.Write, "devilfruits", devilFruit.ID, ChangeUpdate, devilFruit)
+	})
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+func (m DevilFruitModel) Delete(ctx context.Context, id int64) error {
+	return deleteRecord(ctx, m.DB, m.Timeouts.Write, "devilfruits", id, m.getIn(ctx, id))
+}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
+func (m DevilFruitModel) Restore(ctx context.Context, id int64) error {
+	return restoreRecord(ctx, m.DB, m.Timeouts.Write, "devilfruits", id, m.getIn(ctx, id))
+}
 
-	return nil
+// getIn returns a function that reads the devil fruit inside a transaction.
+func (m DevilFruitModel) getIn(ctx context.Context, id int64) func(tx DBTX) (any, error) {
+	return func(tx DBTX) (any, error) {
+		return DevilFruitModel{DB: tx, Timeouts: m.Timeouts}.Get(ctx, id)
+	}
 }
 
-func (m DevilFruitModel) GetAll(search, fruitType string, filters Filters) ([]*DevilFruit, Metadata, error) {
+func (m DevilFruitModel) GetAll(ctx context.Context, search, fruitType string, filters Filters) ([]*DevilFruit, Metadata, error) {
 
-	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, name, description, type, character_id, current_owner,previousOwners, episode 
-		FROM devilfruits
-		WHERE (to_tsvector('english', name || ' ' || description) @@ plainto_tsquery('english', $1) OR $1 = '')
-		AND (LOWER(type) = LOWER($2) OR $2 = '')
-		ORDER BY %s %s, id ASC
-		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+	query := `
+		SELECT COUNT(*) OVER(), id, created_at, updated_at, version, name, description, type, character_id, current_owner, previousOwners, episode
+		FROM devilfruits` + devilFruitFilter(filters) + `
+		LIMIT $3 OFFSET $4`
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*4)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, search, fruitType, filters.limit(), filters.offset())
@@ -214,6 +294,8 @@ func (m DevilFruitModel) GetAll(search, fruitType string, filters Filters) ([]*D
 			&totalRecords,
 			&devilFruit.ID,
 			&devilFruit.CreatedAt,
+			&devilFruit.UpdatedAt,
+			&devilFruit.Version,
 			&devilFruit.Name,
 			&devilFruit.Description,
 			&devilFruit.Type,
@@ -238,3 +320,56 @@ func (m DevilFruitModel) GetAll(search, fruitType string, filters Filters) ([]*D
 	return devilFruits, metadata, nil
 
 }
+
+// Stream calls fn with every devil fruit that GetAll would return across all
+// of its pages, reading them from a single query. It isn't bound by the list
+// timeout, so it is up to the caller to limit how long ctx lives.
+func (m DevilFruitModel) Stream(ctx context.Context, search, fruitType string, filters Filters, fn func(*DevilFruit) error) error {
+	query := `
+		SELECT id, created_at, updated_at, version, name, description, type, character_id, current_owner, previousOwners, episode
+		FROM devilfruits` + devilFruitFilter(filters)
+
+	rows, err := m.DB.QueryContext(ctx, query, search, fruitType)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var devilFruit DevilFruit
+
+		err := rows.Scan(
+			&devilFruit.ID,
+			&devilFruit.CreatedAt,
+			&devilFruit.UpdatedAt,
+			&devilFruit.Version,
+			&devilFruit.Name,
+			&devilFruit.Description,
+			&devilFruit.Type,
+			&devilFruit.Character_id,
+			&devilFruit.CurrentOwner,
+			pq.Array(&devilFruit.PreviousOwners),
+			&devilFruit.Episode,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&devilFruit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// devilFruitFilter returns the WHERE and ORDER BY clauses shared by GetAll
+// and Stream, which take search and type as $1 and $2.
+func devilFruitFilter(filters Filters) string {
+	return fmt.Sprintf(`
+		WHERE deleted_at IS NULL
+		AND (to_tsvector('english', name || ' ' || description) @@ plainto_tsquery('english', $1) OR $1 = '')
+		AND (LOWER(type) = LOWER($2) OR $2 = '')
+		ORDER BY %s %s, id ASC`, filters.sortColumn(), filters.sortDirection())
+}
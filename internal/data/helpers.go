@@ -3,22 +3,95 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
-func deleteRecord(db *sql.DB, tableName string, id int64) error {
+// deleteRecord moves a record to the trash. It stays there, hidden from every
+// other query, until it's restored or purged. get reads the record for the
+// audit log.
+func deleteRecord(ctx context.Context, db DBTX, timeout time.Duration, tableName string, id int64, get func(tx DBTX) (any, error)) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET deleted_at = now(), updated_at = now(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL`, tableName)
+
+	return inTx(ctx, db, func(tx DBTX) error {
+		err := lockRecord(ctx, tx, timeout, tableName, id)
+		if err != nil {
+			return err
+		}
+
+		before, err := get(tx)
+		if err != nil {
+			return err
+		}
+
+		err = execOne(ctx, tx, timeout, query, id)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, timeout, tableName, id, AuditDelete, before, nil)
+		if err != nil {
+			return err
+		}
+
+		return recordChange(ctx, tx, timeout, tableName, id, ChangeDelete, nil)
+	})
+}
+
+// restoreRecord takes a record back out of the trash. It fails with
+// ErrDuplicateName if another record has taken its name in the meantime.
+// get reads the restored record for the audit log.
+func restoreRecord(ctx context.Context, db DBTX, timeout time.Duration, tableName string, id int64, get func(tx DBTX) (any, error)) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", tableName)
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET deleted_at = NULL, updated_at = now(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL`, tableName)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*4)
+	return inTx(ctx, db, func(tx DBTX) error {
+		err := execOne(ctx, tx, timeout, query, id)
+		if err != nil {
+			return err
+		}
+
+		after, err := get(tx)
+		if err != nil {
+			return err
+		}
+
+		err = audit(ctx, tx, timeout, tableName, id, AuditRestore, nil, after)
+		if err != nil {
+			return err
+		}
+
+		return recordEvent(ctx, tx, timeout, tableName, id, ChangeCreate, eventName(tableName, "restored"), after)
+	})
+}
+
+// execOne runs a statement that should affect exactly one row, returning
+// ErrRecordNotFound if it affects none.
+func execOne(ctx context.Context, db DBTX, timeout time.Duration, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	result, err := db.ExecContext(ctx, query, id)
+	result, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicateName
+		}
 		return err
 	}
 
@@ -33,3 +106,62 @@ func deleteRecord(db *sql.DB, tableName string, id int64) error {
 
 	return nil
 }
+
+// inTx runs fn inside a transaction, so that a change and its audit entry
+// are written together or not at all. If db is already a transaction, fn
+// joins it.
+func inTx(ctx context.Context, db DBTX, fn func(tx DBTX) error) error {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockRecord locks a live record's row until the end of the transaction, so
+// what's read from it before changing it is still true when the change is
+// made.
+func lockRecord(ctx context.Context, tx DBTX, timeout time.Duration, tableName string, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, tableName)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres unique_violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isForeignKeyViolation reports whether err is a Postgres foreign_key_violation.
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
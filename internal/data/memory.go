@@ -0,0 +1,2230 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is the shared state behind the in-memory models. It mirrors the
+// Postgres schema closely enough that handlers can't tell the two apart:
+// names are unique among live records, the trash hides and purges records the
+// same way and list queries filter, sort and paginate with the same rules.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	characters  map[int64]*Character
+	devilFruits map[int64]*DevilFruit
+	crews       map[int64]*Crew
+	crewMembers map[int64]map[int64]struct{} // crew id -> character ids
+	apiKeys     map[int64]*APIKey
+
+	// Records in the trash are kept apart from the live ones, so nothing
+	// else has to skip over them. Memberships of trashed characters and
+	// crews stay in crewMembers until they're purged.
+	trashedCharacters  map[int64]trashed[*Character]
+	trashedDevilFruits map[int64]trashed[*DevilFruit]
+	trashedCrews       map[int64]trashed[*Crew]
+
+	// auditLog is append-only, so its entries are never changed once
+	// written and can be shared between clones.
+	auditLog []*AuditEntry
+
+	revisions map[revisionKey][]*Revision
+
+	// changes is append-only too.
+	changes []*Change
+
+	webhooks          map[int64]*Webhook
+	webhookDeliveries map[int64]*WebhookDelivery
+
+	quotaUsage map[quotaKey]int64
+	usage      map[usageKey]*Usage
+	nonces     map[nonceKey]time.Time
+
+	// changeListeners are woken by each change. They aren't part of the
+	// data, so they're left out of clones.
+	changeListeners map[chan struct{}]struct{}
+
+	memoryCounters
+
+	// tx journals the writes of the transaction holding the write lock,
+	// if there is one.
+	tx *memoryTx
+}
+
+// memoryCounters are the store's sequences.
+type memoryCounters struct {
+	nextCharacterID  int64
+	nextDevilFruitID int64
+	nextCrewID       int64
+	nextAPIKeyID     int64
+	nextAuditID      int64
+	nextChangeSeq    int64
+	nextWebhookID    int64
+	nextDeliveryID   int64
+}
+
+// memoryTx records how to undo a transaction's writes. The append-only logs
+// and the sequences are wound back to where they were when it began; every
+// other change is undone by putting back the entries it replaced.
+type memoryTx struct {
+	undo     []func()
+	counters memoryCounters
+	auditLog int
+	changes  int
+}
+
+// NewMemoryModels returns a Models backed by process memory instead of
+// Postgres. It is used for demos and handler tests.
+func NewMemoryModels() Models {
+	store := &memoryStore{
+		characters:  make(map[int64]*Character),
+		devilFruits: make(map[int64]*DevilFruit),
+		crews:       make(map[int64]*Crew),
+		crewMembers: make(map[int64]map[int64]struct{}),
+		apiKeys:     make(map[int64]*APIKey),
+
+		trashedCharacters:  make(map[int64]trashed[*Character]),
+		trashedDevilFruits: make(map[int64]trashed[*DevilFruit]),
+		trashedCrews:       make(map[int64]trashed[*Crew]),
+
+		revisions: make(map[revisionKey][]*Revision),
+
+		webhooks:          make(map[int64]*Webhook),
+		webhookDeliveries: make(map[int64]*WebhookDelivery),
+
+		quotaUsage: make(map[quotaKey]int64),
+		usage:      make(map[usageKey]*Usage),
+		nonces:     make(map[nonceKey]time.Time),
+
+		changeListeners: make(map[chan struct{}]struct{}),
+	}
+
+	return newMemoryModels(store, false)
+}
+
+func newMemoryModels(store *memoryStore, inTx bool) Models {
+	base := memoryModel{store: store, inTx: inTx}
+
+	models := Models{
+		Characters:  memoryCharacterModel{base},
+		DevilFruits: memoryDevilFruitModel{base},
+		Crews:       memoryCrewModel{base},
+		APIKeys:     memoryAPIKeyModel{base},
+		Trash:       memoryTrashModel{base},
+		Audit:       memoryAuditModel{base},
+		Revisions:   memoryRevisionModel{base},
+		Changes:     memoryChangeModel{base},
+		Webhooks:    memoryWebhookModel{base},
+		Usage:       memoryUsageModel{base},
+	}
+
+	models.transaction = func(ctx context.Context, opts *sql.TxOptions, fn func(Models) error) error {
+		if inTx {
+			return fn(models)
+		}
+
+		// A read-only transaction works on its own copy of the store, so
+		// it doesn't hold up writers for as long as fn runs.
+		if opts != nil && opts.ReadOnly {
+			store.mu.RLock()
+			snapshot := store.clone()
+			store.mu.RUnlock()
+
+			return fn(newMemoryModels(snapshot, false))
+		}
+
+		// A transaction holds the write lock throughout, which makes it
+		// serializable, and undoes its writes if fn fails or panics.
+		store.mu.Lock()
+		defer store.mu.Unlock()
+
+		store.begin()
+		defer store.rollback()
+
+		err := fn(newMemoryModels(store, true))
+		if err == nil {
+			store.commit()
+		}
+
+		return err
+	}
+
+	return models
+}
+
+// memoryModel is embedded by each in-memory model. Inside a transaction the
+// store is already locked, so locking becomes a no-op.
+type memoryModel struct {
+	store *memoryStore
+	inTx  bool
+}
+
+func (m memoryModel) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.store.mu.Lock()
+	return m.store.mu.Unlock
+}
+
+func (m memoryModel) rlock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.store.mu.RLock()
+	return m.store.mu.RUnlock
+}
+
+// clone returns a deep copy of the store's data, without its mutex.
+func (s *memoryStore) clone() *memoryStore {
+	clone := &memoryStore{
+		characters:     make(map[int64]*Character, len(s.characters)),
+		devilFruits:    make(map[int64]*DevilFruit, len(s.devilFruits)),
+		crews:          make(map[int64]*Crew, len(s.crews)),
+		crewMembers:    make(map[int64]map[int64]struct{}, len(s.crewMembers)),
+		apiKeys:        make(map[int64]*APIKey, len(s.apiKeys)),
+		auditLog:       slices.Clone(s.auditLog),
+		changes:        slices.Clone(s.changes),
+		revisions:      make(map[revisionKey][]*Revision, len(s.revisions)),
+		quotaUsage:     maps.Clone(s.quotaUsage),
+		nonces:         maps.Clone(s.nonces),
+		memoryCounters: s.memoryCounters,
+	}
+
+	for id, character := range s.characters {
+		clone.characters[id] = cloneCharacter(character)
+	}
+	for id, devilFruit := range s.devilFruits {
+		clone.devilFruits[id] = cloneDevilFruit(devilFruit)
+	}
+	for id, crew := range s.crews {
+		clone.crews[id] = cloneCrew(crew)
+	}
+	for id, members := range s.crewMembers {
+		clone.crewMembers[id] = maps.Clone(members)
+	}
+	for id, apiKey := range s.apiKeys {
+		clone.apiKeys[id] = cloneAPIKey(apiKey)
+	}
+	for key, revisions := range s.revisions {
+		clone.revisions[key] = slices.Clone(revisions)
+	}
+
+	clone.webhooks = make(map[int64]*Webhook, len(s.webhooks))
+	for id, webhook := range s.webhooks {
+		clone.webhooks[id] = cloneWebhook(webhook)
+	}
+	clone.webhookDeliveries = make(map[int64]*WebhookDelivery, len(s.webhookDeliveries))
+	for id, delivery := range s.webhookDeliveries {
+		clone.webhookDeliveries[id] = cloneDelivery(delivery)
+	}
+
+	clone.usage = make(map[usageKey]*Usage, len(s.usage))
+	for key, usage := range s.usage {
+		clone.usage[key] = cloneUsage(usage)
+	}
+
+	clone.trashedCharacters = cloneTrash(s.trashedCharacters, cloneCharacter)
+	clone.trashedDevilFruits = cloneTrash(s.trashedDevilFruits, cloneDevilFruit)
+	clone.trashedCrews = cloneTrash(s.trashedCrews, cloneCrew)
+
+	return clone
+}
+
+// begin starts journaling writes for a transaction. The caller must hold
+// the write lock.
+func (s *memoryStore) begin() {
+	s.tx = &memoryTx{
+		counters: s.memoryCounters,
+		auditLog: len(s.auditLog),
+		changes:  len(s.changes),
+	}
+}
+
+// commit keeps the transaction's writes.
+func (s *memoryStore) commit() {
+	s.tx = nil
+}
+
+// rollback undoes the writes of the transaction in progress, newest first.
+// It does nothing once the transaction has been committed.
+func (s *memoryStore) rollback() {
+	if s.tx == nil {
+		return
+	}
+
+	for _, undo := range slices.Backward(s.tx.undo) {
+		undo()
+	}
+
+	// Clipping the logs stops the next append from writing over entries
+	// that readers may still hold.
+	s.auditLog = slices.Clip(s.auditLog[:s.tx.auditLog])
+	s.changes = slices.Clip(s.changes[:s.tx.changes])
+	s.memoryCounters = s.tx.counters
+
+	s.tx = nil
+}
+
+// keep saves table's entry for key, or notes that it has none, so that a
+// rollback can put it back. Records are changed in place, so clone copies
+// the entry; it is nil for entries that are never changed in place. Outside
+// a transaction keep does nothing. The caller must hold the write lock.
+func keep[K comparable, V any](s *memoryStore, table map[K]V, key K, clone func(V) V) {
+	if s.tx == nil {
+		return
+	}
+
+	old, ok := table[key]
+	if ok && clone != nil {
+		old = clone(old)
+	}
+
+	s.tx.undo = append(s.tx.undo, func() {
+		if ok {
+			table[key] = old
+		} else {
+			delete(table, key)
+		}
+	})
+}
+
+// deleteWhere deletes table's entries that match, keeping each one for a
+// rollback. The caller must hold the write lock.
+func deleteWhere[K comparable, V any](s *memoryStore, table map[K]V, clone func(V) V, match func(K, V) bool) {
+	for key, value := range table {
+		if match(key, value) {
+			keep(s, table, key, clone)
+			delete(table, key)
+		}
+	}
+}
+
+// matchesSearch approximates plainto_tsquery: every search term must appear in
+// one of the fields, case-insensitively.
+func matchesSearch(search string, fields ...string) bool {
+	if search == "" {
+		return true
+	}
+
+	text := strings.ToLower(strings.Join(fields, " "))
+	for _, term := range strings.Fields(strings.ToLower(search)) {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortRecords sorts records by the filter's sort column, falling back to id.
+func sortRecords[T any](records []T, filters Filters, compare func(a, b T, column string) int, id func(T) int64) {
+	column := filters.sortColumn()
+	descending := filters.sortDirection() == "DESC"
+
+	slices.SortFunc(records, func(a, b T) int {
+		c := compare(a, b, column)
+		if descending {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Compare(id(a), id(b))
+		}
+		return c
+	})
+}
+
+// paginate sorts records and returns the requested page along with its
+// metadata.
+func paginate[T any](records []T, filters Filters, compare func(a, b T, column string) int, id func(T) int64) ([]T, Metadata) {
+	sortRecords(records, filters, compare, id)
+
+	start := min(filters.offset(), len(records))
+	end := min(start+filters.limit(), len(records))
+
+	// Postgres reports the total through COUNT(*) OVER(), which yields
+	// nothing at all for a page past the end.
+	if start == end {
+		return records[start:end], Metadata{}
+	}
+
+	return records[start:end], calculateMetadata(len(records), filters.Page, filters.PageSize)
+}
+
+func bountyValue(b *Berries) Berries {
+	if b == nil {
+		return 0
+	}
+	return *b
+}
+
+func cloneAPIKey(k *APIKey) *APIKey {
+	clone := *k
+	clone.Scopes = slices.Clone(k.Scopes)
+	if clone.Scopes == nil {
+		clone.Scopes = []string{}
+	}
+	if k.RateLimit != nil {
+		rateLimit := *k.RateLimit
+		clone.RateLimit = &rateLimit
+	}
+	if k.Quota != nil {
+		quota := *k.Quota
+		clone.Quota = &quota
+	}
+	return &clone
+}
+
+func cloneWebhook(w *Webhook) *Webhook {
+	clone := *w
+	clone.Resources = slices.Clone(w.Resources)
+	return &clone
+}
+
+func cloneDelivery(d *WebhookDelivery) *WebhookDelivery {
+	clone := *d
+	if d.NextAttemptAt != nil {
+		nextAttemptAt := *d.NextAttemptAt
+		clone.NextAttemptAt = &nextAttemptAt
+	}
+	if d.ResponseStatus != nil {
+		responseStatus := *d.ResponseStatus
+		clone.ResponseStatus = &responseStatus
+	}
+	if d.DeliveredAt != nil {
+		deliveredAt := *d.DeliveredAt
+		clone.DeliveredAt = &deliveredAt
+	}
+	return &clone
+}
+
+func cloneCharacter(c *Character) *Character {
+	clone := *c
+	if c.Bounty != nil {
+		bounty := *c.Bounty
+		clone.Bounty = &bounty
+	}
+	return &clone
+}
+
+func cloneDevilFruit(df *DevilFruit) *DevilFruit {
+	clone := *df
+	clone.PreviousOwners = slices.Clone(df.PreviousOwners)
+	return &clone
+}
+
+func cloneCrew(c *Crew) *Crew {
+	clone := *c
+	return &clone
+}
+
+func cloneUsage(u *Usage) *Usage {
+	clone := *u
+	return &clone
+}
+
+// trashed is a record in the trash and when it was put there.
+type trashed[T any] struct {
+	record    T
+	deletedAt time.Time
+}
+
+func cloneTrash[T any](trash map[int64]trashed[T], cloneRecord func(T) T) map[int64]trashed[T] {
+	cloneEntry := cloneTrashed(cloneRecord)
+
+	clone := make(map[int64]trashed[T], len(trash))
+	for id, entry := range trash {
+		clone[id] = cloneEntry(entry)
+	}
+	return clone
+}
+
+// cloneTrashed returns a function that copies one entry of the trash.
+func cloneTrashed[T any](cloneRecord func(T) T) func(trashed[T]) trashed[T] {
+	return func(entry trashed[T]) trashed[T] {
+		return trashed[T]{record: cloneRecord(entry.record), deletedAt: entry.deletedAt}
+	}
+}
+
+// memberCount counts a crew's members, leaving out characters in the trash.
+// The caller must hold the lock.
+func (s *memoryStore) memberCount(crewID int64) int {
+	count := 0
+	for characterID := range s.crewMembers[crewID] {
+		if _, ok := s.characters[characterID]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// adjustCrewBounties adds delta to the total bounty of every crew the
+// character belongs to, including crews in the trash. The caller must hold
+// the lock.
+func (s *memoryStore) adjustCrewBounties(characterID int64, delta Berries, now time.Time) {
+	for crewID, members := range s.crewMembers {
+		if _, ok := members[characterID]; !ok {
+			continue
+		}
+
+		crew, ok := s.crews[crewID]
+		if ok {
+			keep(s, s.crews, crewID, cloneCrew)
+		} else {
+			keep(s, s.trashedCrews, crewID, cloneTrashed(cloneCrew))
+			crew = s.trashedCrews[crewID].record
+		}
+
+		crew.TotalBounty += delta
+		crew.UpdatedAt = now
+		crew.Version++
+	}
+}
+
+// audit appends a change to the audit log. The caller must hold the write
+// lock.
+func (s *memoryStore) audit(ctx context.Context, entity string, id int64, action string, before, after any) error {
+	entry, err := newAuditEntry(ctx, entity, id, action, before, after)
+	if err != nil {
+		return err
+	}
+
+	s.nextAuditID++
+	entry.ID = s.nextAuditID
+	entry.CreatedAt = time.Now().Truncate(time.Second)
+
+	s.auditLog = append(s.auditLog, entry)
+
+	return nil
+}
+
+// recordChange appends a change to the change feed. record is nil for
+// deletes. The caller must hold the write lock.
+func (s *memoryStore) recordChange(entity string, id int64, action string, record any) error {
+	return s.recordEvent(entity, id, action, eventName(entity, action+"d"), record)
+}
+
+// recordEvent is recordChange for changes that have their own event.
+func (s *memoryStore) recordEvent(entity string, id int64, action, event string, record any) error {
+	change := &Change{Entity: entity, ID: id, Action: action, Event: event, ChangedAt: time.Now().Truncate(time.Second)}
+
+	if record != nil {
+		js, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		change.Data = js
+	}
+
+	s.nextChangeSeq++
+	change.Seq = s.nextChangeSeq
+
+	s.changes = append(s.changes, change)
+
+	err := s.queueDeliveries(change)
+	if err != nil {
+		return err
+	}
+
+	// Listeners read the feed under the read lock, so they won't see the
+	// change until the write (or the transaction around it) is done.
+	for notify := range s.changeListeners {
+		wake(notify)
+	}
+
+	return nil
+}
+
+// queueDeliveries queues a change for every webhook that wants it. The
+// caller must hold the write lock.
+func (s *memoryStore) queueDeliveries(change *Change) error {
+	var payload json.RawMessage
+
+	for _, id := range slices.Sorted(maps.Keys(s.webhooks)) {
+		webhook := s.webhooks[id]
+
+		apiKey, ok := s.apiKeys[webhook.APIKeyID]
+		if !ok || !apiKey.IsActive || apiKey.expired() {
+			continue
+		}
+		if len(webhook.Resources) > 0 && !slices.Contains(webhook.Resources, change.Entity) {
+			continue
+		}
+
+		if payload == nil {
+			js, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			payload = js
+		}
+
+		s.queueDelivery(webhook.ID, change.Event, payload, change.ChangedAt)
+	}
+
+	return nil
+}
+
+// queueDelivery adds a pending delivery, due at dueAt. The caller must hold
+// the write lock.
+func (s *memoryStore) queueDelivery(webhookID int64, event string, payload json.RawMessage, dueAt time.Time) *WebhookDelivery {
+	s.nextDeliveryID++
+
+	delivery := &WebhookDelivery{
+		ID:            s.nextDeliveryID,
+		CreatedAt:     time.Now().Truncate(time.Second),
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &dueAt,
+	}
+
+	keep(s, s.webhookDeliveries, delivery.ID, cloneDelivery)
+	s.webhookDeliveries[delivery.ID] = delivery
+
+	return delivery
+}
+
+// recordCrewChanges adds the live crews a character belongs to to the change
+// feed, once the character's bounty has been added to or taken out of their
+// totals. The caller must hold the write lock.
+func (s *memoryStore) recordCrewChanges(characterID int64) error {
+	var crewIDs []int64
+
+	for crewID, members := range s.crewMembers {
+		if _, ok := members[characterID]; ok {
+			if _, live := s.crews[crewID]; live {
+				crewIDs = append(crewIDs, crewID)
+			}
+		}
+	}
+
+	slices.Sort(crewIDs)
+
+	for _, crewID := range crewIDs {
+		crew := cloneCrew(s.crews[crewID])
+		crew.MemberCount = s.memberCount(crewID)
+
+		err := s.recordChange("crews", crewID, ChangeUpdate, crew)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revisionKey identifies the record a revision belongs to.
+type revisionKey struct {
+	entity string
+	id     int64
+}
+
+// saveRevisions snapshots records, skipping any version that already has a
+// revision. The caller must hold the write lock.
+func (s *memoryStore) saveRevisions(entity string, records ...versioned) error {
+	for _, record := range records {
+		id, version, updatedAt := record.revision()
+		key := revisionKey{entity: entity, id: id}
+
+		if slices.ContainsFunc(s.revisions[key], func(r *Revision) bool { return r.Revision == version }) {
+			continue
+		}
+
+		js, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		// Revisions are only ever appended, so the old slice is enough to
+		// put them back.
+		keep(s, s.revisions, key, nil)
+		s.revisions[key] = append(s.revisions[key], &Revision{Revision: version, CreatedAt: updatedAt, Data: js})
+	}
+
+	return nil
+}
+
+// nameTaken reports whether another record already uses name.
+func nameTaken[T any](records map[int64]T, id int64, name string, nameOf func(T) string) bool {
+	for otherID, record := range records {
+		if otherID != id && nameOf(record) == name {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryCharacterModel struct {
+	memoryModel
+}
+
+func (m memoryCharacterModel) Insert(ctx context.Context, character *Character) error {
+	defer m.lock()()
+
+	if nameTaken(m.store.characters, 0, character.Name, func(c *Character) string { return c.Name }) {
+		return ErrDuplicateName
+	}
+
+	m.store.nextCharacterID++
+	now := time.Now().Truncate(time.Second)
+
+	character.ID = m.store.nextCharacterID
+	character.CreatedAt = now
+	character.UpdatedAt = now
+	character.Version = 1
+
+	keep(m.store, m.store.characters, character.ID, cloneCharacter)
+	m.store.characters[character.ID] = cloneCharacter(character)
+
+	err := m.store.saveRevisions("characters", character)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.audit(ctx, "characters", character.ID, AuditCreate, nil, character)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("characters", character.ID, ChangeCreate, character)
+}
+
+func (m memoryCharacterModel) Get(ctx context.Context, id int64) (*Character, error) {
+	defer m.rlock()()
+
+	character, ok := m.store.characters[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneCharacter(character), nil
+}
+
+func (m memoryCharacterModel) GetByName(ctx context.Context, name string) (*Character, error) {
+	defer m.rlock()()
+
+	for _, record := range m.store.characters {
+		if record.Name == name {
+			return cloneCharacter(record), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryCharacterModel) Update(ctx context.Context, character *Character) error {
+	defer m.lock()()
+
+	existing, ok := m.store.characters[character.ID]
+	if !ok || existing.Version != character.Version {
+		return ErrEditConflict
+	}
+
+	if nameTaken(m.store.characters, character.ID, character.Name, func(c *Character) string { return c.Name }) {
+		return ErrDuplicateName
+	}
+
+	character.CreatedAt = existing.CreatedAt
+	character.UpdatedAt = time.Now().Truncate(time.Second)
+	character.Version = existing.Version + 1
+
+	keep(m.store, m.store.characters, character.ID, cloneCharacter)
+	m.store.characters[character.ID] = cloneCharacter(character)
+
+	err := m.store.saveRevisions("characters", existing, character)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.audit(ctx, "characters", character.ID, AuditUpdate, existing, character)
+	if err != nil {
+		return err
+	}
+
+	event := eventName("characters", "updated")
+	if !sameBounty(existing.Bounty, character.Bounty) {
+		event = EventBountyChanged
+	}
+
+	return m.store.recordEvent("characters", character.ID, ChangeUpdate, event, character)
+}
+
+func (m memoryCharacterModel) Delete(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	character, ok := m.store.characters[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	for _, crew := range m.store.crews {
+		if crew.CaptainID == id {
+			return ErrCaptain
+		}
+	}
+
+	before := cloneCharacter(character)
+	now := time.Now().Truncate(time.Second)
+
+	keep(m.store, m.store.characters, id, cloneCharacter)
+	keep(m.store, m.store.trashedCharacters, id, cloneTrashed(cloneCharacter))
+
+	character.UpdatedAt = now
+	character.Version++
+
+	delete(m.store.characters, id)
+	m.store.trashedCharacters[id] = trashed[*Character]{record: character, deletedAt: now}
+
+	m.store.adjustCrewBounties(id, -bountyValue(character.Bounty), now)
+
+	err := m.store.audit(ctx, "characters", id, AuditDelete, before, nil)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.recordChange("characters", id, ChangeDelete, nil)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordCrewChanges(id)
+}
+
+func (m memoryCharacterModel) Restore(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	entry, ok := m.store.trashedCharacters[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	character := entry.record
+
+	if nameTaken(m.store.characters, id, character.Name, func(c *Character) string { return c.Name }) {
+		return ErrDuplicateName
+	}
+
+	now := time.Now().Truncate(time.Second)
+
+	keep(m.store, m.store.trashedCharacters, id, cloneTrashed(cloneCharacter))
+	keep(m.store, m.store.characters, id, cloneCharacter)
+
+	character.UpdatedAt = now
+	character.Version++
+
+	delete(m.store.trashedCharacters, id)
+	m.store.characters[id] = character
+
+	m.store.adjustCrewBounties(id, bountyValue(character.Bounty), now)
+
+	err := m.store.audit(ctx, "characters", id, AuditRestore, nil, character)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.recordEvent("characters", id, ChangeCreate, eventName("characters", "restored"), character)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordCrewChanges(id)
+}
+
+func (m memoryCharacterModel) GetAll(ctx context.Context, search string, age int, origin, race string, bounty Berries, filters Filters) ([]*Character, Metadata, error) {
+	defer m.rlock()()
+
+	page, metadata := paginate(m.matching(search, age, origin, race, bounty, filters), filters, compareCharacters, characterRecordID)
+
+	return page, metadata, nil
+}
+
+func (m memoryCharacterModel) Stream(ctx context.Context, search string, age int, origin, race string, bounty Berries, filters Filters, fn func(*Character) error) error {
+	unlock := m.rlock()
+	characters := m.matching(search, age, origin, race, bounty, filters)
+	unlock()
+
+	sortRecords(characters, filters, compareCharacters, characterRecordID)
+
+	for _, character := range characters {
+		err := fn(character)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matching returns copies of the characters that pass the GetAll filters,
+// in no particular order. The caller must hold the lock.
+func (m memoryCharacterModel) matching(search string, age int, origin, race string, bounty Berries, filters Filters) []*Character {
+	sortByBounty := strings.Contains(filters.Sort, "bounty")
+
+	characters := []*Character{}
+
+	for _, character := range m.store.characters {
+		if !matchesSearch(search, character.Name, character.Description) {
+			continue
+		}
+		if race != "" && !strings.EqualFold(character.Race, race) {
+			continue
+		}
+		if age != 0 && character.Age < age {
+			continue
+		}
+		if origin != "" && !strings.Contains(strings.ToLower(character.Origin), strings.ToLower(origin)) {
+			continue
+		}
+		if sortByBounty {
+			if character.Bounty == nil || *character.Bounty < bounty || *character.Bounty <= 0 {
+				continue
+			}
+		} else if bounty != 0 && (character.Bounty == nil || *character.Bounty < bounty) {
+			continue
+		}
+
+		characters = append(characters, cloneCharacter(character))
+	}
+
+	return characters
+}
+
+func characterRecordID(c *Character) int64 { return c.ID }
+
+func compareCharacters(a, b *Character, column string) int {
+	switch column {
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "age":
+		return cmp.Compare(a.Age, b.Age)
+	case "bounty":
+		return cmp.Compare(bountyValue(a.Bounty), bountyValue(b.Bounty))
+	case "race":
+		return strings.Compare(a.Race, b.Race)
+	default:
+		return cmp.Compare(a.ID, b.ID)
+	}
+}
+
+type memoryDevilFruitModel struct {
+	memoryModel
+}
+
+func (m memoryDevilFruitModel) Insert(ctx context.Context, devilFruit *DevilFruit) error {
+	defer m.lock()()
+
+	if nameTaken(m.store.devilFruits, 0, devilFruit.Name, func(df *DevilFruit) string { return df.Name }) {
+		return ErrDuplicateName
+	}
+
+	m.store.nextDevilFruitID++
+	now := time.Now().Truncate(time.Second)
+
+	devilFruit.ID = m.store.nextDevilFruitID
+	devilFruit.CreatedAt = now
+	devilFruit.UpdatedAt = now
+	devilFruit.Version = 1
+
+	keep(m.store, m.store.devilFruits, devilFruit.ID, cloneDevilFruit)
+	m.store.devilFruits[devilFruit.ID] = cloneDevilFruit(devilFruit)
+
+	err := m.store.saveRevisions("devilfruits", devilFruit)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.audit(ctx, "devilfruits", devilFruit.ID, AuditCreate, nil, devilFruit)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("devilfruits", devilFruit.ID, ChangeCreate, devilFruit)
+}
+
+func (m memoryDevilFruitModel) Get(ctx context.Context, id int64) (*DevilFruit, error) {
+	defer m.rlock()()
+
+	devilFruit, ok := m.store.devilFruits[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneDevilFruit(devilFruit), nil
+}
+
+func (m memoryDevilFruitModel) GetByName(ctx context.Context, name string) (*DevilFruit, error) {
+	defer m.rlock()()
+
+	for _, record := range m.store.devilFruits {
+		if record.Name == name {
+			return cloneDevilFruit(record), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryDevilFruitModel) Update(ctx context.Context, devilFruit *DevilFruit) error {
+	defer m.lock()()
+
+	existing, ok := m.store.devilFruits[devilFruit.ID]
+	if !ok || existing.Version != devilFruit.Version {
+		return ErrEditConflict
+	}
+
+	if nameTaken(m.store.devilFruits, devilFruit.ID, devilFruit.Name, func(df *DevilFruit) string { return df.Name }) {
+		return ErrDuplicateName
+	}
+
+	devilFruit.CreatedAt = existing.CreatedAt
+	devilFruit.UpdatedAt = time.Now().Truncate(time.Second)
+	devilFruit.Version = existing.Version + 1
+
+	keep(m.store, m.store.devilFruits, devilFruit.ID, cloneDevilFruit)
+	m.store.devilFruits[devilFruit.ID] = cloneDevilFruit(devilFruit)
+
+	err := m.store.saveRevisions("devilfruits", existing, devilFruit)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.audit(ctx, "devilfruits", devilFruit.ID, AuditUpdate, existing, devilFruit)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("devilfruits", devilFruit.ID, ChangeUpdate, devilFruit)
+}
+
+func (m memoryDevilFruitModel) Delete(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	devilFruit, ok := m.store.devilFruits[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	before := cloneDevilFruit(devilFruit)
+	now := time.Now().Truncate(time.Second)
+
+	keep(m.store, m.store.devilFruits, id, cloneDevilFruit)
+	keep(m.store, m.store.trashedDevilFruits, id, cloneTrashed(cloneDevilFruit))
+
+	devilFruit.UpdatedAt = now
+	devilFruit.Version++
+
+	delete(m.store.devilFruits, id)
+	m.store.trashedDevilFruits[id] = trashed[*DevilFruit]{record: devilFruit, deletedAt: now}
+
+	err := m.store.audit(ctx, "devilfruits", id, AuditDelete, before, nil)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("devilfruits", id, ChangeDelete, nil)
+}
+
+func (m memoryDevilFruitModel) Restore(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	entry, ok := m.store.trashedDevilFruits[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	devilFruit := entry.record
+
+	if nameTaken(m.store.devilFruits, id, devilFruit.Name, func(df *DevilFruit) string { return df.Name }) {
+		return ErrDuplicateName
+	}
+
+	keep(m.store, m.store.trashedDevilFruits, id, cloneTrashed(cloneDevilFruit))
+	keep(m.store, m.store.devilFruits, id, cloneDevilFruit)
+
+	devilFruit.UpdatedAt = time.Now().Truncate(time.Second)
+	devilFruit.Version++
+
+	delete(m.store.trashedDevilFruits, id)
+	m.store.devilFruits[id] = devilFruit
+
+	err := m.store.audit(ctx, "devilfruits", id, AuditRestore, nil, devilFruit)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordEvent("devilfruits", id, ChangeCreate, eventName("devilfruits", "restored"), devilFruit)
+}
+
+func (m memoryDevilFruitModel) GetAll(ctx context.Context, search, fruitType string, filters Filters) ([]*DevilFruit, Metadata, error) {
+	defer m.rlock()()
+
+	page, metadata := paginate(m.matching(search, fruitType), filters, compareDevilFruits, devilFruitRecordID)
+
+	return page, metadata, nil
+}
+
+func (m memoryDevilFruitModel) Stream(ctx context.Context, search, fruitType string, filters Filters, fn func(*DevilFruit) error) error {
+	unlock := m.rlock()
+	devilFruits := m.matching(search, fruitType)
+	unlock()
+
+	sortRecords(devilFruits, filters, compareDevilFruits, devilFruitRecordID)
+
+	for _, devilFruit := range devilFruits {
+		err := fn(devilFruit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matching returns copies of the devil fruits that pass the GetAll filters,
+// in no particular order. The caller must hold the lock.
+func (m memoryDevilFruitModel) matching(search, fruitType string) []*DevilFruit {
+	devilFruits := []*DevilFruit{}
+
+	for _, devilFruit := range m.store.devilFruits {
+		if !matchesSearch(search, devilFruit.Name, devilFruit.Description) {
+			continue
+		}
+		if fruitType != "" && !strings.EqualFold(devilFruit.Type, fruitType) {
+			continue
+		}
+
+		devilFruits = append(devilFruits, cloneDevilFruit(devilFruit))
+	}
+
+	return devilFruits
+}
+
+func devilFruitRecordID(df *DevilFruit) int64 { return df.ID }
+
+func compareDevilFruits(a, b *DevilFruit, column string) int {
+	switch column {
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	default:
+		return cmp.Compare(a.ID, b.ID)
+	}
+}
+
+type memoryCrewModel struct {
+	memoryModel
+}
+
+func (m memoryCrewModel) Insert(ctx context.Context, crew *Crew) error {
+	defer m.lock()()
+
+	if nameTaken(m.store.crews, 0, crew.Name, func(c *Crew) string { return c.Name }) {
+		return ErrDuplicateName
+	}
+
+	m.store.nextCrewID++
+	now := time.Now().Truncate(time.Second)
+
+	crew.ID = m.store.nextCrewID
+	crew.CreatedAt = now
+	crew.UpdatedAt = now
+	crew.Version = 1
+
+	keep(m.store, m.store.crews, crew.ID, cloneCrew)
+	keep(m.store, m.store.crewMembers, crew.ID, nil)
+
+	m.store.crews[crew.ID] = cloneCrew(crew)
+	m.store.crewMembers[crew.ID] = make(map[int64]struct{})
+
+	err := m.store.saveRevisions("crews", crew)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.audit(ctx, "crews", crew.ID, AuditCreate, nil, crew)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("crews", crew.ID, ChangeCreate, crew)
+}
+
+func (m memoryCrewModel) Get(ctx context.Context, id int64) (*Crew, error) {
+	defer m.rlock()()
+
+	crew, ok := m.store.crews[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	clone := cloneCrew(crew)
+	clone.MemberCount = m.store.memberCount(id)
+
+	return clone, nil
+}
+
+func (m memoryCrewModel) GetByName(ctx context.Context, name string) (*Crew, error) {
+	defer m.rlock()()
+
+	for _, crew := range m.store.crews {
+		if crew.Name == name {
+			clone := cloneCrew(crew)
+			clone.MemberCount = m.store.memberCount(crew.ID)
+			return clone, nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryCrewModel) Update(ctx context.Context, crew *Crew) error {
+	defer m.lock()()
+
+	existing, ok := m.store.crews[crew.ID]
+	if !ok || existing.Version != crew.Version {
+		return ErrEditConflict
+	}
+
+	if nameTaken(m.store.crews, crew.ID, crew.Name, func(c *Crew) string { return c.Name }) {
+		return ErrDuplicateName
+	}
+
+	crew.CreatedAt = existing.CreatedAt
+	crew.UpdatedAt = time.Now().Truncate(time.Second)
+	crew.Version = existing.Version + 1
+
+	keep(m.store, m.store.crews, crew.ID, cloneCrew)
+	m.store.crews[crew.ID] = cloneCrew(crew)
+
+	before := cloneCrew(existing)
+	before.MemberCount = m.store.memberCount(crew.ID)
+
+	err := m.store.saveRevisions("crews", before, crew)
+	if err != nil {
+		return err
+	}
+
+	err = m.store.audit(ctx, "crews", crew.ID, AuditUpdate, before, crew)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("crews", crew.ID, ChangeUpdate, crew)
+}
+
+func (m memoryCrewModel) Delete(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	crew, ok := m.store.crews[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	before := cloneCrew(crew)
+	before.MemberCount = m.store.memberCount(id)
+	now := time.Now().Truncate(time.Second)
+
+	keep(m.store, m.store.crews, id, cloneCrew)
+	keep(m.store, m.store.trashedCrews, id, cloneTrashed(cloneCrew))
+
+	crew.UpdatedAt = now
+	crew.Version++
+
+	delete(m.store.crews, id)
+	m.store.trashedCrews[id] = trashed[*Crew]{record: crew, deletedAt: now}
+
+	err := m.store.audit(ctx, "crews", id, AuditDelete, before, nil)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordChange("crews", id, ChangeDelete, nil)
+}
+
+func (m memoryCrewModel) Restore(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	entry, ok := m.store.trashedCrews[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	crew := entry.record
+
+	if nameTaken(m.store.crews, id, crew.Name, func(c *Crew) string { return c.Name }) {
+		return ErrDuplicateName
+	}
+
+	keep(m.store, m.store.trashedCrews, id, cloneTrashed(cloneCrew))
+	keep(m.store, m.store.crews, id, cloneCrew)
+
+	crew.UpdatedAt = time.Now().Truncate(time.Second)
+	crew.Version++
+
+	delete(m.store.trashedCrews, id)
+	m.store.crews[id] = crew
+
+	after := cloneCrew(crew)
+	after.MemberCount = m.store.memberCount(id)
+
+	err := m.store.audit(ctx, "crews", id, AuditRestore, nil, after)
+	if err != nil {
+		return err
+	}
+
+	return m.store.recordEvent("crews", id, ChangeCreate, eventName("crews", "restored"), after)
+}
+
+func (m memoryCrewModel) AddMember(ctx context.Context, crewID, characterID int64) error {
+	defer m.lock()()
+
+	crew, ok := m.store.crews[crewID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	character, ok := m.store.characters[characterID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	members := m.store.crewMembers[crewID]
+	if _, exists := members[characterID]; exists {
+		return ErrAlreadyMember
+	}
+
+	// A crew's member set is never replaced while the crew exists, so its
+	// entries are journaled one at a time.
+	keep(m.store, members, characterID, nil)
+	keep(m.store, m.store.crews, crewID, cloneCrew)
+
+	members[characterID] = struct{}{}
+	crew.TotalBounty += bountyValue(character.Bounty)
+	crew.UpdatedAt = time.Now().Truncate(time.Second)
+	crew.Version++
+
+	membership := CrewMembership{CrewID: crewID, CharacterID: characterID}
+
+	err := m.store.audit(ctx, "crew_members", crewID, AuditCreate, nil, membership)
+	if err != nil {
+		return err
+	}
+
+	after := cloneCrew(crew)
+	after.MemberCount = m.store.memberCount(crewID)
+
+	return m.store.recordEvent("crews", crewID, ChangeUpdate, EventCrewMemberAdded, after)
+}
+
+func (m memoryCrewModel) DeleteMember(ctx context.Context, crewID, characterID int64) error {
+	defer m.lock()()
+
+	members := m.store.crewMembers[crewID]
+	if _, exists := members[characterID]; !exists {
+		return ErrRecordNotFound
+	}
+
+	// Members in the trash are hidden, so they can't be removed either.
+	character, ok := m.store.characters[characterID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	keep(m.store, members, characterID, nil)
+	keep(m.store, m.store.crews, crewID, cloneCrew)
+
+	delete(members, characterID)
+
+	crew := m.store.crews[crewID]
+	crew.TotalBounty -= bountyValue(character.Bounty)
+	crew.UpdatedAt = time.Now().Truncate(time.Second)
+	crew.Version++
+
+	membership := CrewMembership{CrewID: crewID, CharacterID: characterID}
+
+	err := m.store.audit(ctx, "crew_members", crewID, AuditDelete, membership, nil)
+	if err != nil {
+		return err
+	}
+
+	after := cloneCrew(crew)
+	after.MemberCount = m.store.memberCount(crewID)
+
+	return m.store.recordEvent("crews", crewID, ChangeUpdate, EventCrewMemberRemoved, after)
+}
+
+func (m memoryCrewModel) GetMembers(ctx context.Context, crewID int64, bounty Berries, filters Filters) ([]*CrewMember, Metadata, error) {
+	defer m.rlock()()
+
+	sortByBounty := strings.Contains(filters.Sort, "bounty")
+
+	members := []*CrewMember{}
+
+	for characterID := range m.store.crewMembers[crewID] {
+		character, ok := m.store.characters[characterID]
+		if !ok {
+			continue
+		}
+
+		if sortByBounty {
+			if character.Bounty == nil || *character.Bounty < bounty || *character.Bounty <= 0 {
+				continue
+			}
+		} else if bounty != 0 && (character.Bounty == nil || *character.Bounty < bounty) {
+			continue
+		}
+
+		members = append(members, &CrewMember{
+			ID:     character.ID,
+			Name:   character.Name,
+			Bounty: bountyValue(character.Bounty),
+		})
+	}
+
+	compare := func(a, b *CrewMember, column string) int {
+		switch column {
+		case "name":
+			return strings.Compare(a.Name, b.Name)
+		case "bounty":
+			return cmp.Compare(a.Bounty, b.Bounty)
+		default:
+			return cmp.Compare(a.ID, b.ID)
+		}
+	}
+
+	page, metadata := paginate(members, filters, compare, func(cm *CrewMember) int64 { return cm.ID })
+
+	return page, metadata, nil
+}
+
+func (m memoryCrewModel) GetAll(ctx context.Context, search string, shipName string, totalBounty Berries, filters Filters) ([]*Crew, Metadata, error) {
+	defer m.rlock()()
+
+	page, metadata := paginate(m.matching(search, shipName, totalBounty, filters), filters, compareCrews, crewRecordID)
+
+	return page, metadata, nil
+}
+
+func (m memoryCrewModel) Stream(ctx context.Context, search string, shipName string, totalBounty Berries, filters Filters, fn func(*Crew) error) error {
+	unlock := m.rlock()
+	crews := m.matching(search, shipName, totalBounty, filters)
+	unlock()
+
+	sortRecords(crews, filters, compareCrews, crewRecordID)
+
+	for _, crew := range crews {
+		err := fn(crew)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matching returns copies of the crews that pass the GetAll filters, with
+// their member counts, in no particular order. The caller must hold the lock.
+func (m memoryCrewModel) matching(search string, shipName string, totalBounty Berries, filters Filters) []*Crew {
+	sortByBounty := strings.Contains(filters.Sort, "total_bounty")
+
+	crews := []*Crew{}
+
+	for _, crew := range m.store.crews {
+		if !matchesSearch(search, crew.Name, crew.Description, crew.ShipName, crew.CaptainName) {
+			continue
+		}
+		if shipName != "" && !strings.EqualFold(crew.ShipName, shipName) {
+			continue
+		}
+		if sortByBounty {
+			if crew.TotalBounty < totalBounty || crew.TotalBounty <= 0 {
+				continue
+			}
+		} else if totalBounty != 0 && crew.TotalBounty < totalBounty {
+			continue
+		}
+
+		clone := cloneCrew(crew)
+		clone.MemberCount = m.store.memberCount(crew.ID)
+		crews = append(crews, clone)
+	}
+
+	return crews
+}
+
+func crewRecordID(c *Crew) int64 { return c.ID }
+
+func compareCrews(a, b *Crew, column string) int {
+	switch column {
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "total_bounty":
+		return cmp.Compare(a.TotalBounty, b.TotalBounty)
+	default:
+		return cmp.Compare(a.ID, b.ID)
+	}
+}
+
+type memoryAPIKeyModel struct {
+	memoryModel
+}
+
+func (m memoryAPIKeyModel) Insert(ctx context.Context, apiKey *APIKey) error {
+	defer m.lock()()
+
+	m.store.nextAPIKeyID++
+	now := time.Now().Truncate(time.Second)
+
+	apiKey.ID = m.store.nextAPIKeyID
+	apiKey.CreatedAt = now
+	apiKey.UpdatedAt = now
+
+	keep(m.store, m.store.apiKeys, apiKey.ID, cloneAPIKey)
+	m.store.apiKeys[apiKey.ID] = cloneAPIKey(apiKey)
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) Create(ctx context.Context, apiKey *APIKey) (string, error) {
+	token := generateAPIKey(apiKey)
+
+	err := m.Insert(ctx, apiKey)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (m memoryAPIKeyModel) Get(ctx context.Context, id int64) (*APIKey, error) {
+	defer m.rlock()()
+
+	apiKey, ok := m.store.apiKeys[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneAPIKey(apiKey), nil
+}
+
+func (m memoryAPIKeyModel) GetByHash(ctx context.Context, hash string) (*APIKey, error) {
+	defer m.rlock()()
+
+	for _, apiKey := range m.store.apiKeys {
+		if apiKey.KeyHash != hash || !apiKey.IsActive {
+			continue
+		}
+
+		if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+			return nil, ErrRecordNotFound
+		}
+
+		return cloneAPIKey(apiKey), nil
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryAPIKeyModel) Update(ctx context.Context, apiKey *APIKey) error {
+	defer m.lock()()
+
+	current, ok := m.store.apiKeys[apiKey.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	apiKey.UpdatedAt = time.Now().Truncate(time.Second)
+
+	updated := cloneAPIKey(apiKey)
+	updated.CreatedAt = current.CreatedAt
+	updated.KeyHash = current.KeyHash
+	updated.SigningSecret = current.SigningSecret
+	updated.LastUsedAt = current.LastUsedAt
+	updated.ReplacedBy = current.ReplacedBy
+	updated.RotatedAt = current.RotatedAt
+
+	keep(m.store, m.store.apiKeys, apiKey.ID, cloneAPIKey)
+	m.store.apiKeys[apiKey.ID] = updated
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) Rotate(ctx context.Context, id int64, grace time.Duration) (*APIKey, string, error) {
+	defer m.lock()()
+
+	current, ok := m.store.apiKeys[id]
+	if !ok {
+		return nil, "", ErrRecordNotFound
+	}
+
+	if !current.IsActive || current.expired() || current.Rotated() {
+		return nil, "", ErrKeyInactive
+	}
+
+	successor := cloneAPIKey(current).successor()
+	token := generateAPIKey(successor)
+
+	m.store.nextAPIKeyID++
+	now := time.Now().Truncate(time.Second)
+
+	successor.ID = m.store.nextAPIKeyID
+	successor.CreatedAt = now
+	successor.UpdatedAt = now
+
+	keep(m.store, m.store.apiKeys, successor.ID, cloneAPIKey)
+	m.store.apiKeys[successor.ID] = cloneAPIKey(successor)
+
+	expiresAt := now.Add(grace)
+	if current.ExpiresAt != nil && current.ExpiresAt.Before(expiresAt) {
+		expiresAt = *current.ExpiresAt
+	}
+
+	replacedBy := successor.ID
+
+	keep(m.store, m.store.apiKeys, id, cloneAPIKey)
+
+	current.ReplacedBy = &replacedBy
+	current.RotatedAt = &now
+	current.UpdatedAt = now
+	current.ExpiresAt = &expiresAt
+
+	for webhookID, webhook := range m.store.webhooks {
+		if webhook.APIKeyID == id {
+			keep(m.store, m.store.webhooks, webhookID, cloneWebhook)
+			webhook.APIKeyID = successor.ID
+		}
+	}
+
+	return successor, token, nil
+}
+
+func (m memoryAPIKeyModel) Delete(ctx context.Context, id int64) error {
+	defer m.lock()()
+
+	if _, ok := m.store.apiKeys[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	keep(m.store, m.store.apiKeys, id, cloneAPIKey)
+	delete(m.store.apiKeys, id)
+
+	for otherID, apiKey := range m.store.apiKeys {
+		if apiKey.ReplacedBy != nil && *apiKey.ReplacedBy == id {
+			keep(m.store, m.store.apiKeys, otherID, cloneAPIKey)
+			apiKey.ReplacedBy = nil
+		}
+	}
+
+	deleteWhere(m.store, m.store.webhooks, cloneWebhook, func(_ int64, w *Webhook) bool {
+		return w.APIKeyID == id
+	})
+	deleteWhere(m.store, m.store.quotaUsage, nil, func(key quotaKey, _ int64) bool {
+		return key.apiKeyID == id
+	})
+	deleteWhere(m.store, m.store.usage, cloneUsage, func(key usageKey, _ *Usage) bool {
+		return key.apiKeyID == id
+	})
+	deleteWhere(m.store, m.store.nonces, nil, func(key nonceKey, _ time.Time) bool {
+		return key.apiKeyID == id
+	})
+	deleteWhere(m.store, m.store.webhookDeliveries, cloneDelivery, func(_ int64, d *WebhookDelivery) bool {
+		_, ok := m.store.webhooks[d.WebhookID]
+		return !ok
+	})
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) UpdateLastUsed(ctx context.Context, lastUsed map[int64]time.Time) error {
+	defer m.lock()()
+
+	for id, at := range lastUsed {
+		apiKey, ok := m.store.apiKeys[id]
+		if !ok {
+			continue
+		}
+
+		at = at.Truncate(time.Second)
+		if apiKey.LastUsedAt == nil || at.After(*apiKey.LastUsedAt) {
+			keep(m.store, m.store.apiKeys, id, cloneAPIKey)
+			apiKey.LastUsedAt = &at
+		}
+	}
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) NewSigningSecret(ctx context.Context, id int64) (string, error) {
+	defer m.lock()()
+
+	apiKey, ok := m.store.apiKeys[id]
+	if !ok {
+		return "", ErrRecordNotFound
+	}
+
+	keep(m.store, m.store.apiKeys, id, cloneAPIKey)
+
+	apiKey.SigningSecret = generateSigningSecret()
+	apiKey.UpdatedAt = time.Now().Truncate(time.Second)
+
+	return apiKey.SigningSecret, nil
+}
+
+// nonceKey identifies a nonce used by one key.
+type nonceKey struct {
+	apiKeyID int64
+	nonce    string
+}
+
+func (m memoryAPIKeyModel) UseNonce(ctx context.Context, id int64, nonce string, expiresAt time.Time) error {
+	defer m.lock()()
+
+	key := nonceKey{id, nonce}
+
+	if used, ok := m.store.nonces[key]; ok && used.After(time.Now()) {
+		return ErrNonceUsed
+	}
+
+	keep(m.store, m.store.nonces, key, nil)
+	m.store.nonces[key] = expiresAt
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) PurgeNonces(ctx context.Context, t time.Time) error {
+	defer m.lock()()
+
+	deleteWhere(m.store, m.store.nonces, nil, func(_ nonceKey, expiresAt time.Time) bool {
+		return expiresAt.Before(t)
+	})
+
+	return nil
+}
+
+// quotaKey identifies a key's usage in one quota period.
+type quotaKey struct {
+	apiKeyID    int64
+	periodStart int64 // unix seconds
+}
+
+func (m memoryAPIKeyModel) CountRequest(ctx context.Context, id int64, periodStart time.Time, limit int64) (int64, error) {
+	defer m.lock()()
+
+	key := quotaKey{id, periodStart.Unix()}
+	if m.store.quotaUsage[key] >= limit {
+		return 0, ErrQuotaExceeded
+	}
+
+	keep(m.store, m.store.quotaUsage, key, nil)
+	m.store.quotaUsage[key]++
+
+	return m.store.quotaUsage[key], nil
+}
+
+func (m memoryAPIKeyModel) QuotaUsage(ctx context.Context, id int64, periodStart time.Time) (int64, error) {
+	defer m.rlock()()
+
+	return m.store.quotaUsage[quotaKey{id, periodStart.Unix()}], nil
+}
+
+func (m memoryAPIKeyModel) GetAll(ctx context.Context) ([]*APIKey, error) {
+	defer m.rlock()()
+
+	apiKeys := []*APIKey{}
+
+	for _, apiKey := range m.store.apiKeys {
+		apiKeys = append(apiKeys, cloneAPIKey(apiKey))
+	}
+
+	slices.SortFunc(apiKeys, func(a, b *APIKey) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return apiKeys, nil
+}
+
+type memoryTrashModel struct {
+	memoryModel
+}
+
+func (m memoryTrashModel) GetAll(ctx context.Context, resource string, filters Filters) ([]*TrashedRecord, Metadata, error) {
+	defer m.rlock()()
+
+	records := []*TrashedRecord{}
+
+	add := func(name string, id int64, recordName string, deletedAt time.Time) {
+		if resource == "" || resource == name {
+			records = append(records, &TrashedRecord{Resource: name, ID: id, Name: recordName, DeletedAt: deletedAt})
+		}
+	}
+
+	for id, entry := range m.store.trashedCharacters {
+		add("characters", id, entry.record.Name, entry.deletedAt)
+	}
+	for id, entry := range m.store.trashedDevilFruits {
+		add("devilfruits", id, entry.record.Name, entry.deletedAt)
+	}
+	for id, entry := range m.store.trashedCrews {
+		add("crews", id, entry.record.Name, entry.deletedAt)
+	}
+
+	compare := func(a, b *TrashedRecord, column string) int {
+		if c := a.DeletedAt.Compare(b.DeletedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Resource, b.Resource)
+	}
+
+	page, metadata := paginate(records, filters, compare, func(r *TrashedRecord) int64 { return r.ID })
+
+	return page, metadata, nil
+}
+
+func (m memoryTrashModel) Purge(ctx context.Context, before time.Time) (map[string]int64, error) {
+	defer m.lock()()
+
+	purged := make(map[string]int64, len(TrashResources))
+
+	for id, entry := range m.store.trashedCrews {
+		if entry.deletedAt.Before(before) {
+			purgeTrashed(m.store, m.store.trashedCrews, cloneCrew, "crews", id)
+
+			keep(m.store, m.store.crewMembers, id, nil)
+			delete(m.store.crewMembers, id)
+			purged["crews"]++
+		}
+	}
+
+	for id, entry := range m.store.trashedDevilFruits {
+		if entry.deletedAt.Before(before) {
+			purgeTrashed(m.store, m.store.trashedDevilFruits, cloneDevilFruit, "devilfruits", id)
+			purged["devilfruits"]++
+		}
+	}
+
+	for id, entry := range m.store.trashedCharacters {
+		if entry.deletedAt.Before(before) && !m.store.isCaptain(id) {
+			purgeTrashed(m.store, m.store.trashedCharacters, cloneCharacter, "characters", id)
+			m.store.purgeCharacter(id)
+			purged["characters"]++
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeTrashed deletes a record from the trash along with its revisions.
+// The caller must hold the write lock.
+func purgeTrashed[T any](s *memoryStore, trash map[int64]trashed[T], cloneRecord func(T) T, entity string, id int64) {
+	keep(s, trash, id, cloneTrashed(cloneRecord))
+	delete(trash, id)
+
+	key := revisionKey{entity: entity, id: id}
+	keep(s, s.revisions, key, nil)
+	delete(s.revisions, key)
+}
+
+// isCaptain reports whether the character captains a crew, in the trash or
+// out of it. The caller must hold the lock.
+func (s *memoryStore) isCaptain(id int64) bool {
+	for _, crew := range s.crews {
+		if crew.CaptainID == id {
+			return true
+		}
+	}
+	for _, entry := range s.trashedCrews {
+		if entry.record.CaptainID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeCharacter mirrors the foreign keys on a character's hard delete:
+// memberships cascade and owners are set to NULL. Captains aren't purged.
+// The caller must hold the lock.
+func (s *memoryStore) purgeCharacter(id int64) {
+	for _, members := range s.crewMembers {
+		if _, ok := members[id]; ok {
+			keep(s, members, id, nil)
+			delete(members, id)
+		}
+	}
+
+	owned := func(devilFruit *DevilFruit) bool {
+		return devilFruit.Character_id.Valid && devilFruit.Character_id.Int64 == id
+	}
+	for fruitID, devilFruit := range s.devilFruits {
+		if owned(devilFruit) {
+			keep(s, s.devilFruits, fruitID, cloneDevilFruit)
+			devilFruit.Character_id = sql.NullInt64{}
+		}
+	}
+	for fruitID, entry := range s.trashedDevilFruits {
+		if owned(entry.record) {
+			keep(s, s.trashedDevilFruits, fruitID, cloneTrashed(cloneDevilFruit))
+			entry.record.Character_id = sql.NullInt64{}
+		}
+	}
+}
+
+type memoryAuditModel struct {
+	memoryModel
+}
+
+func (m memoryAuditModel) GetAll(ctx context.Context, entity string, entityID, apiKeyID int64, filters Filters) ([]*AuditEntry, Metadata, error) {
+	defer m.rlock()()
+
+	entries := []*AuditEntry{}
+
+	for _, entry := range m.store.auditLog {
+		if entity != "" && entry.Entity != entity {
+			continue
+		}
+		if entityID != 0 && entry.EntityID != entityID {
+			continue
+		}
+		if apiKeyID != 0 && (entry.APIKeyID == nil || *entry.APIKeyID != apiKeyID) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	page, metadata := paginate(entries, filters, func(a, b *AuditEntry, column string) int {
+		return cmp.Compare(a.ID, b.ID)
+	}, func(e *AuditEntry) int64 { return e.ID })
+
+	return page, metadata, nil
+}
+
+type memoryRevisionModel struct {
+	memoryModel
+}
+
+func (m memoryRevisionModel) GetAll(ctx context.Context, entity string, id int64, filters Filters) ([]*Revision, Metadata, error) {
+	defer m.rlock()()
+
+	revisions := slices.Clone(m.store.revisions[revisionKey{entity: entity, id: id}])
+
+	page, metadata := paginate(revisions, filters, func(a, b *Revision, column string) int {
+		return cmp.Compare(a.Revision, b.Revision)
+	}, func(r *Revision) int64 { return int64(r.Revision) })
+
+	return page, metadata, nil
+}
+
+func (m memoryRevisionModel) Get(ctx context.Context, entity string, id int64, revision int32) (*Revision, error) {
+	defer m.rlock()()
+
+	for _, r := range m.store.revisions[revisionKey{entity: entity, id: id}] {
+		if r.Revision == revision {
+			return r, nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+type memoryChangeModel struct {
+	memoryModel
+}
+
+func (m memoryChangeModel) GetSince(ctx context.Context, since int64, limit int) ([]*Change, error) {
+	defer m.rlock()()
+
+	// Sequence numbers start at 1 and have no gaps, so they index the log.
+	start := min(max(since, 0), int64(len(m.store.changes)))
+	end := min(start+int64(limit), int64(len(m.store.changes)))
+
+	return append([]*Change{}, m.store.changes[start:end]...), nil
+}
+
+func (m memoryChangeModel) Latest(ctx context.Context) (int64, error) {
+	defer m.rlock()()
+
+	return m.store.nextChangeSeq, nil
+}
+
+func (m memoryChangeModel) listen() ChangeListener {
+	defer m.lock()()
+
+	notify := make(chan struct{}, 1)
+	m.store.changeListeners[notify] = struct{}{}
+
+	return &memoryChangeListener{store: m.store, notify: notify}
+}
+
+type memoryChangeListener struct {
+	store  *memoryStore
+	notify chan struct{}
+	once   sync.Once
+}
+
+func (ml *memoryChangeListener) Notify() <-chan struct{} {
+	return ml.notify
+}
+
+func (ml *memoryChangeListener) Close() error {
+	ml.once.Do(func() {
+		ml.store.mu.Lock()
+		defer ml.store.mu.Unlock()
+
+		delete(ml.store.changeListeners, ml.notify)
+		close(ml.notify)
+	})
+
+	return nil
+}
+
+type memoryWebhookModel struct {
+	memoryModel
+}
+
+func (m memoryWebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	defer m.lock()()
+
+	m.store.nextWebhookID++
+
+	webhook.ID = m.store.nextWebhookID
+	webhook.CreatedAt = time.Now().Truncate(time.Second)
+
+	keep(m.store, m.store.webhooks, webhook.ID, cloneWebhook)
+	m.store.webhooks[webhook.ID] = cloneWebhook(webhook)
+
+	return nil
+}
+
+func (m memoryWebhookModel) Get(ctx context.Context, id, apiKeyID int64) (*Webhook, error) {
+	defer m.rlock()()
+
+	webhook, ok := m.store.webhooks[id]
+	if !ok || webhook.APIKeyID != apiKeyID {
+		return nil, ErrRecordNotFound
+	}
+
+	clone := cloneWebhook(webhook)
+	clone.Secret = ""
+
+	return clone, nil
+}
+
+func (m memoryWebhookModel) GetAll(ctx context.Context, apiKeyID int64) ([]*Webhook, error) {
+	defer m.rlock()()
+
+	webhooks := []*Webhook{}
+
+	for _, id := range slices.Sorted(maps.Keys(m.store.webhooks)) {
+		webhook := m.store.webhooks[id]
+		if webhook.APIKeyID != apiKeyID {
+			continue
+		}
+
+		clone := cloneWebhook(webhook)
+		clone.Secret = ""
+
+		webhooks = append(webhooks, clone)
+	}
+
+	return webhooks, nil
+}
+
+func (m memoryWebhookModel) GetEvery(ctx context.Context) ([]*Webhook, error) {
+	defer m.rlock()()
+
+	webhooks := []*Webhook{}
+
+	for _, id := range slices.Sorted(maps.Keys(m.store.webhooks)) {
+		webhooks = append(webhooks, cloneWebhook(m.store.webhooks[id]))
+	}
+
+	return webhooks, nil
+}
+
+func (m memoryWebhookModel) Delete(ctx context.Context, id, apiKeyID int64) error {
+	defer m.lock()()
+
+	webhook, ok := m.store.webhooks[id]
+	if !ok || webhook.APIKeyID != apiKeyID {
+		return ErrRecordNotFound
+	}
+
+	keep(m.store, m.store.webhooks, id, cloneWebhook)
+	delete(m.store.webhooks, id)
+
+	deleteWhere(m.store, m.store.webhookDeliveries, cloneDelivery, func(_ int64, d *WebhookDelivery) bool {
+		return d.WebhookID == id
+	})
+
+	return nil
+}
+
+func (m memoryWebhookModel) Ping(ctx context.Context, webhookID int64, lease time.Duration) (*WebhookDelivery, error) {
+	defer m.lock()()
+
+	webhook, ok := m.store.webhooks[webhookID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	delivery := cloneDelivery(m.store.queueDelivery(webhookID, EventPing, pingPayload(webhookID), time.Now().Add(lease)))
+	delivery.URL = webhook.URL
+	delivery.Secret = webhook.Secret
+
+	return delivery, nil
+}
+
+func (m memoryWebhookModel) GetDeliveries(ctx context.Context, webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	defer m.rlock()()
+
+	deliveries := []*WebhookDelivery{}
+
+	for _, delivery := range m.store.webhookDeliveries {
+		if delivery.WebhookID != webhookID {
+			continue
+		}
+
+		clone := cloneDelivery(delivery)
+		if clone.Status != DeliveryPending {
+			clone.NextAttemptAt = nil
+		}
+
+		deliveries = append(deliveries, clone)
+	}
+
+	page, metadata := paginate(deliveries, filters, func(a, b *WebhookDelivery, column string) int {
+		return cmp.Compare(a.ID, b.ID)
+	}, func(d *WebhookDelivery) int64 { return d.ID })
+
+	return page, metadata, nil
+}
+
+func (m memoryWebhookModel) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	defer m.lock()()
+
+	now := time.Now()
+
+	due := []*WebhookDelivery{}
+
+	for _, delivery := range m.store.webhookDeliveries {
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+
+	slices.SortFunc(due, func(a, b *WebhookDelivery) int {
+		return cmp.Or(a.NextAttemptAt.Compare(*b.NextAttemptAt), cmp.Compare(a.ID, b.ID))
+	})
+
+	deliveries := []*WebhookDelivery{}
+
+	for _, delivery := range due[:min(limit, len(due))] {
+		keep(m.store, m.store.webhookDeliveries, delivery.ID, cloneDelivery)
+
+		nextAttemptAt := now.Add(lease)
+		delivery.NextAttemptAt = &nextAttemptAt
+
+		webhook := m.store.webhooks[delivery.WebhookID]
+
+		clone := cloneDelivery(delivery)
+		clone.URL = webhook.URL
+		clone.Secret = webhook.Secret
+
+		deliveries = append(deliveries, clone)
+	}
+
+	return deliveries, nil
+}
+
+func (m memoryWebhookModel) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	defer m.lock()()
+
+	existing, ok := m.store.webhookDeliveries[delivery.ID]
+	if !ok {
+		return nil
+	}
+
+	updated := cloneDelivery(delivery)
+	updated.URL = ""
+	updated.Secret = ""
+	if updated.NextAttemptAt == nil {
+		updated.NextAttemptAt = existing.NextAttemptAt
+	}
+
+	keep(m.store, m.store.webhookDeliveries, delivery.ID, cloneDelivery)
+	m.store.webhookDeliveries[delivery.ID] = updated
+
+	return nil
+}
+
+type memoryUsageModel struct {
+	memoryModel
+}
+
+// usageKey identifies a key's usage of one route in one hour.
+type usageKey struct {
+	apiKeyID int64
+	hour     int64 // unix seconds
+	route    string
+}
+
+func (m memoryUsageModel) Record(ctx context.Context, usage []*Usage) error {
+	defer m.lock()()
+
+	for _, u := range usage {
+		if _, ok := m.store.apiKeys[u.APIKeyID]; !ok {
+			continue
+		}
+
+		key := usageKey{u.APIKeyID, u.Hour.Unix(), u.Route}
+
+		keep(m.store, m.store.usage, key, cloneUsage)
+
+		total, ok := m.store.usage[key]
+		if !ok {
+			total = &Usage{APIKeyID: u.APIKeyID, Hour: u.Hour.UTC(), Route: u.Route}
+			m.store.usage[key] = total
+		}
+
+		total.merge(u)
+	}
+
+	return nil
+}
+
+func (m memoryUsageModel) GetAll(ctx context.Context, apiKeyID int64, from, to time.Time) ([]*Usage, error) {
+	defer m.rlock()()
+
+	usage := []*Usage{}
+
+	for _, total := range m.store.usage {
+		if apiKeyID != 0 && total.APIKeyID != apiKeyID {
+			continue
+		}
+		if total.Hour.Before(from) || !total.Hour.Before(to) {
+			continue
+		}
+
+		u := *total
+		usage = append(usage, &u)
+	}
+
+	slices.SortFunc(usage, func(a, b *Usage) int {
+		return cmp.Or(
+			a.Hour.Compare(b.Hour),
+			cmp.Compare(a.APIKeyID, b.APIKeyID),
+			cmp.Compare(a.Route, b.Route),
+		)
+	})
+
+	return usage, nil
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransactionRollback(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+	store := models.Characters.(memoryCharacterModel).store
+
+	bounty := Berries(3_000_000_000)
+	luffy := &Character{Name: "Monkey D. Luffy", Age: 19, Bounty: &bounty}
+	zoro := &Character{Name: "Roronoa Zoro", Age: 21, Bounty: &bounty}
+	usopp := &Character{Name: "Usopp", Age: 19}
+
+	for _, character := range []*Character{luffy, zoro, usopp} {
+		err := models.Characters.Insert(ctx, character)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crew := &Crew{Name: "Straw Hat Pirates", CaptainID: luffy.ID}
+	if err := models.Crews.Insert(ctx, crew); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Crews.AddMember(ctx, crew.ID, zoro.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Characters.Delete(ctx, usopp.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	apiKey := &APIKey{Name: "test", IsActive: true}
+	if err := models.APIKeys.Insert(ctx, apiKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Webhooks.Insert(ctx, &Webhook{APIKeyID: apiKey.ID, URL: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := store.clone()
+	errRollback := errors.New("rollback")
+
+	err := models.Transaction(ctx, func(models Models) error {
+		nami := &Character{Name: "Nami", Age: 20, Bounty: &bounty}
+		steps := []func() error{
+			func() error { return models.Characters.Insert(ctx, nami) },
+			func() error { return models.Crews.AddMember(ctx, crew.ID, nami.ID) },
+			func() error { return models.Characters.Delete(ctx, zoro.ID) },
+			func() error { return models.Characters.Restore(ctx, usopp.ID) },
+			func() error { return models.Characters.Delete(ctx, usopp.ID) },
+			func() error {
+				_, err := models.Trash.Purge(ctx, time.Now().Add(time.Hour))
+				return err
+			},
+			func() error {
+				_, _, err := models.APIKeys.Rotate(ctx, apiKey.ID, time.Hour)
+				return err
+			},
+			func() error {
+				_, err := models.APIKeys.CountRequest(ctx, apiKey.ID, time.Now(), 10)
+				return err
+			},
+			func() error { return models.APIKeys.UseNonce(ctx, apiKey.ID, "nonce", time.Now().Add(time.Hour)) },
+			func() error {
+				return models.Usage.Record(ctx, []*Usage{{APIKeyID: apiKey.ID, Hour: time.Now().Truncate(time.Hour), Route: "/v1/characters", Requests: 1}})
+			},
+			func() error { return models.APIKeys.Delete(ctx, apiKey.ID) },
+		}
+
+		for i, step := range steps {
+			err := step()
+			if err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+		}
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("got %v; want %v", err, errRollback)
+	}
+
+	if store.tx != nil {
+		t.Error("transaction still open after rollback")
+	}
+
+	if after := store.clone(); !reflect.DeepEqual(after, before) {
+		t.Errorf("store changed by a rolled-back transaction:\ngot  %+v\nwant %+v", after, before)
+	}
+
+	// The sequences were wound back too.
+	nami := &Character{Name: "Nami", Age: 20}
+	if err := models.Characters.Insert(ctx, nami); err != nil {
+		t.Fatal(err)
+	}
+	if nami.ID != usopp.ID+1 {
+		t.Errorf("got id %d; want %d", nami.ID, usopp.ID+1)
+	}
+}
@@ -1,26 +1,192 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrDuplicateName  = errors.New("duplicate name")
+	ErrAlreadyMember  = errors.New("character is already a member of this crew")
+	ErrEditConflict   = errors.New("edit conflict")
+	ErrCaptain        = errors.New("character is the captain of a crew")
 )
 
+// Timeouts holds the per-operation deadlines applied on top of the caller's
+// context. Reads are single-row lookups, lists are paginated queries and
+// writes cover inserts, updates and deletes.
+type Timeouts struct {
+	Read  time.Duration
+	List  time.Duration
+	Write time.Duration
+}
+
+type CharacterRepository interface {
+	Insert(ctx context.Context, character *Character) error
+	Get(ctx context.Context, id int64) (*Character, error)
+	GetByName(ctx context.Context, name string) (*Character, error)
+	Update(ctx context.Context, character *Character) error
+	Delete(ctx context.Context, id int64) error
+	Restore(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, search string, age int, origin, race string, bounty Berries, filters Filters) ([]*Character, Metadata, error)
+	Stream(ctx context.Context, search string, age int, origin, race string, bounty Berries, filters Filters, fn func(*Character) error) error
+}
+
+type DevilFruitRepository interface {
+	Insert(ctx context.Context, devilFruit *DevilFruit) error
+	Get(ctx context.Context, id int64) (*DevilFruit, error)
+	GetByName(ctx context.Context, name string) (*DevilFruit, error)
+	Update(ctx context.Context, devilFruit *DevilFruit) error
+	Delete(ctx context.Context, id int64) error
+	Restore(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, search, fruitType string, filters Filters) ([]*DevilFruit, Metadata, error)
+	Stream(ctx context.Context, search, fruitType string, filters Filters, fn func(*DevilFruit) error) error
+}
+
+type CrewRepository interface {
+	Insert(ctx context.Context, crew *Crew) error
+	Get(ctx context.Context, id int64) (*Crew, error)
+	GetByName(ctx context.Context, name string) (*Crew, error)
+	Update(ctx context.Context, crew *Crew) error
+	Delete(ctx context.Context, id int64) error
+	Restore(ctx context.Context, id int64) error
+	AddMember(ctx context.Context, crewID, characterID int64) error
+	DeleteMember(ctx context.Context, crewID, characterID int64) error
+	GetMembers(ctx context.Context, crewID int64, bounty Berries, filters Filters) ([]*CrewMember, Metadata, error)
+	GetAll(ctx context.Context, search string, shipName string, totalBounty Berries, filters Filters) ([]*Crew, Metadata, error)
+	Stream(ctx context.Context, search string, shipName string, totalBounty Berries, filters Filters, fn func(*Crew) error) error
+}
+
+type APIKeyRepository interface {
+	Insert(ctx context.Context, apiKey *APIKey) error
+	Create(ctx context.Context, apiKey *APIKey) (string, error)
+	Get(ctx context.Context, id int64) (*APIKey, error)
+	GetByHash(ctx context.Context, hash string) (*APIKey, error)
+	Update(ctx context.Context, apiKey *APIKey) error
+	Rotate(ctx context.Context, id int64, grace time.Duration) (*APIKey, string, error)
+	Delete(ctx context.Context, id int64) error
+	UpdateLastUsed(ctx context.Context, lastUsed map[int64]time.Time) error
+	NewSigningSecret(ctx context.Context, id int64) (string, error)
+	UseNonce(ctx context.Context, id int64, nonce string, expiresAt time.Time) error
+	PurgeNonces(ctx context.Context, t time.Time) error
+	CountRequest(ctx context.Context, id int64, periodStart time.Time, limit int64) (int64, error)
+	QuotaUsage(ctx context.Context, id int64, periodStart time.Time) (int64, error)
+	GetAll(ctx context.Context) ([]*APIKey, error)
+}
+
+type TrashRepository interface {
+	GetAll(ctx context.Context, resource string, filters Filters) ([]*TrashedRecord, Metadata, error)
+	Purge(ctx context.Context, before time.Time) (map[string]int64, error)
+}
+
+type AuditRepository interface {
+	GetAll(ctx context.Context, entity string, entityID, apiKeyID int64, filters Filters) ([]*AuditEntry, Metadata, error)
+}
+
+type RevisionRepository interface {
+	GetAll(ctx context.Context, entity string, id int64, filters Filters) ([]*Revision, Metadata, error)
+	Get(ctx context.Context, entity string, id int64, revision int32) (*Revision, error)
+}
+
+type ChangeRepository interface {
+	GetSince(ctx context.Context, since int64, limit int) ([]*Change, error)
+	Latest(ctx context.Context) (int64, error)
+}
+
+type WebhookRepository interface {
+	Insert(ctx context.Context, webhook *Webhook) error
+	Get(ctx context.Context, id, apiKeyID int64) (*Webhook, error)
+	GetAll(ctx context.Context, apiKeyID int64) ([]*Webhook, error)
+	GetEvery(ctx context.Context) ([]*Webhook, error)
+	Delete(ctx context.Context, id, apiKeyID int64) error
+	Ping(ctx context.Context, webhookID int64, lease time.Duration) (*WebhookDelivery, error)
+	GetDeliveries(ctx context.Context, webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error)
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error
+}
+
+type UsageRepository interface {
+	Record(ctx context.Context, usage []*Usage) error
+	GetAll(ctx context.Context, apiKeyID int64, from, to time.Time) ([]*Usage, error)
+}
+
 type Models struct {
-	Characters  CharacterModel
-	DevilFruits DevilFruitModel
-	Crews       CrewModel
-	APIKeys     APIKeyModel
-}
-
-func NewModels(db *sql.DB) Models {
-	return Models{
-		Characters:  CharacterModel{DB: db},
-		DevilFruits: DevilFruitModel{DB: db},
-		Crews:       CrewModel{DB: db},
-		APIKeys:     APIKeyModel{DB: db},
+	Characters  CharacterRepository
+	DevilFruits DevilFruitRepository
+	Crews       CrewRepository
+	APIKeys     APIKeyRepository
+	Trash       TrashRepository
+	Audit       AuditRepository
+	Revisions   RevisionRepository
+	Changes     ChangeRepository
+	Webhooks    WebhookRepository
+	Usage       UsageRepository
+
+	transaction func(ctx context.Context, opts *sql.TxOptions, fn func(Models) error) error
+}
+
+// DBTX is the part of the database/sql API shared by *sql.DB and *sql.Tx, so
+// the Postgres models can run either on their own or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func NewModels(db *sql.DB, timeouts Timeouts) Models {
+	models := newPostgresModels(db, timeouts)
+
+	models.transaction = func(ctx context.Context, opts *sql.TxOptions, fn func(Models) error) error {
+		tx, err := db.BeginTx(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = fn(newPostgresModels(tx, timeouts))
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	return models
+}
+
+func newPostgresModels(db DBTX, timeouts Timeouts) Models {
+	models := Models{
+		Characters:  CharacterModel{DB: db, Timeouts: timeouts},
+		DevilFruits: DevilFruitModel{DB: db, Timeouts: timeouts},
+		Crews:       CrewModel{DB: db, Timeouts: timeouts},
+		APIKeys:     APIKeyModel{DB: db, Timeouts: timeouts},
+		Trash:       TrashModel{DB: db, Timeouts: timeouts},
+		Audit:       AuditModel{DB: db, Timeouts: timeouts},
+		Revisions:   RevisionModel{DB: db, Timeouts: timeouts},
+		Changes:     ChangeModel{DB: db, Timeouts: timeouts},
+		Webhooks:    WebhookModel{DB: db, Timeouts: timeouts},
+		Usage:       UsageModel{DB: db, Timeouts: timeouts},
+	}
+
+	// Models bound to a transaction run nested transactions inline.
+	models.transaction = func(ctx context.Context, opts *sql.TxOptions, fn func(Models) error) error {
+		return fn(models)
 	}
+
+	return models
+}
+
+// Transaction calls fn with models that share a single transaction, which is
+// committed if fn returns nil and rolled back otherwise.
+func (m Models) Transaction(ctx context.Context, fn func(Models) error) error {
+	return m.transaction(ctx, nil, fn)
+}
+
+// Snapshot calls fn with read-only models that all see the data as it was
+// when the snapshot began, however long fn takes.
+func (m Models) Snapshot(ctx context.Context, fn func(Models) error) error {
+	return m.transaction(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, fn)
 }
@@ -0,0 +1,141 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Revision is a snapshot of a character, devil fruit or crew as it was at one
+// version. Revisions are numbered by the version they capture, so numbers
+// skip over changes that don't go through Update, such as crew membership
+// changes.
+type Revision struct {
+	Revision  int32           `json:"revision"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// versioned is a record whose history is kept as revisions.
+type versioned interface {
+	revision() (id int64, version int32, updatedAt time.Time)
+}
+
+func (c *Character) revision() (int64, int32, time.Time)   { return c.ID, c.Version, c.UpdatedAt }
+func (df *DevilFruit) revision() (int64, int32, time.Time) { return df.ID, df.Version, df.UpdatedAt }
+func (c *Crew) revision() (int64, int32, time.Time)        { return c.ID, c.Version, c.UpdatedAt }
+
+// saveRevisions snapshots records, skipping any version that already has a
+// revision. Insert passes the new record and Update passes it before and
+// after the change, which also covers records created before revisions were
+// kept.
+func saveRevisions(ctx context.Context, db DBTX, timeout time.Duration, entity string, records ...versioned) error {
+	query := `
+		INSERT INTO revisions (entity, entity_id, revision, created_at, data)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, record := range records {
+		id, version, updatedAt := record.revision()
+
+		js, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(ctx, query, entity, id, version, updatedAt, string(js))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type RevisionModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+// GetAll lists the revisions of one record.
+func (m RevisionModel) GetAll(ctx context.Context, entity string, id int64, filters Filters) ([]*Revision, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), revision, created_at, data
+		FROM revisions
+		WHERE entity = $1 AND entity_id = $2
+		ORDER BY %s %s
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, entity, id, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	revisions := []*Revision{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var (
+			revision Revision
+			js       []byte
+		)
+
+		err := rows.Scan(&totalRecords, &revision.Revision, &revision.CreatedAt, &js)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		revision.Data = js
+
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return revisions, metadata, nil
+}
+
+func (m RevisionModel) Get(ctx context.Context, entity string, id int64, revision int32) (*Revision, error) {
+	query := `
+		SELECT revision, created_at, data
+		FROM revisions
+		WHERE entity = $1 AND entity_id = $2 AND revision = $3
+	`
+
+	var (
+		r  Revision
+		js []byte
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, entity, id, revision).Scan(&r.Revision, &r.CreatedAt, &js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	r.Data = js
+
+	return &r, nil
+}
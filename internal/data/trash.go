@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TrashResources are the resources that can be moved to the trash, in the
+// order they're purged.
+var TrashResources = []string{"crews", "devilfruits", "characters"}
+
+// TrashedRecord is a character, devil fruit or crew waiting in the trash.
+type TrashedRecord struct {
+	Resource  string     `json:"resource"`
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"`
+}
+
+type TrashModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+// GetAll lists trashed records of every resource, or of one if resource isn't
+// empty.
+func (m TrashModel) GetAll(ctx context.Context, resource string, filters Filters) ([]*TrashedRecord, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), resource, id, name, deleted_at
+		FROM (
+			SELECT 'characters' AS resource, id, name, deleted_at FROM characters WHERE deleted_at IS NOT NULL
+			UNION ALL
+			SELECT 'devilfruits', id, name, deleted_at FROM devilfruits WHERE deleted_at IS NOT NULL
+			UNION ALL
+			SELECT 'crews', id, name, deleted_at FROM crews WHERE deleted_at IS NOT NULL
+		) trash
+		WHERE (resource = $1 OR $1 = '')
+		ORDER BY %s %s, resource ASC, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, resource, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	records := []*TrashedRecord{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var record TrashedRecord
+
+		err := rows.Scan(&totalRecords, &record.Resource, &record.ID, &record.Name, &record.DeletedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		records = append(records, &record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return records, metadata, nil
+}
+
+// Purge permanently deletes everything trashed before the cutoff, returning
+// how many records of each resource were removed. The foreign keys then
+// apply as they would have to a hard delete: memberships go, and owners are
+// set to NULL. A character who still captains a crew, such as one restored
+// from the trash after them, stays in the trash until the crew has a new
+// captain or is purged itself, as a crew can't be left without one.
+func (m TrashModel) Purge(ctx context.Context, before time.Time) (map[string]int64, error) {
+	purged := make(map[string]int64, len(TrashResources))
+
+	for _, resource := range TrashResources {
+		var keep string
+		if resource == "characters" {
+			keep = "AND NOT EXISTS (SELECT 1 FROM crews WHERE crews.captain_id = characters.id)"
+		}
+
+		// Revisions go with the records they belong to.
+		query := fmt.Sprintf(`
+			WITH purged AS (
+				DELETE FROM %s WHERE deleted_at < $1 %s RETURNING id
+			), forgotten AS (
+				DELETE FROM revisions WHERE entity = '%s' AND entity_id IN (SELECT id FROM purged)
+			)
+			SELECT COUNT(*) FROM purged`, resource, keep, resource)
+
+		n, err := m.purge(ctx, query, before)
+		if err != nil {
+			return nil, err
+		}
+
+		purged[resource] = n
+	}
+
+	return purged, nil
+}
+
+func (m TrashModel) purge(ctx context.Context, query string, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	var n int64
+
+	err := m.DB.QueryRowContext(ctx, query, before).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Usage counts the requests one API key made to one route, such as
+// GET /v1/characters/:id, in the hour starting at Hour.
+type Usage struct {
+	APIKeyID     int64         `json:"api_key_id"`
+	Hour         time.Time     `json:"hour"`
+	Route        string        `json:"route"`
+	Requests     int64         `json:"requests"`
+	Statuses     StatusCounts  `json:"statuses"`
+	TotalLatency time.Duration `json:"-"`
+	MaxLatency   time.Duration `json:"-"`
+}
+
+// StatusCounts counts responses by status class.
+type StatusCounts struct {
+	Success     int64 `json:"2xx"`
+	Redirect    int64 `json:"3xx"`
+	ClientError int64 `json:"4xx"`
+	ServerError int64 `json:"5xx"`
+}
+
+// Add counts one request that got status and took latency.
+func (u *Usage) Add(status int, latency time.Duration) {
+	u.Requests++
+
+	switch status / 100 {
+	case 2:
+		u.Statuses.Success++
+	case 3:
+		u.Statuses.Redirect++
+	case 4:
+		u.Statuses.ClientError++
+	case 5:
+		u.Statuses.ServerError++
+	}
+
+	u.TotalLatency += latency
+	u.MaxLatency = max(u.MaxLatency, latency)
+}
+
+// merge adds other's counts to u's.
+func (u *Usage) merge(other *Usage) {
+	u.Requests += other.Requests
+	u.Statuses.Success += other.Statuses.Success
+	u.Statuses.Redirect += other.Statuses.Redirect
+	u.Statuses.ClientError += other.Statuses.ClientError
+	u.Statuses.ServerError += other.Statuses.ServerError
+	u.TotalLatency += other.TotalLatency
+	u.MaxLatency = max(u.MaxLatency, other.MaxLatency)
+}
+
+// MarshalJSON reports latencies in milliseconds, averaged over the requests.
+func (u Usage) MarshalJSON() ([]byte, error) {
+	type usage Usage
+
+	var average time.Duration
+	if u.Requests > 0 {
+		average = u.TotalLatency / time.Duration(u.Requests)
+	}
+
+	return json.Marshal(struct {
+		usage
+		AvgLatencyMS float64 `json:"avg_latency_ms"`
+		MaxLatencyMS float64 `json:"max_latency_ms"`
+	}{usage(u), milliseconds(average), milliseconds(u.MaxLatency)})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type UsageModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+// Record adds a batch of usage to the totals, which must not have two
+// entries for the same key, hour and route. Usage by keys that have since
+// been deleted is dropped.
+func (m UsageModel) Record(ctx context.Context, usage []*Usage) error {
+	if len(usage) == 0 {
+		return nil
+	}
+
+	// The batch goes over as one array per column, so it's a single
+	// statement however big it is.
+	var (
+		keyIDs, hours, requests           []int64
+		routes                            []string
+		success, redirect, client, server []int64
+		totalLatencies, maxLatencies      []int64
+	)
+
+	for _, u := range usage {
+		keyIDs = append(keyIDs, u.APIKeyID)
+		hours = append(hours, u.Hour.Unix())
+		routes = append(routes, u.Route)
+		requests = append(requests, u.Requests)
+		success = append(success, u.Statuses.Success)
+		redirect = append(redirect, u.Statuses.Redirect)
+		client = append(client, u.Statuses.ClientError)
+		server = append(server, u.Statuses.ServerError)
+		totalLatencies = append(totalLatencies, u.TotalLatency.Microseconds())
+		maxLatencies = append(maxLatencies, u.MaxLatency.Microseconds())
+	}
+
+	query := `
+		INSERT INTO api_usage AS u (api_key_id, hour, route, requests, status_2xx, status_3xx, status_4xx, status_5xx, latency_total_us, latency_max_us)
+		SELECT b.api_key_id, to_timestamp(b.hour), b.route, b.requests, b.status_2xx, b.status_3xx, b.status_4xx, b.status_5xx, b.latency_total_us, b.latency_max_us
+		FROM unnest($1::bigint[], $2::bigint[], $3::text[], $4::bigint[], $5::bigint[], $6::bigint[], $7::bigint[], $8::bigint[], $9::bigint[], $10::bigint[])
+			AS b (api_key_id, hour, route, requests, status_2xx, status_3xx, status_4xx, status_5xx, latency_total_us, latency_max_us)
+		WHERE EXISTS (SELECT 1 FROM api_keys k WHERE k.id = b.api_key_id)
+		ON CONFLICT (api_key_id, hour, route) DO UPDATE SET
+			requests = u.requests + excluded.requests,
+			status_2xx = u.status_2xx + excluded.status_2xx,
+			status_3xx = u.status_3xx + excluded.status_3xx,
+			status_4xx = u.status_4xx + excluded.status_4xx,
+			status_5xx = u.status_5xx + excluded.status_5xx,
+			latency_total_us = u.latency_total_us + excluded.latency_total_us,
+			latency_max_us = GREATEST(u.latency_max_us, excluded.latency_max_us)`
+
+	args := []any{
+		pq.Array(keyIDs),
+		pq.Array(hours),
+		pq.Array(routes),
+		pq.Array(requests),
+		pq.Array(success),
+		pq.Array(redirect),
+		pq.Array(client),
+		pq.Array(server),
+		pq.Array(totalLatencies),
+		pq.Array(maxLatencies),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetAll returns the usage in the hours starting from from up to to, by hour,
+// key and route. An apiKeyID of 0 means every key.
+func (m UsageModel) GetAll(ctx context.Context, apiKeyID int64, from, to time.Time) ([]*Usage, error) {
+	query := `
+		SELECT api_key_id, hour, route, requests, status_2xx, status_3xx, status_4xx, status_5xx, latency_total_us, latency_max_us
+		FROM api_usage
+		WHERE (api_key_id = $1 OR $1 = 0) AND hour >= $2 AND hour < $3
+		ORDER BY hour, api_key_id, route`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, apiKeyID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []*Usage{}
+
+	for rows.Next() {
+		var (
+			u                        Usage
+			totalLatency, maxLatency int64
+		)
+
+		err := rows.Scan(
+			&u.APIKeyID,
+			&u.Hour,
+			&u.Route,
+			&u.Requests,
+			&u.Statuses.Success,
+			&u.Statuses.Redirect,
+			&u.Statuses.ClientError,
+			&u.Statuses.ServerError,
+			&totalLatency,
+			&maxLatency,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		u.Hour = u.Hour.UTC()
+		u.TotalLatency = time.Duration(totalLatency) * time.Microsecond
+		u.MaxLatency = time.Duration(maxLatency) * time.Microsecond
+
+		usage = append(usage, &u)
+	}
+
+	return usage, rows.Err()
+}
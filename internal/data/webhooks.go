@@ -0,0 +1,391 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/05blue04/Poneglyph/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Delivery statuses. A pending delivery is waiting for its next attempt; it
+// fails for good once it runs out of attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// EventPing is the event sent by a webhook test.
+const EventPing = "ping"
+
+// Webhook is an endpoint that's sent changes to characters, devil fruits and
+// crews. The secret signs each delivery, and is only shown when the webhook
+// is created.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	APIKeyID  int64     `json:"-"`
+	URL       string    `json:"url"`
+	Resources []string  `json:"resources"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is one payload on its way to a webhook, and the record of
+// how sending it went. URL and Secret are the webhook's, for the sender.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	ResponseStatus *int            `json:"response_status"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	URL            string          `json:"-"`
+	Secret         string          `json:"-"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 characters long")
+
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	for _, resource := range webhook.Resources {
+		v.Check(validator.PermittedValue(resource, TrashResources...), "resources", "must only contain characters, devilfruits or crews")
+	}
+	v.Check(validator.Unique(webhook.Resources), "resources", "must not contain duplicate values")
+}
+
+// pingPayload is the body of a webhook test.
+func pingPayload(webhookID int64) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"event":%q,"webhook_id":%d}`, EventPing, webhookID))
+}
+
+type WebhookModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (api_key_id, url, secret, resources)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+
+	args := []any{webhook.APIKeyID, webhook.URL, webhook.Secret, pq.Array(webhook.Resources)}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt)
+}
+
+// Get returns one of an API key's webhooks, without its secret.
+func (m WebhookModel) Get(ctx context.Context, id, apiKeyID int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, api_key_id, url, resources
+		FROM webhooks
+		WHERE id = $1 AND api_key_id = $2
+	`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, apiKeyID).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.APIKeyID,
+		&webhook.URL,
+		pq.Array(&webhook.Resources),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// GetAll returns an API key's webhooks, without their secrets, in the order
+// they were created.
+func (m WebhookModel) GetAll(ctx context.Context, apiKeyID int64) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, api_key_id, url, resources
+		FROM webhooks
+		WHERE api_key_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(&webhook.ID, &webhook.CreatedAt, &webhook.APIKeyID, &webhook.URL, pq.Array(&webhook.Resources))
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// GetEvery returns every key's webhooks, secrets included, in the order they
+// were created. It's for backups.
+func (m WebhookModel) GetEvery(ctx context.Context) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, api_key_id, url, resources, secret
+		FROM webhooks
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(&webhook.ID, &webhook.CreatedAt, &webhook.APIKeyID, &webhook.URL, pq.Array(&webhook.Resources), &webhook.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Delete removes a webhook along with its deliveries, sent or not.
+func (m WebhookModel) Delete(ctx context.Context, id, apiKeyID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM webhooks WHERE id = $1 AND api_key_id = $2`
+
+	return execOne(ctx, m.DB, m.Timeouts.Write, query, id, apiKeyID)
+}
+
+// Ping queues a ping to a webhook and returns it ready to send. The caller
+// sends it straight away, so it isn't due for lease, in case the caller
+// doesn't get as far as recording how it went.
+func (m WebhookModel) Ping(ctx context.Context, webhookID int64, lease time.Duration) (*WebhookDelivery, error) {
+	query := `
+		WITH inserted AS (
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at)
+			VALUES ($1, $2, $3, now() + make_interval(secs => $4))
+			RETURNING id, created_at, webhook_id, status, attempts, next_attempt_at
+		)
+		SELECT i.id, i.created_at, i.status, i.attempts, i.next_attempt_at, w.url, w.secret
+		FROM inserted i
+		INNER JOIN webhooks w ON w.id = i.webhook_id`
+
+	delivery := WebhookDelivery{WebhookID: webhookID, Event: EventPing, Payload: pingPayload(webhookID)}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, webhookID, EventPing, string(delivery.Payload), lease.Seconds()).Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.URL,
+		&delivery.Secret,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// GetDeliveries lists a webhook's deliveries.
+func (m WebhookModel) GetDeliveries(ctx context.Context, webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, webhook_id, event, payload, status, attempts,
+			CASE WHEN status = 'pending' THEN next_attempt_at END, response_status, last_error, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY %s %s
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var (
+			delivery WebhookDelivery
+			payload  []byte
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+			&delivery.DeliveredAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		delivery.Payload = payload
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
+
+// ClaimDeliveries takes up to limit deliveries that are due and puts them off
+// for lease, so other instances leave them alone while they're sent. One
+// that isn't updated before the lease runs out is sent again.
+func (m WebhookModel) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		WITH due AS (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = now() + make_interval(secs => $2)
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.created_at, d.webhook_id, d.event, d.payload, d.status, d.attempts,
+			d.next_attempt_at, d.response_status, d.last_error, w.url, w.secret`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var (
+			delivery WebhookDelivery
+			payload  []byte
+		)
+
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		delivery.Payload = payload
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// UpdateDelivery records the outcome of an attempt. A delivery whose webhook
+// has been deleted in the meantime is silently gone.
+func (m WebhookModel) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = COALESCE($3, next_attempt_at),
+			response_status = $4, last_error = $5, delivered_at = $6
+		WHERE id = $7`
+
+	args := []any{
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.ResponseStatus,
+		delivery.LastError,
+		delivery.DeliveredAt,
+		delivery.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
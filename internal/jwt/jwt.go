@@ -0,0 +1,320 @@
+// Package jwt verifies JSON Web Tokens issued by a trusted identity
+// provider, checking their signatures against the public keys it publishes
+// as a JSON Web Key Set (JWKS).
+//
+// Only asymmetric algorithms are accepted: RS256, ES256 and EdDSA, and the
+// larger variants of the first two. The API holds public keys alone, so
+// nothing it stores can be used to mint tokens.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrMalformed   = errors.New("jwt: malformed token")
+	ErrAlgorithm   = errors.New("jwt: unsupported algorithm")
+	ErrUnknownKey  = errors.New("jwt: unknown signing key")
+	ErrSignature   = errors.New("jwt: invalid signature")
+	ErrExpired     = errors.New("jwt: token has expired")
+	ErrNotYetValid = errors.New("jwt: token isn't valid yet")
+	ErrIssuer      = errors.New("jwt: wrong issuer")
+	ErrAudience    = errors.New("jwt: wrong audience")
+)
+
+// Claims are what a verified token says about its subject.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time // zero if the token doesn't have one
+	IssuedAt  time.Time // zero if the token doesn't have one
+
+	// All holds every claim, registered or not, as decoded JSON. Numbers
+	// are json.Numbers.
+	All map[string]any
+}
+
+// Strings reads a claim holding a list of strings, either as an array or as
+// one space-separated string, the way OAuth's scope claim is written. It
+// returns nil if the claim is missing or holds anything else.
+func (c *Claims) Strings(name string) []string {
+	switch value := c.All[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil
+			}
+			values = append(values, s)
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// Verifier checks tokens from one issuer, meant for one audience. Its keys
+// can be replaced while it's in use, as the issuer rotates them.
+type Verifier struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+	keys     atomic.Pointer[KeySet]
+}
+
+// NewVerifier returns a Verifier for tokens from issuer that name audience
+// in their aud claim. leeway allows for clocks that disagree, when checking
+// a token's lifetime.
+func NewVerifier(issuer, audience string, leeway time.Duration, keys *KeySet) *Verifier {
+	v := &Verifier{issuer: issuer, audience: audience, leeway: leeway}
+	v.keys.Store(keys)
+
+	return v
+}
+
+// SetKeys replaces the keys tokens are checked against.
+func (v *Verifier) SetKeys(keys *KeySet) {
+	v.keys.Store(keys)
+}
+
+// Verify checks a token's signature, issuer, audience and lifetime at now,
+// and returns its claims. Tokens must have an exp claim.
+func (v *Verifier) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := v.keys.Load().lookup(header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	// The signature covers the header and payload as they were sent.
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]any
+
+	err = decodeSegment(parts[1], &all)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := parseClaims(all)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case claims.Issuer != v.issuer:
+		return nil, ErrIssuer
+	case !slices.Contains(claims.Audience, v.audience):
+		return nil, ErrAudience
+	case !now.Before(claims.ExpiresAt.Add(v.leeway)):
+		return nil, ErrExpired
+	case !claims.NotBefore.IsZero() && now.Before(claims.NotBefore.Add(-v.leeway)):
+		return nil, ErrNotYetValid
+	}
+
+	return claims, nil
+}
+
+// decodeSegment decodes one base64url-encoded JSON segment of a token.
+func decodeSegment(segment string, dst any) error {
+	js, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	err = dec.Decode(dst)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+func parseClaims(all map[string]any) (*Claims, error) {
+	claims := &Claims{All: all}
+
+	var ok bool
+
+	if claims.Issuer, ok = stringClaim(all, "iss"); !ok {
+		return nil, fmt.Errorf("%w: iss must be a string", ErrMalformed)
+	}
+	if claims.Subject, ok = stringClaim(all, "sub"); !ok {
+		return nil, fmt.Errorf("%w: sub must be a string", ErrMalformed)
+	}
+
+	// aud is either one audience or a list of them.
+	switch aud := all["aud"].(type) {
+	case nil:
+	case string:
+		claims.Audience = []string{aud}
+	default:
+		claims.Audience = claims.Strings("aud")
+		if claims.Audience == nil {
+			return nil, fmt.Errorf("%w: aud must be a string or an array of strings", ErrMalformed)
+		}
+	}
+
+	if claims.ExpiresAt, ok = timeClaim(all, "exp"); !ok || claims.ExpiresAt.IsZero() {
+		return nil, fmt.Errorf("%w: exp must be a number of seconds", ErrMalformed)
+	}
+	if claims.NotBefore, ok = timeClaim(all, "nbf"); !ok {
+		return nil, fmt.Errorf("%w: nbf must be a number of seconds", ErrMalformed)
+	}
+	if claims.IssuedAt, ok = timeClaim(all, "iat"); !ok {
+		return nil, fmt.Errorf("%w: iat must be a number of seconds", ErrMalformed)
+	}
+
+	return claims, nil
+}
+
+// stringClaim reads an optional string claim.
+func stringClaim(all map[string]any, name string) (string, bool) {
+	if all[name] == nil {
+		return "", true
+	}
+
+	s, ok := all[name].(string)
+	return s, ok
+}
+
+// maxNumericDate is the end of the year 9999, past which times are treated
+// as malformed.
+const maxNumericDate = 253402300799
+
+// timeClaim reads an optional NumericDate claim, which counts seconds since
+// the Unix epoch and may have a fraction.
+func timeClaim(all map[string]any, name string) (time.Time, bool) {
+	if all[name] == nil {
+		return time.Time{}, true
+	}
+
+	n, ok := all[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := n.Float64()
+	if err != nil || seconds < 0 || seconds > maxNumericDate {
+		return time.Time{}, false
+	}
+
+	whole, frac := math.Modf(seconds)
+
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))), true
+}
+
+// verifySignature checks signature over signed, with key and the algorithm
+// the token's header names.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("%w: %q", ErrAlgorithm, alg)
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	var valid bool
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("%w: %s with an RSA key", ErrAlgorithm, alg)
+		}
+
+		valid = rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if alg != ecdsaAlgorithms[key.Curve.Params().Name] {
+			return fmt.Errorf("%w: %s with a %s key", ErrAlgorithm, alg, key.Curve.Params().Name)
+		}
+
+		// ECDSA signatures are r and s side by side, each as wide as the
+		// curve, rather than the DER that crypto/ecdsa deals in.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrSignature
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		valid = ecdsa.Verify(key, digest, r, s)
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("%w: %s with an Ed25519 key", ErrAlgorithm, alg)
+		}
+
+		valid = ed25519.Verify(key, signed, signature)
+	}
+
+	if !valid {
+		return ErrSignature
+	}
+
+	return nil
+}
+
+// ecdsaAlgorithms are the algorithms that go with each curve.
+var ecdsaAlgorithms = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
@@ -0,0 +1,355 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://auth.marines.test"
+	testAudience = "poneglyph"
+)
+
+// testKeys are a freshly generated key of each supported type, and the JWKS
+// document that publishes them.
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	jwks    []byte
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	point, err := ecKey.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(point[1:33]), "y": b64(point[33:])},
+		{"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+		{"kty": "oct", "kid": "hmac", "k": b64([]byte("not for us"))},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testKeys{rsa: rsaKey, ec: ecKey, ed25519: edKey, jwks: jwks}
+}
+
+// sign makes a token signed with key, under the algorithm and key ID given.
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims(now time.Time) map[string]any {
+	return map[string]any{
+		"iss":   testIssuer,
+		"sub":   "bounty-service",
+		"aud":   []string{"other", testAudience},
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"scope": "characters:read characters:write",
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+
+	set, err := ParseKeySet(keys.jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The symmetric and encryption keys are skipped.
+	if set.Len() != 3 {
+		t.Fatalf("got %d keys; want 3", set.Len())
+	}
+
+	now := time.Now()
+	v := NewVerifier(testIssuer, testAudience, time.Minute, set)
+
+	for _, tt := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{
+		{"RS256", "rsa", keys.rsa},
+		{"ES256", "ec", keys.ec},
+		{"EdDSA", "ed25519", keys.ed25519},
+	} {
+		t.Run(tt.alg, func(t *testing.T) {
+			claims, err := v.Verify(sign(t, tt.alg, tt.kid, tt.key, validClaims(now)), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "bounty-service" || claims.Issuer != testIssuer {
+				t.Errorf("got subject %q and issuer %q", claims.Subject, claims.Issuer)
+			}
+			if !reflect.DeepEqual(claims.Strings("scope"), []string{"characters:read", "characters:write"}) {
+				t.Errorf("got scopes %q", claims.Strings("scope"))
+			}
+			if claims.ExpiresAt.Unix() != now.Add(time.Hour).Unix() {
+				t.Errorf("got exp %v", claims.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	keys := newTestKeys(t)
+
+	set, err := ParseKeySet(keys.jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	v := NewVerifier(testIssuer, testAudience, time.Minute, set)
+
+	with := func(name string, value any) map[string]any {
+		claims := validClaims(now)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	valid := sign(t, "EdDSA", "ed25519", keys.ed25519, validClaims(now))
+	tampered := valid[:len(valid)-4] + "AAAA"
+
+	// Another token's payload, under the first one's signature.
+	other := strings.Split(sign(t, "EdDSA", "ed25519", keys.ed25519, with("sub", "admin")), ".")
+	parts := strings.Split(valid, ".")
+	forged := parts[0] + "." + other[1] + "." + parts[2]
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+testIssuer+`"}`)) + "."
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"not a token", "marine-hq", ErrMalformed},
+		{"tampered signature", tampered, ErrSignature},
+		{"forged payload", forged, ErrSignature},
+		{"unsigned", unsigned, ErrUnknownKey},
+		{"unknown key", sign(t, "EdDSA", "retired", keys.ed25519, validClaims(now)), ErrUnknownKey},
+		{"wrong key", sign(t, "ES256", "ec", mustECKey(t), validClaims(now)), ErrSignature},
+		{"algorithm pinned by key", sign(t, "RS384", "rsa", keys.rsa, validClaims(now)), ErrAlgorithm},
+		{"algorithm for another key type", sign(t, "RS256", "ed25519", keys.rsa, validClaims(now)), ErrAlgorithm},
+		{"symmetric algorithm", sign(t, "HS256", "ec", keys.ec, validClaims(now)), ErrAlgorithm},
+		{"wrong issuer", sign(t, "EdDSA", "ed25519", keys.ed25519, with("iss", "https://revolutionaries.test")), ErrIssuer},
+		{"wrong audience", sign(t, "EdDSA", "ed25519", keys.ed25519, with("aud", "other")), ErrAudience},
+		{"no audience", sign(t, "EdDSA", "ed25519", keys.ed25519, with("aud", nil)), ErrAudience},
+		{"no expiry", sign(t, "EdDSA", "ed25519", keys.ed25519, with("exp", nil)), ErrMalformed},
+		{"expired", sign(t, "EdDSA", "ed25519", keys.ed25519, with("exp", now.Add(-2*time.Minute).Unix())), ErrExpired},
+		{"not valid yet", sign(t, "EdDSA", "ed25519", keys.ed25519, with("nbf", now.Add(2*time.Minute).Unix())), ErrNotYetValid},
+		{"string expiry", sign(t, "EdDSA", "ed25519", keys.ed25519, with("exp", "tomorrow")), ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(tt.token, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v; want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Tokens within the leeway of their lifetime are still accepted.
+	_, err = v.Verify(sign(t, "EdDSA", "ed25519", keys.ed25519, with("exp", now.Add(-30*time.Second).Unix())), now)
+	if err != nil {
+		t.Errorf("token expired 30s ago: %v", err)
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestSetKeys(t *testing.T) {
+	keys := newTestKeys(t)
+
+	set, err := ParseKeySet(keys.jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	v := NewVerifier(testIssuer, testAudience, 0, set)
+
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := sign(t, "EdDSA", "", newKey, validClaims(now))
+
+	_, err = v.Verify(token, now)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got error %v; want %v", err, ErrUnknownKey)
+	}
+
+	// A token that doesn't name its key is checked against the only one.
+	rotated, err := ParseKeySet([]byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"next","x":"` +
+		base64.RawURLEncoding.EncodeToString(newKey.Public().(ed25519.PublicKey)) + `"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.SetKeys(rotated)
+
+	_, err = v.Verify(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseKeySetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		jwks string
+	}{
+		{"not json", `keys`},
+		{"no keys", `{"keys":[]}`},
+		{"only unsupported keys", `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`},
+		{"small rsa key", `{"keys":[{"kty":"RSA","n":"` + base64.RawURLEncoding.EncodeToString(make([]byte, 128)) + `","e":"AQAB"}]}`},
+		{"point off the curve", `{"keys":[{"kty":"EC","crv":"P-256","x":"` + base64.RawURLEncoding.EncodeToString(make([]byte, 32)) + `","y":"` + base64.RawURLEncoding.EncodeToString(make([]byte, 32)) + `"}]}`},
+		{"unknown curve", `{"keys":[{"kty":"OKP","crv":"X25519","x":"AQAB"}]}`},
+		{"duplicate key ids", `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"` + base64.RawURLEncoding.EncodeToString(make([]byte, 32)) + `"},{"kty":"OKP","crv":"Ed25519","x":"` + base64.RawURLEncoding.EncodeToString(make([]byte, 32)) + `"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeySet([]byte(tt.jwks))
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	keys := newTestKeys(t)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	err := os.WriteFile(path, keys.jwks, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := LoadKeySet(context.Background(), http.DefaultClient, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != 3 {
+		t.Errorf("got %d keys from a file; want 3", set.Len())
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Write(keys.jwks)
+	}))
+	defer ts.Close()
+
+	set, err = LoadKeySet(context.Background(), ts.Client(), ts.URL+"/.well-known/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != 3 {
+		t.Errorf("got %d keys from a URL; want 3", set.Len())
+	}
+
+	_, err = LoadKeySet(context.Background(), ts.Client(), ts.URL+"/jwks.json")
+	if err == nil {
+		t.Error("got no error for a missing key set")
+	}
+}
@@ -0,0 +1,248 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxKeySetBytes is the most LoadKeySet will read. Real key sets are a few
+// kilobytes.
+const maxKeySetBytes = 1 << 20
+
+// minRSABits is the smallest RSA key accepted.
+const minRSABits = 2048
+
+// KeySet is an issuer's public keys, by key ID.
+type KeySet struct {
+	keys map[string]publicKey
+}
+
+type publicKey struct {
+	key crypto.PublicKey
+	alg string // empty if the key doesn't pin one
+}
+
+// jwk is one key of a JWKS document, with the members the supported key
+// types use.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseKeySet parses a JWKS document. Keys meant for encryption rather than
+// signing, and types of key it doesn't support, are skipped, but a key of a
+// supported type that can't be parsed is an error.
+func ParseKeySet(js []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err := json.Unmarshal(js, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: parsing key set: %w", err)
+	}
+
+	set := &KeySet{keys: make(map[string]publicKey)}
+
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %d (%q): %w", i, k.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+
+		if _, ok := set.keys[k.Kid]; ok {
+			return nil, fmt.Errorf("jwt: key %d: duplicate key ID %q", i, k.Kid)
+		}
+
+		set.keys[k.Kid] = publicKey{key: key, alg: k.Alg}
+	}
+
+	if len(set.keys) == 0 {
+		return nil, errors.New("jwt: key set has no signing keys")
+	}
+
+	return set, nil
+}
+
+// LoadKeySet reads a key set from a file, or fetches it with client if
+// source is an http or https URL.
+func LoadKeySet(ctx context.Context, client *http.Client, source string) (*KeySet, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		defer f.Close()
+
+		return readKeySet(f)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: fetching key set: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwt: fetching key set: %s", res.Status)
+	}
+
+	return readKeySet(res.Body)
+}
+
+func readKeySet(r io.Reader) (*KeySet, error) {
+	js, err := io.ReadAll(io.LimitReader(r, maxKeySetBytes))
+	if err != nil {
+		return nil, fmt.Errorf("jwt: reading key set: %w", err)
+	}
+
+	return ParseKeySet(js)
+}
+
+// Len returns how many keys the set holds.
+func (s *KeySet) Len() int {
+	return len(s.keys)
+}
+
+// lookup finds the key a token was signed with. A token that doesn't name
+// its key can still be checked if the issuer only has the one.
+func (s *KeySet) lookup(kid, alg string) (crypto.PublicKey, error) {
+	k, ok := s.keys[kid]
+	if !ok && kid == "" && len(s.keys) == 1 {
+		for _, only := range s.keys {
+			k, ok = only, true
+		}
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if k.alg != "" && k.alg != alg {
+		return nil, fmt.Errorf("%w: key %q is for %s, not %s", ErrAlgorithm, kid, k.alg, alg)
+	}
+
+	return k.key, nil
+}
+
+// publicKey decodes the key, returning nil for types it doesn't support.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64(k.N, "n")
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBase64(k.E, "e")
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		if key.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSABits)
+		}
+
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBase64(k.X, "x")
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBase64(k.Y, "y")
+		if err != nil {
+			return nil, err
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("x and y must be %d bytes for %s", size, k.Crv)
+		}
+
+		// The key is checked to be on the curve as it's parsed.
+		point := append(append([]byte{4}, x...), y...)
+
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBase64(k.X, "x")
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("x must be %d bytes for Ed25519", ed25519.PublicKeySize)
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBase64(s, member string) ([]byte, error) {
+	if s == "" {
+		return nil, fmt.Errorf("missing %s", member)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", member, err)
+	}
+
+	return b, nil
+}
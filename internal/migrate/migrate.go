@@ -0,0 +1,385 @@
+// Package migrate applies goose-annotated SQL migrations from an fs.FS.
+//
+// Applied versions are tracked in goose's own goose_db_version table, the way
+// goose records them: applying a version inserts a row with is_applied set
+// and rolling it back inserts one without, so the latest row for a version
+// decides whether it is applied. The runner and the goose CLI can be used
+// interchangeably against one database.
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockID is the key of the Postgres advisory lock held while migrating. It is
+// an arbitrary constant; it only has to be the same for every instance.
+const lockID int64 = 7_362_011_905
+
+var ErrNoMigrations = errors.New("no migrations to roll back")
+
+type Migration struct {
+	Version       int64
+	Name          string
+	Up            string
+	Down          string
+	NoTransaction bool
+}
+
+// Status describes a known migration and when, if ever, it was applied.
+type Status struct {
+	Migration Migration
+	AppliedAt *time.Time
+}
+
+// queryer is the part of the database/sql API shared by *sql.DB and
+// *sql.Conn, so migrations can run on the connection that holds the lock.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// New parses every .sql file at the root of fsys into a Migrator.
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Load parses the .sql files at the root of fsys, ordered by version. File
+// names must start with their numeric version, e.g. 001_characters.sql.
+func Load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(names))
+	seen := make(map[int64]string)
+
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: file name must start with a positive version number", name)
+		}
+
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, err := parse(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", name, err)
+		}
+
+		migration.Version = version
+		migration.Name = path.Base(name)
+		migrations = append(migrations, migration)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return int(a.Version - b.Version)
+	})
+
+	return migrations, nil
+}
+
+// parse splits a goose file into its Up and Down sections. StatementBegin and
+// StatementEnd markers are accepted but not needed, as each section is sent
+// to Postgres as a single multi-statement query.
+func parse(contents string) (Migration, error) {
+	var (
+		migration Migration
+		section   *strings.Builder
+		up, down  strings.Builder
+		sawUp     bool
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if annotation, ok := strings.CutPrefix(strings.TrimSpace(line), "-- +goose"); ok {
+			switch strings.TrimSpace(annotation) {
+			case "Up":
+				section = &up
+				sawUp = true
+			case "Down":
+				section = &down
+			case "NO TRANSACTION":
+				migration.NoTransaction = true
+			case "StatementBegin", "StatementEnd":
+			default:
+				return Migration{}, fmt.Errorf("unknown annotation %q", strings.TrimSpace(line))
+			}
+			continue
+		}
+
+		if section != nil {
+			section.WriteString(line)
+			section.WriteByte('\n')
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Migration{}, err
+	}
+
+	if !sawUp {
+		return Migration{}, errors.New("missing -- +goose Up annotation")
+	}
+
+	migration.Up = strings.TrimSpace(up.String())
+	migration.Down = strings.TrimSpace(down.String())
+
+	return migration, nil
+}
+
+// Latest returns the highest version known to the migrator, which is the
+// schema version this binary expects.
+func (m *Migrator) Latest() int64 {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+func ensureVersionTable(ctx context.Context, db queryer) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS goose_db_version (
+			id serial PRIMARY KEY,
+			version_id bigint NOT NULL,
+			is_applied boolean NOT NULL,
+			tstamp timestamp NULL DEFAULT now()
+		)`
+
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// appliedVersions returns the applied versions and when they were applied.
+// Rows are read oldest first, so a rollback cancels the rows before it.
+func appliedVersions(ctx context.Context, db queryer) (map[int64]time.Time, error) {
+	err := ensureVersionTable(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT version_id, is_applied, tstamp
+		FROM goose_db_version
+		WHERE version_id > 0
+		ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+
+	for rows.Next() {
+		var version int64
+		var isApplied bool
+		var appliedAt sql.NullTime
+
+		err := rows.Scan(&version, &isApplied, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if isApplied {
+			applied[version] = appliedAt.Time
+		} else {
+			delete(applied, version)
+		}
+	}
+
+	return applied, rows.Err()
+}
+
+// Version returns the highest applied version, or 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	return currentVersion(ctx, m.DB)
+}
+
+func currentVersion(ctx context.Context, db queryer) (int64, error) {
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int64
+	for v := range applied {
+		version = max(version, v)
+	}
+
+	return version, nil
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := appliedVersions(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.Migrations))
+
+	for _, migration := range m.Migrations {
+		status := Status{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Up applies every pending migration in order and returns the ones applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			err := run(ctx, conn, migration.Up, `INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, true)`, migration)
+			if err != nil {
+				return fmt.Errorf("applying %s: %w", migration.Name, err)
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down rolls back the most recently applied migration and returns it.
+func (m *Migrator) Down(ctx context.Context) (Migration, error) {
+	var done Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if current == 0 {
+			return ErrNoMigrations
+		}
+
+		index := slices.IndexFunc(m.Migrations, func(migration Migration) bool {
+			return migration.Version == current
+		})
+		if index == -1 {
+			return fmt.Errorf("applied version %d has no matching migration file", current)
+		}
+
+		migration := m.Migrations[index]
+
+		err = run(ctx, conn, migration.Down, `INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, false)`, migration)
+		if err != nil {
+			return fmt.Errorf("rolling back %s: %w", migration.Name, err)
+		}
+
+		done = migration
+		return nil
+	})
+
+	return done, err
+}
+
+// run executes statements and records the version change, inside a single
+// transaction unless the migration opted out with NO TRANSACTION.
+func run(ctx context.Context, db queryer, statements, record string, migration Migration) error {
+	if migration.NoTransaction {
+		if statements != "" {
+			_, err := db.ExecContext(ctx, statements)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := db.ExecContext(ctx, record, migration.Version)
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if statements != "" {
+		_, err = tx.ExecContext(ctx, statements)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, record, migration.Version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// withLock runs fn while holding a session-level advisory lock, so that
+// several instances starting at once apply each migration exactly once. fn
+// gets the connection that holds the lock and must run everything on it;
+// waiting on another connection from the pool would hang once the pool is
+// down to one.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return err
+	}
+
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	return fn(conn)
+}
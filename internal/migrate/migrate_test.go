@@ -0,0 +1,80 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/05blue04/Poneglyph/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"002_second.sql": {Data: []byte("-- +goose Up\nCREATE INDEX b ON a (id);\n\n-- +goose Down\nDROP INDEX b;\n")},
+		"001_first.sql":  {Data: []byte("-- +goose Up\n-- +goose StatementBegin\nCREATE TABLE a (id int);\n-- +goose StatementEnd\n-- +goose Down\nDROP TABLE a;")},
+		"003_third.sql":  {Data: []byte("-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX CONCURRENTLY c ON a (id);\n")},
+		"README.md":      {Data: []byte("not a migration")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 3 {
+		t.Fatalf("got %d migrations; want 3", len(migrations))
+	}
+
+	tests := []struct {
+		version       int64
+		name          string
+		up            string
+		down          string
+		noTransaction bool
+	}{
+		{1, "001_first.sql", "CREATE TABLE a (id int);", "DROP TABLE a;", false},
+		{2, "002_second.sql", "CREATE INDEX b ON a (id);", "DROP INDEX b;", false},
+		{3, "003_third.sql", "CREATE INDEX CONCURRENTLY c ON a (id);", "", true},
+	}
+
+	for i, tt := range tests {
+		m := migrations[i]
+		if m.Version != tt.version || m.Name != tt.name || m.Up != tt.up || m.Down != tt.down || m.NoTransaction != tt.noTransaction {
+			t.Errorf("migration %d = %+v; want %+v", i, m, tt)
+		}
+	}
+}
+
+func TestLoadRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing version": {"characters.sql": {Data: []byte("-- +goose Up\nSELECT 1;")}},
+		"missing up":      {"001_a.sql": {Data: []byte("SELECT 1;")}},
+		"duplicate":       {"001_a.sql": {Data: []byte("-- +goose Up\n")}, "1_b.sql": {Data: []byte("-- +goose Up\n")}},
+		"bad annotation":  {"001_a.sql": {Data: []byte("-- +goose Sideways\n")}},
+	}
+
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(fsys)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	m, err := New(nil, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Latest() < 6 {
+		t.Errorf("got latest version %d; want at least 6", m.Latest())
+	}
+
+	for _, migration := range m.Migrations {
+		if migration.Up == "" || migration.Down == "" {
+			t.Errorf("%s must have both an Up and a Down section", migration.Name)
+		}
+	}
+}
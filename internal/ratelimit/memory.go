@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleBucket is how long a bucket in memory goes unused before Sweep forgets
+// it.
+const idleBucket = 3 * time.Minute
+
+type memoryBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// MemoryLimiter keeps buckets in process memory.
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemory() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*memoryBucket)}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, rps float64, burst int) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := rate.Limit(rps)
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &memoryBucket{limiter: rate.NewLimiter(limit, burst)}
+		l.buckets[key] = b
+	}
+
+	if b.limiter.Limit() != limit {
+		b.limiter.SetLimit(limit)
+	}
+	if b.limiter.Burst() != burst {
+		b.limiter.SetBurst(burst)
+	}
+
+	b.lastSeen = time.Now()
+
+	allowed := b.limiter.Allow()
+	tokens := b.limiter.Tokens()
+
+	result := Result{Allowed: allowed, Remaining: max(0, int(tokens))}
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / rps)
+	}
+
+	return result, nil
+}
+
+func (l *MemoryLimiter) Peek(ctx context.Context, key string, rps float64, burst int) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		return Result{Allowed: true, Remaining: burst - 1}, nil
+	}
+
+	tokens := b.limiter.Tokens()
+	if tokens < 1 {
+		return Result{RetryAfter: seconds((1 - tokens) / rps)}, nil
+	}
+
+	return Result{Allowed: true, Remaining: int(tokens) - 1}, nil
+}
+
+func (l *MemoryLimiter) Sweep(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if time.Since(b.lastSeen) > idleBucket {
+			delete(l.buckets, key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemory()
+
+	for _, want := range []int{1, 0} {
+		result, err := l.Allow(ctx, "ip:127.0.0.1", 0.5, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != want {
+			t.Errorf("Allow() = %+v, want allowed with %d remaining", result, want)
+		}
+	}
+
+	result, err := l.Allow(ctx, "ip:127.0.0.1", 0.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter <= time.Second || result.RetryAfter > 2*time.Second {
+		t.Errorf("Allow() = %+v, want refused for about 2s", result)
+	}
+
+	// Peeking doesn't take a token, even from a bucket with some left.
+	_, err = l.Allow(ctx, "ip:10.0.0.1", 0.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		result, err = l.Peek(ctx, "ip:127.0.0.1", 0.5, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed {
+			t.Errorf("Peek() = %+v for an empty bucket, want refused", result)
+		}
+
+		result, err = l.Peek(ctx, "ip:10.0.0.1", 0.5, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != 0 {
+			t.Errorf("Peek() = %+v for a bucket with a token left, want allowed with 0 remaining", result)
+		}
+	}
+
+	// Other buckets are unaffected.
+	result, err = l.Allow(ctx, "key:1", 0.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Errorf("Allow() = %+v for a new bucket, want allowed", result)
+	}
+
+	// A bucket can change size between requests.
+	result, err = l.Allow(ctx, "key:1", 0.5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Errorf("Allow() = %+v after raising the burst, want allowed", result)
+	}
+}
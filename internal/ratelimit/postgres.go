@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// PostgresLimiter keeps buckets in Postgres, so every instance sharing the
+// database holds clients to the same limits.
+//
+// It uses the generic cell rate algorithm, which stores one timestamp per
+// bucket rather than a token count: the theoretical arrival time (tat) of the
+// request after next if requests kept coming at exactly the refill rate. A
+// request is allowed if it's no more than a full bucket's worth of time
+// ahead of that. Times come from the database, so clocks on the instances
+// don't have to agree.
+type PostgresLimiter struct {
+	db      *sql.DB
+	timeout time.Duration
+}
+
+func NewPostgres(db *sql.DB, timeout time.Duration) *PostgresLimiter {
+	return &PostgresLimiter{db: db, timeout: timeout}
+}
+
+func (l *PostgresLimiter) Allow(ctx context.Context, key string, rps float64, burst int) (Result, error) {
+	// $2 is the time one token takes to refill, and $3 the time the whole
+	// bucket takes. The row is locked by the upsert, so concurrent requests
+	// for the same bucket take their turns. Every expression in SET sees the
+	// row as it was, and allowed records the decision so it can be returned
+	// along with the new tat.
+	query := `
+		INSERT INTO rate_limits AS r (key, tat, allowed)
+		VALUES ($1, now() + make_interval(secs => $2), true)
+		ON CONFLICT (key) DO UPDATE SET
+			allowed = GREATEST(r.tat, now()) + make_interval(secs => $2) - make_interval(secs => $3) <= now(),
+			tat = CASE
+				WHEN GREATEST(r.tat, now()) + make_interval(secs => $2) - make_interval(secs => $3) <= now()
+				THEN GREATEST(r.tat, now()) + make_interval(secs => $2)
+				ELSE r.tat
+			END
+		RETURNING allowed, EXTRACT(EPOCH FROM tat - now())::float8`
+
+	interval := 1 / rps
+	capacity := interval * float64(burst)
+
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	var (
+		allowed bool
+		ahead   float64 // seconds from now to the tat
+	)
+
+	err := l.db.QueryRowContext(ctx, query, key, interval, capacity).Scan(&allowed, &ahead)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if !allowed {
+		return Result{RetryAfter: seconds(ahead + interval - capacity)}, nil
+	}
+
+	// The tat is only accurate to the microsecond, so a bucket with one token
+	// left can come out a hair short of it.
+	remaining := math.Floor((capacity-ahead)/interval + 1e-3)
+
+	return Result{Allowed: true, Remaining: max(0, int(remaining))}, nil
+}
+
+func (l *PostgresLimiter) Peek(ctx context.Context, key string, rps float64, burst int) (Result, error) {
+	query := `
+		SELECT EXTRACT(EPOCH FROM GREATEST(tat, now()) - now())::float8
+		FROM rate_limits
+		WHERE key = $1`
+
+	interval := 1 / rps
+	capacity := interval * float64(burst)
+
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	var ahead float64
+
+	err := l.db.QueryRowContext(ctx, query, key).Scan(&ahead)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return Result{Allowed: true, Remaining: burst - 1}, nil
+		default:
+			return Result{}, err
+		}
+	}
+
+	// This is the test Allow's upsert makes, with the tat it would move to.
+	if ahead+interval > capacity {
+		return Result{RetryAfter: seconds(ahead + interval - capacity)}, nil
+	}
+
+	remaining := math.Floor((capacity-ahead-interval)/interval + 1e-3)
+
+	return Result{Allowed: true, Remaining: max(0, int(remaining))}, nil
+}
+
+// Sweep deletes the buckets that have filled up again, which are no
+// different from buckets that were never used.
+func (l *PostgresLimiter) Sweep(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	_, err := l.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE tat < now()`)
+	return err
+}
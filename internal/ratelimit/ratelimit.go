@@ -0,0 +1,45 @@
+// Package ratelimit decides whether clients may make another request, by
+// token buckets kept either in process memory or in Postgres.
+//
+// A bucket holds up to burst tokens and refills at rps tokens a second. Each
+// request takes one token, and a request that finds the bucket empty is
+// turned away. Buckets are named by the caller, and their size and refill
+// rate can change from one request to the next.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter keeps the buckets. The in-memory limiter only sees the requests
+// made to its own process, so deployments with more than one instance need a
+// shared one to hold clients to their limits.
+type Limiter interface {
+	// Allow takes a token from the named bucket if there is one.
+	Allow(ctx context.Context, key string, rps float64, burst int) (Result, error)
+
+	// Peek reports what Allow would, without taking a token.
+	Peek(ctx context.Context, key string, rps float64, burst int) (Result, error)
+
+	// Sweep forgets buckets that haven't been used for a while. Forgotten
+	// buckets start out full the next time they're used.
+	Sweep(ctx context.Context) error
+}
+
+// Result is the outcome of a call to Allow or Peek.
+type Result struct {
+	Allowed bool
+
+	// Remaining is how many more requests the bucket allows right now.
+	Remaining int
+
+	// RetryAfter is how long a request that wasn't allowed should wait
+	// before trying again.
+	RetryAfter time.Duration
+}
+
+// seconds converts a fractional number of seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE characters ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+ALTER TABLE devilfruits ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+ALTER TABLE crews ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+
+-- +goose Down
+ALTER TABLE crews DROP COLUMN IF EXISTS version;
+ALTER TABLE devilfruits DROP COLUMN IF EXISTS version;
+ALTER TABLE characters DROP COLUMN IF EXISTS version;
@@ -0,0 +1,40 @@
+-- +goose Up
+ALTER TABLE characters ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE devilfruits ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE crews ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+-- Names only need to be unique among records that aren't in the trash.
+ALTER TABLE characters DROP CONSTRAINT IF EXISTS characters_name_key;
+ALTER TABLE devilfruits DROP CONSTRAINT IF EXISTS devilfruits_name_key;
+ALTER TABLE crews DROP CONSTRAINT IF EXISTS crews_name_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS characters_name_idx ON characters (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS devilfruits_name_idx ON devilfruits (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS crews_name_idx ON crews (name) WHERE deleted_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS characters_deleted_at_idx ON characters (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS devilfruits_deleted_at_idx ON devilfruits (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS crews_deleted_at_idx ON crews (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- +goose Down
+-- Without deleted_at, trashed rows would come back to life, so they're
+-- purged first.
+DELETE FROM crews WHERE deleted_at IS NOT NULL;
+DELETE FROM devilfruits WHERE deleted_at IS NOT NULL;
+DELETE FROM characters WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS crews_deleted_at_idx;
+DROP INDEX IF EXISTS devilfruits_deleted_at_idx;
+DROP INDEX IF EXISTS characters_deleted_at_idx;
+
+DROP INDEX IF EXISTS crews_name_idx;
+DROP INDEX IF EXISTS devilfruits_name_idx;
+DROP INDEX IF EXISTS characters_name_idx;
+
+ALTER TABLE crews ADD CONSTRAINT crews_name_key UNIQUE (name);
+ALTER TABLE devilfruits ADD CONSTRAINT devilfruits_name_key UNIQUE (name);
+ALTER TABLE characters ADD CONSTRAINT characters_name_key UNIQUE (name);
+
+ALTER TABLE crews DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE devilfruits DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE characters DROP COLUMN IF EXISTS deleted_at;
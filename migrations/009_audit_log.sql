@@ -0,0 +1,35 @@
+-- +goose Up
+-- api_key_id has no foreign key, so entries outlive the keys that made them.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    api_key_id bigint,
+    ip text NOT NULL DEFAULT '',
+    route text NOT NULL DEFAULT '',
+    request_id text NOT NULL DEFAULT '',
+    entity text NOT NULL,
+    entity_id bigint NOT NULL,
+    action text NOT NULL,
+    before jsonb,
+    after jsonb
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id);
+CREATE INDEX IF NOT EXISTS audit_log_api_key_id_idx ON audit_log (api_key_id) WHERE api_key_id IS NOT NULL;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- A revision is a record as it was at one version, written alongside each
+-- update. Revisions are deleted with the record when the trash is purged.
+CREATE TABLE IF NOT EXISTS revisions (
+    entity text NOT NULL,
+    entity_id bigint NOT NULL,
+    revision integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL,
+    data jsonb NOT NULL,
+    PRIMARY KEY (entity, entity_id, revision)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS revisions;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- The change feed: every create, update and delete in the order it was
+-- made. Deletes are tombstones with no data.
+CREATE TABLE IF NOT EXISTS changes (
+    seq bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    entity text NOT NULL,
+    entity_id bigint NOT NULL,
+    action text NOT NULL,
+    data jsonb
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS changes;
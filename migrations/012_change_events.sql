@@ -0,0 +1,11 @@
+-- +goose Up
+-- The event names a change for the live stream, such as bounty.changed for a
+-- character update that changed their bounty.
+ALTER TABLE changes ADD COLUMN IF NOT EXISTS event text;
+
+UPDATE changes SET event = rtrim(entity, 's') || '.' || action || 'd' WHERE event IS NULL;
+
+ALTER TABLE changes ALTER COLUMN event SET NOT NULL;
+
+-- +goose Down
+ALTER TABLE changes DROP COLUMN IF EXISTS event;
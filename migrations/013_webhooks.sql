@@ -0,0 +1,36 @@
+-- +goose Up
+-- A webhook belongs to the API key that registered it. resources is empty to
+-- hear about every resource.
+CREATE TABLE IF NOT EXISTS webhooks (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    api_key_id bigint NOT NULL REFERENCES api_keys ON DELETE CASCADE,
+    url text NOT NULL,
+    secret text NOT NULL,
+    resources text[] NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_api_key_id_idx ON webhooks (api_key_id);
+
+-- The delivery queue. Deliveries are queued in the same transaction as the
+-- change they announce, and stay behind as a log once they're done.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    webhook_id bigint NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    response_status integer,
+    last_error text NOT NULL DEFAULT '',
+    delivered_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- +goose Down
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- Keys made before scopes existed could do anything, so they keep admin. New
+-- keys get only the scopes they're given.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS scopes text[] NOT NULL DEFAULT '{admin}';
+ALTER TABLE api_keys ALTER COLUMN scopes SET DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE api_keys DROP COLUMN IF EXISTS scopes;
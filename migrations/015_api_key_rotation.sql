@@ -0,0 +1,9 @@
+-- +goose Up
+-- A rotated key points at the key that replaced it, and keeps working until
+-- its expires_at, which rotation pulls in to the end of the grace period.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS replaced_by bigint REFERENCES api_keys ON DELETE SET NULL;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rotated_at timestamp(0) with time zone;
+
+-- +goose Down
+ALTER TABLE api_keys DROP COLUMN IF EXISTS rotated_at;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS replaced_by;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Null limits mean the key gets the server's defaults, and a null quota means
+-- it has none.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit_rps double precision;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit_burst integer;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS quota_limit bigint;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS quota_period text CHECK (quota_period IN ('day', 'month'));
+
+-- One row per key per quota period, counting every request the key made.
+CREATE TABLE IF NOT EXISTS api_key_quota_usage (
+    api_key_id bigint NOT NULL REFERENCES api_keys ON DELETE CASCADE,
+    period_start timestamp(0) with time zone NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, period_start)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS api_key_quota_usage;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS quota_period;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS quota_limit;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_limit_burst;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_limit_rps;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Token buckets shared by every instance, when LIMITER_BACKEND=postgres. The
+-- table is unlogged: it's written on every request, and losing it in a crash
+-- only means every client starts over with a full bucket.
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    tat timestamp with time zone NOT NULL,
+    allowed boolean NOT NULL
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS rate_limits;
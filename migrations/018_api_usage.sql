@@ -0,0 +1,23 @@
+-- +goose Up
+-- Requests per API key, route and hour, written in batches by each instance.
+-- Latencies are kept as a total, so the average can be worked out from rows
+-- that have been added together.
+CREATE TABLE IF NOT EXISTS api_usage (
+    api_key_id bigint NOT NULL REFERENCES api_keys ON DELETE CASCADE,
+    hour timestamp(0) with time zone NOT NULL,
+    route text NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    status_2xx bigint NOT NULL DEFAULT 0,
+    status_3xx bigint NOT NULL DEFAULT 0,
+    status_4xx bigint NOT NULL DEFAULT 0,
+    status_5xx bigint NOT NULL DEFAULT 0,
+    latency_total_us bigint NOT NULL DEFAULT 0,
+    latency_max_us bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, hour, route)
+);
+
+-- Reports across every key go by time.
+CREATE INDEX IF NOT EXISTS api_usage_hour_idx ON api_usage (hour);
+
+-- +goose Down
+DROP TABLE IF EXISTS api_usage;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Changes made with a JWT have no API key, so they're attributed to the
+-- token's subject instead.
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS subject text NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE audit_log DROP COLUMN IF EXISTS subject;
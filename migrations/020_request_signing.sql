@@ -0,0 +1,21 @@
+-- +goose Up
+-- Keys made before request signing have no secret until one is issued for
+-- them, and can't be made to sign until then.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS signing_secret text NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS require_signing boolean NOT NULL DEFAULT false;
+
+-- The nonces of signed requests, kept until their timestamps are too old to
+-- be accepted anyway, so no signed request can be replayed.
+CREATE TABLE IF NOT EXISTS request_nonces (
+    api_key_id bigint NOT NULL REFERENCES api_keys ON DELETE CASCADE,
+    nonce text NOT NULL,
+    expires_at timestamp(0) with time zone NOT NULL,
+    PRIMARY KEY (api_key_id, nonce)
+);
+
+CREATE INDEX IF NOT EXISTS request_nonces_expires_at_idx ON request_nonces (expires_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS request_nonces;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS require_signing;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS signing_secret;
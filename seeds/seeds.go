@@ -0,0 +1,95 @@
+// Package seeds embeds the canonical Poneglyph dataset loaded by `api seed`.
+package seeds
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/05blue04/Poneglyph/internal/data"
+)
+
+// DefaultFile is the embedded dataset used when no file is given.
+const DefaultFile = "poneglyph.json"
+
+//go:embed *.json
+var FS embed.FS
+
+// Dataset is the canonical seed data. Relationships are expressed by name
+// rather than id so the same file can be loaded into any database.
+type Dataset struct {
+	Version     int          `json:"version"`
+	Characters  []Character  `json:"characters"`
+	DevilFruits []DevilFruit `json:"devil_fruits"`
+	Crews       []Crew       `json:"crews"`
+}
+
+type Character struct {
+	Name        string        `json:"name"`
+	Age         int           `json:"age"`
+	Description string        `json:"description"`
+	Origin      string        `json:"origin"`
+	Bounty      *data.Berries `json:"bounty,omitempty"`
+	Race        string        `json:"race"`
+	Episode     int           `json:"episode"`
+}
+
+type DevilFruit struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Type           string   `json:"type"`
+	Owner          string   `json:"owner,omitempty"`
+	PreviousOwners []string `json:"previous_owners"`
+	Episode        int      `json:"episode"`
+}
+
+type Crew struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	ShipName    string   `json:"ship_name"`
+	Captain     string   `json:"captain"`
+	Members     []string `json:"members"`
+}
+
+// Load reads the embedded dataset.
+func Load() (*Dataset, error) {
+	f, err := FS.Open(DefaultFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Decode(f)
+}
+
+// LoadFile reads a dataset from fsys, e.g. os.DirFS(filepath.Dir(path)) and
+// filepath.Base(path) for a local file.
+func LoadFile(fsys fs.FS, name string) (*Dataset, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Decode(f)
+}
+
+func Decode(r io.Reader) (*Dataset, error) {
+	var dataset Dataset
+
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(&dataset)
+	if err != nil {
+		return nil, fmt.Errorf("decoding seed dataset: %w", err)
+	}
+
+	if dataset.Version < 1 {
+		return nil, fmt.Errorf("seed dataset must declare a positive version")
+	}
+
+	return &dataset, nil
+}